@@ -0,0 +1,191 @@
+package api
+
+import (
+	"cacheServer/apperror"
+	"cacheServer/cache"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// defaultEntryPage is the number of entries listed when the limit query parameter is unset.
+	defaultEntryPage = 100
+	// maxEntryPage bounds the limit query parameter.
+	maxEntryPage = 1000
+)
+
+// authorizeAdmin rejects requests without the admin bearer token.
+func (h *handler) authorizeAdmin(c *gin.Context) {
+	token, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+	if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(h.adminToken)) != 1 {
+		apperror.ErrorResponse(apperror.ErrUnauthorized, c)
+		c.Abort()
+		return
+	}
+	c.Next()
+}
+
+// databaseStats answers the connection pool statistics and the replica and breaker state.
+func (h *handler) databaseStats(c *gin.Context) {
+	c.JSON(http.StatusOK, h.cache.Metrics().Database)
+}
+
+// invalidateRoles drops the cached role model after role definitions changed in the database.
+func (h *handler) invalidateRoles(c *gin.Context) {
+	h.cache.InvalidateRoles()
+	c.Status(http.StatusNoContent)
+}
+
+// reload applies the config file and answers the settings that changed. Changes that need a restart
+// are rejected with 409, invalid configs with 400.
+func (h *handler) reload(c *gin.Context) {
+	changed, err := h.reloader.Reload("admin API")
+	if err != nil {
+		apperror.ErrorResponse(err, c)
+		return
+	}
+	if changed == nil {
+		changed = []string{}
+	}
+	c.JSON(http.StatusOK, gin.H{"changed": changed})
+}
+
+// deadLetters answers the webhook deliveries that kept failing, oldest first.
+func (h *handler) deadLetters(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"deliveries": h.webhooks.DeadLetters()})
+}
+
+// replayWebhook sends a dead-lettered delivery again, answering 404 for an unknown id.
+func (h *handler) replayWebhook(c *gin.Context) {
+	if err := h.webhooks.Replay(c.Param("id")); err != nil {
+		apperror.ErrorResponse(err, c)
+		return
+	}
+	c.Status(http.StatusAccepted)
+}
+
+// inspector returns the admin view of the namespace named by the tenant query parameter, the default one if unset.
+func (h *handler) inspector(c *gin.Context) (cache.Inspector, bool) {
+	inspector, err := h.cache.Inspect(c.Query("tenant"))
+	if err != nil {
+		apperror.ErrorResponse(err, c)
+		return nil, false
+	}
+	return inspector, true
+}
+
+// paramType parses the Type named by the path parameter key.
+func paramType(c *gin.Context, key string) (cache.Type, bool) {
+	t, err := cache.ParseType(c.Param(key))
+	if err != nil {
+		apperror.ErrorResponse(fmt.Errorf("%w: unknown type %q", apperror.ErrInvalidRequest, c.Param(key)), c)
+		return 0, false
+	}
+	return t, true
+}
+
+// listEntries answers a page of the cached entries of a Type ordered by key, filtered by the prefix query
+// parameter. The next page starts after the key answered as next.
+func (h *handler) listEntries(c *gin.Context) {
+	t, ok := paramType(c, "type")
+	if !ok {
+		return
+	}
+	limit := defaultEntryPage
+	if s := c.Query("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n <= 0 || n > maxEntryPage {
+			apperror.ErrorResponse(fmt.Errorf("%w: limit must be between 1 and %d, got %q", apperror.ErrInvalidRequest, maxEntryPage, s), c)
+			return
+		}
+		limit = n
+	}
+	inspector, ok := h.inspector(c)
+	if !ok {
+		return
+	}
+	page, err := inspector.Entries(t, c.Query("prefix"), c.Query("after"), limit)
+	if err != nil {
+		apperror.ErrorResponse(err, c)
+		return
+	}
+	c.JSON(http.StatusOK, page)
+}
+
+// getEntry answers a cached entry and its metadata, 404 if it is not cached. Nothing is loaded.
+func (h *handler) getEntry(c *gin.Context) {
+	t, ok := paramType(c, "type")
+	if !ok {
+		return
+	}
+	inspector, ok := h.inspector(c)
+	if !ok {
+		return
+	}
+	entry, err := inspector.Entry(t, c.Param("key"))
+	if err != nil {
+		apperror.ErrorResponse(err, c)
+		return
+	}
+	c.JSON(http.StatusOK, entry)
+}
+
+// evictEntries drops the cached entries of the types in the type query parameter, every Type if unset,
+// whose key starts with the prefix query parameter, and answers how many were dropped.
+func (h *handler) evictEntries(c *gin.Context) {
+	var types []cache.Type
+	for _, s := range queryList(c, "type") {
+		t, err := cache.ParseType(s)
+		if err != nil {
+			apperror.ErrorResponse(fmt.Errorf("%w: unknown type %q", apperror.ErrInvalidRequest, s), c)
+			return
+		}
+		types = append(types, t)
+	}
+	inspector, ok := h.inspector(c)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"evicted": inspector.Evict(c.Query("prefix"), types...)})
+}
+
+// indexState answers the indices held for a family, those of the parent query parameter for subcategory
+// and product indices.
+func (h *handler) indexState(c *gin.Context) {
+	family, ok := paramType(c, "family")
+	if !ok {
+		return
+	}
+	inspector, ok := h.inspector(c)
+	if !ok {
+		return
+	}
+	st, err := inspector.IndexState(family, c.Query("parent"))
+	if err != nil {
+		apperror.ErrorResponse(err, c)
+		return
+	}
+	c.JSON(http.StatusOK, st)
+}
+
+// reinitializeIndices drops the indices of a family and reads them from the database again.
+func (h *handler) reinitializeIndices(c *gin.Context) {
+	family, ok := paramType(c, "family")
+	if !ok {
+		return
+	}
+	inspector, ok := h.inspector(c)
+	if !ok {
+		return
+	}
+	if err := inspector.Reinitialize(family); err != nil {
+		apperror.ErrorResponse(err, c)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
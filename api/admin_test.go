@@ -0,0 +1,412 @@
+package api
+
+import (
+	"cacheServer/appcontext"
+	"cacheServer/apperror"
+	"cacheServer/cache"
+	"cacheServer/webhook"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAdminDatabaseStats(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	appCache := &metricsCache{metrics: cache.Metrics{
+		Database: map[string]interface{}{"pool": map[string]int{"openConnections": 2}},
+	}}
+	cases := map[string]struct {
+		token         string
+		authorization string
+		wantCode      int
+		wantBody      string
+	}{
+		"valid token": {
+			token:         "secret",
+			authorization: "Bearer secret",
+			wantCode:      http.StatusOK,
+			wantBody:      `{"pool":{"openConnections":2}}`,
+		},
+		"wrong token": {
+			token:         "secret",
+			authorization: "Bearer guess",
+			wantCode:      http.StatusUnauthorized,
+			wantBody:      `{"message":"unauthorized"}`,
+		},
+		"missing token": {
+			token:    "secret",
+			wantCode: http.StatusUnauthorized,
+			wantBody: `{"message":"unauthorized"}`,
+		},
+		"admin api disabled without a configured token": {
+			authorization: "Bearer ",
+			wantCode:      http.StatusNotFound,
+		},
+	}
+
+	for k, v := range cases {
+		t.Run(k, func(t *testing.T) {
+			router := NewRouter(appCache, WithAdminToken(v.token))
+			req := httptest.NewRequest(http.MethodGet, "/admin/db", nil)
+			if v.authorization != "" {
+				req.Header.Set("Authorization", v.authorization)
+			}
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			assert.Equal(t, v.wantCode, w.Code)
+			if v.wantBody != "" {
+				assert.JSONEq(t, v.wantBody, w.Body.String())
+			}
+		})
+	}
+}
+
+type fakeReloader struct {
+	changed []string
+	err     error
+	stats   appcontext.ReloadStats
+}
+
+func (f *fakeReloader) Reload(source string) ([]string, error) {
+	if f.err != nil {
+		f.stats.Failures++
+		return nil, f.err
+	}
+	f.stats.Reloads++
+	return f.changed, nil
+}
+
+func (f *fakeReloader) Stats() appcontext.ReloadStats {
+	return f.stats
+}
+
+func TestAdminReload(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	cases := map[string]struct {
+		reloader   *fakeReloader
+		wantCode   int
+		wantBody   string
+		wantReload string
+	}{
+		"settings applied": {
+			reloader:   &fakeReloader{changed: []string{"cache.ttl"}},
+			wantCode:   http.StatusOK,
+			wantBody:   `{"changed":["cache.ttl"]}`,
+			wantReload: `{"reloads":1,"failures":0,"lastReload":"0001-01-01T00:00:00Z"}`,
+		},
+		"nothing changed": {
+			reloader: &fakeReloader{},
+			wantCode: http.StatusOK,
+			wantBody: `{"changed":[]}`,
+		},
+		"restart required": {
+			reloader:   &fakeReloader{err: &appcontext.RestartRequiredError{Settings: []string{"http.addr"}}},
+			wantCode:   http.StatusConflict,
+			wantBody:   `{"message":"config: http.addr cannot change while the server runs, restart it to apply"}`,
+			wantReload: `{"reloads":0,"failures":1,"lastReload":"0001-01-01T00:00:00Z"}`,
+		},
+		"invalid config": {
+			reloader: &fakeReloader{err: fmt.Errorf("%w: bad level", apperror.ErrInvalidConfig)},
+			wantCode: http.StatusBadRequest,
+			wantBody: `{"message":"invalid config: bad level"}`,
+		},
+	}
+
+	for k, v := range cases {
+		t.Run(k, func(t *testing.T) {
+			router := NewRouter(&metricsCache{}, WithAdminToken("secret"), WithReloader(v.reloader))
+			req := httptest.NewRequest(http.MethodPost, "/admin/reload", nil)
+			req.Header.Set("Authorization", "Bearer secret")
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			assert.Equal(t, v.wantCode, w.Code)
+			assert.JSONEq(t, v.wantBody, w.Body.String())
+
+			if v.wantReload != "" {
+				w = httptest.NewRecorder()
+				router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+				var body map[string]json.RawMessage
+				assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+				assert.JSONEq(t, v.wantReload, string(body["reload"]))
+			}
+		})
+	}
+}
+
+type rolesCache struct {
+	cache.AppCache
+	invalidated int
+}
+
+func (r *rolesCache) InvalidateRoles() {
+	r.invalidated++
+}
+
+func TestAdminInvalidateRoles(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	appCache := &rolesCache{}
+	router := NewRouter(appCache, WithAdminToken("secret"))
+	req := httptest.NewRequest(http.MethodPost, "/admin/roles/invalidate", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	assert.Equal(t, 1, appCache.invalidated)
+}
+
+type fakeWebhooks struct {
+	dead     []webhook.Delivery
+	replayed []string
+}
+
+func (f *fakeWebhooks) DeadLetters() []webhook.Delivery {
+	return f.dead
+}
+
+func (f *fakeWebhooks) Replay(id string) error {
+	for i, d := range f.dead {
+		if d.ID == id {
+			f.dead = append(f.dead[:i], f.dead[i+1:]...)
+			f.replayed = append(f.replayed, id)
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: dead-lettered webhook %q", apperror.ErrNotFound, id)
+}
+
+func (f *fakeWebhooks) Stats() webhook.Stats {
+	return webhook.Stats{Subscriptions: 1, DeadLettered: 1, DeadLetters: len(f.dead)}
+}
+
+func TestAdminWebhooks(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	failedAt := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	cases := map[string]struct {
+		method       string
+		path         string
+		token        string
+		wantCode     int
+		wantBody     string
+		wantReplayed []string
+	}{
+		"list dead letters": {
+			method:   http.MethodGet,
+			path:     "/admin/webhooks/deadletters",
+			token:    "secret",
+			wantCode: http.StatusOK,
+			wantBody: `{"deliveries":[{"id":"d1","subscription":"shop","attempts":5,"lastError":"receiver answered 500 Internal Server Error",
+				"failedAt":"2024-05-01T12:00:00Z","event":{"seq":3,"time":"0001-01-01T00:00:00Z","kind":"statusChanged","type":"Product",
+				"id":"p1","old":"active","new":"passive"}}]}`,
+		},
+		"replay": {
+			method:       http.MethodPost,
+			path:         "/admin/webhooks/deadletters/d1/replay",
+			token:        "secret",
+			wantCode:     http.StatusAccepted,
+			wantReplayed: []string{"d1"},
+		},
+		"replay unknown delivery": {
+			method:   http.MethodPost,
+			path:     "/admin/webhooks/deadletters/d9/replay",
+			token:    "secret",
+			wantCode: http.StatusNotFound,
+			wantBody: `{"message":"not found: dead-lettered webhook \"d9\""}`,
+		},
+		"wrong token": {
+			method:   http.MethodPost,
+			path:     "/admin/webhooks/deadletters/d1/replay",
+			token:    "guess",
+			wantCode: http.StatusUnauthorized,
+			wantBody: `{"message":"unauthorized"}`,
+		},
+	}
+
+	for k, v := range cases {
+		t.Run(k, func(t *testing.T) {
+			hooks := &fakeWebhooks{dead: []webhook.Delivery{{
+				ID: "d1", Subscription: "shop", Attempts: 5, LastError: "receiver answered 500 Internal Server Error", FailedAt: failedAt,
+				Event: cache.Event{Seq: 3, Kind: cache.StatusChanged, Type: cache.Product, ID: "p1", Old: "active", New: "passive"},
+			}}}
+			router := NewRouter(&metricsCache{}, WithAdminToken("secret"), WithWebhooks(hooks))
+			req := httptest.NewRequest(v.method, v.path, nil)
+			req.Header.Set("Authorization", "Bearer "+v.token)
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			assert.Equal(t, v.wantCode, w.Code)
+			if v.wantBody != "" {
+				assert.JSONEq(t, v.wantBody, w.Body.String())
+			}
+			assert.Equal(t, v.wantReplayed, hooks.replayed)
+
+			w = httptest.NewRecorder()
+			router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+			var body map[string]json.RawMessage
+			assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+			assert.JSONEq(t, fmt.Sprintf(`{"subscriptions":1,"queued":0,"delivered":0,"retried":0,"deadLettered":1,"replayed":0,
+				"deadLetters":%d}`, len(hooks.dead)), string(body["webhooks"]))
+		})
+	}
+}
+
+type fakeInspector struct {
+	calls []string
+}
+
+func (f *fakeInspector) Entries(t cache.Type, prefix, after string, limit int) (cache.EntryPage, error) {
+	f.calls = append(f.calls, fmt.Sprintf("entries %s %q %q %d", t, prefix, after, limit))
+	return cache.EntryPage{Entries: []cache.EntryInfo{{Type: t, Key: "p1", Value: "true", Source: "load", Age: "2s", Hits: 3}}, Total: 2, Next: "p1"}, nil
+}
+
+func (f *fakeInspector) Entry(t cache.Type, key string) (cache.EntryInfo, error) {
+	f.calls = append(f.calls, fmt.Sprintf("entry %s %s", t, key))
+	if key != "p1" {
+		return cache.EntryInfo{}, fmt.Errorf("%w: %s %q is not cached", apperror.ErrNotFound, t, key)
+	}
+	return cache.EntryInfo{Type: t, Key: key, Value: "true", Source: "set", Age: "1s", TTL: "59s"}, nil
+}
+
+func (f *fakeInspector) Evict(prefix string, types ...cache.Type) int {
+	f.calls = append(f.calls, fmt.Sprintf("evict %q %v", prefix, types))
+	return 2
+}
+
+func (f *fakeInspector) IndexState(family cache.Type, parent string) (cache.IndexState, error) {
+	f.calls = append(f.calls, fmt.Sprintf("indices %s %s", family, parent))
+	return cache.IndexState{Family: family, Parent: parent, State: "ready", Loaded: true, Available: []int{3}}, nil
+}
+
+func (f *fakeInspector) Reinitialize(family cache.Type) error {
+	f.calls = append(f.calls, fmt.Sprintf("reinitialize %s", family))
+	return nil
+}
+
+type inspectCache struct {
+	cache.AppCache
+	inspector *fakeInspector
+	tenants   []string
+}
+
+func (i *inspectCache) Inspect(tenant string) (cache.Inspector, error) {
+	if tenant == "unknown" {
+		return nil, fmt.Errorf("%w %q", apperror.ErrUnknownTenant, tenant)
+	}
+	i.tenants = append(i.tenants, tenant)
+	return i.inspector, nil
+}
+
+func TestAdminCache(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	cases := map[string]struct {
+		method   string
+		path     string
+		wantCode int
+		wantBody string
+		wantCall string
+	}{
+		"list entries": {
+			method:   http.MethodGet,
+			path:     "/admin/cache/product?prefix=p&after=p0&limit=1&tenant=acme",
+			wantCode: http.StatusOK,
+			wantBody: `{"entries":[{"type":"Product","key":"p1","value":"true","source":"load","storedAt":"0001-01-01T00:00:00Z",
+				"age":"2s","hits":3,"expired":false}],"total":2,"next":"p1"}`,
+			wantCall: `entries Product "p" "p0" 1`,
+		},
+		"default page": {
+			method:   http.MethodGet,
+			path:     "/admin/cache/category",
+			wantCode: http.StatusOK,
+			wantCall: `entries Category "" "" 100`,
+		},
+		"limit out of range": {
+			method:   http.MethodGet,
+			path:     "/admin/cache/product?limit=5000",
+			wantCode: http.StatusBadRequest,
+			wantBody: `{"message":"invalid request: limit must be between 1 and 1000, got \"5000\""}`,
+		},
+		"unknown type": {
+			method:   http.MethodGet,
+			path:     "/admin/cache/order",
+			wantCode: http.StatusBadRequest,
+			wantBody: `{"message":"invalid request: unknown type \"order\""}`,
+		},
+		"unknown tenant": {
+			method:   http.MethodGet,
+			path:     "/admin/cache/product?tenant=unknown",
+			wantCode: http.StatusNotFound,
+			wantBody: `{"message":"unknown tenant \"unknown\""}`,
+		},
+		"entry": {
+			method:   http.MethodGet,
+			path:     "/admin/cache/product/p1",
+			wantCode: http.StatusOK,
+			wantBody: `{"type":"Product","key":"p1","value":"true","source":"set","storedAt":"0001-01-01T00:00:00Z","age":"1s",
+				"ttl":"59s","hits":0,"expired":false}`,
+			wantCall: "entry Product p1",
+		},
+		"entry not cached": {
+			method:   http.MethodGet,
+			path:     "/admin/cache/product/p9",
+			wantCode: http.StatusNotFound,
+			wantBody: `{"message":"not found: Product \"p9\" is not cached"}`,
+			wantCall: "entry Product p9",
+		},
+		"evict everything": {
+			method:   http.MethodDelete,
+			path:     "/admin/cache",
+			wantCode: http.StatusOK,
+			wantBody: `{"evicted":2}`,
+			wantCall: `evict "" []`,
+		},
+		"evict by type and prefix": {
+			method:   http.MethodDelete,
+			path:     "/admin/cache?type=product,category&prefix=p",
+			wantCode: http.StatusOK,
+			wantCall: `evict "p" [Product Category]`,
+		},
+		"index state": {
+			method:   http.MethodGet,
+			path:     "/admin/indices/subcategory?parent=c1",
+			wantCode: http.StatusOK,
+			wantBody: `{"family":"SubCategory","parent":"c1","state":"ready","loaded":true,"available":[3]}`,
+			wantCall: "indices SubCategory c1",
+		},
+		"reinitialize": {
+			method:   http.MethodPost,
+			path:     "/admin/indices/product/reinitialize",
+			wantCode: http.StatusNoContent,
+			wantCall: "reinitialize Product",
+		},
+	}
+
+	for k, v := range cases {
+		t.Run(k, func(t *testing.T) {
+			appCache := &inspectCache{inspector: &fakeInspector{}}
+			router := NewRouter(appCache, WithAdminToken("secret"))
+			req := httptest.NewRequest(v.method, v.path, nil)
+			req.Header.Set("Authorization", "Bearer secret")
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			assert.Equal(t, v.wantCode, w.Code)
+			if v.wantBody != "" {
+				assert.JSONEq(t, v.wantBody, w.Body.String())
+			}
+			if v.wantCall != "" {
+				assert.Equal(t, []string{v.wantCall}, appCache.inspector.calls)
+			} else {
+				assert.Empty(t, appCache.inspector.calls)
+			}
+		})
+	}
+
+	// the endpoints need the admin token
+	router := NewRouter(&inspectCache{inspector: &fakeInspector{}}, WithAdminToken("secret"))
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodDelete, "/admin/cache", nil))
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+}
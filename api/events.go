@@ -0,0 +1,106 @@
+package api
+
+import (
+	"cacheServer/apperror"
+	"cacheServer/cache"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-contrib/sse"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// eventBuffer is the number of events buffered per stream before they are dropped.
+	eventBuffer = 256
+	// eventKeepAlive is how often an idle stream sends a comment to keep proxies from closing it.
+	eventKeepAlive = 15 * time.Second
+)
+
+// droppedEvent tells a stream how many of its events were dropped so far, its state must be resynced.
+type droppedEvent struct {
+	Dropped uint64 `json:"dropped"`
+}
+
+// events streams the cache mutations as Server-Sent Events, filtered by the comma separated kind, type
+// and tenant query parameters. The event name is the kind and the id its sequence number.
+func (h *handler) events(c *gin.Context) {
+	filter, err := parseEventFilter(c)
+	if err != nil {
+		apperror.ErrorResponse(err, c)
+		return
+	}
+	sub := h.cache.Events().Subscribe(filter, eventBuffer)
+	defer sub.Close()
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("X-Accel-Buffering", "no")
+	// the headers go out now, not with the first event, so that clients see the stream is open
+	c.Writer.WriteHeaderNow()
+	c.Writer.Flush()
+	keepAlive := time.NewTicker(eventKeepAlive)
+	defer keepAlive.Stop()
+	var reported uint64
+	c.Stream(func(w io.Writer) bool {
+		select {
+		case e, ok := <-sub.Events():
+			if !ok {
+				return false
+			}
+			if dropped := sub.Dropped(); dropped > reported {
+				reported = dropped
+				c.Render(-1, sse.Event{Event: "dropped", Data: droppedEvent{Dropped: dropped}})
+			}
+			c.Render(-1, sse.Event{Event: e.Kind.String(), Id: strconv.FormatUint(e.Seq, 10), Data: e})
+			return true
+		case <-keepAlive.C:
+			_, err := io.WriteString(w, ": keep-alive\n\n")
+			return err == nil
+		case <-c.Request.Context().Done():
+			return false
+		}
+	})
+}
+
+// parseEventFilter reads the kind, type and tenant query parameters, each a comma separated list that
+// may be repeated. tenant= selects the default namespace.
+func parseEventFilter(c *gin.Context) (cache.EventFilter, error) {
+	var filter cache.EventFilter
+	for _, s := range queryList(c, "kind") {
+		kind, err := cache.ParseEventKind(s)
+		if err != nil {
+			return filter, err
+		}
+		filter.Kinds = append(filter.Kinds, kind)
+	}
+	for _, s := range queryList(c, "type") {
+		t, err := cache.ParseType(s)
+		if err != nil {
+			return filter, fmt.Errorf("%w: unknown type %q", apperror.ErrInvalidRequest, s)
+		}
+		filter.Types = append(filter.Types, t)
+	}
+	if tenants, ok := c.GetQueryArray("tenant"); ok {
+		for _, s := range tenants {
+			filter.Tenants = append(filter.Tenants, strings.Split(s, ",")...)
+		}
+	}
+	return filter, nil
+}
+
+// queryList returns the non-empty comma separated values of the query parameter key.
+func queryList(c *gin.Context, key string) []string {
+	var out []string
+	for _, s := range c.QueryArray(key) {
+		for _, v := range strings.Split(s, ",") {
+			if v = strings.TrimSpace(v); v != "" {
+				out = append(out, v)
+			}
+		}
+	}
+	return out
+}
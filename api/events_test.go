@@ -0,0 +1,123 @@
+package api
+
+import (
+	"bufio"
+	"cacheServer/cache"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+type eventsCache struct {
+	cache.AppCache
+	bus *cache.EventBus
+}
+
+func (e *eventsCache) Events() *cache.EventBus {
+	return e.bus
+}
+
+func TestEventStream(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	bus := cache.NewEventBus()
+	srv := httptest.NewServer(NewRouter(&eventsCache{bus: bus}, WithAdminToken("secret")))
+	defer srv.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL+"/events?kind=entryDeleted&type=product,category&tenant=t1", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	resp, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+
+	assert.Eventually(t, func() bool { return bus.Stats().Subscribers == 1 }, time.Second, 5*time.Millisecond)
+	at := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	bus.Publish(entryEvent(cache.EntryDeleted, cache.Role, "t1", at))
+	bus.Publish(entryEvent(cache.EntryUpdated, cache.Product, "t1", at))
+	bus.Publish(entryEvent(cache.EntryDeleted, cache.Product, "", at))
+	bus.Publish(entryEvent(cache.EntryDeleted, cache.Product, "t1", at))
+
+	reader := bufio.NewReader(resp.Body)
+	var lines []string
+	for len(lines) < 3 {
+		line, err := reader.ReadString('\n')
+		if !assert.NoError(t, err) {
+			return
+		}
+		if line = strings.TrimSpace(line); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	assert.Equal(t, []string{
+		"id:4",
+		"event:entryDeleted",
+		`data:{"seq":4,"time":"2024-01-02T03:04:05Z","kind":"entryDeleted","tenant":"t1","type":"Product","id":"p1"}`,
+	}, lines)
+
+	cancel()
+	assert.Eventually(t, func() bool { return bus.Stats().Subscribers == 0 }, time.Second, 5*time.Millisecond)
+}
+
+// entryEvent returns an event of the entry p1.
+func entryEvent(kind cache.EventKind, t cache.Type, tenant string, at time.Time) cache.Event {
+	return cache.Event{Kind: kind, Type: t, Tenant: tenant, ID: "p1", Time: at}
+}
+
+func TestEventStreamFilter(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := NewRouter(&eventsCache{bus: cache.NewEventBus()}, WithAdminToken("secret"))
+	cases := map[string]struct {
+		query    string
+		token    string
+		wantCode int
+		wantBody string
+	}{
+		"unknown kind": {
+			query:    "kind=entryMoved",
+			token:    "secret",
+			wantCode: http.StatusBadRequest,
+			wantBody: `{"message":"invalid request: unknown event kind \"entryMoved\""}`,
+		},
+		"unknown type": {
+			query:    "type=order",
+			token:    "secret",
+			wantCode: http.StatusBadRequest,
+			wantBody: `{"message":"invalid request: unknown type \"order\""}`,
+		},
+		"without the admin token": {
+			wantCode: http.StatusUnauthorized,
+			wantBody: `{"message":"unauthorized"}`,
+		},
+		"wrong token": {
+			token:    "guess",
+			wantCode: http.StatusUnauthorized,
+			wantBody: `{"message":"unauthorized"}`,
+		},
+	}
+	for k, v := range cases {
+		t.Run(k, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodGet, "/events?"+v.query, nil)
+			if v.token != "" {
+				req.Header.Set("Authorization", "Bearer "+v.token)
+			}
+			router.ServeHTTP(w, req)
+			assert.Equal(t, v.wantCode, w.Code)
+			assert.JSONEq(t, v.wantBody, w.Body.String())
+		})
+	}
+
+	// without an admin token the stream is not served
+	w := httptest.NewRecorder()
+	NewRouter(&eventsCache{bus: cache.NewEventBus()}).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/events", nil))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
@@ -0,0 +1,26 @@
+package api
+
+import (
+	"cacheServer/health"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// liveness answers 200 while the server is able to process requests at all.
+func (h *handler) liveness(c *gin.Context) {
+	writeReport(c, h.cache.Health().Live(c.Request.Context()))
+}
+
+// readiness answers 200 once the caches are initialized and the database and queue are healthy.
+func (h *handler) readiness(c *gin.Context) {
+	writeReport(c, h.cache.Health().Ready(c.Request.Context()))
+}
+
+func writeReport(c *gin.Context, report health.Report) {
+	code := http.StatusOK
+	if report.Status != health.StatusUp {
+		code = http.StatusServiceUnavailable
+	}
+	c.JSON(code, report)
+}
@@ -0,0 +1,70 @@
+package api
+
+import (
+	"cacheServer/health"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHealth(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	cases := map[string]struct {
+		path           string
+		initialization func(phase *health.Phase)
+		wantCode       int
+		wantBody       string
+	}{
+		"live while phases are pending": {
+			path:           "/healthz",
+			initialization: func(phase *health.Phase) {},
+			wantCode:       http.StatusOK,
+			wantBody:       `{"status":"up","checks":{"runLoop":{"status":"up"}}}`,
+		},
+		"not ready while phases are pending": {
+			path:           "/readyz",
+			initialization: func(phase *health.Phase) {},
+			wantCode:       http.StatusServiceUnavailable,
+			wantBody:       `{"status":"down","checks":{"runLoop":{"status":"up"},"categoryIndices":{"status":"down","detail":"pending"}}}`,
+		},
+		"not ready when a phase failed": {
+			path: "/readyz",
+			initialization: func(phase *health.Phase) {
+				phase.Start()
+				phase.Finish(assert.AnError)
+			},
+			wantCode: http.StatusServiceUnavailable,
+			wantBody: `{"status":"down","checks":{"runLoop":{"status":"up"},"categoryIndices":{"status":"down","detail":"` + assert.AnError.Error() + `"}}}`,
+		},
+	}
+
+	for k, v := range cases {
+		t.Run(k, func(t *testing.T) {
+			phase, router := newHealthRouter()
+			v.initialization(phase)
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, v.path, nil))
+			assert.Equal(t, v.wantCode, w.Code)
+			assert.JSONEq(t, v.wantBody, w.Body.String())
+		})
+	}
+
+	phase, router := newHealthRouter()
+	phase.Start()
+	phase.Finish(nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+}
+
+func newHealthRouter() (*health.Phase, *gin.Engine) {
+	phase := health.NewPhase()
+	registry := health.NewRegistry()
+	registry.AddLiveness("runLoop", health.CheckerFunc(func(ctx context.Context) health.Result { return health.Up("") }))
+	registry.AddReadiness("categoryIndices", phase)
+	return phase, NewRouter(&fakeCache{health: registry})
+}
@@ -0,0 +1,37 @@
+package api
+
+import (
+	"cacheServer/appcontext"
+	"cacheServer/cache"
+	"cacheServer/cluster"
+	"cacheServer/webhook"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// metricsResponse adds the config reload, webhook and cluster counters to the cache metrics.
+type metricsResponse struct {
+	cache.Metrics
+	Reload   *appcontext.ReloadStats `json:"reload,omitempty"`
+	Webhooks *webhook.Stats          `json:"webhooks,omitempty"`
+	Cluster  *cluster.Stats          `json:"cluster,omitempty"`
+}
+
+// metrics answers the cache, queue, database, reload, webhook and cluster counters as JSON.
+func (h *handler) metrics(c *gin.Context) {
+	resp := metricsResponse{Metrics: h.cache.Metrics()}
+	if h.reloader != nil {
+		stats := h.reloader.Stats()
+		resp.Reload = &stats
+	}
+	if h.webhooks != nil {
+		stats := h.webhooks.Stats()
+		resp.Webhooks = &stats
+	}
+	if h.cluster != nil {
+		stats := h.cluster.ClusterStats()
+		resp.Cluster = &stats
+	}
+	c.JSON(http.StatusOK, resp)
+}
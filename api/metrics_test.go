@@ -0,0 +1,73 @@
+package api
+
+import (
+	"cacheServer/cache"
+	"cacheServer/cluster"
+	"cacheServer/typedcache"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+type metricsCache struct {
+	cache.AppCache
+	metrics cache.Metrics
+}
+
+func (m *metricsCache) Metrics() cache.Metrics {
+	return m.metrics
+}
+
+func TestMetrics(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := NewRouter(&metricsCache{metrics: cache.Metrics{
+		Caches:   map[cache.Type]typedcache.Stats{cache.Product: {Hits: 3, Fallbacks: 1}},
+		Queue:    cache.QueueStats{Queued: 1, QueueSize: 10},
+		Events:   cache.EventStats{Published: 4, Delivered: 3, Dropped: 1, Subscribers: 1},
+		Database: map[string]interface{}{"breaker": map[string]string{"state": "open"}},
+	}})
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{
+		"caches":{"Product":{"Hits":3,"Misses":0,"Loads":0,"LoadErrors":0,"Evictions":0,"Expirations":0,
+			"StaleHits":0,"Refreshes":0,"Fallbacks":1,"Entries":0}},
+		"queue":{"queued":1,"queueSize":10,"busyWorkers":0,"workers":0},
+		"events":{"published":4,"delivered":3,"dropped":1,"subscribers":1},
+		"database":{"breaker":{"state":"open"}}}`, w.Body.String())
+}
+
+type fakeCluster struct{}
+
+func (fakeCluster) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.URL.Path))
+	})
+}
+
+func (fakeCluster) ClusterStats() cluster.Stats {
+	return cluster.Stats{Self: "a:1", Members: []string{"a:1", "b:1"}, Forwarded: 3, Broadcast: cluster.BroadcastStats{Sent: 2}}
+}
+
+func TestClusterRoutes(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := NewRouter(&metricsCache{}, WithCluster(fakeCluster{}))
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/cluster/verify", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "/cluster/verify", w.Body.String())
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	var body map[string]json.RawMessage
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+	assert.JSONEq(t, `{"self":"a:1","members":["a:1","b:1"],"rebalances":0,"forwarded":3,"forwardErrors":0,"served":0,
+		"broadcast":{"sent":2,"sendErrors":0,"received":0,"duplicates":0,"stale":0,"applied":0}}`,
+		string(body["cluster"]))
+}
@@ -0,0 +1,110 @@
+package api
+
+import (
+	"cacheServer/appcontext"
+	"cacheServer/cache"
+	"cacheServer/cluster"
+	"cacheServer/webhook"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+type handler struct {
+	cache      cache.AppCache
+	adminToken string
+	reloader   Reloader
+	webhooks   Webhooks
+	cluster    Cluster
+}
+
+// Reloader reloads the runtime configuration, see appcontext.Reloader.
+type Reloader interface {
+	Reload(source string) ([]string, error)
+	Stats() appcontext.ReloadStats
+}
+
+// Webhooks holds the failed webhook deliveries, see webhook.Dispatcher.
+type Webhooks interface {
+	DeadLetters() []webhook.Delivery
+	Replay(id string) error
+	Stats() webhook.Stats
+}
+
+// Cluster serves the calls between pods, see cluster.Node.
+type Cluster interface {
+	Handler() http.Handler
+	ClusterStats() cluster.Stats
+}
+
+// Option configures the router.
+type Option func(h *handler)
+
+// WithAdminToken enables the /admin endpoints for requests presenting token as a bearer token.
+func WithAdminToken(token string) Option {
+	return func(h *handler) {
+		h.adminToken = token
+	}
+}
+
+// WithReloader exposes r as POST /admin/reload and adds its counters to /metrics.
+func WithReloader(r Reloader) Option {
+	return func(h *handler) {
+		h.reloader = r
+	}
+}
+
+// WithWebhooks exposes the dead-lettered deliveries of w under /admin/webhooks and adds its counters
+// to /metrics.
+func WithWebhooks(w Webhooks) Option {
+	return func(h *handler) {
+		h.webhooks = w
+	}
+}
+
+// WithCluster serves the peer endpoints of c under /cluster and adds its membership to /metrics.
+func WithCluster(c Cluster) Option {
+	return func(h *handler) {
+		h.cluster = c
+	}
+}
+
+// NewRouter returns the gin engine exposing the cache over HTTP.
+func NewRouter(appCache cache.AppCache, opts ...Option) *gin.Engine {
+	h := &handler{cache: appCache}
+	for _, opt := range opts {
+		opt(h)
+	}
+	r := gin.New()
+	r.Use(gin.Logger(), gin.Recovery())
+	r.POST("/verify", h.verify)
+	r.POST("/verify/batch", h.verifyBatch)
+	r.POST("/verify/permission", h.verifyPermission)
+	r.POST("/verify/roles", h.verifyRoles)
+	r.GET("/healthz", h.liveness)
+	r.GET("/readyz", h.readiness)
+	r.GET("/metrics", h.metrics)
+	if h.cluster != nil {
+		r.Any(cluster.PathPrefix+"/*path", gin.WrapH(h.cluster.Handler()))
+	}
+	if h.adminToken != "" {
+		// events name users and their roles
+		r.GET("/events", h.authorizeAdmin, h.events)
+		admin := r.Group("/admin", h.authorizeAdmin)
+		admin.GET("/db", h.databaseStats)
+		admin.POST("/roles/invalidate", h.invalidateRoles)
+		admin.GET("/cache/:type", h.listEntries)
+		admin.GET("/cache/:type/:key", h.getEntry)
+		admin.DELETE("/cache", h.evictEntries)
+		admin.GET("/indices/:family", h.indexState)
+		admin.POST("/indices/:family/reinitialize", h.reinitializeIndices)
+		if h.reloader != nil {
+			admin.POST("/reload", h.reload)
+		}
+		if h.webhooks != nil {
+			admin.GET("/webhooks/deadletters", h.deadLetters)
+			admin.POST("/webhooks/deadletters/:id/replay", h.replayWebhook)
+		}
+	}
+	return r
+}
@@ -0,0 +1,161 @@
+package api
+
+import (
+	"cacheServer/apperror"
+	"cacheServer/cache"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// maxBatchSize bounds the number of ids verified by one batch request.
+const maxBatchSize = 500
+
+type verifyItem struct {
+	Type   string  `json:"type" binding:"required"`
+	ID     string  `json:"id" binding:"required"`
+	Role   *string `json:"role,omitempty"`   // claimed role, required for role verification
+	Tenant string  `json:"tenant,omitempty"` // namespace of the id, empty for the default one
+}
+
+type verifyResult struct {
+	Type   string `json:"type"`
+	ID     string `json:"id"`
+	Tenant string `json:"tenant,omitempty"`
+	Valid  bool   `json:"valid"`
+}
+
+type permissionItem struct {
+	ID         string `json:"id" binding:"required"` // email of the user
+	Tenant     string `json:"tenant"`                // empty checks the global roles only
+	Permission string `json:"permission" binding:"required"`
+}
+
+type permissionResult struct {
+	ID         string `json:"id"`
+	Tenant     string `json:"tenant,omitempty"`
+	Permission string `json:"permission"`
+	Valid      bool   `json:"valid"`
+}
+
+type rolesItem struct {
+	ID     string   `json:"id" binding:"required"` // email of the user
+	Tenant string   `json:"tenant"`                // empty checks the roles held in every tenant
+	Roles  []string `json:"roles" binding:"required"`
+	Match  string   `json:"match"` // any (default) or all
+}
+
+type rolesResult struct {
+	ID     string   `json:"id"`
+	Tenant string   `json:"tenant"`
+	Roles  []string `json:"roles"`
+	Match  string   `json:"match"`
+	Valid  bool     `json:"valid"`
+}
+
+type batchRequest struct {
+	Items []verifyItem `json:"items" binding:"required"`
+}
+
+// toBatchItem converts the json item to a cache.BatchItem, a nil role stays a nil opt.
+func (v verifyItem) toBatchItem() (cache.BatchItem, error) {
+	t, err := cache.ParseType(v.Type)
+	if err != nil {
+		return cache.BatchItem{}, fmt.Errorf("%w: unknown type %q", apperror.ErrInvalidRequest, v.Type)
+	}
+	item := cache.BatchItem{Type: t, ID: v.ID, Tenant: v.Tenant}
+	if v.Role != nil {
+		item.Opt = *v.Role
+	}
+	return item, nil
+}
+
+func (h *handler) verify(c *gin.Context) {
+	var body verifyItem
+	if err := c.ShouldBindJSON(&body); err != nil {
+		apperror.ErrorResponse(fmt.Errorf("%w: %v", apperror.ErrInvalidRequest, err), c)
+		return
+	}
+	item, err := body.toBatchItem()
+	if err != nil {
+		apperror.ErrorResponse(err, c)
+		return
+	}
+	req := cache.NewRequest(item.ID, item.Type, item.Opt).InTenant(item.Tenant)
+	h.cache.MakeRequest(req)
+	c.JSON(http.StatusOK, verifyResult{Type: item.Type.String(), ID: item.ID, Tenant: item.Tenant, Valid: <-req.Out})
+}
+
+func (h *handler) verifyBatch(c *gin.Context) {
+	var body batchRequest
+	if err := c.ShouldBindJSON(&body); err != nil {
+		apperror.ErrorResponse(fmt.Errorf("%w: %v", apperror.ErrInvalidRequest, err), c)
+		return
+	}
+	if len(body.Items) > maxBatchSize {
+		apperror.ErrorResponse(fmt.Errorf("%w: at most %d items per batch", apperror.ErrInvalidRequest, maxBatchSize), c)
+		return
+	}
+	items := make([]cache.BatchItem, len(body.Items))
+	for i, v := range body.Items {
+		item, err := v.toBatchItem()
+		if err != nil {
+			apperror.ErrorResponse(err, c)
+			return
+		}
+		items[i] = item
+	}
+	req := cache.NewBatchRequest(items)
+	h.cache.MakeBatchRequest(req)
+
+	results := make([]verifyResult, 0, len(items))
+	for i, r := range <-req.Out {
+		results = append(results, verifyResult{Type: r.Type.String(), ID: r.ID, Tenant: items[i].Tenant, Valid: r.Valid})
+	}
+	c.JSON(http.StatusOK, gin.H{"results": results})
+}
+
+// verifyPermission checks that a role the user holds in the tenant, or a role it inherits, is granted the
+// permission.
+func (h *handler) verifyPermission(c *gin.Context) {
+	var body permissionItem
+	if err := c.ShouldBindJSON(&body); err != nil {
+		apperror.ErrorResponse(fmt.Errorf("%w: %v", apperror.ErrInvalidRequest, err), c)
+		return
+	}
+	valid, err := h.cache.HasPermission(body.ID, body.Tenant, body.Permission)
+	if err != nil {
+		log.Println("permission check failed", err)
+	}
+	c.JSON(http.StatusOK, permissionResult{ID: body.ID, Tenant: body.Tenant, Permission: body.Permission, Valid: valid})
+}
+
+// verifyRoles checks a list of claimed roles against the roles the user holds in a tenant.
+func (h *handler) verifyRoles(c *gin.Context) {
+	var body rolesItem
+	if err := c.ShouldBindJSON(&body); err != nil {
+		apperror.ErrorResponse(fmt.Errorf("%w: %v", apperror.ErrInvalidRequest, err), c)
+		return
+	}
+	match, err := cache.ParseMatch(body.Match)
+	if err != nil {
+		apperror.ErrorResponse(err, c)
+		return
+	}
+	valid, err := h.cache.HasRoles(body.ID, body.Tenant, body.Roles, match)
+	if errors.Is(err, apperror.ErrInvalidRequest) {
+		apperror.ErrorResponse(err, c)
+		return
+	}
+	if err != nil {
+		log.Println("role check failed", err)
+	}
+	result := rolesResult{ID: body.ID, Tenant: body.Tenant, Roles: body.Roles, Match: "any", Valid: valid}
+	if match == cache.AllOf {
+		result.Match = "all"
+	}
+	c.JSON(http.StatusOK, result)
+}
@@ -0,0 +1,169 @@
+package api
+
+import (
+	"cacheServer/apperror"
+	"cacheServer/cache"
+	"cacheServer/health"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeCache answers verification requests with Valid set for ids listed in valid, as tenant/id for
+// ids of a tenant.
+type fakeCache struct {
+	cache.AppCache
+	valid  map[string]bool
+	health *health.Registry
+}
+
+func (f *fakeCache) MakeRequest(request *cache.Request) {
+	go func() { request.Out <- f.valid[tenantKey(request.Tenant(), request.ID())] }()
+}
+
+func (f *fakeCache) MakeBatchRequest(request *cache.BatchRequest) {
+	go func() {
+		var results []cache.BatchResult
+		for _, item := range request.Items() {
+			results = append(results, cache.BatchResult{Type: item.Type, ID: item.ID, Valid: f.valid[tenantKey(item.Tenant, item.ID)]})
+		}
+		request.Out <- results
+	}()
+}
+
+func tenantKey(tenant string, id string) string {
+	if tenant == "" {
+		return id
+	}
+	return tenant + "/" + id
+}
+
+func TestVerify(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	cases := map[string]struct {
+		path     string
+		body     string
+		wantCode int
+		wantBody string
+	}{
+		"single id": {
+			path:     "/verify",
+			body:     `{"type":"product","id":"p1"}`,
+			wantCode: http.StatusOK,
+			wantBody: `{"type":"Product","id":"p1","valid":true}`,
+		},
+		"id of a tenant": {
+			path:     "/verify",
+			body:     `{"type":"product","id":"p3","tenant":"t1"}`,
+			wantCode: http.StatusOK,
+			wantBody: `{"type":"Product","id":"p3","tenant":"t1","valid":true}`,
+		},
+		"batch across tenants": {
+			path:     "/verify/batch",
+			body:     `{"items":[{"type":"product","id":"p3","tenant":"t1"},{"type":"product","id":"p3"}]}`,
+			wantCode: http.StatusOK,
+			wantBody: `{"results":[{"type":"Product","id":"p3","tenant":"t1","valid":true},{"type":"Product","id":"p3","valid":false}]}`,
+		},
+		"unknown type": {
+			path:     "/verify",
+			body:     `{"type":"order","id":"p1"}`,
+			wantCode: http.StatusBadRequest,
+			wantBody: `{"message":"invalid request: unknown type \"order\""}`,
+		},
+		"batch keeps item order": {
+			path:     "/verify/batch",
+			body:     `{"items":[{"type":"product","id":"p2"},{"type":"role","id":"u1","role":"admin"},{"type":"category","id":"c1"}]}`,
+			wantCode: http.StatusOK,
+			wantBody: `{"results":[{"type":"Product","id":"p2","valid":false},{"type":"Role","id":"u1","valid":true},{"type":"Category","id":"c1","valid":true}]}`,
+		},
+		"granted permission": {
+			path:     "/verify/permission",
+			body:     `{"id":"u1","permission":"products.write"}`,
+			wantCode: http.StatusOK,
+			wantBody: `{"id":"u1","permission":"products.write","valid":true}`,
+		},
+		"missing permission": {
+			path:     "/verify/permission",
+			body:     `{"id":"u1","permission":"users.delete"}`,
+			wantCode: http.StatusOK,
+			wantBody: `{"id":"u1","permission":"users.delete","valid":false}`,
+		},
+		"permission in a tenant": {
+			path:     "/verify/permission",
+			body:     `{"id":"u1","tenant":"t1","permission":"invoices.read"}`,
+			wantCode: http.StatusOK,
+			wantBody: `{"id":"u1","tenant":"t1","permission":"invoices.read","valid":true}`,
+		},
+		"any of the claimed roles": {
+			path:     "/verify/roles",
+			body:     `{"id":"u1","tenant":"t1","roles":["admin","editor"]}`,
+			wantCode: http.StatusOK,
+			wantBody: `{"id":"u1","tenant":"t1","roles":["admin","editor"],"match":"any","valid":true}`,
+		},
+		"all of the claimed roles": {
+			path:     "/verify/roles",
+			body:     `{"id":"u1","tenant":"t1","roles":["admin","editor"],"match":"all"}`,
+			wantCode: http.StatusOK,
+			wantBody: `{"id":"u1","tenant":"t1","roles":["admin","editor"],"match":"all","valid":false}`,
+		},
+		"unknown match": {
+			path:     "/verify/roles",
+			body:     `{"id":"u1","roles":["admin"],"match":"most"}`,
+			wantCode: http.StatusBadRequest,
+			wantBody: `{"message":"invalid request: unknown match \"most\", want any or all"}`,
+		},
+		"no claimed role": {
+			path:     "/verify/roles",
+			body:     `{"id":"u1","roles":[]}`,
+			wantCode: http.StatusBadRequest,
+			wantBody: `{"message":"invalid request: no role claimed"}`,
+		},
+		"batch with missing items": {
+			path:     "/verify/batch",
+			body:     `{}`,
+			wantCode: http.StatusBadRequest,
+		},
+	}
+
+	router := NewRouter(&fakeCache{valid: map[string]bool{"p1": true, "u1": true, "c1": true, "u1  products.write": true, "u1 t1 invoices.read": true, "u1 t1 editor": true, "t1/p3": true}})
+	for k, v := range cases {
+		t.Run(k, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodPost, v.path, strings.NewReader(v.body))
+			router.ServeHTTP(w, req)
+			assert.Equal(t, v.wantCode, w.Code)
+			if v.wantBody != "" {
+				assert.JSONEq(t, v.wantBody, w.Body.String())
+			}
+		})
+	}
+}
+
+func (f *fakeCache) HasPermission(email string, tenant string, permission string) (bool, error) {
+	return f.valid[email+" "+tenant+" "+permission], nil
+}
+
+func (f *fakeCache) HasRoles(email string, tenant string, claimed []string, match cache.Match) (bool, error) {
+	if len(claimed) == 0 {
+		return false, fmt.Errorf("%w: no role claimed", apperror.ErrInvalidRequest)
+	}
+	held := 0
+	for _, role := range claimed {
+		if f.valid[email+" "+tenant+" "+role] {
+			held++
+		}
+	}
+	if match == cache.AllOf {
+		return held == len(claimed), nil
+	}
+	return held > 0, nil
+}
+
+func (f *fakeCache) Health() *health.Registry {
+	return f.health
+}
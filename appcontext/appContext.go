@@ -2,15 +2,79 @@ package appcontext
 
 import (
 	"cacheServer/db"
+	"cacheServer/typedcache"
 )
 
-// Context struct contains database client and db timeout.
+// Context struct contains database client, db timeout and cache options.
 type Context struct {
 	DatabaseClient db.DatabaseClient
+	Dialect        db.Dialect // SQL flavour of DatabaseClient, Postgres by default
 	DBTimeout      int
+	CacheOptions   typedcache.Options
+	Warmup         WarmupConfig
+	Queue          QueueConfig
+	Roles          RolesConfig
+	Tenants        TenantsConfig
+	MaxProcs       int    // GOMAXPROCS set by the server, zero keeps the runtime default
+	IndexLock      string // IndexLockNone or IndexLockAdvisory
+}
+
+// QueueConfig bounds the verification request queue and the workers draining it.
+type QueueConfig struct {
+	Size    int `yaml:"size" toml:"size" env:"QUEUE_SIZE" help:"requests buffered before MakeRequest blocks"`
+	Workers int `yaml:"workers" toml:"workers" env:"QUEUE_WORKERS" reload:"true" help:"requests verified concurrently"`
+}
+
+// Role sources of RolesConfig.
+const (
+	RoleSourceColumn = "column" // one role per user in users."role"
+	RoleSourceTable  = "table"  // any number of roles per user and tenant in userRoles
+)
+
+// Index locks of DatabaseConfig.
+const (
+	IndexLockNone     = "none"     // index mutations only change the memory of the pod
+	IndexLockAdvisory = "advisory" // index mutations of a parent hold a Postgres advisory lock
+)
+
+// Fsync modes of WALConfig.
+const (
+	WALSyncAlways   = "always"   // every index change is on disk before it returns
+	WALSyncInterval = "interval" // the journal is fsynced every WALConfig.SyncInterval
+	WALSyncNever    = "never"    // flushing is left to the operating system
+)
+
+// RolesConfig selects where the roles of a user are read from.
+type RolesConfig struct {
+	Source string `yaml:"source" toml:"source" env:"ROLE_SOURCE" help:"column (users.role) or table (userRoles)"`
+}
+
+// DefaultTenantColumn is the column holding the tenant of every row.
+const DefaultTenantColumn = "tenantID"
+
+// TenantsConfig scopes cache entries and index spaces per tenant. Each tenant verified or indexed gets a
+// namespace of its own, reading only the rows whose tenant column holds its name.
+type TenantsConfig struct {
+	Column     string   `yaml:"column" toml:"column" env:"TENANT_COLUMN" help:"column holding the tenant of every row"`
+	Names      []string `yaml:"names,omitempty" toml:"names,omitempty" env:"TENANTS" help:"tenants served, empty serves any up to tenants.max"`
+	Max        int      `yaml:"max" toml:"max" env:"TENANTS_MAX" help:"namespaces created at most when names is empty, zero means no limit"`
+	MaxEntries int      `yaml:"maxEntries" toml:"maxEntries" env:"TENANT_MAX_ENTRIES" reload:"true" help:"entries kept per cache of a tenant, zero uses cache.maxEntries"`
+}
+
+// WarmupConfig controls bulk loading of roles and active entities into the cache on startup.
+type WarmupConfig struct {
+	Enabled  bool `yaml:"enabled" toml:"enabled" env:"WARMUP_ENABLED"`
+	PageSize int  `yaml:"pageSize" toml:"pageSize" env:"WARMUP_PAGE_SIZE" help:"rows fetched per query"`
+	Limit    int  `yaml:"limit" toml:"limit" env:"WARMUP_LIMIT" help:"maximum rows loaded per type, zero means no limit"`
 }
 
 // NewContext constructor for appcontext struct.
-func NewContext(db db.DatabaseClient, timeout int) *Context {
-	return &Context{DatabaseClient: db, DBTimeout: timeout}
+func NewContext(client db.DatabaseClient, timeout int) *Context {
+	return &Context{
+		DatabaseClient: client,
+		Dialect:        db.PostgresDialect,
+		DBTimeout:      timeout,
+		Queue:          QueueConfig{Size: 1024, Workers: 128},
+		Tenants:        TenantsConfig{Column: DefaultTenantColumn, Max: 64},
+	}
 }
@@ -0,0 +1,630 @@
+package appcontext
+
+import (
+	"cacheServer/db"
+	"cacheServer/logging"
+	"cacheServer/typedcache"
+	"encoding"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pelletier/go-toml/v2"
+	"gopkg.in/yaml.v3"
+)
+
+// redacted replaces the value of secret settings in the printed config.
+const redacted = "<redacted>"
+
+// identifier matches the column names that may be configured.
+var identifier = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// Config is the typed configuration of the server. LoadConfig fills it from, in increasing precedence,
+// the defaults, a YAML or TOML file, environment variables and command line flags. Every setting has a
+// flag named after its path in the file, e.g. -database.pool.maxOpenConns, and most an environment
+// variable given by the env tag; the first variable of a comma separated list that is set wins.
+// Settings tagged reload can be changed by a Reloader while the server runs.
+type Config struct {
+	Database DatabaseConfig `yaml:"database" toml:"database"`
+	Cache    CacheConfig    `yaml:"cache" toml:"cache"`
+	Warmup   WarmupConfig   `yaml:"warmup" toml:"warmup"`
+	Queue    QueueConfig    `yaml:"queue" toml:"queue"`
+	Roles    RolesConfig    `yaml:"roles" toml:"roles"`
+	Tenants  TenantsConfig  `yaml:"tenants" toml:"tenants"`
+	Webhooks WebhooksConfig `yaml:"webhooks" toml:"webhooks"`
+	Cluster  ClusterConfig  `yaml:"cluster" toml:"cluster"`
+	WAL      WALConfig      `yaml:"wal" toml:"wal"`
+	HTTP     HTTPConfig     `yaml:"http" toml:"http"`
+	Log      LogConfig      `yaml:"log" toml:"log"`
+	Runtime  RuntimeConfig  `yaml:"runtime" toml:"runtime"`
+
+	path string // file the config was read from, if any
+}
+
+// DatabaseConfig selects the database and how it is reached.
+type DatabaseConfig struct {
+	Driver        string        `yaml:"driver" toml:"driver" env:"DB_DRIVER" help:"postgres, sqlite3 or mysql"`
+	URI           string        `yaml:"uri" toml:"uri" env:"DATABASE_URI,POSTGRES_URI" secret:"true" help:"connection string of the primary"`
+	Timeout       int           `yaml:"timeout" toml:"timeout" env:"DB_TIMEOUT" help:"seconds the readiness ping may take, zero for the default"`
+	MaxStatements int           `yaml:"maxStatements" toml:"maxStatements" env:"DB_MAX_STATEMENTS" help:"prepared statements kept per pool"`
+	Pool          PoolConfig    `yaml:"pool" toml:"pool"`
+	Connect       ConnectConfig `yaml:"connect" toml:"connect"`
+	Replicas      ReplicaConfig `yaml:"replicas" toml:"replicas"`
+	Retry         RetryConfig   `yaml:"retry" toml:"retry"`
+	Breaker       BreakerConfig `yaml:"breaker" toml:"breaker"`
+	IndexLock     string        `yaml:"indexLock" toml:"indexLock" env:"DB_INDEX_LOCK" help:"none, or advisory to serialize index changes of a parent across pods (postgres only)"`
+}
+
+// PoolConfig is the file form of db.PoolConfig.
+type PoolConfig struct {
+	MaxOpenConns    int      `yaml:"maxOpenConns" toml:"maxOpenConns" env:"DB_MAX_OPEN_CONNS"`
+	MaxIdleConns    int      `yaml:"maxIdleConns" toml:"maxIdleConns" env:"DB_MAX_IDLE_CONNS"`
+	ConnMaxLifetime Duration `yaml:"connMaxLifetime" toml:"connMaxLifetime" env:"DB_CONN_MAX_LIFETIME"`
+	ConnMaxIdleTime Duration `yaml:"connMaxIdleTime" toml:"connMaxIdleTime" env:"DB_CONN_MAX_IDLE_TIME"`
+}
+
+// ConnectConfig is the file form of db.ConnectConfig.
+type ConnectConfig struct {
+	Attempts int      `yaml:"attempts" toml:"attempts" env:"DB_CONNECT_ATTEMPTS" help:"startup pings before giving up"`
+	Backoff  Duration `yaml:"backoff" toml:"backoff" env:"DB_CONNECT_BACKOFF" help:"wait after the first failed startup ping"`
+}
+
+// ReplicaConfig lists the read replicas, empty to read from the primary only.
+type ReplicaConfig struct {
+	URIs          []string `yaml:"uris" toml:"uris" env:"DB_REPLICA_URIS" secret:"true" help:"comma separated connection strings"`
+	Policy        string   `yaml:"policy" toml:"policy" env:"DB_REPLICA_POLICY" help:"round-robin or least-latency"`
+	CheckInterval Duration `yaml:"checkInterval" toml:"checkInterval" env:"DB_REPLICA_CHECK_INTERVAL"`
+}
+
+// RetryConfig is the file form of db.RetryConfig.
+type RetryConfig struct {
+	Attempts  int      `yaml:"attempts" toml:"attempts" env:"DB_RETRY_ATTEMPTS"`
+	BaseDelay Duration `yaml:"baseDelay" toml:"baseDelay" env:"DB_RETRY_BASE_DELAY"`
+	MaxDelay  Duration `yaml:"maxDelay" toml:"maxDelay" env:"DB_RETRY_MAX_DELAY"`
+}
+
+// BreakerConfig is the file form of db.BreakerConfig.
+type BreakerConfig struct {
+	Threshold   int      `yaml:"threshold" toml:"threshold" env:"DB_BREAKER_THRESHOLD"`
+	OpenTimeout Duration `yaml:"openTimeout" toml:"openTimeout" env:"DB_BREAKER_OPEN_TIMEOUT"`
+	SlowCall    Duration `yaml:"slowCall" toml:"slowCall" env:"DB_BREAKER_SLOW_CALL"`
+}
+
+// CacheConfig is the file form of typedcache.Options.
+type CacheConfig struct {
+	TTL            Duration `yaml:"ttl" toml:"ttl" env:"CACHE_TTL" reload:"true"`
+	MaxEntries     int      `yaml:"maxEntries" toml:"maxEntries" env:"CACHE_MAX_ENTRIES" reload:"true"`
+	RefreshAhead   float64  `yaml:"refreshAhead" toml:"refreshAhead" env:"CACHE_REFRESH_AHEAD" reload:"true" help:"fraction of the TTL after which hot entries are reloaded"`
+	RefreshMinHits uint64   `yaml:"refreshMinHits" toml:"refreshMinHits" env:"CACHE_REFRESH_MIN_HITS" reload:"true"`
+	MaxStale       Duration `yaml:"maxStale" toml:"maxStale" env:"CACHE_MAX_STALE" reload:"true"`
+}
+
+// WebhooksConfig lists the receivers of entity status changes and how their deliveries are retried.
+type WebhooksConfig struct {
+	Subscriptions []WebhookConfig `yaml:"subscriptions,omitempty" toml:"subscriptions,omitempty" help:"receivers, set in the config file only"`
+	Workers       int             `yaml:"workers" toml:"workers" env:"WEBHOOK_WORKERS" help:"deliveries sent at the same time"`
+	Attempts      int             `yaml:"attempts" toml:"attempts" env:"WEBHOOK_ATTEMPTS" help:"deliveries tried before a webhook is dead-lettered"`
+	BaseDelay     Duration        `yaml:"baseDelay" toml:"baseDelay" env:"WEBHOOK_BASE_DELAY" help:"wait after the first failed delivery, doubled per attempt"`
+	MaxDelay      Duration        `yaml:"maxDelay" toml:"maxDelay" env:"WEBHOOK_MAX_DELAY"`
+	Timeout       Duration        `yaml:"timeout" toml:"timeout" env:"WEBHOOK_TIMEOUT" help:"time a receiver has to answer"`
+	DeadLetters   int             `yaml:"deadLetters" toml:"deadLetters" env:"WEBHOOK_DEAD_LETTERS" help:"failed deliveries kept for replay"`
+}
+
+// WebhookConfig is one receiver. Its payloads are signed with Secret.
+type WebhookConfig struct {
+	Name   string   `yaml:"name" toml:"name"`
+	URL    string   `yaml:"url" toml:"url"`
+	Secret string   `yaml:"secret" toml:"secret" secret:"true"`
+	Types  []string `yaml:"types,omitempty" toml:"types,omitempty"` // empty for every type
+}
+
+// ClusterConfig makes the pods share their keys over a consistent-hash ring and broadcast their
+// invalidations, see package cluster.
+type ClusterConfig struct {
+	Self            string   `yaml:"self" toml:"self" env:"CLUSTER_SELF" help:"host:port the peers reach this pod at, empty disables cluster mode"`
+	Peers           []string `yaml:"peers,omitempty" toml:"peers,omitempty" env:"CLUSTER_PEERS" help:"comma separated host:port of the pods"`
+	DNS             string   `yaml:"dns" toml:"dns" env:"CLUSTER_DNS" help:"host:port whose addresses are the pods, e.g. a headless service"`
+	RefreshInterval Duration `yaml:"refreshInterval" toml:"refreshInterval" env:"CLUSTER_REFRESH_INTERVAL" help:"how often the peers are discovered and pinged"`
+	Replicas        int      `yaml:"replicas" toml:"replicas" env:"CLUSTER_REPLICAS" help:"points per pod on the hash ring"`
+	Timeout         Duration `yaml:"timeout" toml:"timeout" env:"CLUSTER_TIMEOUT" help:"time a peer has to answer"`
+	Secret          string   `yaml:"secret" toml:"secret" env:"CLUSTER_SECRET" secret:"true" help:"bearer token of the calls between pods, required in cluster mode"`
+	Sharding        bool     `yaml:"sharding" toml:"sharding" env:"CLUSTER_SHARDING" help:"forward lookups to the pod owning the key, otherwise pods only broadcast invalidations"`
+	RaftPort        int      `yaml:"raftPort" toml:"raftPort" env:"CLUSTER_RAFT_PORT" help:"port of the Raft group the pods allocate indices through, listened on the host of cluster.self only, connections must prove cluster.secret, 0 broadcasts index changes instead"`
+}
+
+// WALConfig journals the index mutations so that a restarted pod recovers them, see package wal.
+type WALConfig struct {
+	Dir           string   `yaml:"dir" toml:"dir" env:"WAL_DIR" help:"directory of the index journal, empty keeps index changes in memory only"`
+	Fsync         string   `yaml:"fsync" toml:"fsync" env:"WAL_FSYNC" help:"always, interval or never"`
+	SyncInterval  Duration `yaml:"syncInterval" toml:"syncInterval" env:"WAL_SYNC_INTERVAL" help:"how often the journal is fsynced with fsync interval"`
+	SegmentSize   int      `yaml:"segmentSize" toml:"segmentSize" env:"WAL_SEGMENT_SIZE" help:"bytes after which a new segment file is started"`
+	SnapshotEvery int      `yaml:"snapshotEvery" toml:"snapshotEvery" env:"WAL_SNAPSHOT_EVERY" help:"records after which the indices are snapshotted and older segments removed"`
+}
+
+// HTTPConfig configures the API listener.
+type HTTPConfig struct {
+	Addr       string `yaml:"addr" toml:"addr" env:"HTTP_ADDR"`
+	AdminToken string `yaml:"adminToken" toml:"adminToken" env:"ADMIN_TOKEN" secret:"true" help:"bearer token of /admin, empty disables it"`
+}
+
+// LogConfig ...
+type LogConfig struct {
+	Level string `yaml:"level" toml:"level" env:"LOG_LEVEL" reload:"true" help:"debug, info, warn or error"`
+}
+
+// RuntimeConfig tunes the Go runtime.
+type RuntimeConfig struct {
+	MaxProcs int `yaml:"maxProcs" toml:"maxProcs" env:"GO_MAX_PROC" reload:"true" help:"GOMAXPROCS, zero keeps the number of CPUs"`
+}
+
+// Duration is a time.Duration written as a string such as "1m30s".
+type Duration time.Duration
+
+// UnmarshalText ...
+func (d *Duration) UnmarshalText(text []byte) error {
+	v, err := time.ParseDuration(string(text))
+	if err != nil {
+		return fmt.Errorf("%q is not a valid duration, e.g. 500ms or 1m30s", text)
+	}
+	*d = Duration(v)
+	return nil
+}
+
+func (d Duration) String() string {
+	return time.Duration(d).String()
+}
+
+// MarshalText ...
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(time.Duration(d).String()), nil
+}
+
+// DefaultConfig returns the settings used when nothing else is configured.
+func DefaultConfig() *Config {
+	return &Config{
+		Database: DatabaseConfig{Driver: db.DriverPostgres, IndexLock: IndexLockNone},
+		Queue:    QueueConfig{Size: 1024, Workers: 128},
+		Roles:    RolesConfig{Source: RoleSourceColumn},
+		Tenants:  TenantsConfig{Column: DefaultTenantColumn, Max: 64},
+		Webhooks: WebhooksConfig{
+			Workers:     4,
+			Attempts:    5,
+			BaseDelay:   Duration(time.Second),
+			MaxDelay:    Duration(time.Minute),
+			Timeout:     Duration(10 * time.Second),
+			DeadLetters: 1000,
+		},
+		Cluster: ClusterConfig{
+			RefreshInterval: Duration(10 * time.Second),
+			Replicas:        128,
+			Timeout:         Duration(2 * time.Second),
+			Sharding:        true,
+		},
+		WAL: WALConfig{
+			Fsync:         WALSyncInterval,
+			SyncInterval:  Duration(time.Second),
+			SegmentSize:   16 << 20,
+			SnapshotEvery: 10000,
+		},
+		HTTP: HTTPConfig{Addr: ":8080"},
+		Log:  LogConfig{Level: logging.Info.String()},
+	}
+}
+
+// LoadConfig builds the config from args, the command line without the program name, and the
+// environment read through lookupEnv. The file is named by -config or CONFIG_FILE, its format
+// follows the extension (.yaml, .yml or .toml). The result is validated.
+func LoadConfig(args []string, lookupEnv func(string) (string, bool)) (*Config, error) {
+	cfg := DefaultConfig()
+	fs := flag.NewFlagSet("cacheServer", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	path := fs.String("config", "", "YAML or TOML config file")
+	var flagSets []func() error
+	for _, f := range cfg.fields() {
+		f := f
+		if f.fileOnly {
+			continue
+		}
+		fs.Func(f.path, f.help, func(s string) error {
+			flagSets = append(flagSets, func() error { return f.set(s) })
+			return nil
+		})
+	}
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			fs.SetOutput(os.Stderr)
+			fs.PrintDefaults()
+		}
+		return nil, fmt.Errorf("config: %w", err)
+	}
+	if *path == "" {
+		*path, _ = lookupEnv("CONFIG_FILE")
+	}
+	if *path != "" {
+		if err := cfg.readFile(*path); err != nil {
+			return nil, err
+		}
+		cfg.path = *path
+	}
+	var errs []error
+	for _, f := range cfg.fields() {
+		for _, name := range f.env {
+			if s, ok := lookupEnv(name); ok && s != "" {
+				if err := f.set(s); err != nil {
+					errs = append(errs, fmt.Errorf("config: environment %s: %w", name, err))
+				}
+				break
+			}
+		}
+	}
+	for _, set := range flagSets {
+		if err := set(); err != nil {
+			errs = append(errs, fmt.Errorf("config: flag: %w", err))
+		}
+	}
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// readFile decodes path over c, rejecting keys that are not settings.
+func (c *Config) readFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("config: %w", err)
+	}
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".yaml", ".yml":
+		dec := yaml.NewDecoder(strings.NewReader(string(data)))
+		dec.KnownFields(true)
+		err = dec.Decode(c)
+		if err == io.EOF {
+			err = nil
+		}
+	case ".toml":
+		dec := toml.NewDecoder(strings.NewReader(string(data)))
+		dec.DisallowUnknownFields()
+		err = dec.Decode(c)
+		var strict *toml.StrictMissingError
+		if errors.As(err, &strict) {
+			err = errors.New(strict.String())
+		}
+	default:
+		return fmt.Errorf("config: %s: unsupported format %q, use .yaml, .yml or .toml", path, ext)
+	}
+	if err != nil {
+		return fmt.Errorf("config: %s: %w", path, err)
+	}
+	return nil
+}
+
+// Validate checks every setting and returns all problems found, each naming the setting, its
+// environment variable and its flag.
+func (c *Config) Validate() error {
+	var errs []error
+	fields := make(map[string]field)
+	for _, f := range c.fields() {
+		fields[f.path] = f
+		switch f.value.Kind() {
+		case reflect.Int, reflect.Int64:
+			if f.value.Int() < 0 {
+				errs = append(errs, f.errorf("must not be negative, got %v", f.value.Interface()))
+			}
+		case reflect.Float64:
+			if f.value.Float() < 0 {
+				errs = append(errs, f.errorf("must not be negative, got %v", f.value.Float()))
+			}
+		}
+	}
+	check := func(path string, ok bool, format string, args ...interface{}) {
+		if !ok {
+			errs = append(errs, fields[path].errorf(format, args...))
+		}
+	}
+	_, err := db.DialectFor(c.Database.Driver)
+	check("database.driver", err == nil, "unknown driver %q, want %s, %s or %s",
+		c.Database.Driver, db.DriverPostgres, db.DriverSQLite, db.DriverMySQL)
+	check("database.uri", c.Database.URI != "", "is required")
+	pool := c.Database.Pool
+	check("database.pool.maxIdleConns", pool.MaxOpenConns == 0 || pool.MaxIdleConns <= pool.MaxOpenConns,
+		"must not exceed database.pool.maxOpenConns (%d), got %d", pool.MaxOpenConns, pool.MaxIdleConns)
+	for _, uri := range c.Database.Replicas.URIs {
+		check("database.replicas.uris", strings.TrimSpace(uri) != "", "must not contain empty entries")
+	}
+	_, err = db.ParsePolicy(c.Database.Replicas.Policy)
+	check("database.replicas.policy", err == nil, "unknown policy %q, want round-robin or least-latency",
+		c.Database.Replicas.Policy)
+	check("database.indexLock", c.Database.IndexLock == IndexLockNone || c.Database.IndexLock == IndexLockAdvisory,
+		"unknown lock %q, want %s or %s", c.Database.IndexLock, IndexLockNone, IndexLockAdvisory)
+	dialect, _ := db.DialectFor(c.Database.Driver)
+	check("database.indexLock", c.Database.IndexLock != IndexLockAdvisory || dialect == db.PostgresDialect,
+		"%s requires the %s driver", IndexLockAdvisory, db.DriverPostgres)
+	retry := c.Database.Retry
+	check("database.retry.maxDelay", retry.MaxDelay == 0 || retry.MaxDelay >= retry.BaseDelay,
+		"must not be below database.retry.baseDelay (%v), got %v", retry.BaseDelay, retry.MaxDelay)
+	check("cache.refreshAhead", c.Cache.RefreshAhead < 1, "must be a fraction below 1, got %v", c.Cache.RefreshAhead)
+	check("queue.size", c.Queue.Size > 0, "must be positive, got %d", c.Queue.Size)
+	check("queue.workers", c.Queue.Workers > 0, "must be positive, got %d", c.Queue.Workers)
+	check("roles.source", c.Roles.Source == RoleSourceColumn || c.Roles.Source == RoleSourceTable,
+		"unknown source %q, want %s or %s", c.Roles.Source, RoleSourceColumn, RoleSourceTable)
+	check("tenants.column", identifier.MatchString(c.Tenants.Column), "must be a column name, got %q", c.Tenants.Column)
+	for _, name := range c.Tenants.Names {
+		check("tenants.names", strings.TrimSpace(name) != "", "must not contain empty entries")
+	}
+	hooks := c.Webhooks
+	check("webhooks.workers", hooks.Workers > 0, "must be positive, got %d", hooks.Workers)
+	check("webhooks.attempts", hooks.Attempts > 0, "must be positive, got %d", hooks.Attempts)
+	check("webhooks.maxDelay", hooks.MaxDelay >= hooks.BaseDelay,
+		"must not be below webhooks.baseDelay (%v), got %v", hooks.BaseDelay, hooks.MaxDelay)
+	names := make(map[string]bool, len(hooks.Subscriptions))
+	for i, sub := range hooks.Subscriptions {
+		check("webhooks.subscriptions", sub.Name != "" && !names[sub.Name], "entry %d: name must be set and unique, got %q", i, sub.Name)
+		names[sub.Name] = true
+		u, err := url.Parse(sub.URL)
+		check("webhooks.subscriptions", err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != "",
+			"%s: url must be an absolute http or https URL, got %q", sub.Name, sub.URL)
+		check("webhooks.subscriptions", sub.Secret != "", "%s: secret is required", sub.Name)
+	}
+	cluster := c.Cluster
+	if cluster.Self != "" {
+		_, _, err = net.SplitHostPort(cluster.Self)
+		check("cluster.self", err == nil, "must be host:port, got %q", cluster.Self)
+	}
+	check("cluster.self", cluster.Self != "" || (len(cluster.Peers) == 0 && cluster.DNS == ""),
+		"is required with cluster.peers or cluster.dns")
+	// the peer endpoints are served on the public router and change the cache of every pod
+	check("cluster.secret", cluster.Self == "" || cluster.Secret != "", "is required with cluster.self")
+	check("cluster.dns", len(cluster.Peers) == 0 || cluster.DNS == "", "must not be set with cluster.peers")
+	for _, peer := range cluster.Peers {
+		_, _, err = net.SplitHostPort(peer)
+		check("cluster.peers", err == nil, "must be host:port entries, got %q", peer)
+	}
+	if cluster.DNS != "" {
+		_, _, err = net.SplitHostPort(cluster.DNS)
+		check("cluster.dns", err == nil, "must be host:port, got %q", cluster.DNS)
+	}
+	check("cluster.raftPort", cluster.RaftPort >= 0 && cluster.RaftPort <= 65535, "must be a port number, got %d", cluster.RaftPort)
+	check("cluster.raftPort", cluster.RaftPort == 0 || len(cluster.Peers) > 0, "requires cluster.peers, the Raft group is formed from them and not from cluster.dns")
+	journal := c.WAL
+	check("wal.fsync", journal.Fsync == WALSyncAlways || journal.Fsync == WALSyncInterval || journal.Fsync == WALSyncNever,
+		"unknown mode %q, want %s, %s or %s", journal.Fsync, WALSyncAlways, WALSyncInterval, WALSyncNever)
+	check("wal.syncInterval", journal.Fsync != WALSyncInterval || journal.SyncInterval > 0, "must be positive, got %v", journal.SyncInterval)
+	check("wal.segmentSize", journal.SegmentSize > 0, "must be positive, got %d", journal.SegmentSize)
+	check("wal.snapshotEvery", journal.SnapshotEvery > 0, "must be positive, got %d", journal.SnapshotEvery)
+	check("http.addr", c.HTTP.Addr != "", "is required")
+	_, err = logging.ParseLevel(c.Log.Level)
+	check("log.level", err == nil, "unknown level %q, want debug, info, warn or error", c.Log.Level)
+	return errors.Join(errs...)
+}
+
+// Path returns the file c was read from, empty if there was none.
+func (c *Config) Path() string {
+	return c.path
+}
+
+// LogLevel ...
+func (c *Config) LogLevel() logging.Level {
+	level, _ := logging.ParseLevel(c.Log.Level)
+	return level
+}
+
+// Redacted returns a copy of c with the secret settings replaced.
+func (c *Config) Redacted() *Config {
+	out := *c
+	out.Database.Replicas.URIs = append([]string(nil), c.Database.Replicas.URIs...)
+	out.Webhooks.Subscriptions = append([]WebhookConfig(nil), c.Webhooks.Subscriptions...)
+	for i := range out.Webhooks.Subscriptions {
+		if out.Webhooks.Subscriptions[i].Secret != "" {
+			out.Webhooks.Subscriptions[i].Secret = redacted
+		}
+	}
+	for _, f := range out.fields() {
+		if !f.secret {
+			continue
+		}
+		switch v := f.value.Addr().Interface().(type) {
+		case *string:
+			if *v != "" {
+				*v = redacted
+			}
+		case *[]string:
+			for i := range *v {
+				(*v)[i] = redacted
+			}
+		}
+	}
+	return &out
+}
+
+// Print writes the effective config as YAML with the secrets redacted.
+func (c *Config) Print(w io.Writer) error {
+	enc := yaml.NewEncoder(w)
+	enc.SetIndent(2)
+	if err := enc.Encode(c.Redacted()); err != nil {
+		return err
+	}
+	return enc.Close()
+}
+
+// Context returns a Context for client configured by c.
+func (c *Config) Context(client db.DatabaseClient) *Context {
+	ctx := NewContext(client, c.Database.Timeout)
+	ctx.CacheOptions = c.Cache.Options()
+	ctx.Warmup = c.Warmup
+	ctx.Queue = c.Queue
+	ctx.Roles = c.Roles
+	ctx.Tenants = c.Tenants
+	ctx.MaxProcs = c.Runtime.MaxProcs
+	ctx.IndexLock = c.Database.IndexLock
+	return ctx
+}
+
+// PoolConfig ...
+func (c DatabaseConfig) PoolConfig() db.PoolConfig {
+	return db.PoolConfig{
+		MaxOpenConns:    c.Pool.MaxOpenConns,
+		MaxIdleConns:    c.Pool.MaxIdleConns,
+		ConnMaxLifetime: time.Duration(c.Pool.ConnMaxLifetime),
+		ConnMaxIdleTime: time.Duration(c.Pool.ConnMaxIdleTime),
+	}
+}
+
+// ConnectConfig ...
+func (c DatabaseConfig) ConnectConfig() db.ConnectConfig {
+	return db.ConnectConfig{Attempts: c.Connect.Attempts, BaseDelay: time.Duration(c.Connect.Backoff)}
+}
+
+// ReplicaConfig ...
+func (c DatabaseConfig) ReplicaConfig() db.ReplicaConfig {
+	policy, _ := db.ParsePolicy(c.Replicas.Policy)
+	return db.ReplicaConfig{Policy: policy, CheckInterval: time.Duration(c.Replicas.CheckInterval)}
+}
+
+// RetryConfig ...
+func (c DatabaseConfig) RetryConfig() db.RetryConfig {
+	return db.RetryConfig{
+		MaxAttempts: c.Retry.Attempts,
+		BaseDelay:   time.Duration(c.Retry.BaseDelay),
+		MaxDelay:    time.Duration(c.Retry.MaxDelay),
+	}
+}
+
+// BreakerConfig ...
+func (c DatabaseConfig) BreakerConfig() db.BreakerConfig {
+	return db.BreakerConfig{
+		FailureThreshold:  c.Breaker.Threshold,
+		OpenTimeout:       time.Duration(c.Breaker.OpenTimeout),
+		SlowCallThreshold: time.Duration(c.Breaker.SlowCall),
+	}
+}
+
+// Options ...
+func (c CacheConfig) Options() typedcache.Options {
+	return typedcache.Options{
+		TTL:            time.Duration(c.TTL),
+		MaxEntries:     c.MaxEntries,
+		RefreshAhead:   c.RefreshAhead,
+		RefreshMinHits: c.RefreshMinHits,
+		MaxStale:       time.Duration(c.MaxStale),
+	}
+}
+
+// field is one setting of a Config.
+type field struct {
+	path   string // dotted file keys, also the flag name
+	env    []string
+	help   string
+	secret bool
+	reload bool // can change while the server runs
+	// fileOnly settings, lists of structs, have neither a flag nor an environment variable
+	fileOnly bool
+	value    reflect.Value
+}
+
+// fields lists the settings of c in declaration order, their values addressable.
+func (c *Config) fields() []field {
+	var out []field
+	var walk func(v reflect.Value, prefix string)
+	walk = func(v reflect.Value, prefix string) {
+		for i := 0; i < v.NumField(); i++ {
+			sf := v.Type().Field(i)
+			if !sf.IsExported() {
+				continue
+			}
+			name, _, _ := strings.Cut(sf.Tag.Get("yaml"), ",")
+			path := prefix + name
+			if sf.Type.Kind() == reflect.Struct {
+				walk(v.Field(i), path+".")
+				continue
+			}
+			f := field{path: path, help: sf.Tag.Get("help"), secret: sf.Tag.Get("secret") == "true",
+				reload: sf.Tag.Get("reload") == "true", value: v.Field(i)}
+			f.fileOnly = sf.Type.Kind() == reflect.Slice && sf.Type.Elem().Kind() == reflect.Struct
+			if env := sf.Tag.Get("env"); env != "" {
+				f.env = strings.Split(env, ",")
+				if f.help != "" {
+					f.help += ", "
+				}
+				f.help += "env " + env
+			}
+			out = append(out, f)
+		}
+	}
+	walk(reflect.ValueOf(c).Elem(), "")
+	return out
+}
+
+// set parses s into the setting. Lists are comma separated.
+func (f field) set(s string) error {
+	s = strings.TrimSpace(s)
+	if u, ok := f.value.Addr().Interface().(encoding.TextUnmarshaler); ok {
+		if err := u.UnmarshalText([]byte(s)); err != nil {
+			return fmt.Errorf("%s: %w", f.path, err)
+		}
+		return nil
+	}
+	switch f.value.Kind() {
+	case reflect.String:
+		f.value.SetString(s)
+	case reflect.Slice:
+		var list []string
+		for _, item := range strings.Split(s, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				list = append(list, item)
+			}
+		}
+		f.value.Set(reflect.ValueOf(list))
+	case reflect.Int:
+		v, err := strconv.Atoi(s)
+		if err != nil {
+			return fmt.Errorf("%s: %q is not a valid integer", f.path, s)
+		}
+		f.value.SetInt(int64(v))
+	case reflect.Uint64:
+		v, err := strconv.ParseUint(s, 10, 64)
+		if err != nil {
+			return fmt.Errorf("%s: %q is not a valid non-negative integer", f.path, s)
+		}
+		f.value.SetUint(v)
+	case reflect.Float64:
+		v, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return fmt.Errorf("%s: %q is not a valid number", f.path, s)
+		}
+		f.value.SetFloat(v)
+	case reflect.Bool:
+		v, err := strconv.ParseBool(s)
+		if err != nil {
+			return fmt.Errorf("%s: %q is not a valid boolean, want true or false", f.path, s)
+		}
+		f.value.SetBool(v)
+	default:
+		return fmt.Errorf("%s: unsupported setting type %s", f.path, f.value.Type())
+	}
+	return nil
+}
+
+// errorf returns a validation error naming the setting and where it can be set.
+func (f field) errorf(format string, args ...interface{}) error {
+	where := "flag -" + f.path
+	if f.fileOnly {
+		where = "config file"
+	} else if len(f.env) > 0 {
+		where = "env " + strings.Join(f.env, " or ") + ", " + where
+	}
+	return fmt.Errorf("config: %s (%s): %s", f.path, where, fmt.Sprintf(format, args...))
+}
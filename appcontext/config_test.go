@@ -0,0 +1,311 @@
+package appcontext
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func env(vars map[string]string) func(string) (string, bool) {
+	return func(name string) (string, bool) {
+		v, ok := vars[name]
+		return v, ok
+	}
+}
+
+func writeFile(t *testing.T, name string, content string) string {
+	path := filepath.Join(t.TempDir(), name)
+	assert.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+	return path
+}
+
+const yamlConfig = `
+database:
+  uri: postgres://cache:secret@db/shop
+  timeout: 3
+  pool:
+    maxOpenConns: 20
+    connMaxLifetime: 5m
+cache:
+  ttl: 1m
+queue:
+  workers: 16
+`
+
+const tomlConfig = `
+[database]
+uri = "postgres://cache:secret@db/shop"
+timeout = 3
+
+[database.pool]
+maxOpenConns = 20
+connMaxLifetime = "5m"
+
+[cache]
+ttl = "1m"
+
+[queue]
+workers = 16
+`
+
+const webhooksConfig = `
+webhooks:
+  subscriptions:
+    - name: shop
+      url: https://shop.example/hooks
+      secret: hook-secret
+      types: [product, category]
+`
+
+func TestLoadConfig(t *testing.T) {
+	cases := map[string]struct {
+		file  string
+		args  []string
+		env   map[string]string
+		check func(t *testing.T, cfg *Config)
+	}{
+		"yaml file": {
+			file: writeFile(t, "cache.yaml", yamlConfig),
+			check: func(t *testing.T, cfg *Config) {
+				assert.Equal(t, "postgres://cache:secret@db/shop", cfg.Database.URI)
+				assert.Equal(t, 3, cfg.Database.Timeout)
+				assert.Equal(t, 20, cfg.Database.PoolConfig().MaxOpenConns)
+				assert.Equal(t, 5*time.Minute, cfg.Database.PoolConfig().ConnMaxLifetime)
+				assert.Equal(t, time.Minute, cfg.Cache.Options().TTL)
+				assert.Equal(t, QueueConfig{Size: 1024, Workers: 16}, cfg.Queue)
+			},
+		},
+		"toml file": {
+			file: writeFile(t, "cache.toml", tomlConfig),
+			check: func(t *testing.T, cfg *Config) {
+				assert.Equal(t, 20, cfg.Database.PoolConfig().MaxOpenConns)
+				assert.Equal(t, 5*time.Minute, cfg.Database.PoolConfig().ConnMaxLifetime)
+				assert.Equal(t, time.Minute, cfg.Cache.Options().TTL)
+				assert.Equal(t, QueueConfig{Size: 1024, Workers: 16}, cfg.Queue)
+			},
+		},
+		"environment overrides the file": {
+			file: writeFile(t, "cache.yaml", yamlConfig),
+			env:  map[string]string{"CACHE_TTL": "2m", "QUEUE_WORKERS": "8", "GO_MAX_PROC": "4"},
+			check: func(t *testing.T, cfg *Config) {
+				assert.Equal(t, 2*time.Minute, cfg.Cache.Options().TTL)
+				assert.Equal(t, 8, cfg.Queue.Workers)
+				assert.Equal(t, 4, cfg.Context(nil).MaxProcs)
+			},
+		},
+		"flags override the environment": {
+			file: writeFile(t, "cache.yaml", yamlConfig),
+			args: []string{"-cache.ttl", "3m", "-database.replicas.uris", "r1, r2"},
+			env:  map[string]string{"CACHE_TTL": "2m"},
+			check: func(t *testing.T, cfg *Config) {
+				assert.Equal(t, 3*time.Minute, cfg.Cache.Options().TTL)
+				assert.Equal(t, []string{"r1", "r2"}, cfg.Database.Replicas.URIs)
+			},
+		},
+		"webhooks from the file": {
+			file: writeFile(t, "cache.yaml", yamlConfig+webhooksConfig),
+			env:  map[string]string{"WEBHOOK_ATTEMPTS": "3"},
+			check: func(t *testing.T, cfg *Config) {
+				assert.Equal(t, []WebhookConfig{
+					{Name: "shop", URL: "https://shop.example/hooks", Secret: "hook-secret", Types: []string{"product", "category"}},
+				}, cfg.Webhooks.Subscriptions)
+				assert.Equal(t, 3, cfg.Webhooks.Attempts)
+				assert.Equal(t, Duration(time.Second), cfg.Webhooks.BaseDelay)
+			},
+		},
+		"cluster from the environment": {
+			env: map[string]string{"DATABASE_URI": "x", "CLUSTER_SELF": "10.0.0.1:8080", "CLUSTER_PEERS": "10.0.0.1:8080,10.0.0.2:8080", "CLUSTER_SHARDING": "false", "CLUSTER_SECRET": "s"},
+			check: func(t *testing.T, cfg *Config) {
+				assert.Equal(t, ClusterConfig{
+					Self:            "10.0.0.1:8080",
+					Peers:           []string{"10.0.0.1:8080", "10.0.0.2:8080"},
+					RefreshInterval: Duration(10 * time.Second),
+					Replicas:        128,
+					Timeout:         Duration(2 * time.Second),
+					Secret:          "s",
+				}, cfg.Cluster)
+			},
+		},
+		"index journal from the environment": {
+			env: map[string]string{"DATABASE_URI": "x", "WAL_DIR": "/var/lib/cache/wal", "WAL_FSYNC": "always"},
+			check: func(t *testing.T, cfg *Config) {
+				assert.Equal(t, WALConfig{
+					Dir:           "/var/lib/cache/wal",
+					Fsync:         WALSyncAlways,
+					SyncInterval:  Duration(time.Second),
+					SegmentSize:   16 << 20,
+					SnapshotEvery: 10000,
+				}, cfg.WAL)
+			},
+		},
+		"legacy environment without a file": {
+			env: map[string]string{"POSTGRES_URI": "postgres://db/shop", "DB_TIMEOUT": "2"},
+			check: func(t *testing.T, cfg *Config) {
+				assert.Equal(t, "postgres://db/shop", cfg.Database.URI)
+				assert.Equal(t, 2, cfg.Context(nil).DBTimeout)
+				assert.Equal(t, ":8080", cfg.HTTP.Addr)
+			},
+		},
+	}
+
+	for k, v := range cases {
+		t.Run(k, func(t *testing.T) {
+			args := v.args
+			if v.file != "" {
+				args = append([]string{"-config", v.file}, args...)
+			}
+			cfg, err := LoadConfig(args, env(v.env))
+			assert.NoError(t, err)
+			if err == nil {
+				v.check(t, cfg)
+			}
+		})
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	cases := map[string]struct {
+		file string
+		args []string
+		env  map[string]string
+		errs []string
+	}{
+		"malformed values": {
+			env: map[string]string{"DATABASE_URI": "x", "DB_TIMEOUT": "abc", "CACHE_TTL": "soon"},
+			errs: []string{
+				`config: environment DB_TIMEOUT: database.timeout: "abc" is not a valid integer`,
+				`config: environment CACHE_TTL: cache.ttl: "soon" is not a valid duration, e.g. 500ms or 1m30s`,
+			},
+		},
+		"invalid settings": {
+			args: []string{"-database.driver", "oracle", "-queue.workers", "0", "-database.pool.maxOpenConns", "2",
+				"-database.pool.maxIdleConns", "5", "-cache.refreshAhead", "1.5", "-database.retry.attempts", "-1"},
+			errs: []string{
+				`config: database.driver (env DB_DRIVER, flag -database.driver): unknown driver "oracle", want postgres, sqlite3 or mysql`,
+				`config: database.uri (env DATABASE_URI or POSTGRES_URI, flag -database.uri): is required`,
+				`config: database.pool.maxIdleConns (env DB_MAX_IDLE_CONNS, flag -database.pool.maxIdleConns): must not exceed database.pool.maxOpenConns (2), got 5`,
+				`config: database.retry.attempts (env DB_RETRY_ATTEMPTS, flag -database.retry.attempts): must not be negative, got -1`,
+				`config: cache.refreshAhead (env CACHE_REFRESH_AHEAD, flag -cache.refreshAhead): must be a fraction below 1, got 1.5`,
+				`config: queue.workers (env QUEUE_WORKERS, flag -queue.workers): must be positive, got 0`,
+			},
+		},
+		"invalid index locks": {
+			env: map[string]string{"DATABASE_URI": "x", "DB_DRIVER": "mysql", "DB_INDEX_LOCK": "advisory"},
+			errs: []string{
+				`config: database.indexLock (env DB_INDEX_LOCK, flag -database.indexLock): advisory requires the postgres driver`,
+			},
+		},
+		"unknown index lock": {
+			env:  map[string]string{"DATABASE_URI": "x", "DB_INDEX_LOCK": "mutex"},
+			errs: []string{`config: database.indexLock (env DB_INDEX_LOCK, flag -database.indexLock): unknown lock "mutex", want none or advisory`},
+		},
+		"invalid tenants": {
+			file: writeFile(t, "cache.yaml", "tenants:\n  names: [t1, '']\n"),
+			env:  map[string]string{"DATABASE_URI": "x", "TENANT_COLUMN": `tenant"; --`},
+			errs: []string{
+				`config: tenants.column (env TENANT_COLUMN, flag -tenants.column): must be a column name, got "tenant\"; --"`,
+				`config: tenants.names (env TENANTS, flag -tenants.names): must not contain empty entries`,
+			},
+		},
+		"invalid webhooks": {
+			file: writeFile(t, "cache.yaml", "webhooks:\n  subscriptions:\n    - {name: a, url: 'ftp://x', secret: s}\n    - {name: a, url: 'http://x'}\n"),
+			env:  map[string]string{"DATABASE_URI": "x", "WEBHOOK_ATTEMPTS": "0", "WEBHOOK_MAX_DELAY": "1ms"},
+			errs: []string{
+				`config: webhooks.attempts (env WEBHOOK_ATTEMPTS, flag -webhooks.attempts): must be positive, got 0`,
+				`config: webhooks.maxDelay (env WEBHOOK_MAX_DELAY, flag -webhooks.maxDelay): must not be below webhooks.baseDelay (1s), got 1ms`,
+				`config: webhooks.subscriptions (config file): a: url must be an absolute http or https URL, got "ftp://x"`,
+				`config: webhooks.subscriptions (config file): entry 1: name must be set and unique, got "a"`,
+				`config: webhooks.subscriptions (config file): a: secret is required`,
+			},
+		},
+		"invalid cluster": {
+			env: map[string]string{"DATABASE_URI": "x", "CLUSTER_PEERS": "a:1,b", "CLUSTER_DNS": "cache"},
+			errs: []string{
+				`config: cluster.self (env CLUSTER_SELF, flag -cluster.self): is required with cluster.peers or cluster.dns`,
+				`config: cluster.dns (env CLUSTER_DNS, flag -cluster.dns): must not be set with cluster.peers`,
+				`config: cluster.peers (env CLUSTER_PEERS, flag -cluster.peers): must be host:port entries, got "b"`,
+				`config: cluster.dns (env CLUSTER_DNS, flag -cluster.dns): must be host:port, got "cache"`,
+			},
+		},
+		"raft without static peers": {
+			env: map[string]string{"DATABASE_URI": "x", "CLUSTER_SELF": "a:1", "CLUSTER_DNS": "cache:1", "CLUSTER_RAFT_PORT": "70000"},
+			errs: []string{
+				`config: cluster.secret (env CLUSTER_SECRET, flag -cluster.secret): is required with cluster.self`,
+				`config: cluster.raftPort (env CLUSTER_RAFT_PORT, flag -cluster.raftPort): must be a port number, got 70000`,
+				`config: cluster.raftPort (env CLUSTER_RAFT_PORT, flag -cluster.raftPort): requires cluster.peers, the Raft group is formed from them and not from cluster.dns`,
+			},
+		},
+		"invalid index journal": {
+			env: map[string]string{"DATABASE_URI": "x", "WAL_FSYNC": "sometimes", "WAL_SNAPSHOT_EVERY": "0"},
+			errs: []string{
+				`config: wal.fsync (env WAL_FSYNC, flag -wal.fsync): unknown mode "sometimes", want always, interval or never`,
+				`config: wal.snapshotEvery (env WAL_SNAPSHOT_EVERY, flag -wal.snapshotEvery): must be positive, got 0`,
+			},
+		},
+		"webhook subscriptions have no flag": {
+			args: []string{"-webhooks.subscriptions", "x"},
+			errs: []string{"flag provided but not defined: -webhooks.subscriptions"},
+		},
+		"unknown file key": {
+			file: writeFile(t, "cache.yaml", "database:\n  url: postgres://db/shop\n"),
+			errs: []string{"field url not found in type appcontext.DatabaseConfig"},
+		},
+		"unsupported file format": {
+			file: writeFile(t, "cache.json", "{}"),
+			errs: []string{`unsupported format ".json", use .yaml, .yml or .toml`},
+		},
+		"unknown flag": {
+			args: []string{"-database.url", "x"},
+			errs: []string{"flag provided but not defined: -database.url"},
+		},
+	}
+
+	for k, v := range cases {
+		t.Run(k, func(t *testing.T) {
+			args := v.args
+			if v.file != "" {
+				args = append([]string{"-config", v.file}, args...)
+			}
+			_, err := LoadConfig(args, env(v.env))
+			if assert.Error(t, err) {
+				for _, msg := range v.errs {
+					assert.Contains(t, err.Error(), msg)
+				}
+			}
+		})
+	}
+}
+
+func TestPrintConfig(t *testing.T) {
+	cfg, err := LoadConfig([]string{"-config", writeFile(t, "cache.yaml", webhooksConfig),
+		"-database.replicas.uris", "postgres://cache:secret@r1/shop"},
+		env(map[string]string{"DATABASE_URI": "postgres://cache:secret@db/shop", "ADMIN_TOKEN": "token", "CACHE_TTL": "90s"}))
+	assert.NoError(t, err)
+
+	var out bytes.Buffer
+	assert.NoError(t, cfg.Print(&out))
+	assert.NotContains(t, out.String(), ":secret@")
+	assert.NotContains(t, out.String(), "hook-secret")
+	assert.Contains(t, out.String(), "secret: <redacted>")
+	assert.NotContains(t, out.String(), "token\n")
+	assert.Contains(t, out.String(), "uri: <redacted>")
+	assert.Contains(t, out.String(), "adminToken: <redacted>")
+	assert.Contains(t, out.String(), "ttl: 1m30s")
+	// the loaded config keeps its secrets
+	assert.Equal(t, "postgres://cache:secret@r1/shop", cfg.Database.Replicas.URIs[0])
+	assert.Equal(t, "token", cfg.HTTP.AdminToken)
+	assert.Equal(t, "hook-secret", cfg.Webhooks.Subscriptions[0].Secret)
+
+	// the printed config loads back
+	path := writeFile(t, "printed.yaml", out.String())
+	printed, err := LoadConfig([]string{"-config", path}, env(nil))
+	assert.NoError(t, err)
+	assert.Equal(t, path, printed.Path())
+	printed.path = ""
+	cfg.path = ""
+	assert.Equal(t, cfg.Redacted(), printed)
+}
@@ -0,0 +1,196 @@
+package appcontext
+
+import (
+	"bytes"
+	"cacheServer/apperror"
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultWatchInterval is used by Watch when no interval is given.
+const defaultWatchInterval = 5 * time.Second
+
+// ReloadStats counts the reloads of a Reloader.
+type ReloadStats struct {
+	Reloads    uint64    `json:"reloads"`
+	Failures   uint64    `json:"failures"`
+	LastReload time.Time `json:"lastReload"`
+	LastError  string    `json:"lastError,omitempty"`
+}
+
+// RestartRequiredError rejects a reload changing settings that only take effect on restart.
+type RestartRequiredError struct {
+	Settings []string
+}
+
+func (e *RestartRequiredError) Error() string {
+	return "config: " + strings.Join(e.Settings, ", ") + " cannot change while the server runs, restart it to apply"
+}
+
+// Is matches apperror.ErrRestartRequired.
+func (e *RestartRequiredError) Is(target error) bool {
+	return target == apperror.ErrRestartRequired
+}
+
+// Reloader loads the config again from the command line, environment and file it was first loaded
+// from and passes it to apply when only settings tagged reload changed. A reload changing any other
+// setting is rejected as a whole. Every reload is logged and counted.
+type Reloader struct {
+	args      []string
+	lookupEnv func(string) (string, bool)
+	apply     func(cfg *Config)
+
+	mu      sync.Mutex // serializes reloads
+	current *Config
+	stats   ReloadStats
+}
+
+// NewReloader returns a Reloader of current, which LoadConfig returned for args and lookupEnv.
+func NewReloader(current *Config, args []string, lookupEnv func(string) (string, bool), apply func(cfg *Config)) *Reloader {
+	return &Reloader{args: args, lookupEnv: lookupEnv, apply: apply, current: current}
+}
+
+// Current returns the config applied last.
+func (r *Reloader) Current() *Config {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.current
+}
+
+// Stats ...
+func (r *Reloader) Stats() ReloadStats {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.stats
+}
+
+// Reload loads and applies the config, source names what triggered it in the log. It returns the
+// settings that changed. Invalid configs fail with apperror.ErrInvalidConfig, changes needing a
+// restart with a *RestartRequiredError; the running config is kept in both cases.
+func (r *Reloader) Reload(source string) ([]string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	changes, cfg, err := r.load()
+	if err != nil {
+		r.stats.Failures++
+		r.stats.LastError = err.Error()
+		log.Println("config reload triggered by", source, "failed:", err)
+		return nil, err
+	}
+	r.apply(cfg)
+	r.current = cfg
+	r.stats.Reloads++
+	r.stats.LastReload = time.Now()
+	r.stats.LastError = ""
+	var changed []string
+	for _, c := range changes {
+		changed = append(changed, c.f.path)
+	}
+	if len(changes) == 0 {
+		log.Println("config reload triggered by", source+": nothing changed")
+	} else {
+		log.Println("config reload triggered by", source+":", changes)
+	}
+	return changed, nil
+}
+
+// load returns the new config and its changes if it can be applied. Caller must hold mu.
+func (r *Reloader) load() ([]change, *Config, error) {
+	cfg, err := LoadConfig(r.args, r.lookupEnv)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %w", apperror.ErrInvalidConfig, err)
+	}
+	changes := r.current.diff(cfg)
+	var restart []string
+	for _, c := range changes {
+		if !c.f.reload {
+			restart = append(restart, c.f.path)
+		}
+	}
+	if len(restart) > 0 {
+		return nil, nil, &RestartRequiredError{Settings: restart}
+	}
+	return changes, cfg, nil
+}
+
+// Watch reloads the config whenever the content of its file changes, checking every interval
+// (default 5s) until ctx is done. It returns at once if the config was not read from a file.
+func (r *Reloader) Watch(ctx context.Context, interval time.Duration) {
+	path := r.Current().Path()
+	if path == "" {
+		return
+	}
+	if interval <= 0 {
+		interval = defaultWatchInterval
+	}
+	last, _ := os.ReadFile(path)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		data, err := os.ReadFile(path)
+		if err != nil || bytes.Equal(data, last) {
+			continue
+		}
+		last = data
+		r.Reload("change of " + path)
+	}
+}
+
+// ReloadOnSignal reloads the config on every sig, e.g. SIGHUP, until ctx is done. The signals are
+// caught from the time it returns.
+func (r *Reloader) ReloadOnSignal(ctx context.Context, sig ...os.Signal) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, sig...)
+	go func() {
+		defer signal.Stop(signals)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case s := <-signals:
+				r.Reload(s.String())
+			}
+		}
+	}()
+}
+
+// change is a setting with its old and new value.
+type change struct {
+	f        field
+	old, new interface{}
+}
+
+func (c change) String() string {
+	if c.f.secret {
+		return c.f.path + " changed"
+	}
+	return fmt.Sprintf("%s %v -> %v", c.f.path, c.old, c.new)
+}
+
+// diff returns the settings whose value differs in other, in declaration order.
+func (c *Config) diff(other *Config) []change {
+	var changes []change
+	old, updated := c.fields(), other.fields()
+	for i, f := range updated {
+		a, b := old[i].value.Interface(), f.value.Interface()
+		if f.value.Kind() == reflect.Slice && old[i].value.Len() == 0 && f.value.Len() == 0 {
+			continue
+		}
+		if !reflect.DeepEqual(a, b) {
+			changes = append(changes, change{f: f, old: a, new: b})
+		}
+	}
+	return changes
+}
@@ -0,0 +1,109 @@
+package appcontext
+
+import (
+	"cacheServer/apperror"
+	"context"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestReloader(t *testing.T, content string) (*Reloader, string, chan *Config) {
+	path := writeFile(t, "cache.yaml", content)
+	args := []string{"-config", path}
+	cfg, err := LoadConfig(args, env(nil))
+	assert.NoError(t, err)
+	applied := make(chan *Config, 10)
+	return NewReloader(cfg, args, env(nil), func(cfg *Config) { applied <- cfg }), path, applied
+}
+
+func TestReload(t *testing.T) {
+	cases := map[string]struct {
+		content   string
+		changed   []string
+		err       error
+		wantStats ReloadStats
+	}{
+		"runtime settings are applied": {
+			content: strings.NewReplacer("ttl: 1m", "ttl: 2m", "workers: 16", "workers: 32").Replace(yamlConfig) +
+				"log:\n  level: debug\n",
+			changed:   []string{"cache.ttl", "queue.workers", "log.level"},
+			wantStats: ReloadStats{Reloads: 1},
+		},
+		"unchanged file": {
+			content:   yamlConfig,
+			wantStats: ReloadStats{Reloads: 1},
+		},
+		"settings needing a restart are rejected": {
+			content: strings.Replace(yamlConfig, "timeout: 3", "timeout: 4", 1) + "http:\n  addr: :9090\n",
+			err:     apperror.ErrRestartRequired,
+			wantStats: ReloadStats{Failures: 1,
+				LastError: "config: database.timeout, http.addr cannot change while the server runs, restart it to apply"},
+		},
+		"invalid config is rejected": {
+			content: yamlConfig + "log:\n  level: loud\n",
+			err:     apperror.ErrInvalidConfig,
+			wantStats: ReloadStats{Failures: 1,
+				LastError: `invalid config: config: log.level (env LOG_LEVEL, flag -log.level): unknown level "loud", want debug, info, warn or error`},
+		},
+	}
+
+	for k, v := range cases {
+		t.Run(k, func(t *testing.T) {
+			r, path, applied := newTestReloader(t, yamlConfig)
+			before := r.Current()
+			assert.NoError(t, os.WriteFile(path, []byte(v.content), 0o600))
+
+			changed, err := r.Reload("test")
+			stats := r.Stats()
+			stats.LastReload = time.Time{}
+			assert.Equal(t, v.wantStats, stats)
+			if v.err != nil {
+				assert.ErrorIs(t, err, v.err)
+				assert.Same(t, before, r.Current())
+				assert.Len(t, applied, 0)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, v.changed, changed)
+			assert.Same(t, <-applied, r.Current())
+		})
+	}
+}
+
+func TestWatch(t *testing.T) {
+	r, path, applied := newTestReloader(t, yamlConfig)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go r.Watch(ctx, 10*time.Millisecond)
+
+	time.Sleep(30 * time.Millisecond)
+	assert.NoError(t, os.WriteFile(path, []byte(yamlConfig+"log:\n  level: warn\n"), 0o600))
+	select {
+	case cfg := <-applied:
+		assert.Equal(t, "warn", cfg.Log.Level)
+	case <-time.After(2 * time.Second):
+		t.Fatal("config change was not applied")
+	}
+}
+
+func TestReloadOnSignal(t *testing.T) {
+	r, path, applied := newTestReloader(t, yamlConfig)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	r.ReloadOnSignal(ctx, syscall.SIGHUP)
+
+	assert.NoError(t, os.WriteFile(path, []byte(yamlConfig+"log:\n  level: error\n"), 0o600))
+	assert.NoError(t, syscall.Kill(os.Getpid(), syscall.SIGHUP))
+	select {
+	case cfg := <-applied:
+		assert.Equal(t, "error", cfg.Log.Level)
+	case <-time.After(2 * time.Second):
+		t.Fatal("SIGHUP did not reload the config")
+	}
+	assert.Equal(t, uint64(1), r.Stats().Reloads)
+}
@@ -16,8 +16,41 @@ type ErrorModel struct {
 var (
 	// ErrCacheNotInitialized ...
 	ErrCacheNotInitialized = errors.New("service not available at this moment, try after sometime")
+	// ErrInvalidRequest ...
+	ErrInvalidRequest = errors.New("invalid request")
+	// ErrUnknownParent ...
+	ErrUnknownParent = errors.New("unknown parent")
+	// ErrNoAvailableIndex ...
+	ErrNoAvailableIndex = errors.New("no available index")
+	// ErrUnauthorized ...
+	ErrUnauthorized = errors.New("unauthorized")
+	// ErrInvalidConfig ...
+	ErrInvalidConfig = errors.New("invalid config")
+	// ErrRestartRequired ...
+	ErrRestartRequired = errors.New("restart required")
+	// ErrUnknownTenant ...
+	ErrUnknownTenant = errors.New("unknown tenant")
+	// ErrNotFound ...
+	ErrNotFound = errors.New("not found")
+	// ErrIndexTaken ...
+	ErrIndexTaken = errors.New("index already allocated")
 )
 
+// UnknownParentError is returned by index operations on a category or subcategory that does not exist.
+type UnknownParentError struct {
+	Kind string // category or subcategory
+	ID   string
+}
+
+func (e *UnknownParentError) Error() string {
+	return "unknown " + e.Kind + " " + e.ID
+}
+
+// Is matches ErrUnknownParent.
+func (e *UnknownParentError) Is(target error) bool {
+	return target == ErrUnknownParent
+}
+
 func assertError(err error) *ErrorModel {
 	if errors.Is(err, ErrCacheNotInitialized) {
 		return &ErrorModel{
@@ -25,6 +58,60 @@ func assertError(err error) *ErrorModel {
 			Code:    http.StatusInternalServerError,
 		}
 	}
+	if errors.Is(err, ErrUnknownParent) {
+		return &ErrorModel{
+			Message: err.Error(),
+			Code:    http.StatusNotFound,
+		}
+	}
+	if errors.Is(err, ErrUnknownTenant) {
+		return &ErrorModel{
+			Message: err.Error(),
+			Code:    http.StatusNotFound,
+		}
+	}
+	if errors.Is(err, ErrNotFound) {
+		return &ErrorModel{
+			Message: err.Error(),
+			Code:    http.StatusNotFound,
+		}
+	}
+	if errors.Is(err, ErrNoAvailableIndex) {
+		return &ErrorModel{
+			Message: err.Error(),
+			Code:    http.StatusConflict,
+		}
+	}
+	if errors.Is(err, ErrIndexTaken) {
+		return &ErrorModel{
+			Message: err.Error(),
+			Code:    http.StatusConflict,
+		}
+	}
+	if errors.Is(err, ErrUnauthorized) {
+		return &ErrorModel{
+			Message: ErrUnauthorized.Error(),
+			Code:    http.StatusUnauthorized,
+		}
+	}
+	if errors.Is(err, ErrRestartRequired) {
+		return &ErrorModel{
+			Message: err.Error(),
+			Code:    http.StatusConflict,
+		}
+	}
+	if errors.Is(err, ErrInvalidConfig) {
+		return &ErrorModel{
+			Message: err.Error(),
+			Code:    http.StatusBadRequest,
+		}
+	}
+	if errors.Is(err, ErrInvalidRequest) {
+		return &ErrorModel{
+			Message: err.Error(),
+			Code:    http.StatusBadRequest,
+		}
+	}
 	return &ErrorModel{
 		Message: "Unidentified Error",
 		Code:    http.StatusInternalServerError,
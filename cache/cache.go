@@ -3,13 +3,18 @@ package cache
 import (
 	"cacheServer/appcontext"
 	"cacheServer/apperror"
-	"github.com/lib/pq"
+	database "cacheServer/db"
+	"cacheServer/health"
+	"cacheServer/logging"
+	"cacheServer/typedcache"
+	"database/sql"
+	"errors"
+	"fmt"
 	"log"
-	"os"
 	"runtime"
-	"sort"
-	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 )
 
 // Type ...
@@ -32,9 +37,58 @@ func (t Type) String() string {
 	return [...]string{"Role", "Product", "Category", "SubCategory"}[t]
 }
 
-// AppCache ...
+// MarshalText : encodes the Type by name, e.g. as a json map key
+func (t Type) MarshalText() ([]byte, error) {
+	return []byte(t.String()), nil
+}
+
+// UnmarshalText : decodes a Type encoded by MarshalText
+func (t *Type) UnmarshalText(text []byte) error {
+	v, err := ParseType(string(text))
+	if err != nil {
+		return err
+	}
+	*t = v
+	return nil
+}
+
+// ParseType : returns the Type named s, matching is case insensitive
+func ParseType(s string) (Type, error) {
+	for t := Role; t < Quit; t++ {
+		if strings.EqualFold(t.String(), s) {
+			return t, nil
+		}
+	}
+	return 0, apperror.ErrInvalidRequest
+}
+
+// tableNames maps each verifiable Type to the table its ids are read from.
+var tableNames = map[Type]string{
+	Role:        "users",
+	Product:     "products",
+	Category:    "productCategory",
+	Subcategory: "productSubCategory",
+}
+
+// AppCache : the cache server, its index operations act on the default namespace
 type AppCache interface {
+	Namespace
 	MakeRequest(request *Request)
+	MakeBatchRequest(request *BatchRequest)
+	Tenant(tenant string) (Namespace, error)
+	Inspect(tenant string) (Inspector, error)
+	Events() *EventBus
+	Metrics() Metrics
+	WarmupStatus() WarmupStatus
+	Health() *health.Registry
+	HasRole(email string, role string) (bool, error)
+	HasRoles(email string, tenant string, claimed []string, match Match) (bool, error)
+	HasPermission(email string, tenant string, permission string) (bool, error)
+	InvalidateRoles()
+}
+
+// Namespace : cache entries and index spaces of one tenant
+type Namespace interface {
 	DeleteCache(id string, t Type)
 	GetCategoryIndicesCache() ([]int, error)
 	GetMaximumIndexCategory() (int, error)
@@ -50,11 +104,13 @@ type AppCache interface {
 	CreateProductCache(subcategoryID string) error
 	GetMaximumIndexProduct(subcategoryID string) (int, error)
 	UpdateProductCacheIndex(index int, subcategoryID string) error
+	Stats() map[Type]typedcache.Stats
 }
 
 // Request ...
 type Request struct {
 	id      string
+	tenant  string // namespace the id is verified in, empty for the default one
 	reqType Type
 	Out     chan bool   // Channel used to receive data from cache
 	opt     interface{} // optional parameter
@@ -70,57 +126,183 @@ func NewRequest(id string, Type Type, opt interface{}) *Request {
 	}
 }
 
-// Server ...
-type Server struct {
-	request chan Request
-	store   Store
-	appCtx  *appcontext.Context
+// ID : returns the id being verified
+func (r *Request) ID() string {
+	return r.id
+}
+
+// Type : returns the Type of the id
+func (r *Request) Type() Type {
+	return r.reqType
+}
+
+// Opt : returns the optional parameter, the claimed role for Role requests
+func (r *Request) Opt() interface{} {
+	return r.opt
+}
+
+// InTenant : verifies the id in the namespace of tenant instead of the default one
+func (r *Request) InTenant(tenant string) *Request {
+	r.tenant = tenant
+	return r
 }
 
-// Store : map of maps (category,subcategory,product,role)
+// Tenant : returns the tenant the id is verified in
+func (r *Request) Tenant() string {
+	return r.tenant
+}
+
+// BatchItem : one (Type, id) pair of a batch verification
+type BatchItem struct {
+	Type   Type
+	ID     string
+	Opt    interface{} // optional parameter, claimed role for Role items
+	Tenant string      // namespace the id is verified in, empty for the default one
+}
+
+// BatchResult : verification result of one BatchItem
+type BatchResult struct {
+	Type  Type
+	ID    string
+	Valid bool
+}
+
+// BatchRequest : verifies many ids in one round trip
+type BatchRequest struct {
+	items []BatchItem
+	Out   chan []BatchResult // results in the same order as the items
+}
+
+// NewBatchRequest ...
+func NewBatchRequest(items []BatchItem) *BatchRequest {
+	return &BatchRequest{
+		items: items,
+		Out:   make(chan []BatchResult),
+	}
+}
+
+// Items : returns the items being verified
+func (r *BatchRequest) Items() []BatchItem {
+	return r.items
+}
+
+// defaultWorkers is used when the queue config leaves Workers unset.
+const defaultWorkers = 128
+
+// defaultMaxProcs is GOMAXPROCS as the process started, restored when the setting goes back to zero.
+var defaultMaxProcs = runtime.GOMAXPROCS(0)
+
+// Server ...
+type Server struct {
+	*namespace // default namespace, unscoped: its entries and indices span every tenant
+
+	request  chan Request
+	batch    chan BatchRequest
+	workers  *workerPool // bounds the requests being verified
+	running  atomic.Bool // set while Run is draining the queue
+	appCtx   *appcontext.Context
+	initWg   sync.WaitGroup // tracks the index cache loads started by NewServer
+	warmup   warmupState
+	health   *health.Registry
+	rbac     *rbac                              // role hierarchy and permissions
+	roleSets *typedcache.Cache[string, RoleSet] // roles per tenant of each user, nil with one role per user
+	events   *EventBus                          // mutations of entries and indices
+	journal  atomic.Pointer[journal]            // write-ahead log of the index changes, nil without one
+
+	nsMu       sync.Mutex
+	namespaces map[string]*namespace // tenant vs its namespace, created on first use
+	tenants    appcontext.TenantsConfig
+	cacheOpts  typedcache.Options // options of the entity caches, current after Reconfigure
+}
+
+// Store : typed caches (category,subcategory,product,role) and index caches of one namespace
 type Store struct {
-	data               map[Type]map[string]string
+	data               map[Type]*typedcache.Cache[string, string]
 	categoryIndices    [255]bool
 	subcategoryIndices map[string][255]bool
 	productIndices     map[string]*SortedIndices // subcategoryID vs struct
-	sync.Mutex
+	sync.RWMutex
 }
 
 func newStore() Store {
 	return Store{
-		data: map[Type]map[string]string{
-			Role:        make(map[string]string), // Map of role id vs role
-			Category:    make(map[string]string), // Map categoryID vs active/passive
-			Subcategory: make(map[string]string), // Map subcategoryID vs active/passive
-			Product:     make(map[string]string), // Map productID vs  active/passive
-		},
 		categoryIndices:    [255]bool{},
 		subcategoryIndices: make(map[string][255]bool), // Map of categoryID vs availableIndices
 		productIndices:     make(map[string]*SortedIndices),
 	}
 }
 
-func newServer(appCtx *appcontext.Context) *Server {
+// NewServer : returns a server of its own, unlike GetCacheInstance, e.g. for several nodes in one process
+func NewServer(appCtx *appcontext.Context) *Server {
+	workers := appCtx.Queue.Workers
+	if workers <= 0 {
+		workers = defaultWorkers
+	}
 	s := &Server{
-		request: make(chan Request),
-		store:   newStore(),
+		request: make(chan Request, appCtx.Queue.Size),
+		batch:   make(chan BatchRequest, appCtx.Queue.Size),
+		workers: newWorkerPool(workers),
+		warmup:  warmupState{done: make(chan struct{})},
+		health:  health.NewRegistry(),
+		events:  NewEventBus(),
+
+		namespaces: make(map[string]*namespace),
+		tenants:    appCtx.Tenants,
+		cacheOpts:  appCtx.CacheOptions,
 	}
 	s.setAppCtx(appCtx)
-	go s.initializeCategoryCache()
-	go s.initializeSubcategoryCache()
-	go s.initializeProductCache()
+	s.namespace = s.newNamespace(globalTenant)
+	s.rbac = newRBAC(s.loadRBAC)
+	s.registerHealthChecks()
+	s.roleSets = s.newRoleSetCache()
+	s.initWg.Add(3)
+	go s.runInit(s.categoryInit)
+	go s.runInit(s.subcategoryInit)
+	go s.runInit(s.productInit)
+	if appCtx.Warmup.Enabled {
+		s.initWg.Add(1)
+		go s.runWarmup(appCtx.Warmup)
+	} else {
+		s.warmup.finish(nil, nil)
+	}
 	return s
 }
 
-// SortedIndices : struct used to store available indices and maintain the order
-type SortedIndices struct {
-	availableIndices map[int]struct{}
-	orderedIndices   []int
+func isCircuitOpen(err error) bool {
+	return errors.Is(err, database.ErrCircuitOpen)
 }
 
-// NewSortedIndices ...
-func NewSortedIndices(s []int) *SortedIndices {
-	return &SortedIndices{availableIndices: make(map[int]struct{}), orderedIndices: s}
+// entityLoader loads ids of one Type of a namespace from the database, one at a time or in batches.
+type entityLoader struct {
+	ns *namespace
+	t  Type
+}
+
+// Load ...
+func (l *entityLoader) Load(id string) (string, error) {
+	logging.Debugln(l.t, " not present in cache")
+	value, err := l.ns.fetchQuery(id, l.t)
+	if errors.Is(err, sql.ErrNoRows) {
+		// the id is gone: a cached value is dropped rather than served again
+		return value, fmt.Errorf("%w: %w", typedcache.ErrNotFound, err)
+	}
+	return value, err
+}
+
+// LoadMany ...
+func (l *entityLoader) LoadMany(ids []string) (map[string]string, error) {
+	logging.Debugln(len(ids), l.t, "ids not present in cache")
+	return l.ns.fetchMany(ids, l.t)
+}
+
+func (s *Server) runInit(t *initTracker) {
+	defer s.initWg.Done()
+	t.ensure()
+}
+
+// waitForInit blocks until the index cache loads started by NewServer have returned.
+func (s *Server) waitForInit() {
+	s.initWg.Wait()
 }
 
 var once sync.Once
@@ -130,7 +312,7 @@ var instance *Server
 func GetCacheInstance(appCtx *appcontext.Context) *Server {
 	once.Do(func() {
 		log.Println("server instance initialized")
-		instance = newServer(appCtx)
+		instance = NewServer(appCtx)
 	})
 	return instance
 }
@@ -139,119 +321,148 @@ func (s *Server) setAppCtx(appCtx *appcontext.Context) {
 	s.appCtx = appCtx
 }
 
+// Reconfigure applies the settings of cfg that can change while the server runs: the typed cache
+// options, the quota of tenant namespaces, the worker pool size and GOMAXPROCS. The other settings are ignored.
+func (s *Server) Reconfigure(cfg *appcontext.Config) {
+	opts := cfg.Cache.Options()
+	if s.roleSets != nil {
+		s.roleSets.SetOptions(opts)
+	}
+	s.nsMu.Lock()
+	s.cacheOpts = opts
+	s.tenants.MaxEntries = cfg.Tenants.MaxEntries
+	s.namespace.setOptions(s.namespaceOptions(globalTenant))
+	for name, ns := range s.namespaces {
+		ns.setOptions(s.namespaceOptions(name))
+	}
+	s.nsMu.Unlock()
+	workers := cfg.Queue.Workers
+	if workers <= 0 {
+		workers = defaultWorkers
+	}
+	s.workers.resize(workers)
+	procs := cfg.Runtime.MaxProcs
+	if procs <= 0 {
+		procs = defaultMaxProcs
+	}
+	runtime.GOMAXPROCS(procs)
+}
+
 // GetCategoryIndicesCache ...
-func (s *Server) GetCategoryIndicesCache() ([]int, error) {
+func (ns *namespace) GetCategoryIndicesCache() ([]int, error) {
+	if err := ns.categoryInit.ensure(); err != nil {
+		return nil, apperror.ErrCacheNotInitialized
+	}
 	var result []int
-	for k, v := range s.store.categoryIndices {
+	ns.store.RLock()
+	for k, v := range ns.store.categoryIndices {
 		if v == true {
 			result = append(result, k)
 		}
 	}
-	if len(result) == 0 {
-		err := s.initializeCategoryCache()
-		if err != nil {
-			return nil, apperror.ErrCacheNotInitialized
-		}
-	}
-
+	ns.store.RUnlock()
 	return result, nil
 }
 
 // GetSubcategoryIndicesCache ...
-func (s *Server) GetSubcategoryIndicesCache(categoryID string) ([]int, error) {
+func (ns *namespace) GetSubcategoryIndicesCache(categoryID string) ([]int, error) {
+	if err := ns.ensureSubcategoryParent(categoryID); err != nil {
+		return nil, err
+	}
 	var result []int
-	for k, v := range s.store.subcategoryIndices[categoryID] {
+	ns.store.RLock()
+	for k, v := range ns.store.subcategoryIndices[categoryID] {
 		if v == true {
 			result = append(result, k)
 		}
 	}
-	if len(result) == 0 {
-		err := s.initializeSubcategoryCache()
+	ns.store.RUnlock()
+	return result, nil
+}
+
+// ensureSubcategoryParent : loads the subcategory indices once and the indices of categoryID if it is missing
+func (ns *namespace) ensureSubcategoryParent(categoryID string) error {
+	present := func() bool {
+		ns.store.RLock()
+		defer ns.store.RUnlock()
+		_, ok := ns.store.subcategoryIndices[categoryID]
+		return ok
+	}
+	fill := func(occupied []int32) error {
+		missingIndices, err := ns.getMissingIndices(occupied)
 		if err != nil {
-			return nil, apperror.ErrCacheNotInitialized
+			return err
 		}
+		ns.store.Lock()
+		ns.store.subcategoryIndices[categoryID] = missingIndices
+		ns.store.Unlock()
+		return nil
 	}
-	return result, nil
+	return ns.ensureParent(ns.subcategoryInit, ns.subcategoryParents, subcategoryParent, categoryID, present, fill)
 }
 
 // CreateSubcategoryCache ...
-func (s *Server) CreateSubcategoryCache(categoryID string) error {
-	s.store.Lock()
-	var result [255]bool
-	result[1] = true
-	s.store.subcategoryIndices[categoryID] = result
-	s.store.Unlock()
+func (ns *namespace) CreateSubcategoryCache(categoryID string) error {
+	ns.reinitMu.RLock()
+	defer ns.reinitMu.RUnlock()
+	ns.journaled(indexRecord{Op: opReset, Type: Subcategory, Parent: categoryID})
 	return nil
 }
 
 // GetMaximumIndexCategory : returns the maximum value present in availableIndices
-func (s *Server) GetMaximumIndexCategory() (int, error) {
-	arr, err := s.GetCategoryIndicesCache()
+func (ns *namespace) GetMaximumIndexCategory() (int, error) {
+	arr, err := ns.GetCategoryIndicesCache()
 	if err != nil {
 		return 0, err
 	}
+	if len(arr) == 0 {
+		return 0, apperror.ErrNoAvailableIndex
+	}
 	return arr[len(arr)-1], nil
 }
 
 // GetMaximumIndexSubcategory : returns max subcategory index
-func (s *Server) GetMaximumIndexSubcategory(categoryID string) (int, error) {
-	arr, err := s.GetSubcategoryIndicesCache(categoryID)
+func (ns *namespace) GetMaximumIndexSubcategory(categoryID string) (int, error) {
+	arr, err := ns.GetSubcategoryIndicesCache(categoryID)
 	if err != nil {
 		return 0, err
 	}
+	if len(arr) == 0 {
+		return 0, apperror.ErrNoAvailableIndex
+	}
 	return arr[len(arr)-1], nil
 }
 
 // UpdateCategoryIndexCache ...
-func (s *Server) UpdateCategoryIndexCache(index int) error {
-	_, err := s.GetCategoryIndicesCache()
-	if err != nil {
-		return err
+func (ns *namespace) UpdateCategoryIndexCache(index int) error {
+	if err := ns.categoryInit.ensure(); err != nil {
+		return apperror.ErrCacheNotInitialized
 	}
-	s.store.Lock()
-	s.store.categoryIndices[index] = true
-	s.store.Unlock()
-	return nil
+	return ns.release(Category, "", index)
 }
 
 // DeleteCategoryIndexCache ...
-func (s *Server) DeleteCategoryIndexCache(key int) error {
-	_, err := s.GetCategoryIndicesCache()
-	if err != nil {
-		return err
+func (ns *namespace) DeleteCategoryIndexCache(key int) error {
+	if err := ns.categoryInit.ensure(); err != nil {
+		return apperror.ErrCacheNotInitialized
 	}
-	s.store.Lock()
-	s.store.categoryIndices[key] = false
-	s.store.Unlock()
-	return nil
+	return ns.allocate(Category, "", key)
 }
 
 // UpdateSubcategoryIndexCache ...
-func (s *Server) UpdateSubcategoryIndexCache(index int, categoryID string) error {
-	_, err := s.GetSubcategoryIndicesCache(categoryID)
-	if err != nil {
+func (ns *namespace) UpdateSubcategoryIndexCache(index int, categoryID string) error {
+	if err := ns.ensureSubcategoryParent(categoryID); err != nil {
 		return err
 	}
-	s.store.Lock()
-	res := s.store.subcategoryIndices[categoryID]
-	res[index] = true
-	s.store.subcategoryIndices[categoryID] = res
-	s.store.Unlock()
-	return nil
+	return ns.release(Subcategory, categoryID, index)
 }
 
 // DeleteSubcategoryIndexCache ...
-func (s *Server) DeleteSubcategoryIndexCache(categoryID string, index int) error {
-	_, err := s.GetSubcategoryIndicesCache(categoryID)
-	if err != nil {
+func (ns *namespace) DeleteSubcategoryIndexCache(categoryID string, index int) error {
+	if err := ns.ensureSubcategoryParent(categoryID); err != nil {
 		return err
 	}
-	s.store.Lock()
-	res := s.store.subcategoryIndices[categoryID]
-	res[index] = false
-	s.store.subcategoryIndices[categoryID] = res
-	s.store.Unlock()
-	return nil
+	return ns.allocate(Subcategory, categoryID, index)
 }
 
 type occupiedSubcategoryIndices struct {
@@ -259,34 +470,41 @@ type occupiedSubcategoryIndices struct {
 	indices    []int32
 }
 
-func (s *Server) initializeSubcategoryCache() error {
-	query := `SELECT "categoryID",ARRAY_AGG("index") FROM (
-              SELECT "categoryID","index" FROM "productSubCategory" GROUP BY 1,2 ORDER BY 2 ASC) t1 
-              GROUP BY 1;`
-	result, err := s.appCtx.DatabaseClient.Query(query)
+func (ns *namespace) initializeSubcategoryCache() error {
+	result, err := ns.client().Query(ns.queries.subcategoryIndices, ns.queries.args()...)
 	if err != nil {
 		return err
 	}
 
 	for result.Next() {
 		var subcategoryIndex occupiedSubcategoryIndices
-		err := result.Scan(&subcategoryIndex.categoryID, (*pq.Int32Array)(&subcategoryIndex.indices))
+		err := result.Scan(&subcategoryIndex.categoryID, ns.queries.dialect.IntArray(&subcategoryIndex.indices))
 		if err != nil {
 			log.Println("failed to initialize subcategory cache", err)
 			return err
 		}
-		s.store.subcategoryIndices[subcategoryIndex.categoryID] = s.getMissingIndices(subcategoryIndex.indices)
+		missingIndices, err := ns.getMissingIndices(subcategoryIndex.indices)
+		if err != nil {
+			log.Println("failed to initialize subcategory cache", err)
+			return err
+		}
+		ns.store.Lock()
+		ns.store.subcategoryIndices[subcategoryIndex.categoryID] = missingIndices
+		ns.store.Unlock()
 	}
 	return nil
 }
 
-func (s *Server) getMissingIndices(occupiedIndices []int32) [255]bool {
+func (ns *namespace) getMissingIndices(occupiedIndices []int32) ([255]bool, error) {
 	var result [255]bool
 	var count int32
 	count = 1
 	var maxValue int32
 	maxValue = 0
 	for _, v := range occupiedIndices {
+		if err := checkIndex(Subcategory, int(v)); err != nil {
+			return result, err
+		}
 		if count != v {
 			for count < v {
 				result[int(count)] = true
@@ -296,128 +514,123 @@ func (s *Server) getMissingIndices(occupiedIndices []int32) [255]bool {
 		count++
 		maxValue = v
 	}
-	result[maxValue+1] = true
+	if int(maxValue)+1 < len(result) {
+		result[maxValue+1] = true
+	}
 
-	return result
+	return result, nil
 }
 
 // initializeCategoryCache ...
-func (s *Server) initializeCategoryCache() error {
-	query := `SELECT index from "productCategory" ORDER BY index ASC;`
-	result, err := s.appCtx.DatabaseClient.Query(query)
+func (ns *namespace) initializeCategoryCache() error {
+	result, err := ns.client().Query(ns.queries.categoryIndices, ns.queries.args()...)
 	if err != nil {
 		return err
 	}
 
 	count := 1
 	var index int
+	var categoryIndices [255]bool
 	for result.Next() {
 		if err = result.Scan(&index); err != nil {
 			log.Println("failed to initialize category cache", err)
 			return err
 		}
+		if err = checkIndex(Category, index); err != nil {
+			log.Println("failed to initialize category cache", err)
+			return err
+		}
 		if count != index {
 			for count < index {
-				s.store.categoryIndices[count] = true
+				categoryIndices[count] = true
 				count++
 			}
 		}
 		count++
 	}
-	s.store.categoryIndices[index+1] = true
+	if index+1 < len(categoryIndices) {
+		categoryIndices[index+1] = true
+	}
+	ns.store.Lock()
+	ns.store.categoryIndices = categoryIndices
+	ns.store.Unlock()
 	return nil
 }
 
 // GetProductIndicesCache ...
-func (s *Server) GetProductIndicesCache(subcategoryID string) ([]int, error) {
-	res := s.store.productIndices[subcategoryID].orderedIndices
-	if len(res) == 0 {
-		err := s.initializeProductCache()
-		if err != nil {
-			return nil, apperror.ErrCacheNotInitialized
-		}
+func (ns *namespace) GetProductIndicesCache(subcategoryID string) ([]int, error) {
+	if err := ns.ensureProductParent(subcategoryID); err != nil {
+		return nil, err
 	}
-
-	return res, nil
+	ns.store.RLock()
+	p := ns.store.productIndices[subcategoryID]
+	ns.store.RUnlock()
+	return p.Slice(), nil
+}
+
+// ensureProductParent : loads the product indices once and the indices of subcategoryID if it is missing
+func (ns *namespace) ensureProductParent(subcategoryID string) error {
+	present := func() bool {
+		ns.store.RLock()
+		defer ns.store.RUnlock()
+		_, ok := ns.store.productIndices[subcategoryID]
+		return ok
+	}
+	fill := func(occupied []int32) error {
+		ns.fillAvailableIndices(subcategoryID, occupied)
+		return nil
+	}
+	return ns.ensureParent(ns.productInit, ns.productParents, productParent, subcategoryID, present, fill)
 }
 
 // CreateProductCache ...
-func (s *Server) CreateProductCache(subcategoryID string) error {
-	s.store.Lock()
-	//orderedIndices.store.ProductIndex[subcategoryID] = []int64{1}
-	p := NewSortedIndices(make([]int, 0))
-	p.orderedIndices = append(p.orderedIndices, 1)
-	p.availableIndices[1] = struct{}{}
-	s.store.productIndices[subcategoryID] = p
-	s.store.Unlock()
+func (ns *namespace) CreateProductCache(subcategoryID string) error {
+	ns.reinitMu.RLock()
+	defer ns.reinitMu.RUnlock()
+	ns.journaled(indexRecord{Op: opReset, Type: Product, Parent: subcategoryID})
 	return nil
 }
 
 // UpdateProductCacheIndex ...
-func (s *Server) UpdateProductCacheIndex(index int, subcategoryID string) error {
-	_, err := s.GetProductIndicesCache(subcategoryID)
-	if err != nil {
+func (ns *namespace) UpdateProductCacheIndex(index int, subcategoryID string) error {
+	if err := ns.ensureProductParent(subcategoryID); err != nil {
 		return err
 	}
-	s.store.Lock()
-	s.store.productIndices[subcategoryID].availableIndices[index] = struct{}{}
-	go func() {
-		// sorting the indices in a goroutine to not affect performance of end user
-		var result []int
-		for k := range s.store.productIndices[subcategoryID].availableIndices {
-			result = append(result, k)
-		}
-		sort.Ints(result)
-		s.store.productIndices[subcategoryID].orderedIndices = result
-	}()
-	s.store.Unlock()
-	return nil
+	return ns.release(Product, subcategoryID, index)
 }
 
 // DeleteProductCacheIndex ...
-func (s *Server) DeleteProductCacheIndex(subcategoryID string, index int) error {
-	_, err := s.GetProductIndicesCache(subcategoryID)
-	if err != nil {
+func (ns *namespace) DeleteProductCacheIndex(subcategoryID string, index int) error {
+	if err := ns.ensureProductParent(subcategoryID); err != nil {
 		return err
 	}
-	s.store.Lock()
-	delete(s.store.productIndices[subcategoryID].availableIndices, index)
-	go func() {
-		// sorting the indices in a goroutine to not affect performance of end user
-		var result []int
-		for k := range s.store.productIndices[subcategoryID].availableIndices {
-			result = append(result, k)
-		}
-		sort.Ints(result)
-		s.store.productIndices[subcategoryID].orderedIndices = result
-	}()
-	s.store.Unlock()
-	return nil
+	return ns.allocate(Product, subcategoryID, index)
 }
 
 // GetMaximumIndexProduct ...
-func (s *Server) GetMaximumIndexProduct(subcategoryID string) (int, error) {
-	result, err := s.GetProductIndicesCache(subcategoryID)
+func (ns *namespace) GetMaximumIndexProduct(subcategoryID string) (int, error) {
+	result, err := ns.GetProductIndicesCache(subcategoryID)
 	if err != nil {
 		return 0, err
 	}
+	if len(result) == 0 {
+		return 0, apperror.ErrNoAvailableIndex
+	}
 	return result[len(result)-1], nil
 }
 
 // fillAvailableIndices uses the indices which are occupied to get the indices which are available
 // and stores them in cache
-func (s *Server) fillAvailableIndices(subcategoryID string, occupiedIndices []int32) {
+func (ns *namespace) fillAvailableIndices(subcategoryID string, occupiedIndices []int32) {
 	var count int32
 	count = 1
 	var maxValue int32
 	maxValue = 0
-	p := NewSortedIndices(make([]int, 0))
-	s.store.productIndices[subcategoryID] = p
+	p := NewSortedIndices(nil)
 	for _, v := range occupiedIndices {
 		if count != v {
 			for count < v {
-				s.store.productIndices[subcategoryID].availableIndices[int(count)] = struct{}{}
-				s.store.productIndices[subcategoryID].orderedIndices = append(s.store.productIndices[subcategoryID].orderedIndices, int(count))
+				p.Insert(int(count))
 				count++
 			}
 		}
@@ -425,8 +638,10 @@ func (s *Server) fillAvailableIndices(subcategoryID string, occupiedIndices []in
 		maxValue = v
 	}
 
-	s.store.productIndices[subcategoryID].availableIndices[int(maxValue)+1] = struct{}{}
-	s.store.productIndices[subcategoryID].orderedIndices = append(s.store.productIndices[subcategoryID].orderedIndices, int(maxValue)+1)
+	p.Insert(int(maxValue) + 1)
+	ns.store.Lock()
+	ns.store.productIndices[subcategoryID] = p
+	ns.store.Unlock()
 	return
 }
 
@@ -436,10 +651,9 @@ type occupiedIndices struct {
 }
 
 // initializeProductCache ...
-func (s *Server) initializeProductCache() error {
+func (ns *namespace) initializeProductCache() error {
 
-	query2 := `SELECT id FROM "productSubCategory";`
-	result, err := s.appCtx.DatabaseClient.Query(query2)
+	result, err := ns.client().Query(ns.queries.subcategoryIDs, ns.queries.args()...)
 	if err != nil {
 		log.Println("Error getting subcategoryID :", err)
 		return err
@@ -451,16 +665,13 @@ func (s *Server) initializeProductCache() error {
 			log.Println("Error scanning subcategoryID:", err)
 			return err
 		}
-		p := NewSortedIndices(make([]int, 0))
-		s.store.productIndices[subcategoryID] = p
-		s.store.productIndices[subcategoryID].availableIndices[1] = struct{}{}
-		s.store.productIndices[subcategoryID].orderedIndices = append(s.store.productIndices[subcategoryID].orderedIndices, 1)
+		p := NewSortedIndices([]int{1})
+		ns.store.Lock()
+		ns.store.productIndices[subcategoryID] = p
+		ns.store.Unlock()
 	}
 
-	query := `SELECT "subCategoryID",ARRAY_AGG("index") FROM (
-              SELECT "subCategoryID","index" FROM "products" GROUP BY 1,2 ORDER BY 2 ASC) t1 
-              GROUP BY 1;`
-	result, err = s.appCtx.DatabaseClient.Query(query)
+	result, err = ns.client().Query(ns.queries.productIndices, ns.queries.args()...)
 	if err != nil {
 		log.Println(err)
 		return err
@@ -469,36 +680,47 @@ func (s *Server) initializeProductCache() error {
 	var count int
 	for result.Next() {
 		var productIndex occupiedIndices
-		err := result.Scan(&productIndex.subcategoryID, (*pq.Int32Array)(&productIndex.indices))
+		err := result.Scan(&productIndex.subcategoryID, ns.queries.dialect.IntArray(&productIndex.indices))
 		if err != nil {
 			return err
 		}
 		count++
-		s.fillAvailableIndices(productIndex.subcategoryID, productIndex.indices)
+		ns.fillAvailableIndices(productIndex.subcategoryID, productIndex.indices)
 	}
 	return nil
 }
 
 // Run ....
 func (s *Server) Run() {
-	maxProc, _ := strconv.Atoi(os.Getenv("GO_MAX_PROC"))
-	runtime.GOMAXPROCS(maxProc)
+	if s.appCtx.MaxProcs > 0 {
+		runtime.GOMAXPROCS(s.appCtx.MaxProcs)
+	}
+	s.running.Store(true)
+	defer s.running.Store(false)
 	for {
-		req := <-s.request
+		var req Request
+		select {
+		case req = <-s.request:
+		case batch := <-s.batch:
+			logging.Debugln("Batch request received for", len(batch.items), "ids")
+			s.dispatch(func() { s.verifyBatch(batch) })
+			continue
+		}
 		switch req.reqType {
 		case Role:
-			log.Println("Request received for role verification")
-			go s.verifyRequest(req, Role, true, "users")
+			logging.Debugln("Request received for role verification")
+			s.dispatch(func() { s.verifyRequest(req, Role, true) })
 		case Category:
-			log.Println("Request received for categoryID verification")
-			go s.verifyRequest(req, Category, false, "productCategory")
+			logging.Debugln("Request received for categoryID verification")
+			s.dispatch(func() { s.verifyRequest(req, Category, false) })
 		case Subcategory:
-			log.Println("Request received for subcategoryID verification")
-			go s.verifyRequest(req, Subcategory, false, "productSubCategory")
+			logging.Debugln("Request received for subcategoryID verification")
+			s.dispatch(func() { s.verifyRequest(req, Subcategory, false) })
 		case Product:
-			log.Println("Request received for productID verification")
-			go s.verifyRequest(req, Product, false, "products")
+			logging.Debugln("Request received for productID verification")
+			s.dispatch(func() { s.verifyRequest(req, Product, false) })
 		case Quit:
+			req.Out <- true
 			return
 		default:
 			log.Println("Not supported")
@@ -506,73 +728,156 @@ func (s *Server) Run() {
 	}
 }
 
+// dispatch runs verify on a worker, waiting for a free one so that excess requests stay queued.
+func (s *Server) dispatch(verify func()) {
+	s.workers.acquire()
+	go func() {
+		defer s.workers.release()
+		verify()
+	}()
+}
+
 // MakeRequest ....
 func (s *Server) MakeRequest(request *Request) {
 	s.request <- *request
 }
 
+// MakeBatchRequest ....
+func (s *Server) MakeBatchRequest(request *BatchRequest) {
+	s.batch <- *request
+}
+
 // Close ...
 func (s *Server) Close() {
-	s.request <- *NewRequest("Quit", Quit, nil)
-}
-
-// verifyRequest : verifies the request from cache
-func (s *Server) verifyRequest(req Request, reqType Type, isOpt bool, tableName string) {
-	s.store.Lock()
-	if cachedValue, ok := s.store.data[reqType][req.id]; ok {
-		s.store.Unlock()
-		if !isOpt { // isOpt is false for category,subcategory,product
-			if req.opt == nil {
-				req.Out <- "active" == cachedValue
-				log.Println(reqType, "id fetched from cache")
-			}
-		} else {
-			if req.opt != nil {
-				// opt.(string) contains claimedRole from claims
-				req.Out <- req.opt.(string) == cachedValue
-				log.Println(reqType, "id fetched from cache")
-			} else {
-				req.Out <- false
-				log.Println("isOpt not passed when required")
-			}
+	quit := NewRequest("Quit", Quit, nil)
+	s.request <- *quit
+	<-quit.Out
+}
+
+// verifyRequest : verifies the request from the cache of its tenant, ids missing from cache are fetched from db
+func (s *Server) verifyRequest(req Request, reqType Type, isOpt bool) {
+	if isOpt && req.opt == nil {
+		req.Out <- false
+		log.Println("isOpt not passed when required")
+		return
+	}
+	ns, err := s.lookupNamespace(req.tenant)
+	if err != nil {
+		req.Out <- false
+		log.Println("request rejected:", err)
+		return
+	}
+	if reqType == Role && s.roleSets != nil {
+		claimedRole, isString := req.opt.(string)
+		valid, err := s.HasRoles(req.id, ns.name, []string{claimedRole}, AnyOf)
+		req.Out <- isString && err == nil && valid
+		return
+	}
+	value, err := ns.store.data[reqType].Get(req.id)
+	if err != nil {
+		req.Out <- false
+		return
+	}
+	if isOpt {
+		// opt.(string) contains claimedRole from claims, held directly or through an inherited role
+		claimedRole, isString := req.opt.(string)
+		req.Out <- isString && s.rbac.hasRole(value, claimedRole)
+	} else { // isOpt is false for category,subcategory,product
+		req.Out <- "active" == value
+	}
+}
+
+// verifyBatch : verifies every item of the batch in the namespace of its tenant
+func (s *Server) verifyBatch(req BatchRequest) {
+	results := make([]BatchResult, len(req.items))
+	positions := make(map[string][]int) // tenant vs the positions of its items
+	for i, item := range req.items {
+		results[i] = BatchResult{Type: item.Type, ID: item.ID}
+		positions[item.Tenant] = append(positions[item.Tenant], i)
+	}
+	for tenant, pos := range positions {
+		ns, err := s.lookupNamespace(tenant)
+		if err != nil {
+			log.Println("batch items rejected:", err)
+			continue
 		}
-	} else {
-		log.Println(reqType, " not present in cache")
-		s.store.Unlock()
-		// if not present in cache, fetch from db and update cache
-		dbVal, err := s.fetchQuery(req.id, tableName, reqType)
+		s.verifyItems(ns, req.items, pos, results)
+	}
+	req.Out <- results
+}
+
+// verifyItems : verifies the items at pos within ns, misses of each Type are loaded with a single query
+func (s *Server) verifyItems(ns *namespace, items []BatchItem, pos []int, results []BatchResult) {
+	ids := make(map[Type][]string)
+	for _, i := range pos {
+		if _, ok := ns.store.data[items[i].Type]; ok {
+			ids[items[i].Type] = append(ids[items[i].Type], items[i].ID)
+		}
+	}
+	values := make(map[Type]map[string]string, len(ids))
+	var roleSets map[string]RoleSet
+	for t := Role; t < Quit; t++ {
+		typeIDs, ok := ids[t]
+		if !ok {
+			continue
+		}
+		if t == Role && s.roleSets != nil {
+			roleSets = s.verifyRoleSets(typeIDs)
+			continue
+		}
+		res, err := ns.store.data[t].GetMany(typeIDs)
 		if err != nil {
-			req.Out <- false
-			return
+			log.Println("failed to load batch of", t, err)
 		}
+		values[t] = res
+	}
 
-		go s.updateCache(dbVal, req.id, reqType)
-		if isOpt {
-			req.Out <- req.opt.(string) == dbVal
+	for _, i := range pos {
+		item := items[i]
+		if item.Type == Role && s.roleSets != nil {
+			claimedRole, isString := item.Opt.(string)
+			set, ok := roleSets[item.ID]
+			results[i].Valid = isString && ok && s.matchRoles(set.in(ns.name), []string{claimedRole}, AnyOf)
+			continue
+		}
+		value, ok := values[item.Type][item.ID]
+		if !ok {
+			continue
+		}
+		if item.Type == Role {
+			claimedRole, isString := item.Opt.(string)
+			results[i].Valid = isString && s.rbac.hasRole(value, claimedRole)
 		} else {
-			req.Out <- "active" == dbVal
+			results[i].Valid = "active" == value
 		}
 	}
 }
 
-func (s *Server) updateCache(dbVal string, id string, t Type) {
-	s.store.Lock()
-	s.store.data[t][id] = dbVal
-	s.store.Unlock()
-	log.Println("cache is updated")
+// DeleteCache : pass in the id and the type to delete value in cache
+func (ns *namespace) DeleteCache(id string, t Type) {
+	ns.store.data[t].Delete(id)
+	if t == Role && ns.server.roleSets != nil {
+		ns.server.roleSets.Delete(id)
+	}
+	ns.publish(Event{Kind: EntryDeleted, Type: t, ID: id})
 }
 
-// DeleteCache : pass in the id and the type to delete value in cache
-func (s *Server) DeleteCache(id string, t Type) {
-	s.store.Lock()
-	delete(s.store.data[t], id)
-	s.store.Unlock()
+// Stats : returns hit/miss/load metrics of every typed cache
+func (ns *namespace) Stats() map[Type]typedcache.Stats {
+	result := make(map[Type]typedcache.Stats, len(ns.store.data))
+	for t, c := range ns.store.data {
+		result[t] = c.Stats()
+	}
+	return result
 }
 
-func (s *Server) fetchQuery(ID string, tableName string, t Type) (string, error) {
+func (ns *namespace) fetchQuery(ID string, t Type) (string, error) {
+	query, err := ns.queries.lookup(t)
+	if err != nil {
+		return "", err
+	}
 	if t != Role {
-		query := `SELECT id FROM ` + `"` + tableName + `"` + ` WHERE id=$1;`
-		result := s.appCtx.DatabaseClient.QueryRow(query, ID)
+		result := ns.client().QueryRow(query, ns.queries.args(ID)...)
 		var categoryID string
 		err := result.Scan(&categoryID)
 		if err != nil {
@@ -581,13 +886,37 @@ func (s *Server) fetchQuery(ID string, tableName string, t Type) (string, error)
 		}
 		return "active", nil
 	}
-	query := `SELECT "role" FROM "users" WHERE "emailId" = $1`
-	result := s.appCtx.DatabaseClient.QueryRow(query, ID)
+	result := ns.client().QueryRow(query, ns.queries.args(ID)...)
 	var dbRole string
-	err := result.Scan(&dbRole)
+	err = result.Scan(&dbRole)
 	if err != nil {
 		log.Println("error while scanning db result ", err)
 		return "", err
 	}
 	return dbRole, nil
 }
+
+// fetchMany : loads many ids with one query, ids not found in the table are left out of the result
+func (ns *namespace) fetchMany(IDs []string, t Type) (map[string]string, error) {
+	query, args, err := ns.queries.batch(t, IDs)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := ns.client().Query(query, args...)
+	if err != nil {
+		log.Println("error while fetching batch ", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := make(map[string]string, len(IDs))
+	for rows.Next() {
+		var id, value string
+		if err := rows.Scan(&id, &value); err != nil {
+			log.Println("error while scanning db result ", err)
+			return nil, err
+		}
+		result[id] = value
+	}
+	return result, rows.Err()
+}
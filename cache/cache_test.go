@@ -39,6 +39,7 @@ var (
 )
 
 func setUp() {
+	s.waitForInit()
 	go s.Run()
 }
 
@@ -46,6 +47,22 @@ func tearDown() {
 	s.Close()
 }
 
+// setInitialized marks every index family ready, or resets it so that the next access loads from db.
+// Per-parent loads are forgotten either way.
+func setInitialized(ready bool) {
+	for _, t := range []*initTracker{s.categoryInit, s.subcategoryInit, s.productInit} {
+		if ready {
+			t.markReady()
+		} else {
+			t.reset()
+		}
+	}
+	s.initMu.Lock()
+	s.subcategoryParents = make(map[string]*initTracker)
+	s.productParents = make(map[string]*initTracker)
+	s.initMu.Unlock()
+}
+
 func TestRunProduct(t *testing.T) {
 	cases := map[string]struct {
 		want       bool
@@ -98,7 +115,7 @@ func TestRunProduct(t *testing.T) {
 				}
 			case "cache":
 				if v.want {
-					s.store.data[Product]["test3"] = "active"
+					s.store.data[Product].Set("test3", "active")
 					s.MakeRequest(v.request)
 					time.Sleep(1 * time.Millisecond)
 					assert.Equal(t, v.want, <-v.request.Out)
@@ -161,7 +178,7 @@ func TestRunCacheCategory(t *testing.T) {
 				}
 			case "cache":
 				if v.want {
-					s.store.data[Category]["test3"] = "active"
+					s.store.data[Category].Set("test3", "active")
 					s.MakeRequest(v.request)
 					time.Sleep(1 * time.Millisecond)
 					assert.Equal(t, v.want, <-v.request.Out)
@@ -175,7 +192,7 @@ func TestRunCacheCategory(t *testing.T) {
 func TestUpdateCache(t *testing.T) {
 	setUp()
 	defer tearDown()
-	s.updateCache("test", "test", Role)
+	s.store.data[Role].Set("test", "test")
 }
 
 func TestDeleteCache(t *testing.T) {
@@ -235,7 +252,7 @@ func TestRunSubcategory(t *testing.T) {
 				}
 			case "cache":
 				if v.want {
-					s.store.data[Subcategory]["test3"] = "active"
+					s.store.data[Subcategory].Set("test3", "active")
 					s.MakeRequest(v.request)
 					time.Sleep(1 * time.Millisecond)
 					assert.Equal(t, v.want, <-v.request.Out)
@@ -303,13 +320,13 @@ func TestRunRole(t *testing.T) {
 				}
 			case "cache":
 				if v.want {
-					s.store.data[Role]["test3"] = "admin"
+					s.store.data[Role].Set("test3", "admin")
 					s.MakeRequest(v.request)
 					time.Sleep(1 * time.Millisecond)
 					assert.Equal(t, v.want, <-v.request.Out)
 					time.Sleep(1 * time.Millisecond)
 				} else if !v.want {
-					s.store.data[Role]["test4"] = "admin"
+					s.store.data[Role].Set("test4", "admin")
 					s.MakeRequest(v.request)
 					time.Sleep(1 * time.Millisecond)
 					assert.Equal(t, v.want, <-v.request.Out)
@@ -362,19 +379,17 @@ func TestInitializeSubcategoryCache(t *testing.T) {
 type queryPrepareFunc = func(prep *sqlmock.ExpectedQuery)
 
 func TestInitializeProductCache(t *testing.T) {
-	testMap := make(map[int]struct{})
-	testMap[2] = struct{}{}
-	p := NewSortedIndices(make([]int, 0))
+	p := NewSortedIndices(nil)
 	s.store.productIndices["test4"] = p
 
 	cases := map[string]struct {
-		want      map[int]struct{}
+		want      []int
 		getErr    error
 		prepFunc1 queryPrepareFunc
 		prepFunc2 queryPrepareFunc
 	}{
 		"success": {
-			want:   testMap,
+			want:   []int{2},
 			getErr: nil,
 			prepFunc1: func(prep *sqlmock.ExpectedQuery) {
 				prep.WillReturnRows(sqlmock.NewRows([]string{"subcategoryID", "index"}).AddRow("test4", (pq.Int32Array)([]int32{1})))
@@ -385,7 +400,7 @@ func TestInitializeProductCache(t *testing.T) {
 		},
 	}
 	query := `SELECT "subCategoryID",ARRAY_AGG("index") FROM (
-              SELECT "subCategoryID","index" FROM "products" GROUP BY 1,2 ORDER BY 2 ASC) t1 
+              SELECT "subCategoryID","index" FROM "products" GROUP BY 1,2 ORDER BY 2 ASC) t1
               GROUP BY 1;`
 	query2 := `SELECT id FROM "productSubCategory";`
 	setUp()
@@ -398,17 +413,17 @@ func TestInitializeProductCache(t *testing.T) {
 			prep1 := db.mocksql.ExpectQuery(regexp.QuoteMeta(query))
 			v.prepFunc1(prep1)
 			s.initializeProductCache()
-			assert.Equal(t, v.want, s.store.productIndices["test4"].availableIndices)
+			assert.Equal(t, v.want, s.store.productIndices["test4"].Slice())
 		})
 	}
-	time.Sleep(10 * time.Millisecond)
 	delete(s.store.productIndices, "test4")
+	delete(s.store.productIndices, "test")
 }
 
 func TestDeleteCategoryIndexCache(t *testing.T) {
 	var result [255]bool
 	result[1] = true
-	query := `SELECT index from "productCategory" ORDER BY index ASC;`
+	query := `SELECT "index" FROM "productCategory" ORDER BY "index" ASC;`
 	cases := map[string]struct {
 		want           bool
 		err            error
@@ -418,6 +433,7 @@ func TestDeleteCategoryIndexCache(t *testing.T) {
 			want: false,
 			err:  nil,
 			initialization: func() {
+				setInitialized(true)
 				s.store.categoryIndices = result
 			},
 		},
@@ -425,6 +441,7 @@ func TestDeleteCategoryIndexCache(t *testing.T) {
 			want: false,
 			err:  apperror.ErrCacheNotInitialized,
 			initialization: func() {
+				setInitialized(false)
 				s.store.categoryIndices = [255]bool{}
 				prep := db.mocksql.ExpectQuery(regexp.QuoteMeta(query))
 				prep.WillReturnError(apperror.ErrCacheNotInitialized)
@@ -453,13 +470,14 @@ func TestUpdateCategoryIndexCache(t *testing.T) {
 			want: true,
 			err:  nil,
 			initialization: func() {
+				setInitialized(true)
 				s.store.categoryIndices[1] = true
 			},
 		},
 		"cache is not initialized": {
 			want:           false,
 			err:            apperror.ErrCacheNotInitialized,
-			initialization: func() {},
+			initialization: func() { setInitialized(false) },
 		},
 	}
 
@@ -485,6 +503,7 @@ func TestGetCategoryIndicesCache(t *testing.T) {
 			want: response,
 			err:  nil,
 			initialization: func() {
+				setInitialized(true)
 				s.store.categoryIndices = [255]bool{}
 				s.store.categoryIndices[1] = true
 			},
@@ -492,7 +511,7 @@ func TestGetCategoryIndicesCache(t *testing.T) {
 		"cache is not initialized": {
 			want:           nil,
 			err:            apperror.ErrCacheNotInitialized,
-			initialization: func() {},
+			initialization: func() { setInitialized(false) },
 		},
 	}
 
@@ -517,6 +536,7 @@ func TestGetMaximumIndexCategory(t *testing.T) {
 			want: 1,
 			err:  nil,
 			initialization: func() {
+				setInitialized(true)
 				s.store.categoryIndices = [255]bool{}
 				s.store.categoryIndices[1] = true
 			},
@@ -524,7 +544,7 @@ func TestGetMaximumIndexCategory(t *testing.T) {
 		"cache is not initialized": {
 			want:           0,
 			err:            apperror.ErrCacheNotInitialized,
-			initialization: func() {},
+			initialization: func() { setInitialized(false) },
 		},
 	}
 
@@ -540,9 +560,7 @@ func TestGetMaximumIndexCategory(t *testing.T) {
 }
 
 func TestInitializeCategoryCache(t *testing.T) {
-	query := `SELECT index from "productCategory" ORDER BY index ASC;`
-	prep := db.mocksql.ExpectQuery(regexp.QuoteMeta(query))
-	prep.WillReturnRows(sqlmock.NewRows([]string{"index"}).AddRow(1).AddRow(3))
+	query := `SELECT "index" FROM "productCategory" ORDER BY "index" ASC;`
 	s.store.categoryIndices = [255]bool{}
 
 	arr := [255]bool{}
@@ -610,13 +628,14 @@ func TestUpdateSubcategoryIndexCache(t *testing.T) {
 			want: result,
 			err:  nil,
 			initialization: func() {
+				setInitialized(true)
 				s.store.subcategoryIndices["test"] = result
 			},
 		},
 		"cache is not initialized": {
 			want:           [255]bool{},
 			err:            apperror.ErrCacheNotInitialized,
-			initialization: func() {},
+			initialization: func() { setInitialized(false) },
 		},
 	}
 	for k, v := range cases {
@@ -642,13 +661,14 @@ func TestDeleteSubcategoryIndexCache(t *testing.T) {
 			want: [255]bool{},
 			err:  nil,
 			initialization: func() {
+				setInitialized(true)
 				s.store.subcategoryIndices["test"] = result
 			},
 		},
 		"cache is not initialized": {
 			want:           [255]bool{},
 			err:            apperror.ErrCacheNotInitialized,
-			initialization: func() {},
+			initialization: func() { setInitialized(false) },
 		},
 	}
 	for k, v := range cases {
@@ -675,13 +695,14 @@ func TestGetSubcategoryIndicesCache(t *testing.T) {
 			want: response,
 			err:  nil,
 			initialization: func() {
+				setInitialized(true)
 				s.store.subcategoryIndices["test"] = result
 			},
 		},
 		"cache is not initialized": {
 			want:           nil,
 			err:            apperror.ErrCacheNotInitialized,
-			initialization: func() {},
+			initialization: func() { setInitialized(false) },
 		},
 	}
 	for k, v := range cases {
@@ -707,13 +728,14 @@ func TestGetMaximumIndexSubcategory(t *testing.T) {
 			want: 1,
 			err:  nil,
 			initialization: func() {
+				setInitialized(true)
 				s.store.subcategoryIndices["test"] = result
 			},
 		},
 		"cache is not initialized": {
 			want:           0,
 			err:            apperror.ErrCacheNotInitialized,
-			initialization: func() {},
+			initialization: func() { setInitialized(false) },
 		},
 	}
 
@@ -730,37 +752,30 @@ func TestGetMaximumIndexSubcategory(t *testing.T) {
 
 func TestCreateProductCache(t *testing.T) {
 	s.CreateProductCache("test5")
-	assert.Equal(t, s.store.productIndices["test5"].orderedIndices, []int{1})
-	delete(s.store.subcategoryIndices, "test5")
+	assert.Equal(t, s.store.productIndices["test5"].Slice(), []int{1})
+	delete(s.store.productIndices, "test5")
 }
 
 func TestUpdateProductCacheIndex(t *testing.T) {
-	testMap := make(map[int]struct{})
-	testMap[1] = struct{}{}
-	testMap[2] = struct{}{}
-
-	wrongMap := make(map[int]struct{})
 	cases := map[string]struct {
-		want           map[int]struct{}
+		want           []int
 		err            error
 		initialization func()
 	}{
 		"success": {
-			want: testMap,
+			want: []int{1, 2},
 			err:  nil,
 			initialization: func() {
-				p := NewSortedIndices(make([]int, 0))
-				s.store.productIndices["test4"] = p
-				s.store.productIndices["test4"].availableIndices[2] = struct{}{}
-				s.store.productIndices["test4"].orderedIndices = []int{2}
+				setInitialized(true)
+				s.store.productIndices["test4"] = NewSortedIndices([]int{2})
 			},
 		},
 		"cache not initialized": {
-			want: wrongMap,
+			want: nil,
 			err:  apperror.ErrCacheNotInitialized,
 			initialization: func() {
-				p := NewSortedIndices(make([]int, 0))
-				s.store.productIndices["test4"] = p
+				setInitialized(false)
+				s.store.productIndices["test4"] = NewSortedIndices(nil)
 			},
 		},
 	}
@@ -769,41 +784,33 @@ func TestUpdateProductCacheIndex(t *testing.T) {
 		t.Run(k, func(t *testing.T) {
 			v.initialization()
 			err := s.UpdateProductCacheIndex(1, "test4")
-			time.Sleep(10 * time.Millisecond)
 			assert.Equal(t, v.err, err)
-			assert.Equal(t, v.want, s.store.productIndices["test4"].availableIndices)
+			assert.Equal(t, v.want, s.store.productIndices["test4"].Slice())
 			delete(s.store.productIndices, "test4")
 		})
 	}
 }
 
 func TestDeleteProductCacheIndex(t *testing.T) {
-	testMap := make(map[int]struct{})
-	testMap[1] = struct{}{}
-	wrongMap := make(map[int]struct{})
-
 	cases := map[string]struct {
-		want           map[int]struct{}
+		want           []int
 		err            error
 		initialization func()
 	}{
 		"success": {
-			want: testMap,
+			want: []int{1},
 			err:  nil,
 			initialization: func() {
-				p := NewSortedIndices(make([]int, 0))
-				s.store.productIndices["test3"] = p
-				s.store.productIndices["test3"].availableIndices[1] = struct{}{}
-				s.store.productIndices["test3"].availableIndices[2] = struct{}{}
-				s.store.productIndices["test3"].orderedIndices = []int{1, 2}
+				setInitialized(true)
+				s.store.productIndices["test3"] = NewSortedIndices([]int{1, 2})
 			},
 		},
 		"cache not initialized": {
-			want: wrongMap,
+			want: nil,
 			err:  apperror.ErrCacheNotInitialized,
 			initialization: func() {
-				p := NewSortedIndices(make([]int, 0))
-				s.store.productIndices["test3"] = p
+				setInitialized(false)
+				s.store.productIndices["test3"] = NewSortedIndices(nil)
 			},
 		},
 	}
@@ -813,8 +820,7 @@ func TestDeleteProductCacheIndex(t *testing.T) {
 			v.initialization()
 			err := s.DeleteProductCacheIndex("test3", 2)
 			assert.Equal(t, v.err, err)
-			assert.Equal(t, v.want, s.store.productIndices["test3"].availableIndices)
-			time.Sleep(10 * time.Millisecond)
+			assert.Equal(t, v.want, s.store.productIndices["test3"].Slice())
 			delete(s.store.productIndices, "test3")
 		})
 	}
@@ -832,18 +838,16 @@ func TestGetProductIndicesCache(t *testing.T) {
 			want: []int{1},
 			err:  nil,
 			initialization: func() {
-				p := NewSortedIndices(make([]int, 0))
-				s.store.productIndices["test2"] = p
-				s.store.productIndices["test2"].availableIndices[1] = struct{}{}
-				s.store.productIndices["test2"].orderedIndices = []int{1}
+				setInitialized(true)
+				s.store.productIndices["test2"] = NewSortedIndices([]int{1})
 			},
 		},
 		"cache not initialized": {
 			want: nil,
 			err:  apperror.ErrCacheNotInitialized,
 			initialization: func() {
-				p := NewSortedIndices(make([]int, 0))
-				s.store.productIndices["test2"] = p
+				setInitialized(false)
+				s.store.productIndices["test2"] = NewSortedIndices(nil)
 			},
 		},
 	}
@@ -854,7 +858,6 @@ func TestGetProductIndicesCache(t *testing.T) {
 			get, err := s.GetProductIndicesCache("test2")
 			assert.Equal(t, v.err, err)
 			assert.Equal(t, v.want, get)
-			time.Sleep(10 * time.Millisecond)
 			delete(s.store.productIndices, "test2")
 		})
 	}
@@ -871,18 +874,16 @@ func TestGetMaximumIndexProduct(t *testing.T) {
 			want: 1,
 			err:  nil,
 			initialization: func() {
-				p := NewSortedIndices(make([]int, 0))
-				s.store.productIndices["test1"] = p
-				s.store.productIndices["test1"].availableIndices[1] = struct{}{}
-				s.store.productIndices["test1"].orderedIndices = []int{1}
+				setInitialized(true)
+				s.store.productIndices["test1"] = NewSortedIndices([]int{1})
 			},
 		},
 		"cache not initialized": {
 			want: 0,
 			err:  apperror.ErrCacheNotInitialized,
 			initialization: func() {
-				p := NewSortedIndices(make([]int, 0))
-				s.store.productIndices["test1"] = p
+				setInitialized(false)
+				s.store.productIndices["test1"] = NewSortedIndices(nil)
 			},
 		},
 	}
@@ -893,9 +894,71 @@ func TestGetMaximumIndexProduct(t *testing.T) {
 			get, err := s.GetMaximumIndexProduct("test1")
 			assert.Equal(t, v.err, err)
 			assert.Equal(t, v.want, get)
-			time.Sleep(10 * time.Millisecond)
 			delete(s.store.productIndices, "test1")
 		})
 	}
 
 }
+
+func TestMakeBatchRequest(t *testing.T) {
+	productQuery := `SELECT id, 'active' FROM "products" WHERE id = ANY($1);`
+	roleQuery := `SELECT "emailId", "role" FROM "users" WHERE "emailId" = ANY($1);`
+	cases := map[string]struct {
+		items          []BatchItem
+		want           []BatchResult
+		initialization func()
+	}{
+		"hits from cache and misses loaded with one query per type": {
+			items: []BatchItem{
+				{Type: Product, ID: "batch1"},
+				{Type: Product, ID: "batch2"},
+				{Type: Product, ID: "batch3"},
+				{Type: Role, ID: "batchUser", Opt: "admin"},
+				{Type: Role, ID: "batchUser", Opt: "editor"},
+			},
+			want: []BatchResult{
+				{Type: Product, ID: "batch1", Valid: true},
+				{Type: Product, ID: "batch2", Valid: true},
+				{Type: Product, ID: "batch3", Valid: false},
+				{Type: Role, ID: "batchUser", Valid: true},
+				{Type: Role, ID: "batchUser", Valid: false},
+			},
+			initialization: func() {
+				s.store.data[Product].Set("batch1", "active")
+				db.mocksql.ExpectQuery(regexp.QuoteMeta(roleQuery)).
+					WillReturnRows(sqlmock.NewRows([]string{"emailId", "role"}).AddRow("batchUser", "admin"))
+				db.mocksql.ExpectQuery(regexp.QuoteMeta(productQuery)).
+					WillReturnRows(sqlmock.NewRows([]string{"id", "active"}).AddRow("batch2", "active"))
+			},
+		},
+		"database error marks misses invalid": {
+			items: []BatchItem{
+				{Type: Product, ID: "batch1"},
+				{Type: Product, ID: "batch4"},
+			},
+			want: []BatchResult{
+				{Type: Product, ID: "batch1", Valid: true},
+				{Type: Product, ID: "batch4", Valid: false},
+			},
+			initialization: func() {
+				s.store.data[Product].Set("batch1", "active")
+				db.mocksql.ExpectQuery(regexp.QuoteMeta(productQuery)).WillReturnError(errors.New("error"))
+			},
+		},
+	}
+	setUp()
+	defer tearDown()
+
+	for k, v := range cases {
+		t.Run(k, func(t *testing.T) {
+			v.initialization()
+			req := NewBatchRequest(v.items)
+			s.MakeBatchRequest(req)
+			assert.Equal(t, v.want, <-req.Out)
+			assert.NoError(t, db.mocksql.ExpectationsWereMet())
+			for _, item := range v.items {
+				s.DeleteCache(item.ID, item.Type)
+			}
+		})
+	}
+}
@@ -0,0 +1,249 @@
+package cache
+
+import (
+	"cacheServer/apperror"
+	"cacheServer/typedcache"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// EventKind : what changed in the cache
+type EventKind int
+
+const (
+	// EntryUpdated : an entry was stored in a typed cache, by a load, a refresh or the warm-up
+	EntryUpdated EventKind = iota
+	// EntryDeleted : an entry was dropped from a typed cache, the next read loads it again
+	EntryDeleted
+	// IndexAllocated : an index was taken, it is no longer available
+	IndexAllocated
+	// IndexReleased : an index became available again
+	IndexReleased
+	// StatusChanged : a reload found an entity with another status than the cached one, or a user with
+	// other roles
+	StatusChanged
+)
+
+var eventKindNames = [...]string{"entryUpdated", "entryDeleted", "indexAllocated", "indexReleased", "statusChanged"}
+
+func (k EventKind) String() string {
+	return eventKindNames[k]
+}
+
+// MarshalText : encodes the EventKind by name
+func (k EventKind) MarshalText() ([]byte, error) {
+	return []byte(k.String()), nil
+}
+
+// UnmarshalText : decodes an EventKind encoded by MarshalText
+func (k *EventKind) UnmarshalText(text []byte) error {
+	v, err := ParseEventKind(string(text))
+	if err != nil {
+		return err
+	}
+	*k = v
+	return nil
+}
+
+// ParseEventKind : returns the EventKind named s, matching is case insensitive
+func ParseEventKind(s string) (EventKind, error) {
+	for k, name := range eventKindNames {
+		if strings.EqualFold(name, s) {
+			return EventKind(k), nil
+		}
+	}
+	return 0, fmt.Errorf("%w: unknown event kind %q", apperror.ErrInvalidRequest, s)
+}
+
+// Event : one mutation of the cache. Entry events carry the id of the entry, index events the index and,
+// for subcategory and product indices, the id of their parent. Status events carry the previous and the
+// new status, "active" or "passive", or the roles of a user as a comma separated list.
+type Event struct {
+	Seq    uint64    `json:"seq"` // increases by one per published event
+	Time   time.Time `json:"time"`
+	Kind   EventKind `json:"kind"`
+	Tenant string    `json:"tenant,omitempty"`
+	Type   Type      `json:"type"`
+	ID     string    `json:"id,omitempty"`
+	Parent string    `json:"parent,omitempty"` // categoryID of subcategory indices, subcategoryID of product indices
+	Index  int       `json:"index,omitempty"`
+	Old    string    `json:"old,omitempty"`
+	New    string    `json:"new,omitempty"`
+}
+
+// EventFilter : selects the events delivered to a subscription, an empty list matches every value
+type EventFilter struct {
+	Kinds   []EventKind
+	Types   []Type
+	Tenants []string // "" selects the default namespace
+}
+
+func (f EventFilter) match(e Event) bool {
+	return matchAny(f.Kinds, e.Kind) && matchAny(f.Types, e.Type) && matchAny(f.Tenants, e.Tenant)
+}
+
+func matchAny[T comparable](values []T, v T) bool {
+	if len(values) == 0 {
+		return true
+	}
+	for _, value := range values {
+		if value == v {
+			return true
+		}
+	}
+	return false
+}
+
+// EventStats : counters of the event bus
+type EventStats struct {
+	Published   uint64 `json:"published"`
+	Delivered   uint64 `json:"delivered"`
+	Dropped     uint64 `json:"dropped"` // events a subscriber had no room for
+	Subscribers int    `json:"subscribers"`
+}
+
+// EventBus : in-process publisher of cache mutations. Publishing never blocks: each subscription
+// has a buffer of its own and an event that does not fit is dropped and counted.
+type EventBus struct {
+	mu   sync.RWMutex
+	subs map[*Subscription]struct{}
+
+	seq       atomic.Uint64
+	delivered atomic.Uint64
+	dropped   atomic.Uint64
+}
+
+// NewEventBus ...
+func NewEventBus() *EventBus {
+	return &EventBus{subs: make(map[*Subscription]struct{})}
+}
+
+// Subscription : events of a bus matching a filter, read from Events until Close
+type Subscription struct {
+	bus     *EventBus
+	filter  EventFilter
+	ch      chan Event
+	dropped atomic.Uint64
+	once    sync.Once
+}
+
+// Subscribe : delivers the events matching filter, buffering up to buffer of them
+func (b *EventBus) Subscribe(filter EventFilter, buffer int) *Subscription {
+	sub := &Subscription{bus: b, filter: filter, ch: make(chan Event, buffer)}
+	b.mu.Lock()
+	b.subs[sub] = struct{}{}
+	b.mu.Unlock()
+	return sub
+}
+
+// Publish : numbers e and hands it to every matching subscription with room for it
+func (b *EventBus) Publish(e Event) {
+	e.Seq = b.seq.Add(1)
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for sub := range b.subs {
+		if !sub.filter.match(e) {
+			continue
+		}
+		select {
+		case sub.ch <- e:
+			b.delivered.Add(1)
+		default:
+			sub.dropped.Add(1)
+			b.dropped.Add(1)
+		}
+	}
+}
+
+// Stats : returns the counters of the bus
+func (b *EventBus) Stats() EventStats {
+	b.mu.RLock()
+	subscribers := len(b.subs)
+	b.mu.RUnlock()
+	return EventStats{
+		Published:   b.seq.Load(),
+		Delivered:   b.delivered.Load(),
+		Dropped:     b.dropped.Load(),
+		Subscribers: subscribers,
+	}
+}
+
+// Events : returns the channel the events are delivered on, closed by Close
+func (s *Subscription) Events() <-chan Event {
+	return s.ch
+}
+
+// Dropped : returns the number of matching events dropped because the buffer was full
+func (s *Subscription) Dropped() uint64 {
+	return s.dropped.Load()
+}
+
+// Close : stops the delivery and closes the channel, it is safe to call more than once
+func (s *Subscription) Close() {
+	s.once.Do(func() {
+		s.bus.mu.Lock()
+		delete(s.bus.subs, s)
+		s.bus.mu.Unlock()
+		close(s.ch)
+	})
+}
+
+// Events : returns the bus the cache mutations are published on
+func (s *Server) Events() *EventBus {
+	return s.events
+}
+
+// watchStatus publishes a StatusChanged event for every entry of the cache of t a reload changed. An
+// entity found gone becomes passive, a user found gone has no role.
+func (ns *namespace) watchStatus(t Type, c *typedcache.Cache[string, string]) {
+	c.Watch(func(change typedcache.Change[string, string]) {
+		status := change.New
+		if change.Removed && t != Role {
+			status = "passive"
+		}
+		if status == change.Old {
+			return
+		}
+		ns.publish(Event{Kind: StatusChanged, Type: t, ID: change.Key, Old: change.Old, New: status})
+	})
+}
+
+// watchRoleSets publishes a StatusChanged event for every tenant in which a reload changed the roles of
+// a user.
+func (s *Server) watchRoleSets(c *typedcache.Cache[string, RoleSet]) {
+	c.Watch(func(change typedcache.Change[string, RoleSet]) {
+		tenants := make(map[string]struct{}, len(change.Old)+len(change.New))
+		for tenant := range change.Old {
+			tenants[tenant] = struct{}{}
+		}
+		for tenant := range change.New {
+			tenants[tenant] = struct{}{}
+		}
+		for tenant := range tenants {
+			old, roles := joinRoles(change.Old[tenant]), joinRoles(change.New[tenant])
+			if old != roles {
+				s.events.Publish(Event{Kind: StatusChanged, Tenant: tenant, Type: Role, ID: change.Key, Old: old, New: roles})
+			}
+		}
+	})
+}
+
+// joinRoles lists roles sorted, so that rows read in another order are no change.
+func joinRoles(roles []string) string {
+	roles = append([]string(nil), roles...)
+	sort.Strings(roles)
+	return strings.Join(roles, ",")
+}
+
+// publish stamps e with the tenant of the namespace and publishes it.
+func (ns *namespace) publish(e Event) {
+	e.Tenant = ns.name
+	ns.server.events.Publish(e)
+}
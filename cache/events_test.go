@@ -0,0 +1,158 @@
+package cache
+
+import (
+	"cacheServer/appcontext"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEventFilter(t *testing.T) {
+	e := Event{Kind: IndexAllocated, Type: Product, Tenant: "t1"}
+	cases := map[string]struct {
+		filter EventFilter
+		want   bool
+	}{
+		"empty filter": {
+			want: true,
+		},
+		"matching kind and type": {
+			filter: EventFilter{Kinds: []EventKind{IndexAllocated, IndexReleased}, Types: []Type{Product}},
+			want:   true,
+		},
+		"other kind": {
+			filter: EventFilter{Kinds: []EventKind{EntryDeleted}},
+		},
+		"other tenant": {
+			filter: EventFilter{Tenants: []string{""}},
+		},
+	}
+	for k, v := range cases {
+		t.Run(k, func(t *testing.T) {
+			assert.Equal(t, v.want, v.filter.match(e))
+		})
+	}
+}
+
+func TestEventBus(t *testing.T) {
+	bus := NewEventBus()
+	all := bus.Subscribe(EventFilter{}, 2)
+	deletes := bus.Subscribe(EventFilter{Kinds: []EventKind{EntryDeleted}}, 10)
+
+	bus.Publish(Event{Kind: EntryUpdated, Type: Role, ID: "a@x"})
+	bus.Publish(Event{Kind: EntryDeleted, Type: Role, ID: "a@x"})
+	bus.Publish(Event{Kind: EntryDeleted, Type: Product, ID: "p1"}) // no room left in all
+
+	assert.Equal(t, uint64(1), all.Dropped())
+	assert.Equal(t, uint64(0), deletes.Dropped())
+	assert.Equal(t, EventStats{Published: 3, Delivered: 4, Dropped: 1, Subscribers: 2}, bus.Stats())
+
+	first := <-all.Events()
+	assert.Equal(t, uint64(1), first.Seq)
+	assert.False(t, first.Time.IsZero())
+	assert.Equal(t, EntryDeleted, (<-all.Events()).Kind)
+	assert.Equal(t, "a@x", (<-deletes.Events()).ID)
+	assert.Equal(t, "p1", (<-deletes.Events()).ID)
+
+	all.Close()
+	all.Close()
+	_, open := <-all.Events()
+	assert.False(t, open)
+	bus.Publish(Event{Kind: EntryUpdated})
+	assert.Equal(t, 1, bus.Stats().Subscribers)
+}
+
+func TestMutationEvents(t *testing.T) {
+	srv := newSQLiteServer(t, func(ctx *appcontext.Context) {
+		ctx.Tenants = appcontext.TenantsConfig{Column: "tenantID"}
+	})
+	_, err := srv.appCtx.DatabaseClient.Exec(tenantSchema)
+	assert.NoError(t, err)
+	go srv.Run()
+	defer srv.Close()
+	sub := srv.Events().Subscribe(EventFilter{}, 16)
+	defer sub.Close()
+
+	assert.NoError(t, srv.DeleteCategoryIndexCache(2))
+	assert.NoError(t, srv.UpdateSubcategoryIndexCache(3, "c1"))
+	assert.NoError(t, srv.DeleteProductCacheIndex("s1", 2))
+	// a verification loading the entry stores it
+	req := NewRequest("p1", Product, nil)
+	srv.MakeRequest(req)
+	<-req.Out
+	srv.DeleteCache("a@x", Role)
+	t2, err := srv.Tenant("t2")
+	assert.NoError(t, err)
+	assert.NoError(t, t2.UpdateProductCacheIndex(3, "s9"))
+	// failed operations publish nothing
+	assert.Error(t, srv.DeleteProductCacheIndex("ghost", 1))
+
+	want := []Event{
+		{Kind: IndexAllocated, Type: Category, Index: 2},
+		{Kind: IndexReleased, Type: Subcategory, Parent: "c1", Index: 3},
+		{Kind: IndexAllocated, Type: Product, Parent: "s1", Index: 2},
+		{Kind: EntryUpdated, Type: Product, ID: "p1"},
+		{Kind: EntryDeleted, Type: Role, ID: "a@x"},
+		{Kind: IndexReleased, Type: Product, Parent: "s9", Index: 3, Tenant: "t2"},
+	}
+	for i, w := range want {
+		got := <-sub.Events()
+		w.Seq, w.Time = uint64(i+1), got.Time
+		assert.Equal(t, w, got)
+	}
+	assert.Len(t, sub.Events(), 0)
+	assert.Equal(t, uint64(6), srv.Metrics().Events.Published)
+}
+
+func TestStatusEvents(t *testing.T) {
+	srv := newSQLiteServer(t, func(ctx *appcontext.Context) {
+		ctx.CacheOptions.TTL = time.Millisecond
+	})
+	sub := srv.Events().Subscribe(EventFilter{Kinds: []EventKind{StatusChanged}}, 16)
+	defer sub.Close()
+
+	for _, k := range []struct {
+		t  Type
+		id string
+	}{{Product, "p1"}, {Product, "p2"}, {Role, "a@x"}, {Role, "b@x"}} {
+		_, err := srv.store.data[k.t].Get(k.id)
+		assert.NoError(t, err)
+	}
+	_, err := srv.appCtx.DatabaseClient.Exec(`DELETE FROM products WHERE id = 'p1'; UPDATE users SET "role" = 'viewer' WHERE "emailId" = 'a@x';`)
+	assert.NoError(t, err)
+	time.Sleep(5 * time.Millisecond)
+
+	_, err = srv.store.data[Product].Get("p1")
+	assert.Error(t, err)
+	_, ok := srv.store.data[Product].Peek("p1")
+	assert.False(t, ok)
+	_, err = srv.store.data[Product].Get("p2") // unchanged
+	assert.NoError(t, err)
+	_, err = srv.store.data[Role].Get("a@x")
+	assert.NoError(t, err)
+
+	want := []Event{
+		{Kind: StatusChanged, Type: Product, ID: "p1", Old: "active", New: "passive"},
+		{Kind: StatusChanged, Type: Role, ID: "a@x", Old: "admin", New: "viewer"},
+	}
+	for _, w := range want {
+		got := <-sub.Events()
+		w.Seq, w.Time = got.Seq, got.Time
+		assert.Equal(t, w, got)
+	}
+	assert.Len(t, sub.Events(), 0)
+}
+
+func TestEventJSON(t *testing.T) {
+	e := Event{Seq: 7, Time: time.Unix(1, 0).UTC(), Kind: StatusChanged, Tenant: "t1", Type: Subcategory, ID: "s1",
+		Old: "active", New: "passive"}
+	data, err := json.Marshal(e)
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"seq":7,"time":"1970-01-01T00:00:01Z","kind":"statusChanged","tenant":"t1","type":"SubCategory",
+		"id":"s1","old":"active","new":"passive"}`, string(data))
+	var decoded Event
+	assert.NoError(t, json.Unmarshal(data, &decoded))
+	assert.Equal(t, e, decoded)
+}
@@ -0,0 +1,47 @@
+package cache
+
+import (
+	"cacheServer/appcontext"
+	database "cacheServer/db"
+	"errors"
+	"net"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBreakerFallback(t *testing.T) {
+	mockDB, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	client := database.NewResilientClient(mockDB, database.RetryConfig{}, database.BreakerConfig{FailureThreshold: 1, OpenTimeout: time.Hour})
+	ctx := appcontext.NewContext(client, 1)
+	ctx.CacheOptions.TTL = time.Millisecond
+	srv := NewServer(ctx)
+	srv.waitForInit()
+
+	query := regexp.QuoteMeta(`SELECT id FROM "products" WHERE id=$1;`)
+	mock.ExpectQuery(query).WithArgs("p1").WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("p1"))
+	get, err := srv.store.data[Product].Get("p1")
+	assert.NoError(t, err)
+	assert.Equal(t, "active", get)
+	time.Sleep(2 * time.Millisecond)
+
+	// the failure opening the breaker is returned, later misses are answered with the last known value
+	mock.ExpectQuery(query).WithArgs("p1").WillReturnError(&net.OpError{Op: "dial", Net: "tcp", Err: errors.New("refused")})
+	_, err = srv.store.data[Product].Get("p1")
+	assert.Error(t, err)
+	get, err = srv.store.data[Product].Get("p1")
+	assert.NoError(t, err)
+	assert.Equal(t, "active", get)
+
+	_, err = srv.store.data[Product].Get("p2")
+	assert.ErrorIs(t, err, database.ErrCircuitOpen)
+	assert.NoError(t, mock.ExpectationsWereMet())
+
+	metrics := srv.Metrics()
+	assert.Equal(t, uint64(1), metrics.Caches[Product].Fallbacks)
+	assert.Equal(t, database.BreakerOpen, metrics.Database["breaker"].(database.BreakerStats).State)
+}
@@ -0,0 +1,103 @@
+package cache
+
+import (
+	database "cacheServer/db"
+	"cacheServer/health"
+	"context"
+	"fmt"
+	"time"
+)
+
+const (
+	categoryIndicesPhase    = "categoryIndices"
+	subcategoryIndicesPhase = "subcategoryIndices"
+	productIndicesPhase     = "productIndices"
+
+	// queueSaturationLimit is the fill ratio of the request queue above which the server is not ready.
+	queueSaturationLimit = 0.9
+	// defaultPingTimeout is used for the database check when DBTimeout is unset.
+	defaultPingTimeout = time.Second
+)
+
+// QueueStats : occupancy of the request queue and of the worker pool
+type QueueStats struct {
+	Queued      int `json:"queued"`
+	QueueSize   int `json:"queueSize"`
+	BusyWorkers int `json:"busyWorkers"`
+	Workers     int `json:"workers"`
+}
+
+// Health : returns the registry behind the liveness and readiness endpoints
+func (s *Server) Health() *health.Registry {
+	return s.health
+}
+
+// QueueStats : returns the current occupancy of the request queue and worker pool
+func (s *Server) QueueStats() QueueStats {
+	busy, workers := s.workers.stats()
+	return QueueStats{
+		Queued:      len(s.request) + len(s.batch),
+		QueueSize:   cap(s.request) + cap(s.batch),
+		BusyWorkers: busy,
+		Workers:     workers,
+	}
+}
+
+func (s *Server) registerHealthChecks() {
+	s.health.AddLiveness("runLoop", health.CheckerFunc(s.checkRunLoop))
+	s.health.AddReadiness("db", health.CheckerFunc(s.checkDatabase))
+	s.health.AddReadiness("queue", health.CheckerFunc(s.checkQueue))
+	s.health.AddReadiness("warmup", health.CheckerFunc(s.checkWarmup))
+	s.health.AddReadiness(categoryIndicesPhase, health.CheckerFunc(s.categoryInit.check))
+	s.health.AddReadiness(subcategoryIndicesPhase, health.CheckerFunc(s.subcategoryInit.check))
+	s.health.AddReadiness(productIndicesPhase, health.CheckerFunc(s.productInit.check))
+}
+
+func (s *Server) checkRunLoop(ctx context.Context) health.Result {
+	if !s.running.Load() {
+		return health.Down("request loop is not running")
+	}
+	return health.Up("")
+}
+
+func (s *Server) checkDatabase(ctx context.Context) health.Result {
+	timeout := defaultPingTimeout
+	if s.appCtx.DBTimeout > 0 {
+		timeout = time.Duration(s.appCtx.DBTimeout) * time.Second
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	start := time.Now()
+	res := health.Up("")
+	if err := s.appCtx.DatabaseClient.PingContext(ctx); err != nil {
+		res = health.Down(err.Error())
+	} else {
+		res.Detail = "ping took " + time.Since(start).String()
+	}
+	// replica and breaker state is reported without affecting readiness, the ping above decides it
+	if report := database.Report(s.appCtx.DatabaseClient); len(report) > 0 {
+		res.Data = report
+	}
+	return res
+}
+
+func (s *Server) checkQueue(ctx context.Context) health.Result {
+	stats := s.QueueStats()
+	res := health.Up(fmt.Sprintf("%d/%d queued", stats.Queued, stats.QueueSize))
+	if stats.QueueSize > 0 && float64(stats.Queued) >= queueSaturationLimit*float64(stats.QueueSize) {
+		res.Status = health.StatusDown
+	}
+	res.Data = stats
+	return res
+}
+
+func (s *Server) checkWarmup(ctx context.Context) health.Result {
+	status := s.WarmupStatus()
+	if !status.Done {
+		return health.Result{Status: health.StatusDown, Detail: "warming up"}
+	}
+	// a failed warm-up only costs cache misses, it does not make the server unusable
+	res := health.Up(status.Error)
+	res.Data = status
+	return res
+}
@@ -0,0 +1,28 @@
+package cache
+
+import (
+	"cacheServer/health"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHealthChecks(t *testing.T) {
+	assert.Equal(t, health.StatusDown, s.Health().Live(context.Background()).Status)
+
+	setUp()
+	assert.Eventually(t, func() bool {
+		return s.Health().Live(context.Background()).Status == health.StatusUp
+	}, time.Second, time.Millisecond)
+
+	ready := s.Health().Ready(context.Background())
+	for _, name := range []string{"runLoop", "db", "queue", "warmup", categoryIndicesPhase, subcategoryIndicesPhase, productIndicesPhase} {
+		assert.Contains(t, ready.Checks, name)
+	}
+	assert.Equal(t, health.StatusUp, ready.Checks["db"].Status)
+	assert.Equal(t, health.StatusUp, ready.Checks["queue"].Status)
+	assert.Equal(t, QueueStats{QueueSize: 2048, Workers: 128}, ready.Checks["queue"].Data)
+	tearDown()
+}
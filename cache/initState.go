@@ -0,0 +1,256 @@
+package cache
+
+import (
+	"cacheServer/apperror"
+	"cacheServer/health"
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"sync"
+	"time"
+)
+
+// initState is the lifecycle of an index family or of one parent within it.
+type initState int
+
+const (
+	stateUninitialized initState = iota
+	stateLoading
+	stateReady
+	stateFailed
+)
+
+func (st initState) String() string {
+	return [...]string{"uninitialized", "loading", "ready", "failed"}[st]
+}
+
+const (
+	// initRetryBackoff is the wait after the first failed load, doubled on every further failure.
+	initRetryBackoff = 500 * time.Millisecond
+	// maxInitRetryBackoff caps the wait between retries.
+	maxInitRetryBackoff = 30 * time.Second
+)
+
+// initTracker deduplicates the loads of an index family or parent and retries failed loads with backoff.
+type initTracker struct {
+	mu       sync.Mutex
+	load     func() error
+	phase    *health.Phase // nil for per-parent trackers
+	state    initState
+	err      error
+	done     chan struct{} // closed when the running load finishes
+	dirty    bool          // reset during the running load, it is run again before the waiters resume
+	failures int
+	retryAt  time.Time
+}
+
+func newInitTracker(load func() error, phase *health.Phase) *initTracker {
+	return &initTracker{load: load, phase: phase}
+}
+
+// ensure returns nil once the load succeeded. Callers arriving during a load wait for it, callers
+// arriving after a failure get the last error until the backoff has elapsed and the load is retried.
+func (t *initTracker) ensure() error {
+	t.mu.Lock()
+	switch t.state {
+	case stateReady:
+		t.mu.Unlock()
+		return nil
+	case stateLoading:
+		done := t.done
+		t.mu.Unlock()
+		<-done
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		return t.err
+	case stateFailed:
+		if time.Now().Before(t.retryAt) {
+			defer t.mu.Unlock()
+			return t.err
+		}
+	}
+	t.state = stateLoading
+	t.done = make(chan struct{})
+	t.mu.Unlock()
+	if t.phase != nil {
+		t.phase.Start()
+	}
+
+	var err error
+	for {
+		err = t.load()
+		t.mu.Lock()
+		if !t.dirty {
+			break
+		}
+		t.dirty = false
+		t.mu.Unlock()
+	}
+	t.err = err
+	if err == nil {
+		t.state = stateReady
+		t.failures = 0
+	} else {
+		t.state = stateFailed
+		t.failures++
+		t.retryAt = time.Now().Add(backoff(t.failures))
+	}
+	close(t.done)
+	t.mu.Unlock()
+	if t.phase != nil {
+		t.phase.Finish(err)
+	}
+	return err
+}
+
+// retryIfDue starts a retry of a failed load in the background once its backoff has elapsed.
+func (t *initTracker) retryIfDue() {
+	t.mu.Lock()
+	due := t.state == stateFailed && !time.Now().Before(t.retryAt)
+	t.mu.Unlock()
+	if due {
+		go t.ensure()
+	}
+}
+
+// markReady records that the data was filled in without running the load.
+func (t *initTracker) markReady() {
+	t.mu.Lock()
+	if t.state != stateLoading {
+		t.state = stateReady
+		t.err = nil
+		t.failures = 0
+	}
+	t.mu.Unlock()
+}
+
+// reset forgets the state so that the next ensure loads again. A running load may have read the data
+// before the change reset stands for, it is run once more before its waiters resume.
+func (t *initTracker) reset() {
+	t.mu.Lock()
+	if t.state == stateLoading {
+		t.dirty = true
+	} else {
+		t.state = stateUninitialized
+		t.err = nil
+		t.failures = 0
+	}
+	t.mu.Unlock()
+}
+
+func (t *initTracker) current() initState {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.state
+}
+
+// check reports the family phase and kicks off a retry of a failed load, so readiness probes drive recovery.
+func (t *initTracker) check(ctx context.Context) health.Result {
+	t.retryIfDue()
+	return t.phase.Check(ctx)
+}
+
+func backoff(failures int) time.Duration {
+	d := initRetryBackoff
+	for i := 1; i < failures && d < maxInitRetryBackoff; i++ {
+		d *= 2
+	}
+	if d > maxInitRetryBackoff {
+		d = maxInitRetryBackoff
+	}
+	return d
+}
+
+// parentIndex describes how the indices of one parent are loaded for a child index family.
+type parentIndex struct {
+	kind         string // name of the parent in errors, e.g. "category"
+	parentType   Type
+	childTable   string
+	parentColumn string // column of childTable referencing the parent
+}
+
+var (
+	subcategoryParent = parentIndex{
+		kind:         "category",
+		parentType:   Category,
+		childTable:   "productSubCategory",
+		parentColumn: "categoryID",
+	}
+	productParent = parentIndex{
+		kind:         "subcategory",
+		parentType:   Subcategory,
+		childTable:   "products",
+		parentColumn: "subCategoryID",
+	}
+)
+
+// ensureParent makes sure the index family is loaded and parentID is known within it.
+// Parents missing after the family load are loaded on their own, unknown ones return an UnknownParentError.
+func (ns *namespace) ensureParent(family *initTracker, trackers map[string]*initTracker, p parentIndex, parentID string,
+	present func() bool, fill func(occupied []int32) error) error {
+	if err := family.ensure(); err != nil {
+		return apperror.ErrCacheNotInitialized
+	}
+	if present() {
+		return nil
+	}
+
+	ns.initMu.Lock()
+	t, ok := trackers[parentID]
+	if !ok {
+		t = newInitTracker(func() error { return ns.loadParent(p, parentID, fill) }, nil)
+		trackers[parentID] = t
+	}
+	ns.initMu.Unlock()
+
+	err := t.ensure()
+	var unknown *apperror.UnknownParentError
+	if errors.As(err, &unknown) {
+		// parent ids come from requests, unknown ones are not kept
+		ns.initMu.Lock()
+		if trackers[parentID] == t {
+			delete(trackers, parentID)
+		}
+		ns.initMu.Unlock()
+		return err
+	}
+	if err != nil {
+		return apperror.ErrCacheNotInitialized
+	}
+	return nil
+}
+
+// loadParent reads the occupied child indices of parentID, a parent without children must exist in its own table.
+func (ns *namespace) loadParent(p parentIndex, parentID string, fill func(occupied []int32) error) error {
+	rows, err := ns.client().Query(ns.queries.children[p.kind], ns.queries.args(parentID)...)
+	if err != nil {
+		log.Println("failed to load indices of", p.kind, parentID, err)
+		return err
+	}
+	var occupied []int32
+	for rows.Next() {
+		var index int32
+		if err := rows.Scan(&index); err != nil {
+			rows.Close()
+			return err
+		}
+		occupied = append(occupied, index)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	if len(occupied) == 0 {
+		var id string
+		err := ns.client().QueryRow(ns.queries.exists[p.parentType], ns.queries.args(parentID)...).Scan(&id)
+		if errors.Is(err, sql.ErrNoRows) {
+			return &apperror.UnknownParentError{Kind: p.kind, ID: parentID}
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return fill(occupied)
+}
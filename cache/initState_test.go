@@ -0,0 +1,171 @@
+package cache
+
+import (
+	"cacheServer/apperror"
+	"database/sql"
+	"errors"
+	"fmt"
+	"regexp"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInitTracker(t *testing.T) {
+	var loads atomic.Int32
+	release := make(chan struct{})
+	fail := errors.New("db down")
+	var loadErr error
+	tracker := newInitTracker(func() error {
+		loads.Add(1)
+		<-release
+		return loadErr
+	}, nil)
+
+	// concurrent callers share the running load
+	loadErr = fail
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.Equal(t, fail, tracker.ensure())
+		}()
+	}
+	assert.Eventually(t, func() bool { return tracker.current() == stateLoading }, time.Second, time.Millisecond)
+	close(release)
+	wg.Wait()
+	assert.Equal(t, int32(1), loads.Load())
+	assert.Equal(t, stateFailed, tracker.current())
+
+	// failures are not retried before the backoff has elapsed
+	assert.Equal(t, fail, tracker.ensure())
+	assert.Equal(t, int32(1), loads.Load())
+
+	tracker.mu.Lock()
+	tracker.retryAt = time.Now()
+	tracker.mu.Unlock()
+	loadErr = nil
+	assert.NoError(t, tracker.ensure())
+	assert.NoError(t, tracker.ensure())
+	assert.Equal(t, int32(2), loads.Load())
+	assert.Equal(t, stateReady, tracker.current())
+}
+
+func TestBackoff(t *testing.T) {
+	assert.Equal(t, initRetryBackoff, backoff(1))
+	assert.Equal(t, 4*initRetryBackoff, backoff(3))
+	assert.Equal(t, maxInitRetryBackoff, backoff(100))
+}
+
+func TestEmptyIndicesDoNotReinitialize(t *testing.T) {
+	setInitialized(true)
+	s.store.categoryIndices = [255]bool{}
+	s.store.productIndices["emptyProducts"] = NewSortedIndices(nil)
+
+	get, err := s.GetCategoryIndicesCache()
+	assert.NoError(t, err)
+	assert.Nil(t, get)
+	_, err = s.GetMaximumIndexCategory()
+	assert.Equal(t, apperror.ErrNoAvailableIndex, err)
+
+	_, err = s.GetMaximumIndexProduct("emptyProducts")
+	assert.Equal(t, apperror.ErrNoAvailableIndex, err)
+	assert.NoError(t, db.mocksql.ExpectationsWereMet())
+	delete(s.store.productIndices, "emptyProducts")
+}
+
+func TestUnknownParent(t *testing.T) {
+	productChildQuery := `SELECT "index" FROM "products" WHERE "subCategoryID" = $1 ORDER BY "index" ASC;`
+	subcategoryChildQuery := `SELECT "index" FROM "productSubCategory" WHERE "categoryID" = $1 ORDER BY "index" ASC;`
+	cases := map[string]struct {
+		call     func() ([]int, error)
+		prepFunc func()
+		want     []int
+		err      error
+	}{
+		"unknown subcategory returns a typed error instead of panicking": {
+			call: func() ([]int, error) { return s.GetProductIndicesCache("ghost") },
+			prepFunc: func() {
+				db.mocksql.ExpectQuery(regexp.QuoteMeta(productChildQuery)).WithArgs("ghost").
+					WillReturnRows(sqlmock.NewRows([]string{"index"}))
+				db.mocksql.ExpectQuery(regexp.QuoteMeta(`SELECT id FROM "productSubCategory" WHERE id=$1;`)).WithArgs("ghost").
+					WillReturnError(sql.ErrNoRows)
+			},
+			err: &apperror.UnknownParentError{Kind: "subcategory", ID: "ghost"},
+		},
+		"subcategory created by another pod is loaded on its own": {
+			call: func() ([]int, error) { return s.GetProductIndicesCache("newSub") },
+			prepFunc: func() {
+				db.mocksql.ExpectQuery(regexp.QuoteMeta(productChildQuery)).WithArgs("newSub").
+					WillReturnRows(sqlmock.NewRows([]string{"index"}).AddRow(1).AddRow(3))
+			},
+			want: []int{2, 4},
+		},
+		"category without subcategories starts at index 1": {
+			call: func() ([]int, error) { return s.GetSubcategoryIndicesCache("emptyCat") },
+			prepFunc: func() {
+				db.mocksql.ExpectQuery(regexp.QuoteMeta(subcategoryChildQuery)).WithArgs("emptyCat").
+					WillReturnRows(sqlmock.NewRows([]string{"index"}))
+				db.mocksql.ExpectQuery(regexp.QuoteMeta(`SELECT id FROM "productCategory" WHERE id=$1;`)).WithArgs("emptyCat").
+					WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("emptyCat"))
+			},
+			want: []int{1},
+		},
+		"database error while loading a parent": {
+			call: func() ([]int, error) { return s.GetSubcategoryIndicesCache("brokenCat") },
+			prepFunc: func() {
+				db.mocksql.ExpectQuery(regexp.QuoteMeta(subcategoryChildQuery)).WithArgs("brokenCat").
+					WillReturnError(errors.New("error"))
+			},
+			err: apperror.ErrCacheNotInitialized,
+		},
+	}
+
+	for k, v := range cases {
+		t.Run(k, func(t *testing.T) {
+			setInitialized(true)
+			v.prepFunc()
+			get, err := v.call()
+			assert.Equal(t, v.err, err)
+			assert.Equal(t, v.want, get)
+
+			// a failed parent is not reloaded before its backoff has elapsed, an unknown one is not kept
+			_, unknown := v.err.(*apperror.UnknownParentError)
+			if unknown {
+				v.prepFunc()
+			}
+			get, err = v.call()
+			assert.Equal(t, v.err, err)
+			assert.Equal(t, v.want, get)
+			if unknown {
+				v.prepFunc()
+				assert.ErrorIs(t, s.UpdateProductCacheIndex(1, "ghost"), apperror.ErrUnknownParent)
+			}
+			assert.NoError(t, db.mocksql.ExpectationsWereMet())
+		})
+	}
+	delete(s.store.productIndices, "newSub")
+	delete(s.store.subcategoryIndices, "emptyCat")
+	setInitialized(true)
+}
+
+func TestUnknownParentsAreNotKept(t *testing.T) {
+	srv := newSQLiteServer(t)
+	for i := 0; i < 50; i++ {
+		id := fmt.Sprintf("ghost%d", i)
+		_, err := srv.GetProductIndicesCache(id)
+		assert.ErrorIs(t, err, apperror.ErrUnknownParent)
+		_, err = srv.GetSubcategoryIndicesCache(id)
+		assert.ErrorIs(t, err, apperror.ErrUnknownParent)
+	}
+
+	srv.initMu.Lock()
+	defer srv.initMu.Unlock()
+	assert.Empty(t, srv.productParents)
+	assert.Empty(t, srv.subcategoryParents)
+}
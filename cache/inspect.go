@@ -0,0 +1,220 @@
+package cache
+
+import (
+	"cacheServer/apperror"
+	"cacheServer/typedcache"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Inspector : admin access to the entries and indices held by one namespace of this pod
+type Inspector interface {
+	Entries(t Type, prefix, after string, limit int) (EntryPage, error)
+	Entry(t Type, key string) (EntryInfo, error)
+	Evict(prefix string, types ...Type) int
+	IndexState(family Type, parent string) (IndexState, error)
+	Reinitialize(family Type) error
+}
+
+// EntryInfo : a cached entry and its metadata
+type EntryInfo struct {
+	Type     Type      `json:"type"`
+	Key      string    `json:"key"`
+	Value    string    `json:"value"`
+	Source   string    `json:"source"` // load or set, see typedcache.SourceLoad
+	StoredAt time.Time `json:"storedAt"`
+	Age      string    `json:"age"`
+	TTL      string    `json:"ttl,omitempty"` // left until the entry expires, empty without expiry
+	Hits     uint64    `json:"hits"`
+	Expired  bool      `json:"expired"` // served stale or kept as a fallback
+}
+
+// EntryPage : entries of one Type ordered by key, Next is the after of the following page
+type EntryPage struct {
+	Entries []EntryInfo `json:"entries"`
+	Total   int         `json:"total"` // entries matching the prefix
+	Next    string      `json:"next,omitempty"`
+}
+
+// IndexState : the available indices of a family, or of one parent within it, as held in memory
+type IndexState struct {
+	Family    Type   `json:"family"`
+	Parent    string `json:"parent,omitempty"`
+	State     string `json:"state"`  // of the family: uninitialized, loading, ready or failed
+	Loaded    bool   `json:"loaded"` // the indices are held, otherwise they are read on first use
+	Available []int  `json:"available"`
+}
+
+// Inspect : returns the admin view of the namespace of tenant, the default namespace for ""
+func (s *Server) Inspect(tenant string) (Inspector, error) {
+	ns, err := s.lookupNamespace(tenant)
+	if err != nil {
+		return nil, err
+	}
+	return ns, nil
+}
+
+// Entries : returns up to limit entries of t whose key starts with prefix, from the first key after after
+func (ns *namespace) Entries(t Type, prefix, after string, limit int) (EntryPage, error) {
+	c, ok := ns.store.data[t]
+	if !ok {
+		return EntryPage{}, fmt.Errorf("%w: no entries of type %s", apperror.ErrInvalidRequest, t)
+	}
+	now := time.Now()
+	var matching []EntryInfo
+	for _, e := range c.Entries() {
+		if strings.HasPrefix(e.Key, prefix) {
+			matching = append(matching, entryInfo(t, e, now))
+		}
+	}
+	sort.Slice(matching, func(i, j int) bool { return matching[i].Key < matching[j].Key })
+	page := EntryPage{Entries: []EntryInfo{}, Total: len(matching)}
+	start := sort.Search(len(matching), func(i int) bool { return matching[i].Key > after })
+	for _, e := range matching[start:] {
+		if limit > 0 && len(page.Entries) == limit {
+			page.Next = page.Entries[len(page.Entries)-1].Key
+			break
+		}
+		page.Entries = append(page.Entries, e)
+	}
+	return page, nil
+}
+
+// Entry : returns the entry of key, ErrNotFound if it is not cached
+func (ns *namespace) Entry(t Type, key string) (EntryInfo, error) {
+	c, ok := ns.store.data[t]
+	if !ok {
+		return EntryInfo{}, fmt.Errorf("%w: no entries of type %s", apperror.ErrInvalidRequest, t)
+	}
+	e, ok := c.Inspect(key)
+	if !ok {
+		return EntryInfo{}, fmt.Errorf("%w: %s %q is not cached", apperror.ErrNotFound, t, key)
+	}
+	return entryInfo(t, e, time.Now()), nil
+}
+
+// Evict : drops the entries whose key starts with prefix, of types or of every Type, and returns how many
+func (ns *namespace) Evict(prefix string, types ...Type) int {
+	if len(types) == 0 {
+		for t := range ns.store.data {
+			types = append(types, t)
+		}
+	}
+	evicted := 0
+	for _, t := range types {
+		c, ok := ns.store.data[t]
+		if !ok {
+			continue
+		}
+		removed := c.DeleteFunc(func(key string) bool { return strings.HasPrefix(key, prefix) })
+		for _, id := range removed {
+			if t == Role && ns.server.roleSets != nil {
+				ns.server.roleSets.Delete(id)
+			}
+			ns.publish(Event{Kind: EntryDeleted, Type: t, ID: id})
+		}
+		evicted += len(removed)
+	}
+	return evicted
+}
+
+// IndexState : returns the indices held for family, parent being the category of subcategory indices and
+// the subcategory of product indices. Nothing is loaded.
+func (ns *namespace) IndexState(family Type, parent string) (IndexState, error) {
+	if (family == Subcategory || family == Product) && parent == "" {
+		return IndexState{}, fmt.Errorf("%w: %s indices need a parent", apperror.ErrInvalidRequest, family)
+	}
+	st := IndexState{Family: family, Parent: parent, Available: []int{}}
+	ns.store.RLock()
+	defer ns.store.RUnlock()
+	switch family {
+	case Category:
+		st.Parent = ""
+		st.State = ns.categoryInit.current().String()
+		st.Loaded = st.State == stateReady.String()
+		if st.Loaded {
+			st.Available = availableIndices(ns.store.categoryIndices)
+		}
+	case Subcategory:
+		st.State = ns.subcategoryInit.current().String()
+		indices, ok := ns.store.subcategoryIndices[parent]
+		st.Loaded = ok
+		if ok {
+			st.Available = availableIndices(indices)
+		}
+	case Product:
+		st.State = ns.productInit.current().String()
+		indices, ok := ns.store.productIndices[parent]
+		st.Loaded = ok
+		if ok {
+			st.Available = indices.Slice()
+		}
+	default:
+		return IndexState{}, fmt.Errorf("%w: %s has no indices", apperror.ErrInvalidRequest, family)
+	}
+	return st, nil
+}
+
+// Reinitialize : drops the indices of family and reads them from the database again. Index changes of
+// the namespace wait for it and no snapshot of the journal sees it half done, the journal is snapshotted
+// before the changes resume.
+func (ns *namespace) Reinitialize(family Type) error {
+	ns.reinitMu.Lock()
+	defer ns.reinitMu.Unlock()
+	j := ns.server.journal.Load()
+	if j != nil {
+		j.snapshotMu.Lock()
+		defer j.snapshotMu.Unlock()
+	}
+	var tracker *initTracker
+	ns.initMu.Lock()
+	ns.store.Lock()
+	switch family {
+	case Category:
+		tracker = ns.categoryInit
+	case Subcategory:
+		tracker = ns.subcategoryInit
+		ns.store.subcategoryIndices = make(map[string][255]bool)
+		// cleared in place, ensureParent is handed the map without holding initMu
+		clear(ns.subcategoryParents)
+	case Product:
+		tracker = ns.productInit
+		ns.store.productIndices = make(map[string]*SortedIndices)
+		clear(ns.productParents)
+	}
+	ns.store.Unlock()
+	ns.initMu.Unlock()
+	if tracker == nil {
+		return fmt.Errorf("%w: %s has no indices", apperror.ErrInvalidRequest, family)
+	}
+	tracker.reset()
+	if err := tracker.ensure(); err != nil {
+		return fmt.Errorf("%w: %v", apperror.ErrCacheNotInitialized, err)
+	}
+	log.Println(family, "indices reinitialized")
+	if j != nil {
+		// the journal is based on a snapshot of the new indices, not on the dropped ones
+		return j.snapshotLocked()
+	}
+	return nil
+}
+
+func entryInfo(t Type, e typedcache.EntryInfo[string, string], now time.Time) EntryInfo {
+	info := EntryInfo{
+		Type:     t,
+		Key:      e.Key,
+		Value:    e.Value,
+		Source:   e.Source,
+		StoredAt: e.StoredAt,
+		Age:      now.Sub(e.StoredAt).Round(time.Millisecond).String(),
+		Hits:     e.Hits,
+		Expired:  e.Expired,
+	}
+	if !e.ExpiresAt.IsZero() && !e.Expired {
+		info.TTL = e.ExpiresAt.Sub(now).Round(time.Millisecond).String()
+	}
+	return info
+}
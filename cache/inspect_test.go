@@ -0,0 +1,193 @@
+package cache
+
+import (
+	"cacheServer/appcontext"
+	"cacheServer/apperror"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInspectEntries(t *testing.T) {
+	srv := newSQLiteServer(t)
+	_, err := srv.store.data[Category].Get("c1")
+	assert.NoError(t, err)
+	for _, id := range []string{"p3", "p1", "x1", "p2"} {
+		srv.store.data[Product].Set(id, "true")
+	}
+
+	cases := map[string]struct {
+		t             Type
+		prefix, after string
+		limit         int
+		keys          []string
+		total         int
+		next          string
+	}{
+		"every entry ordered by key": {t: Product, keys: []string{"p1", "p2", "p3", "x1"}, total: 4},
+		"prefix":                     {t: Product, prefix: "p", keys: []string{"p1", "p2", "p3"}, total: 3},
+		"first page":                 {t: Product, prefix: "p", limit: 2, keys: []string{"p1", "p2"}, total: 3, next: "p2"},
+		"last page":                  {t: Product, prefix: "p", after: "p2", limit: 2, keys: []string{"p3"}, total: 3},
+		"no match":                   {t: Role, keys: []string{}},
+	}
+	for k, v := range cases {
+		t.Run(k, func(t *testing.T) {
+			page, err := srv.Entries(v.t, v.prefix, v.after, v.limit)
+			assert.NoError(t, err)
+			keys := []string{}
+			for _, e := range page.Entries {
+				keys = append(keys, e.Key)
+			}
+			assert.Equal(t, v.keys, keys)
+			assert.Equal(t, v.total, page.Total)
+			assert.Equal(t, v.next, page.Next)
+		})
+	}
+
+	entry, err := srv.Entry(Category, "c1")
+	assert.NoError(t, err)
+	assert.Equal(t, "load", entry.Source)
+	assert.Equal(t, Category, entry.Type)
+	assert.Empty(t, entry.TTL, "no TTL configured")
+	entry, err = srv.Entry(Product, "p1")
+	assert.NoError(t, err)
+	assert.Equal(t, EntryInfo{Type: Product, Key: "p1", Value: "true", Source: "set", StoredAt: entry.StoredAt, Age: entry.Age}, entry)
+	_, err = srv.Entry(Product, "p9")
+	assert.ErrorIs(t, err, apperror.ErrNotFound)
+}
+
+func TestEvict(t *testing.T) {
+	fill := func(srv *Server) {
+		for _, id := range []string{"p1", "p2", "x1"} {
+			srv.store.data[Product].Set(id, "true")
+		}
+		srv.store.data[Category].Set("p1", "true")
+	}
+	cases := map[string]struct {
+		prefix string
+		types  []Type
+		want   int
+		left   map[Type]int
+	}{
+		"type":       {types: []Type{Product}, want: 3, left: map[Type]int{Product: 0, Category: 1}},
+		"prefix":     {prefix: "p", types: []Type{Product}, want: 2, left: map[Type]int{Product: 1, Category: 1}},
+		"everything": {want: 4, left: map[Type]int{Product: 0, Category: 0}},
+	}
+	for k, v := range cases {
+		t.Run(k, func(t *testing.T) {
+			srv := newSQLiteServer(t)
+			fill(srv)
+			sub := srv.Events().Subscribe(EventFilter{}, 16)
+			defer sub.Close()
+			assert.Equal(t, v.want, srv.Evict(v.prefix, v.types...))
+			for typ, n := range v.left {
+				assert.Equal(t, n, srv.store.data[typ].Len(), typ.String())
+			}
+			event := <-sub.Events()
+			assert.Equal(t, EntryDeleted, event.Kind)
+		})
+	}
+}
+
+func TestIndexState(t *testing.T) {
+	srv := newSQLiteServer(t)
+	_, err := srv.GetSubcategoryIndicesCache("c1")
+	assert.NoError(t, err)
+
+	cases := map[string]struct {
+		family Type
+		parent string
+		want   IndexState
+		err    error
+	}{
+		"categories": {
+			family: Category,
+			want:   IndexState{Family: Category, State: "ready", Loaded: true, Available: []int{2, 4}},
+		},
+		"subcategories of a category": {
+			family: Subcategory,
+			parent: "c1",
+			want:   IndexState{Family: Subcategory, Parent: "c1", State: "ready", Loaded: true, Available: []int{3}},
+		},
+		"parent not held": {
+			family: Product,
+			parent: "s9",
+			want:   IndexState{Family: Product, Parent: "s9", State: "ready", Available: []int{}},
+		},
+		"parent missing": {family: Product, err: apperror.ErrInvalidRequest},
+		"no indices":     {family: Role, err: apperror.ErrInvalidRequest},
+	}
+	for k, v := range cases {
+		t.Run(k, func(t *testing.T) {
+			st, err := srv.IndexState(v.family, v.parent)
+			if v.err != nil {
+				assert.ErrorIs(t, err, v.err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, v.want, st)
+		})
+	}
+}
+
+func TestReinitialize(t *testing.T) {
+	srv := newSQLiteServer(t)
+	assert.NoError(t, srv.DeleteCategoryIndexCache(2))
+	assert.NoError(t, srv.CreateSubcategoryCache("c7"))
+	assert.NoError(t, srv.UpdateProductCacheIndex(9, "s1"))
+
+	assert.NoError(t, srv.Reinitialize(Category))
+	categories, err := srv.GetCategoryIndicesCache()
+	assert.NoError(t, err)
+	assert.Equal(t, []int{2, 4}, categories)
+
+	assert.NoError(t, srv.Reinitialize(Subcategory))
+	st, err := srv.IndexState(Subcategory, "c7")
+	assert.NoError(t, err)
+	assert.False(t, st.Loaded, "c7 is not in the database")
+
+	assert.NoError(t, srv.Reinitialize(Product))
+	products, err := srv.GetProductIndicesCache("s1")
+	assert.NoError(t, err)
+	assert.Equal(t, []int{2, 4}, products)
+
+	assert.ErrorIs(t, srv.Reinitialize(Role), apperror.ErrInvalidRequest)
+}
+
+func TestReinitializeDuringChanges(t *testing.T) {
+	cfg := appcontext.WALConfig{Dir: t.TempDir(), Fsync: appcontext.WALSyncNever, SnapshotEvery: 7}
+	srv := newSQLiteServer(t)
+	assert.NoError(t, srv.OpenJournal(cfg))
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 10; i < 60; i++ {
+			// a change may find its index dropped by a reinitialization, only the outcome is compared
+			_ = srv.UpdateProductCacheIndex(i, "s1")
+			if i%3 == 0 {
+				_ = srv.DeleteProductCacheIndex("s1", i)
+			}
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 10; i++ {
+			assert.NoError(t, srv.Reinitialize(Product))
+		}
+	}()
+	wg.Wait()
+	live, err := srv.GetProductIndicesCache("s1")
+	assert.NoError(t, err)
+	assert.NoError(t, srv.CloseJournal())
+
+	// the journal holds what the live server ended with, not a mix of dropped and reread indices
+	restarted := newSQLiteServer(t)
+	assert.NoError(t, restarted.OpenJournal(cfg))
+	defer restarted.CloseJournal()
+	recovered, err := restarted.GetProductIndicesCache("s1")
+	assert.NoError(t, err)
+	assert.Equal(t, live, recovered)
+}
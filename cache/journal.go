@@ -0,0 +1,401 @@
+package cache
+
+import (
+	"cacheServer/appcontext"
+	"cacheServer/apperror"
+	"cacheServer/health"
+	"cacheServer/wal"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	journalCheck = "journal"
+	// defaultSnapshotEvery is used when the config leaves SnapshotEvery unset.
+	defaultSnapshotEvery = 10000
+)
+
+// Ops of indexRecord.
+const (
+	opAllocate = "allocate"
+	opRelease  = "release"
+	opReset    = "reset" // the parent was created, only its first index is available
+)
+
+// indexRecord is one index change as written to the journal.
+type indexRecord struct {
+	Op     string `json:"op"`
+	Tenant string `json:"tenant,omitempty"`
+	Type   Type   `json:"type"`
+	Parent string `json:"parent,omitempty"`
+	Index  int    `json:"index,omitempty"`
+}
+
+// indexSnapshot is the index state of every namespace, by tenant.
+type indexSnapshot map[string]*namespaceIndices
+
+// namespaceIndices holds the available indices of the families of a namespace that were loaded, the
+// others are read from the database as usual. Parents held by a family not loaded are kept as well.
+type namespaceIndices struct {
+	Ready         []Type           `json:"ready"`
+	Categories    []int            `json:"categories,omitempty"`
+	Subcategories map[string][]int `json:"subcategories,omitempty"`
+	Products      map[string][]int `json:"products,omitempty"`
+}
+
+// journal writes the index changes to a write-ahead log and snapshots the indices every so many records.
+type journal struct {
+	server *Server
+	log    *wal.Log
+	every  int
+
+	mu           sync.Mutex // orders the changes with their records and the snapshots
+	snapshots    sync.WaitGroup
+	snapshotMu   sync.Mutex // keeps the snapshots in the order of their records
+	since        int        // records since the last snapshot
+	snapshotting bool
+	snapshotAt   time.Time
+	appendErr    error // of the last append, nil once one succeeds again
+	snapshotErr  error
+}
+
+// OpenJournal : recovers the index changes journaled in cfg.Dir and journals every further change. The
+// latest snapshot replaces the indices loaded from the database, the records written after it are
+// replayed on top and a new snapshot compacts the journal. Call it before serving requests.
+func (s *Server) OpenJournal(cfg appcontext.WALConfig) error {
+	l, err := wal.Open(cfg.Dir, wal.Options{
+		Sync:         cfg.Fsync,
+		SyncInterval: time.Duration(cfg.SyncInterval),
+		SegmentSize:  int64(cfg.SegmentSize),
+	})
+	if err != nil {
+		return err
+	}
+	s.waitForInit()
+	if err := s.recoverIndices(l); err != nil {
+		l.Close()
+		return err
+	}
+	j := &journal{server: s, log: l, every: cfg.SnapshotEvery}
+	if j.every <= 0 {
+		j.every = defaultSnapshotEvery
+	}
+	if err := j.snapshot(); err != nil {
+		l.Close()
+		return err
+	}
+	s.journal.Store(j)
+	s.health.AddReadiness(journalCheck, health.CheckerFunc(j.check))
+	return nil
+}
+
+// CloseJournal : flushes the journal and stops journaling, index changes are kept in memory only afterwards
+func (s *Server) CloseJournal() error {
+	j := s.journal.Swap(nil)
+	if j == nil {
+		return nil
+	}
+	j.snapshots.Wait()
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.log.Close()
+}
+
+// recoverIndices restores the latest snapshot of l and replays the records after it.
+func (s *Server) recoverIndices(l *wal.Log) error {
+	seq, data, err := l.LoadSnapshot()
+	if err != nil {
+		return err
+	}
+	if data != nil {
+		var snap indexSnapshot
+		if err := json.Unmarshal(data, &snap); err != nil {
+			return fmt.Errorf("journal: snapshot %d: %w", seq, err)
+		}
+		for tenant, indices := range snap {
+			ns, err := s.lookupNamespace(tenant)
+			if err != nil {
+				return fmt.Errorf("journal: snapshot %d: %w", seq, err)
+			}
+			ns.restoreIndices(indices)
+		}
+	}
+	replayed := 0
+	err = l.Replay(func(seq uint64, data []byte) error {
+		var rec indexRecord
+		if err := json.Unmarshal(data, &rec); err != nil {
+			return fmt.Errorf("journal: record %d: %w", seq, err)
+		}
+		ns, err := s.lookupNamespace(rec.Tenant)
+		if err != nil {
+			return fmt.Errorf("journal: record %d: %w", seq, err)
+		}
+		if err := ns.replay(rec); err != nil {
+			return fmt.Errorf("journal: record %d: %w", seq, err)
+		}
+		replayed++
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	log.Println("index journal recovered,", replayed, "changes replayed after snapshot", seq)
+	return nil
+}
+
+// journaled makes the index change of rec and writes it to the journal, if any.
+func (ns *namespace) journaled(rec indexRecord) {
+	j := ns.server.journal.Load()
+	if j == nil {
+		ns.apply(rec)
+		return
+	}
+	rec.Tenant = ns.name
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	ns.apply(rec)
+	j.append(rec)
+}
+
+// apply makes the index change of rec in the store.
+func (ns *namespace) apply(rec indexRecord) {
+	ns.store.Lock()
+	defer ns.store.Unlock()
+	available := rec.Op == opRelease
+	switch rec.Type {
+	case Category:
+		ns.store.categoryIndices[rec.Index] = available
+	case Subcategory:
+		var res [255]bool
+		if rec.Op == opReset {
+			res[1] = true
+		} else {
+			res = ns.store.subcategoryIndices[rec.Parent]
+			res[rec.Index] = available
+		}
+		ns.store.subcategoryIndices[rec.Parent] = res
+	case Product:
+		if rec.Op == opReset {
+			ns.store.productIndices[rec.Parent] = NewSortedIndices([]int{1})
+			return
+		}
+		p := ns.store.productIndices[rec.Parent]
+		if p == nil {
+			return
+		}
+		if available {
+			p.Insert(rec.Index)
+		} else {
+			p.Delete(rec.Index)
+		}
+	}
+}
+
+// replay makes the index change of a journaled rec, loading the indices it changes first. A record of a
+// parent no longer in the database is skipped.
+func (ns *namespace) replay(rec indexRecord) error {
+	if rec.Op != opReset {
+		if err := checkIndex(rec.Type, rec.Index); err != nil {
+			return err
+		}
+		var err error
+		switch rec.Type {
+		case Category:
+			err = ns.categoryInit.ensure()
+		case Subcategory:
+			err = ns.ensureSubcategoryParent(rec.Parent)
+		case Product:
+			err = ns.ensureProductParent(rec.Parent)
+		}
+		var unknown *apperror.UnknownParentError
+		if errors.As(err, &unknown) {
+			log.Println("journal: skipping", rec.Op, rec.Type, "index", rec.Index, err)
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+	ns.apply(rec)
+	return nil
+}
+
+// captureIndices returns the available indices of the loaded families of the namespace, and those of the
+// parents held by a family not loaded yet, such as a parent created before its family was first used.
+func (ns *namespace) captureIndices() *namespaceIndices {
+	out := &namespaceIndices{Ready: []Type{}}
+	ns.store.RLock()
+	defer ns.store.RUnlock()
+	if ns.categoryInit.current() == stateReady {
+		out.Ready = append(out.Ready, Category)
+		out.Categories = availableIndices(ns.store.categoryIndices)
+	}
+	if ns.subcategoryInit.current() == stateReady {
+		out.Ready = append(out.Ready, Subcategory)
+	}
+	if len(ns.store.subcategoryIndices) > 0 {
+		out.Subcategories = make(map[string][]int, len(ns.store.subcategoryIndices))
+		for parent, indices := range ns.store.subcategoryIndices {
+			out.Subcategories[parent] = availableIndices(indices)
+		}
+	}
+	if ns.productInit.current() == stateReady {
+		out.Ready = append(out.Ready, Product)
+	}
+	if len(ns.store.productIndices) > 0 {
+		out.Products = make(map[string][]int, len(ns.store.productIndices))
+		for parent, indices := range ns.store.productIndices {
+			out.Products[parent] = indices.Slice()
+		}
+	}
+	return out
+}
+
+// restoreIndices replaces the families of the namespace loaded in in and marks them loaded, the parents
+// of the other families are added to those held.
+func (ns *namespace) restoreIndices(in *namespaceIndices) {
+	ready := make(map[Type]bool, len(in.Ready))
+	for _, family := range in.Ready {
+		ready[family] = true
+	}
+	ns.store.Lock()
+	if ready[Category] {
+		ns.store.categoryIndices = indexArray(in.Categories)
+	}
+	if ready[Subcategory] {
+		ns.store.subcategoryIndices = make(map[string][255]bool, len(in.Subcategories))
+	}
+	for parent, indices := range in.Subcategories {
+		ns.store.subcategoryIndices[parent] = indexArray(indices)
+	}
+	if ready[Product] {
+		ns.store.productIndices = make(map[string]*SortedIndices, len(in.Products))
+	}
+	for parent, indices := range in.Products {
+		ns.store.productIndices[parent] = NewSortedIndices(indices)
+	}
+	ns.store.Unlock()
+	for _, family := range in.Ready {
+		switch family {
+		case Category:
+			ns.categoryInit.markReady()
+		case Subcategory:
+			ns.subcategoryInit.markReady()
+		case Product:
+			ns.productInit.markReady()
+		}
+	}
+}
+
+// append writes rec and starts a snapshot once enough records followed the last one, the caller holds mu.
+func (j *journal) append(rec indexRecord) {
+	data, err := json.Marshal(rec)
+	if err == nil {
+		_, err = j.log.Append(data)
+	}
+	j.appendErr = err
+	if err != nil {
+		log.Println("journal: failed to write", rec.Op, rec.Type, "index", rec.Index, err)
+		return
+	}
+	j.since++
+	if j.since >= j.every && !j.snapshotting {
+		j.snapshotting = true
+		j.snapshots.Add(1)
+		go func() {
+			defer j.snapshots.Done()
+			j.snapshot()
+		}()
+	}
+}
+
+// snapshot writes the indices of every namespace as of the last record, the journal before it is compacted.
+func (j *journal) snapshot() error {
+	j.snapshotMu.Lock()
+	defer j.snapshotMu.Unlock()
+	return j.snapshotLocked()
+}
+
+// snapshotLocked is snapshot for a caller holding snapshotMu.
+func (j *journal) snapshotLocked() error {
+	j.mu.Lock()
+	snap := indexSnapshot{globalTenant: j.server.namespace.captureIndices()}
+	j.server.nsMu.Lock()
+	for tenant, ns := range j.server.namespaces {
+		snap[tenant] = ns.captureIndices()
+	}
+	j.server.nsMu.Unlock()
+	seq := j.log.Last()
+	j.since = 0
+	j.mu.Unlock()
+
+	data, err := json.Marshal(snap)
+	if err == nil {
+		err = j.log.Snapshot(seq, data)
+	}
+	if err != nil {
+		log.Println("journal: snapshot failed", err)
+	}
+	j.mu.Lock()
+	j.snapshotting = false
+	j.snapshotErr = err
+	if err == nil {
+		j.snapshotAt = time.Now()
+	}
+	j.mu.Unlock()
+	return err
+}
+
+// check reports a journal that failed to write, index changes made since are lost on a restart.
+func (j *journal) check(ctx context.Context) health.Result {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	data := map[string]interface{}{"recordsSinceSnapshot": j.since, "lastSnapshot": j.snapshotAt}
+	var res health.Result
+	switch {
+	case j.appendErr != nil:
+		res = health.Down("write failed: " + j.appendErr.Error())
+	case j.snapshotErr != nil:
+		res = health.Down("snapshot failed: " + j.snapshotErr.Error())
+	default:
+		res = health.Up("")
+	}
+	res.Data = data
+	return res
+}
+
+// availableIndices returns the indices set in arr, in order.
+func availableIndices(arr [255]bool) []int {
+	indices := []int{}
+	for i, available := range arr {
+		if available {
+			indices = append(indices, i)
+		}
+	}
+	return indices
+}
+
+// checkIndex returns an ErrInvalidRequest for an index outside the category or subcategory index
+// arrays, such as one of a corrupt record or of a bad peer message. Product indices are not bounded.
+func checkIndex(family Type, index int) error {
+	var arr [255]bool
+	if family != Product && (index < 0 || index >= len(arr)) {
+		return fmt.Errorf("%w: %s index %d out of range", apperror.ErrInvalidRequest, family, index)
+	}
+	return nil
+}
+
+func indexArray(indices []int) [255]bool {
+	var arr [255]bool
+	for _, i := range indices {
+		if i >= 0 && i < len(arr) {
+			arr[i] = true
+		}
+	}
+	return arr
+}
@@ -0,0 +1,178 @@
+package cache
+
+import (
+	"cacheServer/appcontext"
+	"cacheServer/apperror"
+	"cacheServer/health"
+	"cacheServer/wal"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// indexState is what a test compares of the indices of a server.
+type indexState struct {
+	categories, c1, s1, s9 []int
+}
+
+func readIndices(t *testing.T, srv *Server) indexState {
+	var st indexState
+	var err error
+	st.categories, err = srv.GetCategoryIndicesCache()
+	assert.NoError(t, err)
+	st.c1, err = srv.GetSubcategoryIndicesCache("c1")
+	assert.NoError(t, err)
+	st.s1, err = srv.GetProductIndicesCache("s1")
+	assert.NoError(t, err)
+	srv.store.RLock()
+	if p := srv.store.productIndices["s9"]; p != nil {
+		st.s9 = p.Slice()
+	}
+	srv.store.RUnlock()
+	return st
+}
+
+// changeIndices makes one index change of every kind, the last one allocates product index 4 of s1.
+func changeIndices(t *testing.T, srv *Server) {
+	assert.NoError(t, srv.DeleteCategoryIndexCache(2))
+	assert.NoError(t, srv.UpdateCategoryIndexCache(9))
+	assert.NoError(t, srv.UpdateSubcategoryIndexCache(7, "c1"))
+	assert.NoError(t, srv.CreateProductCache("s9"))
+	assert.NoError(t, srv.UpdateProductCacheIndex(6, "s9"))
+	assert.NoError(t, srv.DeleteProductCacheIndex("s1", 4))
+}
+
+func TestJournalRecovery(t *testing.T) {
+	fresh := readIndices(t, newSQLiteServer(t))
+	assert.Equal(t, indexState{categories: []int{2, 4}, c1: []int{3}, s1: []int{2, 4}}, fresh)
+	changed := indexState{categories: []int{4, 9}, c1: []int{3, 7}, s1: []int{2}, s9: []int{1, 6}}
+
+	cases := map[string]struct {
+		snapshotEvery int
+		damage        func(t *testing.T, dir string)
+		want          indexState
+	}{
+		"records replayed on the database": {
+			snapshotEvery: 1000,
+			want:          changed,
+		},
+		"records replayed on a snapshot": {
+			snapshotEvery: 4,
+			want:          changed,
+		},
+		"truncated tail": {
+			snapshotEvery: 1000,
+			damage: func(t *testing.T, dir string) {
+				name := lastSegment(t, dir)
+				info, err := os.Stat(name)
+				assert.NoError(t, err)
+				assert.NoError(t, os.Truncate(name, info.Size()-3))
+			},
+			want: indexState{categories: changed.categories, c1: changed.c1, s1: fresh.s1, s9: changed.s9},
+		},
+		"corrupt tail": {
+			snapshotEvery: 1000,
+			damage: func(t *testing.T, dir string) {
+				f, err := os.OpenFile(lastSegment(t, dir), os.O_RDWR, 0)
+				assert.NoError(t, err)
+				info, err := f.Stat()
+				assert.NoError(t, err)
+				f.WriteAt([]byte("}"), info.Size()-2)
+				assert.NoError(t, f.Close())
+			},
+			want: indexState{categories: changed.categories, c1: changed.c1, s1: fresh.s1, s9: changed.s9},
+		},
+	}
+	for k, v := range cases {
+		t.Run(k, func(t *testing.T) {
+			dir := t.TempDir()
+			cfg := appcontext.WALConfig{Dir: dir, Fsync: appcontext.WALSyncAlways, SnapshotEvery: v.snapshotEvery}
+			srv := newSQLiteServer(t)
+			assert.NoError(t, srv.OpenJournal(cfg))
+			changeIndices(t, srv)
+			assert.Equal(t, changed, readIndices(t, srv))
+			assert.NoError(t, srv.CloseJournal())
+			if v.damage != nil {
+				v.damage(t, dir)
+			}
+
+			// a restarted server reads the database as it was, the journal brings the changes back
+			restarted := newSQLiteServer(t)
+			assert.NoError(t, restarted.OpenJournal(cfg))
+			defer restarted.CloseJournal()
+			assert.Equal(t, v.want, readIndices(t, restarted))
+			res := restarted.Health().Ready(context.Background())
+			assert.Equal(t, health.StatusUp, res.Checks[journalCheck].Status)
+
+			// recovering wrote a snapshot, the journal is compacted to one empty segment
+			segments, err := filepath.Glob(filepath.Join(dir, "*.wal"))
+			assert.NoError(t, err)
+			assert.Len(t, segments, 1)
+			info, err := os.Stat(segments[0])
+			assert.NoError(t, err)
+			assert.Zero(t, info.Size())
+		})
+	}
+}
+
+func TestJournalTenants(t *testing.T) {
+	dir := t.TempDir()
+	cfg := appcontext.WALConfig{Dir: dir, Fsync: appcontext.WALSyncNever, SnapshotEvery: 1}
+	srv := newSQLiteServer(t)
+	assert.NoError(t, srv.OpenJournal(cfg))
+	tenant, err := srv.lookupNamespace("acme")
+	assert.NoError(t, err)
+	assert.NoError(t, tenant.CreateSubcategoryCache("c7"))
+	assert.NoError(t, tenant.UpdateSubcategoryIndexCache(5, "c7"))
+	assert.NoError(t, srv.CloseJournal())
+
+	restarted := newSQLiteServer(t)
+	assert.NoError(t, restarted.OpenJournal(cfg))
+	defer restarted.CloseJournal()
+	tenant, err = restarted.lookupNamespace("acme")
+	assert.NoError(t, err)
+	indices, err := tenant.GetSubcategoryIndicesCache("c7")
+	assert.NoError(t, err)
+	assert.Equal(t, []int{1, 5}, indices)
+	_, err = restarted.GetSubcategoryIndicesCache("c7")
+	assert.Error(t, err, "the default namespace does not know c7")
+}
+
+func lastSegment(t *testing.T, dir string) string {
+	segments, err := filepath.Glob(filepath.Join(dir, "*.wal"))
+	assert.NoError(t, err)
+	assert.NotEmpty(t, segments)
+	return segments[len(segments)-1]
+}
+
+func TestIndexBounds(t *testing.T) {
+	srv := newSQLiteServer(t)
+	assert.ErrorIs(t, srv.DeleteCategoryIndexCache(255), apperror.ErrInvalidRequest)
+	assert.ErrorIs(t, srv.UpdateSubcategoryIndexCache(-1, "c1"), apperror.ErrInvalidRequest)
+	assert.NoError(t, srv.UpdateProductCacheIndex(300, "s1"), "product indices are not bounded")
+
+	_, err := srv.client().Exec(`INSERT INTO "productCategory" VALUES ('c8', 5), ('c9', 6);
+		INSERT INTO "productSubCategory" VALUES ('s8', 'c8', 300), ('s9', 'c9', 254);`)
+	assert.NoError(t, err)
+	_, err = srv.GetSubcategoryIndicesCache("c8")
+	assert.Error(t, err, "a row out of range fails the load")
+	indices, err := srv.GetSubcategoryIndicesCache("c9")
+	assert.NoError(t, err)
+	assert.Len(t, indices, 253, "the last index is taken, none follows it")
+
+	// a journal holding a record out of range is refused rather than applied
+	dir := t.TempDir()
+	l, err := wal.Open(dir, wal.Options{Sync: wal.SyncNever})
+	assert.NoError(t, err)
+	data, err := json.Marshal(indexRecord{Op: opAllocate, Type: Category, Index: 1000})
+	assert.NoError(t, err)
+	_, err = l.Append(data)
+	assert.NoError(t, err)
+	assert.NoError(t, l.Close())
+	err = newSQLiteServer(t).OpenJournal(appcontext.WALConfig{Dir: dir, Fsync: appcontext.WALSyncNever})
+	assert.ErrorIs(t, err, apperror.ErrInvalidRequest)
+}
@@ -0,0 +1,143 @@
+package cache
+
+import (
+	"cacheServer/appcontext"
+	"cacheServer/apperror"
+	"database/sql"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"sync"
+)
+
+// lockKey returns the advisory lock key of the family indices of parent, the same on every pod.
+func (ns *namespace) lockKey(family Type, parent string) int64 {
+	h := fnv.New64a()
+	h.Write([]byte(ns.name + "/" + family.String() + "/" + parent))
+	return int64(h.Sum64())
+}
+
+// parentLock returns the mutex ordering the index changes of the family indices of parent on this pod.
+func (ns *namespace) parentLock(key int64) *sync.Mutex {
+	ns.locksMu.Lock()
+	defer ns.locksMu.Unlock()
+	mu, ok := ns.parentLocks[key]
+	if !ok {
+		mu = &sync.Mutex{}
+		ns.parentLocks[key] = mu
+	}
+	return mu
+}
+
+// lockIndices runs claim and then change while no other change of the family indices of parent, and no
+// Reinitialize, runs.
+// With advisory index locks claim runs in a transaction of the primary holding pg_advisory_xact_lock
+// of the parent, released when the transaction ends, and change only once it is committed; tx is nil
+// otherwise. Neither runs if taking the lock fails, change does not run if claim or the commit fails.
+func (ns *namespace) lockIndices(family Type, parent string, claim func(tx *sql.Tx) error, change func()) error {
+	ns.reinitMu.RLock()
+	defer ns.reinitMu.RUnlock()
+	key := ns.lockKey(family, parent)
+	mu := ns.parentLock(key)
+	mu.Lock()
+	defer mu.Unlock()
+	if ns.server.appCtx.IndexLock != appcontext.IndexLockAdvisory {
+		if err := claim(nil); err != nil {
+			return err
+		}
+		change()
+		return nil
+	}
+	tx, err := ns.client().Begin()
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec(ns.queries.indexLock, key); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := claim(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	change()
+	return nil
+}
+
+// claimIndex writes the claim of the family index of parent within the lock of the parent, and reports
+// whether a row of the database or the claim of another pod already holds it. Without a transaction the
+// cached indices are trusted and it is false.
+func (ns *namespace) claimIndex(tx *sql.Tx, family Type, parent string, index int) (bool, error) {
+	if tx == nil {
+		return false, nil
+	}
+	args := []interface{}{parent, index}
+	if family == Category {
+		args = args[1:]
+	}
+	var one int
+	err := tx.QueryRow(ns.queries.indexTaken[family], ns.queries.args(args...)...).Scan(&one)
+	if err == nil {
+		return true, nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return false, err
+	}
+	res, err := tx.Exec(ns.queries.indexClaim, ns.name, family.String(), parent, index)
+	if err != nil {
+		return false, err
+	}
+	claimed, err := res.RowsAffected()
+	return claimed == 0, err
+}
+
+// unclaimIndex drops the claim of the family index of parent within the lock of the parent.
+func (ns *namespace) unclaimIndex(tx *sql.Tx, family Type, parent string, index int) error {
+	if tx == nil {
+		return nil
+	}
+	_, err := tx.Exec(ns.queries.indexUnclaim, ns.name, family.String(), parent, index)
+	return err
+}
+
+// allocate marks the family index of parent taken, within the lock of the parent. An index another pod
+// already holds is dropped from the available indices of this pod, without being journaled, and refused.
+func (ns *namespace) allocate(family Type, parent string, index int) error {
+	if err := checkIndex(family, index); err != nil {
+		return err
+	}
+	rec := indexRecord{Op: opAllocate, Type: family, Parent: parent, Index: index}
+	taken := false
+	err := ns.lockIndices(family, parent, func(tx *sql.Tx) error {
+		var err error
+		taken, err = ns.claimIndex(tx, family, parent, index)
+		return err
+	}, func() {
+		if taken {
+			ns.apply(rec)
+			return
+		}
+		ns.journaled(rec)
+		ns.publish(Event{Kind: IndexAllocated, Type: family, Parent: parent, Index: index})
+	})
+	if err == nil && taken {
+		err = fmt.Errorf("%w: %s %d of %q", apperror.ErrIndexTaken, family, index, parent)
+	}
+	return err
+}
+
+// release marks the family index of parent available, within the lock of the parent.
+func (ns *namespace) release(family Type, parent string, index int) error {
+	if err := checkIndex(family, index); err != nil {
+		return err
+	}
+	return ns.lockIndices(family, parent, func(tx *sql.Tx) error {
+		return ns.unclaimIndex(tx, family, parent, index)
+	}, func() {
+		ns.journaled(indexRecord{Op: opRelease, Type: family, Parent: parent, Index: index})
+		ns.publish(Event{Kind: IndexReleased, Type: family, Parent: parent, Index: index})
+	})
+}
@@ -0,0 +1,203 @@
+package cache
+
+import (
+	"cacheServer/appcontext"
+	"cacheServer/apperror"
+	"errors"
+	"regexp"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+)
+
+// newLockedServer returns a server with advisory index locks whose subcategory s1 has the product
+// indices 3 and 4 available and category index 2 available.
+func newLockedServer(t *testing.T) (*Server, sqlmock.Sqlmock) {
+	mockDB, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	t.Cleanup(func() { mockDB.Close() })
+	ctx := appcontext.NewContext(mockDB, 1)
+	ctx.IndexLock = appcontext.IndexLockAdvisory
+	srv := NewServer(ctx)
+	srv.waitForInit() // the loads fail, nothing is expected yet
+	for _, tracker := range []*initTracker{srv.categoryInit, srv.subcategoryInit, srv.productInit} {
+		tracker.markReady()
+	}
+	srv.store.Lock()
+	srv.store.categoryIndices[2] = true
+	srv.store.productIndices["s1"] = NewSortedIndices([]int{3, 4})
+	srv.store.Unlock()
+	return srv, mock
+}
+
+func TestAdvisoryIndexLocks(t *testing.T) {
+	lock := regexp.QuoteMeta(`SELECT pg_advisory_xact_lock($1);`)
+	productTaken := regexp.QuoteMeta(`SELECT 1 FROM "products" WHERE "subCategoryID" = $1 AND "index" = $2;`)
+	categoryTaken := regexp.QuoteMeta(`SELECT 1 FROM "productCategory" WHERE "index" = $1;`)
+	claim := regexp.QuoteMeta(`INSERT INTO "indexClaims" ("tenant", "family", "parent", "index") VALUES ($1, $2, $3, $4) ON CONFLICT DO NOTHING;`)
+	unclaim := regexp.QuoteMeta(`DELETE FROM "indexClaims" WHERE "tenant" = $1 AND "family" = $2 AND "parent" = $3 AND "index" = $4;`)
+
+	cases := map[string]struct {
+		expect   func(srv *Server, mock sqlmock.Sqlmock)
+		call     func(srv *Server) error
+		err      error
+		products []int
+		events   []EventKind // published by the call
+	}{
+		"allocating a free index": {
+			expect: func(srv *Server, mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectExec(lock).WithArgs(srv.lockKey(Product, "s1")).WillReturnResult(sqlmock.NewResult(0, 0))
+				mock.ExpectQuery(productTaken).WithArgs("s1", 4).WillReturnRows(sqlmock.NewRows([]string{"?column?"}))
+				mock.ExpectExec(claim).WithArgs("", "Product", "s1", 4).WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectCommit()
+			},
+			call:     func(srv *Server) error { return srv.DeleteProductCacheIndex("s1", 4) },
+			products: []int{3},
+			events:   []EventKind{IndexAllocated},
+		},
+		"index another pod wrote is refused and dropped": {
+			expect: func(srv *Server, mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectExec(lock).WithArgs(srv.lockKey(Product, "s1")).WillReturnResult(sqlmock.NewResult(0, 0))
+				mock.ExpectQuery(productTaken).WithArgs("s1", 4).WillReturnRows(sqlmock.NewRows([]string{"?column?"}).AddRow(1))
+				mock.ExpectCommit()
+			},
+			call:     func(srv *Server) error { return srv.DeleteProductCacheIndex("s1", 4) },
+			err:      apperror.ErrIndexTaken,
+			products: []int{3},
+		},
+		"index another pod claimed is refused and dropped": {
+			expect: func(srv *Server, mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectExec(lock).WithArgs(srv.lockKey(Product, "s1")).WillReturnResult(sqlmock.NewResult(0, 0))
+				mock.ExpectQuery(productTaken).WithArgs("s1", 4).WillReturnRows(sqlmock.NewRows([]string{"?column?"}))
+				mock.ExpectExec(claim).WithArgs("", "Product", "s1", 4).WillReturnResult(sqlmock.NewResult(0, 0))
+				mock.ExpectCommit()
+			},
+			call:     func(srv *Server) error { return srv.DeleteProductCacheIndex("s1", 4) },
+			err:      apperror.ErrIndexTaken,
+			products: []int{3},
+		},
+		"failed commit leaves the indices alone": {
+			expect: func(srv *Server, mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectExec(lock).WithArgs(srv.lockKey(Product, "s1")).WillReturnResult(sqlmock.NewResult(0, 0))
+				mock.ExpectQuery(productTaken).WithArgs("s1", 4).WillReturnRows(sqlmock.NewRows([]string{"?column?"}))
+				mock.ExpectExec(claim).WithArgs("", "Product", "s1", 4).WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectCommit().WillReturnError(errors.New("connection reset"))
+			},
+			call:     func(srv *Server) error { return srv.DeleteProductCacheIndex("s1", 4) },
+			err:      errors.New("connection reset"),
+			products: []int{3, 4},
+		},
+		"releasing drops the claim": {
+			expect: func(srv *Server, mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectExec(lock).WithArgs(srv.lockKey(Product, "s1")).WillReturnResult(sqlmock.NewResult(0, 0))
+				mock.ExpectExec(unclaim).WithArgs("", "Product", "s1", 7).WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectCommit()
+			},
+			call:     func(srv *Server) error { return srv.UpdateProductCacheIndex(7, "s1") },
+			products: []int{3, 4, 7},
+			events:   []EventKind{IndexReleased},
+		},
+		"lock not taken leaves the indices alone": {
+			expect: func(srv *Server, mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectExec(lock).WillReturnError(errors.New("canceling statement due to lock timeout"))
+				mock.ExpectRollback()
+			},
+			call:     func(srv *Server) error { return srv.DeleteProductCacheIndex("s1", 4) },
+			err:      errors.New("canceling statement due to lock timeout"),
+			products: []int{3, 4},
+		},
+		"category indices share one lock": {
+			expect: func(srv *Server, mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectExec(lock).WithArgs(srv.lockKey(Category, "")).WillReturnResult(sqlmock.NewResult(0, 0))
+				mock.ExpectQuery(categoryTaken).WithArgs(2).WillReturnRows(sqlmock.NewRows([]string{"?column?"}))
+				mock.ExpectExec(claim).WithArgs("", "Category", "", 2).WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectCommit()
+			},
+			call:     func(srv *Server) error { return srv.DeleteCategoryIndexCache(2) },
+			products: []int{3, 4},
+			events:   []EventKind{IndexAllocated},
+		},
+	}
+	for k, v := range cases {
+		t.Run(k, func(t *testing.T) {
+			srv, mock := newLockedServer(t)
+			v.expect(srv, mock)
+			sub := srv.Events().Subscribe(EventFilter{}, 4)
+			defer sub.Close()
+			err := v.call(srv)
+			switch {
+			case v.err == nil:
+				assert.NoError(t, err)
+			case errors.Is(v.err, apperror.ErrIndexTaken):
+				assert.ErrorIs(t, err, v.err)
+			default:
+				assert.EqualError(t, err, v.err.Error())
+			}
+			assert.NoError(t, mock.ExpectationsWereMet())
+			products, err := srv.GetProductIndicesCache("s1")
+			assert.NoError(t, err)
+			assert.Equal(t, v.products, products)
+			var events []EventKind
+			for len(sub.Events()) > 0 {
+				events = append(events, (<-sub.Events()).Kind)
+			}
+			assert.Equal(t, v.events, events)
+		})
+	}
+}
+
+func TestConcurrentAllocations(t *testing.T) {
+	productTaken := regexp.QuoteMeta(`SELECT 1 FROM "products" WHERE "subCategoryID" = $1 AND "index" = $2;`)
+	claim := regexp.QuoteMeta(`INSERT INTO "indexClaims"`)
+	srv, mock := newLockedServer(t)
+	// whichever call takes the lock first claims the index, the other finds the claim
+	for _, claimed := range []int64{1, 0} {
+		mock.ExpectBegin()
+		mock.ExpectExec(`pg_advisory_xact_lock`).WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectQuery(productTaken).WithArgs("s1", 4).WillReturnRows(sqlmock.NewRows([]string{"?column?"}))
+		mock.ExpectExec(claim).WithArgs("", "Product", "s1", 4).WillReturnResult(sqlmock.NewResult(0, claimed))
+		mock.ExpectCommit()
+	}
+
+	errs := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() { errs <- srv.DeleteProductCacheIndex("s1", 4) }()
+	}
+	succeeded, refused := 0, 0
+	for i := 0; i < 2; i++ {
+		err := <-errs
+		switch {
+		case err == nil:
+			succeeded++
+		case errors.Is(err, apperror.ErrIndexTaken):
+			refused++
+		default:
+			t.Fatal(err)
+		}
+	}
+	assert.Equal(t, 1, succeeded)
+	assert.Equal(t, 1, refused)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestLockKeys(t *testing.T) {
+	srv, _ := newLockedServer(t)
+	tenant, err := srv.lookupNamespace("t1")
+	assert.NoError(t, err)
+	keys := map[int64]bool{
+		srv.lockKey(Product, "s1"):     true,
+		srv.lockKey(Product, "s2"):     true,
+		srv.lockKey(Subcategory, "s1"): true,
+		tenant.lockKey(Product, "s1"):  true,
+	}
+	assert.Len(t, keys, 4, "parents, families and tenants lock apart")
+	assert.Equal(t, srv.lockKey(Product, "s1"), srv.lockKey(Product, "s1"))
+}
@@ -0,0 +1,45 @@
+package cache
+
+import (
+	database "cacheServer/db"
+	"cacheServer/typedcache"
+)
+
+// Metrics : point in time counters of the typed caches, the request queue and the database client
+type Metrics struct {
+	Caches     map[Type]typedcache.Stats   `json:"caches"`               // default namespace
+	Namespaces map[string]NamespaceMetrics `json:"namespaces,omitempty"` // tenant vs the metrics of its namespace
+	RoleSets   *typedcache.Stats           `json:"roleSets,omitempty"`   // set when users have several roles
+	Queue      QueueStats                  `json:"queue"`
+	Events     EventStats                  `json:"events"`
+	Database   map[string]interface{}      `json:"database,omitempty"` // e.g. breaker and replica state
+}
+
+// NamespaceMetrics : counters of the typed caches of one tenant and the quota they are held to
+type NamespaceMetrics struct {
+	Caches     map[Type]typedcache.Stats `json:"caches"`
+	MaxEntries int                       `json:"maxEntries"` // entries kept per cache, zero when unbounded
+}
+
+// Metrics : returns the current metrics of the server
+func (s *Server) Metrics() Metrics {
+	m := Metrics{
+		Caches:   s.Stats(),
+		Queue:    s.QueueStats(),
+		Events:   s.events.Stats(),
+		Database: database.Report(s.appCtx.DatabaseClient),
+	}
+	if s.roleSets != nil {
+		stats := s.roleSets.Stats()
+		m.RoleSets = &stats
+	}
+	s.nsMu.Lock()
+	defer s.nsMu.Unlock()
+	if len(s.namespaces) > 0 {
+		m.Namespaces = make(map[string]NamespaceMetrics, len(s.namespaces))
+	}
+	for tenant, ns := range s.namespaces {
+		m.Namespaces[tenant] = NamespaceMetrics{Caches: ns.Stats(), MaxEntries: s.namespaceOptions(tenant).MaxEntries}
+	}
+	return m
+}
@@ -0,0 +1,133 @@
+package cache
+
+import (
+	"cacheServer/appcontext"
+	"cacheServer/apperror"
+	database "cacheServer/db"
+	"cacheServer/health"
+	"cacheServer/typedcache"
+	"fmt"
+	"log"
+	"sync"
+)
+
+// namespace holds the cache entries and index spaces of one tenant. Tenant namespaces read only the rows
+// of their tenant and keep their own typed caches, quota and metrics; the default namespace is unscoped.
+type namespace struct {
+	name    string
+	server  *Server
+	store   Store
+	queries *queries // SQL scoped to the tenant
+
+	categoryInit       *initTracker
+	subcategoryInit    *initTracker
+	productInit        *initTracker
+	initMu             sync.Mutex              // guards the per-parent trackers
+	subcategoryParents map[string]*initTracker // categoryID vs load of its subcategory indices
+	productParents     map[string]*initTracker // subcategoryID vs load of its product indices
+	reinitMu           sync.RWMutex            // held by Reinitialize, shared by the index changes
+	locksMu            sync.Mutex              // guards parentLocks
+	parentLocks        map[int64]*sync.Mutex   // lock key vs the index changes of a parent on this pod
+}
+
+// newNamespace returns the namespace of tenant, its indices are loaded on first use. The caller holds
+// nsMu unless the server is being created.
+func (s *Server) newNamespace(tenant string) *namespace {
+	ns := &namespace{
+		name:               tenant,
+		server:             s,
+		store:              newStore(),
+		subcategoryParents: make(map[string]*initTracker),
+		productParents:     make(map[string]*initTracker),
+		parentLocks:        make(map[int64]*sync.Mutex),
+	}
+	if tenant == globalTenant {
+		ns.queries = newQueries(s.appCtx.Dialect)
+	} else {
+		column := s.tenants.Column
+		if column == "" {
+			column = appcontext.DefaultTenantColumn
+		}
+		ns.queries = newTenantQueries(s.appCtx.Dialect, column, tenant)
+	}
+	ns.categoryInit = newInitTracker(ns.initializeCategoryCache, health.NewPhase())
+	ns.subcategoryInit = newInitTracker(ns.initializeSubcategoryCache, health.NewPhase())
+	ns.productInit = newInitTracker(ns.initializeProductCache, health.NewPhase())
+	opts := s.namespaceOptions(tenant)
+	ns.store.data = map[Type]*typedcache.Cache[string, string]{
+		Role:        ns.newEntityCache(Role, opts),        // Cache of role id vs role
+		Category:    ns.newEntityCache(Category, opts),    // Cache of categoryID vs active/passive
+		Subcategory: ns.newEntityCache(Subcategory, opts), // Cache of subcategoryID vs active/passive
+		Product:     ns.newEntityCache(Product, opts),     // Cache of productID vs active/passive
+	}
+	return ns
+}
+
+// namespaceOptions returns the cache options of the namespace of tenant, tenants are held to their quota.
+func (s *Server) namespaceOptions(tenant string) typedcache.Options {
+	opts := s.cacheOpts
+	if tenant != globalTenant && s.tenants.MaxEntries > 0 {
+		opts.MaxEntries = s.tenants.MaxEntries
+	}
+	return opts
+}
+
+// lookupNamespace returns the namespace of tenant, creating it on first use. Tenants outside the
+// configured names, or beyond the maximum number of namespaces, are rejected with ErrUnknownTenant.
+func (s *Server) lookupNamespace(tenant string) (*namespace, error) {
+	if tenant == globalTenant {
+		return s.namespace, nil
+	}
+	s.nsMu.Lock()
+	defer s.nsMu.Unlock()
+	if ns, ok := s.namespaces[tenant]; ok {
+		return ns, nil
+	}
+	if len(s.tenants.Names) > 0 {
+		known := false
+		for _, name := range s.tenants.Names {
+			known = known || name == tenant
+		}
+		if !known {
+			return nil, fmt.Errorf("%w %q", apperror.ErrUnknownTenant, tenant)
+		}
+	} else if s.tenants.Max > 0 && len(s.namespaces) >= s.tenants.Max {
+		return nil, fmt.Errorf("%w %q, %d namespaces in use", apperror.ErrUnknownTenant, tenant, s.tenants.Max)
+	}
+	ns := s.newNamespace(tenant)
+	s.namespaces[tenant] = ns
+	log.Println("namespace of tenant", tenant, "created")
+	return ns, nil
+}
+
+// Tenant : returns the cache entries and index spaces of tenant, the default namespace for ""
+func (s *Server) Tenant(tenant string) (Namespace, error) {
+	ns, err := s.lookupNamespace(tenant)
+	if err != nil {
+		return nil, err
+	}
+	return ns, nil
+}
+
+// newEntityCache returns a cache of t that loads missing ids from the database.
+// While the database circuit breaker is open, ids are answered with their last known value.
+func (ns *namespace) newEntityCache(t Type, opts typedcache.Options) *typedcache.Cache[string, string] {
+	if opts.Fallback == nil {
+		opts.Fallback = isCircuitOpen
+	}
+	c := typedcache.New[string, string](&entityLoader{ns: ns, t: t}, opts)
+	ns.watchStatus(t, c)
+	c.OnStore(func(id string, _ string) { ns.publish(Event{Kind: EntryUpdated, Type: t, ID: id}) })
+	return c
+}
+
+// setOptions applies opts to the typed caches of the namespace.
+func (ns *namespace) setOptions(opts typedcache.Options) {
+	for _, c := range ns.store.data {
+		c.SetOptions(opts)
+	}
+}
+
+func (ns *namespace) client() database.DatabaseClient {
+	return ns.server.appCtx.DatabaseClient
+}
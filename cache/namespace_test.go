@@ -0,0 +1,190 @@
+package cache
+
+import (
+	"cacheServer/appcontext"
+	"cacheServer/apperror"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// tenantSchema assigns the seeded rows to tenant t1 and adds a catalog of tenant t2.
+const tenantSchema = `
+ALTER TABLE "users" ADD COLUMN "tenantID" TEXT;
+ALTER TABLE "productCategory" ADD COLUMN "tenantID" TEXT;
+ALTER TABLE "productSubCategory" ADD COLUMN "tenantID" TEXT;
+ALTER TABLE "products" ADD COLUMN "tenantID" TEXT;
+UPDATE "users" SET "tenantID" = 't1';
+UPDATE "productCategory" SET "tenantID" = 't1';
+UPDATE "productSubCategory" SET "tenantID" = 't1';
+UPDATE "products" SET "tenantID" = 't1';
+INSERT INTO "users" VALUES ('c@x', 'viewer', 't2');
+INSERT INTO "productCategory" VALUES ('c9', 1, 't2');
+INSERT INTO "productSubCategory" VALUES ('s9', 'c9', 1, 't2');
+INSERT INTO "products" VALUES ('p9', 's9', 2, 't2'), ('p8', 's9', 4, 't2');
+`
+
+func newTenantServer(t *testing.T, tenants appcontext.TenantsConfig) *Server {
+	srv := newSQLiteServer(t, func(ctx *appcontext.Context) {
+		ctx.Tenants = tenants
+	})
+	_, err := srv.appCtx.DatabaseClient.Exec(tenantSchema)
+	assert.NoError(t, err)
+	return srv
+}
+
+func TestTenantIndices(t *testing.T) {
+	srv := newTenantServer(t, appcontext.TenantsConfig{Column: "tenantID"})
+	t1, err := srv.Tenant("t1")
+	assert.NoError(t, err)
+	t2, err := srv.Tenant("t2")
+	assert.NoError(t, err)
+
+	cases := map[string]struct {
+		call func() ([]int, error)
+		want []int
+		err  error
+	}{
+		"category indices of t1": {
+			call: t1.GetCategoryIndicesCache,
+			want: []int{2, 4},
+		},
+		"category indices of t2": {
+			call: t2.GetCategoryIndicesCache,
+			want: []int{2},
+		},
+		"product indices of t2": {
+			call: func() ([]int, error) { return t2.GetProductIndicesCache("s9") },
+			want: []int{1, 3, 5},
+		},
+		"subcategory of another tenant": {
+			call: func() ([]int, error) { return t2.GetProductIndicesCache("s1") },
+			err:  &apperror.UnknownParentError{Kind: "subcategory", ID: "s1"},
+		},
+		"category loaded on its own": {
+			call: func() ([]int, error) { return t2.GetSubcategoryIndicesCache("c9") },
+			want: []int{2},
+		},
+	}
+	for k, v := range cases {
+		t.Run(k, func(t *testing.T) {
+			got, err := v.call()
+			assert.Equal(t, v.err, err)
+			assert.Equal(t, v.want, got)
+		})
+	}
+
+	// updates stay within their namespace
+	assert.NoError(t, t2.UpdateCategoryIndexCache(5))
+	got, _ := t2.GetCategoryIndicesCache()
+	assert.Equal(t, []int{2, 5}, got)
+	got, _ = t1.GetCategoryIndicesCache()
+	assert.Equal(t, []int{2, 4}, got)
+	got, _ = srv.GetCategoryIndicesCache()
+	assert.Equal(t, []int{2, 4}, got)
+}
+
+func TestTenantVerification(t *testing.T) {
+	srv := newTenantServer(t, appcontext.TenantsConfig{Column: "tenantID", Names: []string{"t1", "t2"}, MaxEntries: 1})
+	go srv.Run()
+	defer srv.Close()
+
+	cases := map[string]struct {
+		request *Request
+		want    bool
+	}{
+		"product of the tenant":         {request: NewRequest("p9", Product, nil).InTenant("t2"), want: true},
+		"product of another tenant":     {request: NewRequest("p1", Product, nil).InTenant("t2")},
+		"default namespace spans all":   {request: NewRequest("p9", Product, nil), want: true},
+		"role of the tenant":            {request: NewRequest("c@x", Role, "viewer").InTenant("t2"), want: true},
+		"user of another tenant":        {request: NewRequest("c@x", Role, "viewer").InTenant("t1")},
+		"tenant outside the configured": {request: NewRequest("p9", Product, nil).InTenant("t3")},
+	}
+	for k, v := range cases {
+		t.Run(k, func(t *testing.T) {
+			srv.MakeRequest(v.request)
+			assert.Equal(t, v.want, <-v.request.Out)
+		})
+	}
+
+	batch := NewBatchRequest([]BatchItem{
+		{Type: Product, ID: "p1", Tenant: "t1"},
+		{Type: Product, ID: "p1", Tenant: "t2"},
+		{Type: Role, ID: "a@x", Opt: "admin", Tenant: "t1"},
+		{Type: Product, ID: "p8", Tenant: "t2"},
+		{Type: Product, ID: "p1", Tenant: "t3"},
+	})
+	srv.MakeBatchRequest(batch)
+	assert.Equal(t, []BatchResult{
+		{Type: Product, ID: "p1", Valid: true},
+		{Type: Product, ID: "p1"},
+		{Type: Role, ID: "a@x", Valid: true},
+		{Type: Product, ID: "p8", Valid: true},
+		{Type: Product, ID: "p1"},
+	}, <-batch.Out)
+
+	_, err := srv.Tenant("t3")
+	assert.ErrorIs(t, err, apperror.ErrUnknownTenant)
+
+	// each tenant keeps at most one entry per cache and reports its own counters
+	m := srv.Metrics()
+	assert.Len(t, m.Namespaces, 2)
+	t2 := m.Namespaces["t2"]
+	assert.Equal(t, 1, t2.MaxEntries)
+	assert.Equal(t, 1, t2.Caches[Product].Entries)
+	assert.Equal(t, uint64(1), t2.Caches[Product].Evictions)
+	assert.Equal(t, 1, m.Caches[Product].Entries)
+
+	srv.Reconfigure(&appcontext.Config{Tenants: appcontext.TenantsConfig{MaxEntries: 5}})
+	assert.Equal(t, 5, srv.Metrics().Namespaces["t2"].MaxEntries)
+}
+
+func TestTenantLimit(t *testing.T) {
+	srv := newTenantServer(t, appcontext.TenantsConfig{Column: "tenantID", Max: 1})
+	_, err := srv.Tenant("t1")
+	assert.NoError(t, err)
+	_, err = srv.Tenant("t1")
+	assert.NoError(t, err)
+	_, err = srv.Tenant("t2")
+	assert.ErrorIs(t, err, apperror.ErrUnknownTenant)
+	ns, err := srv.Tenant("")
+	assert.NoError(t, err)
+	assert.Same(t, srv.namespace, ns)
+}
+
+func TestTenantRoles(t *testing.T) {
+	srv := newTenantServer(t, appcontext.TenantsConfig{Column: "tenantID"})
+	_, err := srv.appCtx.DatabaseClient.Exec(`
+DROP TABLE "users";
+CREATE TABLE "users" ("emailId" TEXT, "role" TEXT, "tenantID" TEXT);
+INSERT INTO "users" VALUES ('m@x', 'admin', 't1'), ('m@x', 'viewer', 't2');
+CREATE TABLE "roleInherits" ("role" TEXT, "inherits" TEXT);
+CREATE TABLE "rolePermissions" ("role" TEXT, "permission" TEXT);
+INSERT INTO "rolePermissions" VALUES ('admin', 'users.write');`)
+	assert.NoError(t, err)
+	go srv.Run()
+	defer srv.Close()
+
+	cases := map[string]struct {
+		tenant string
+		role   string
+		want   bool
+	}{
+		"admin in its tenant":          {tenant: "t1", role: "admin", want: true},
+		"admin role of another tenant": {tenant: "t2", role: "admin"},
+		"viewer in its tenant":         {tenant: "t2", role: "viewer", want: true},
+	}
+	for k, v := range cases {
+		t.Run(k, func(t *testing.T) {
+			got, err := srv.HasRoles("m@x", v.tenant, []string{v.role}, AnyOf)
+			assert.NoError(t, err)
+			assert.Equal(t, v.want, got)
+			req := NewRequest("m@x", Role, v.role).InTenant(v.tenant)
+			srv.MakeRequest(req)
+			assert.Equal(t, v.want, <-req.Out)
+			got, err = srv.HasPermission("m@x", v.tenant, "users.write")
+			assert.NoError(t, err)
+			assert.Equal(t, v.role == "admin" && v.want, got)
+		})
+	}
+}
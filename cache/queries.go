@@ -0,0 +1,179 @@
+package cache
+
+import (
+	"cacheServer/apperror"
+	database "cacheServer/db"
+	"fmt"
+	"strings"
+)
+
+// allowedTables is the fixed set of tables read by the cache, the only names ever placed into its SQL.
+// Every query is rendered from it when the server starts; requests only select among them by Type.
+var allowedTables = map[string]bool{
+	"users":              true,
+	"products":           true,
+	"productCategory":    true,
+	"productSubCategory": true,
+	"roleInherits":       true,
+	"rolePermissions":    true,
+	"userRoles":          true,
+	"indexClaims":        true,
+}
+
+// table quotes name for d. A name outside allowedTables is a programming error and panics.
+func table(d database.Dialect, name string) string {
+	if !allowedTables[name] {
+		panic(fmt.Sprintf("cache: table %q is not in the allowlist", name))
+	}
+	return d.Quote(name)
+}
+
+// queries holds the SQL of the cache rendered for the dialect of the database. The queries of a tenant
+// namespace are scoped: every entity and index query filters on the tenant column, bound as the first
+// argument by args.
+type queries struct {
+	dialect database.Dialect
+	scope   string // condition on the tenant column, empty when unscoped
+	tenant  string // value bound to scope
+
+	exists             map[Type]string // id of an entity, also used for parents without children
+	role               string
+	categoryIndices    string
+	subcategoryIndices string // occupied indices aggregated per category
+	subcategoryIDs     string
+	productIndices     string // occupied indices aggregated per subcategory
+	children           map[string]string
+	warmup             map[Type]string
+	roleInherits       string // role vs a role it inherits
+	rolePermissions    string // role vs a permission granted to it
+	roleSet            string // emailId, tenantID, role of one user
+	indexLock          string // takes the advisory lock of a parent until the end of the transaction
+	indexTaken         map[Type]string
+	indexClaim         string // claims an index for the tenant, nothing is inserted if it is claimed already
+	indexUnclaim       string
+}
+
+// newQueries renders the unscoped queries, reading the rows of every tenant.
+func newQueries(d database.Dialect) *queries {
+	return newTenantQueries(d, "", "")
+}
+
+// newTenantQueries renders the queries of tenant, scoped on tenantColumn. An empty column leaves them unscoped.
+func newTenantQueries(d database.Dialect, tenantColumn string, tenant string) *queries {
+	if d == nil {
+		d = database.PostgresDialect
+	}
+	q := d.Quote
+	qs := &queries{
+		dialect:    d,
+		exists:     make(map[Type]string),
+		children:   make(map[string]string),
+		warmup:     make(map[Type]string),
+		indexTaken: make(map[Type]string),
+	}
+	first := 1 // placeholder of the first argument of the query
+	if tenantColumn != "" {
+		qs.scope, qs.tenant = q(tenantColumn)+" = "+d.Placeholder(1), tenant
+		first = 2
+	}
+	p1, p2 := d.Placeholder(first), d.Placeholder(first+1)
+	for t, name := range tableNames {
+		if t == Role {
+			continue
+		}
+		qs.exists[t] = fmt.Sprintf(`SELECT id FROM %s%s;`, table(d, name), qs.where("id="+p1))
+		qs.warmup[t] = fmt.Sprintf(`SELECT id, 'active' FROM %s%s ORDER BY id LIMIT %s;`, table(d, name), qs.where("id > "+p1), p2)
+	}
+	qs.role = fmt.Sprintf(`SELECT %s FROM %s%s`, q("role"), table(d, "users"), qs.where(q("emailId")+" = "+p1))
+	qs.warmup[Role] = fmt.Sprintf(`SELECT %s, %s FROM %s%s ORDER BY %s LIMIT %s;`,
+		q("emailId"), q("role"), table(d, "users"), qs.where(q("emailId")+" > "+p1), q("emailId"), p2)
+
+	qs.categoryIndices = fmt.Sprintf(`SELECT %s FROM %s%s ORDER BY %s ASC;`, q("index"), table(d, "productCategory"), qs.where(), q("index"))
+	qs.subcategoryIndices = qs.aggregateIndices("categoryID", "productSubCategory")
+	qs.subcategoryIDs = fmt.Sprintf(`SELECT id FROM %s%s;`, table(d, "productSubCategory"), qs.where())
+	qs.productIndices = qs.aggregateIndices("subCategoryID", "products")
+	for _, p := range []parentIndex{subcategoryParent, productParent} {
+		qs.children[p.kind] = fmt.Sprintf(`SELECT %s FROM %s%s ORDER BY %s ASC;`,
+			q("index"), table(d, p.childTable), qs.where(q(p.parentColumn)+" = "+p1), q("index"))
+	}
+	qs.indexTaken[Category] = fmt.Sprintf(`SELECT 1 FROM %s%s;`, table(d, "productCategory"), qs.where(q("index")+" = "+p1))
+	qs.indexTaken[Subcategory] = fmt.Sprintf(`SELECT 1 FROM %s%s;`,
+		table(d, subcategoryParent.childTable), qs.where(q(subcategoryParent.parentColumn)+" = "+p1, q("index")+" = "+p2))
+	qs.indexTaken[Product] = fmt.Sprintf(`SELECT 1 FROM %s%s;`,
+		table(d, productParent.childTable), qs.where(q(productParent.parentColumn)+" = "+p1, q("index")+" = "+p2))
+	qs.indexLock = `SELECT pg_advisory_xact_lock(` + d.Placeholder(1) + `);`
+	claims, claimColumns := table(d, "indexClaims"), []string{q("tenant"), q("family"), q("parent"), q("index")}
+	qs.indexClaim = fmt.Sprintf(`INSERT INTO %s (%s) VALUES (%s, %s, %s, %s) ON CONFLICT DO NOTHING;`,
+		claims, strings.Join(claimColumns, ", "), d.Placeholder(1), d.Placeholder(2), d.Placeholder(3), d.Placeholder(4))
+	qs.indexUnclaim = fmt.Sprintf(`DELETE FROM %s WHERE %s = %s AND %s = %s AND %s = %s AND %s = %s;`, claims,
+		claimColumns[0], d.Placeholder(1), claimColumns[1], d.Placeholder(2), claimColumns[2], d.Placeholder(3), claimColumns[3], d.Placeholder(4))
+	qs.roleInherits = fmt.Sprintf(`SELECT %s, %s FROM %s;`, q("role"), q("inherits"), table(d, "roleInherits"))
+	qs.rolePermissions = fmt.Sprintf(`SELECT %s, %s FROM %s;`, q("role"), q("permission"), table(d, "rolePermissions"))
+	qs.roleSet = fmt.Sprintf(`SELECT %s, COALESCE(%s, ''), %s FROM %s WHERE %s = %s;`,
+		q("emailId"), q("tenantID"), q("role"), table(d, "userRoles"), q("emailId"), d.Placeholder(1))
+	return qs
+}
+
+// where returns the WHERE clause of conds, preceded by the tenant scope. It is empty without conditions.
+func (qs *queries) where(conds ...string) string {
+	if qs.scope != "" {
+		conds = append([]string{qs.scope}, conds...)
+	}
+	if len(conds) == 0 {
+		return ""
+	}
+	return " WHERE " + strings.Join(conds, " AND ")
+}
+
+// args binds the tenant ahead of the arguments of a scoped query.
+func (qs *queries) args(args ...interface{}) []interface{} {
+	if qs.scope == "" {
+		return args
+	}
+	return append([]interface{}{qs.tenant}, args...)
+}
+
+// roleSetBatch selects the emailId, tenantID, role rows of many users in one query.
+func (qs *queries) roleSetBatch(emails []string) (string, []interface{}) {
+	d, q := qs.dialect, qs.dialect.Quote
+	cond, args := d.AnyOf(q("emailId"), 1, emails)
+	return fmt.Sprintf(`SELECT %s, COALESCE(%s, ''), %s FROM %s WHERE %s;`,
+		q("emailId"), q("tenantID"), q("role"), table(d, "userRoles"), cond), args
+}
+
+// aggregateIndices selects the occupied indices of childTable grouped by parentColumn.
+func (qs *queries) aggregateIndices(parentColumn string, childTable string) string {
+	d := qs.dialect
+	parent, index := d.Quote(parentColumn), d.Quote("index")
+	return fmt.Sprintf(`SELECT %s,%s FROM (
+              SELECT %s,%s FROM %s%s GROUP BY 1,2 ORDER BY 2 ASC) t1
+              GROUP BY 1;`, parent, d.AggregateInts(index), parent, index, table(d, childTable), qs.where())
+}
+
+// lookup returns the id query of t, the role query for Role.
+func (qs *queries) lookup(t Type) (string, error) {
+	if t == Role {
+		return qs.role, nil
+	}
+	query, ok := qs.exists[t]
+	if !ok {
+		return "", apperror.ErrInvalidRequest
+	}
+	return query, nil
+}
+
+// batch selects the ids of t found in the database with their cached value, in one query.
+func (qs *queries) batch(t Type, IDs []string) (string, []interface{}, error) {
+	d, q := qs.dialect, qs.dialect.Quote
+	first := len(qs.args()) + 1
+	if t == Role {
+		cond, args := d.AnyOf(q("emailId"), first, IDs)
+		return fmt.Sprintf(`SELECT %s, %s FROM %s%s;`, q("emailId"), q("role"), table(d, "users"), qs.where(cond)), qs.args(args...), nil
+	}
+	name, ok := tableNames[t]
+	if !ok {
+		return "", nil, apperror.ErrInvalidRequest
+	}
+	cond, args := d.AnyOf("id", first, IDs)
+	return fmt.Sprintf(`SELECT id, 'active' FROM %s%s;`, table(d, name), qs.where(cond)), qs.args(args...), nil
+}
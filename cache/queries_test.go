@@ -0,0 +1,70 @@
+package cache
+
+import (
+	"cacheServer/apperror"
+	database "cacheServer/db"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQueriesAllowlist(t *testing.T) {
+	for _, d := range []database.Dialect{database.PostgresDialect, database.SQLiteDialect, database.MySQLDialect} {
+		t.Run(d.Name(), func(t *testing.T) {
+			qs := newQueries(d)
+			_, err := qs.lookup(Quit)
+			assert.Equal(t, apperror.ErrInvalidRequest, err)
+			_, _, err = qs.batch(Quit, []string{"1"})
+			assert.Equal(t, apperror.ErrInvalidRequest, err)
+			_, ok := qs.warmup[Quit]
+			assert.False(t, ok)
+
+			query, err := qs.lookup(Product)
+			assert.NoError(t, err)
+			assert.Contains(t, query, d.Quote("products"))
+			assert.Panics(t, func() { table(d, "products; DROP TABLE users") })
+		})
+	}
+}
+
+func TestTenantQueries(t *testing.T) {
+	cases := map[string]struct {
+		dialect   database.Dialect
+		exists    string
+		indices   string
+		batch     string
+		batchArgs []interface{}
+	}{
+		"postgres": {
+			dialect: database.PostgresDialect,
+			exists:  `SELECT id FROM "products" WHERE "tenantID" = $1 AND id=$2;`,
+			indices: `SELECT "index" FROM "productCategory" WHERE "tenantID" = $1 ORDER BY "index" ASC;`,
+			batch:   `SELECT id, 'active' FROM "products" WHERE "tenantID" = $1 AND id = ANY($2);`,
+		},
+		"mysql": {
+			dialect:   database.MySQLDialect,
+			exists:    "SELECT id FROM `products` WHERE `tenantID` = ? AND id=?;",
+			indices:   "SELECT `index` FROM `productCategory` WHERE `tenantID` = ? ORDER BY `index` ASC;",
+			batch:     "SELECT id, 'active' FROM `products` WHERE `tenantID` = ? AND id IN (?,?);",
+			batchArgs: []interface{}{"t1", "p1", "p2"},
+		},
+	}
+	for k, v := range cases {
+		t.Run(k, func(t *testing.T) {
+			qs := newTenantQueries(v.dialect, "tenantID", "t1")
+			assert.Equal(t, v.exists, qs.exists[Product])
+			assert.Equal(t, v.indices, qs.categoryIndices)
+			assert.Equal(t, []interface{}{"t1", "p1"}, qs.args("p1"))
+			query, args, err := qs.batch(Product, []string{"p1", "p2"})
+			assert.NoError(t, err)
+			assert.Equal(t, v.batch, query)
+			if v.batchArgs != nil {
+				assert.Equal(t, v.batchArgs, args)
+			}
+		})
+	}
+
+	unscoped := newQueries(database.PostgresDialect)
+	assert.Equal(t, `SELECT id FROM "products" WHERE id=$1;`, unscoped.exists[Product])
+	assert.Equal(t, []interface{}{"p1"}, unscoped.args("p1"))
+}
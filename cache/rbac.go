@@ -0,0 +1,159 @@
+package cache
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"sync"
+)
+
+// rbac is the role model read from the database: the roles each role inherits, e.g. admin inherits
+// editor, and the permissions granted to each role. A role holds every role and permission reachable
+// through its inherited roles. The model is loaded on first use and again after invalidate; the
+// effective grants of each role are computed once per model.
+type rbac struct {
+	init *initTracker
+
+	mu          sync.RWMutex
+	inherits    map[string][]string // role vs the roles it directly inherits
+	permissions map[string][]string // role vs its directly granted permissions
+	effective   map[string]*grants  // role vs its resolved grants, cleared with the model
+}
+
+// grants are the roles and permissions a role holds, itself included.
+type grants struct {
+	roles       map[string]bool
+	permissions map[string]bool
+}
+
+func newRBAC(load func() (map[string][]string, map[string][]string, error)) *rbac {
+	r := &rbac{effective: make(map[string]*grants)}
+	r.init = newInitTracker(func() error {
+		inherits, permissions, err := load()
+		if err != nil {
+			log.Println("role model not loaded, roles are compared exactly until it is:", err)
+			return err
+		}
+		r.mu.Lock()
+		r.inherits, r.permissions = inherits, permissions
+		r.effective = make(map[string]*grants)
+		r.mu.Unlock()
+		return nil
+	}, nil)
+	return r
+}
+
+// grantsOf returns the resolved grants of role. Without a model, after a failed load, a role holds only
+// itself.
+func (r *rbac) grantsOf(role string) *grants {
+	if err := r.init.ensure(); err != nil {
+		return &grants{roles: map[string]bool{role: true}, permissions: map[string]bool{}}
+	}
+	r.mu.RLock()
+	g, ok := r.effective[role]
+	r.mu.RUnlock()
+	if ok {
+		return g
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	g = &grants{roles: make(map[string]bool), permissions: make(map[string]bool)}
+	pending := []string{role}
+	for len(pending) > 0 {
+		current := pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+		if g.roles[current] {
+			continue // inheritance cycles are cut here
+		}
+		g.roles[current] = true
+		for _, p := range r.permissions[current] {
+			g.permissions[p] = true
+		}
+		pending = append(pending, r.inherits[current]...)
+	}
+	r.effective[role] = g
+	return g
+}
+
+// hasRole reports whether a user holding role passes a check for claimed.
+func (r *rbac) hasRole(role string, claimed string) bool {
+	if role == claimed {
+		return true
+	}
+	return r.grantsOf(role).roles[claimed]
+}
+
+// hasPermission reports whether a user holding role is granted permission.
+func (r *rbac) hasPermission(role string, permission string) bool {
+	return r.grantsOf(role).permissions[permission]
+}
+
+// invalidate drops the model, the next check loads it again. A load running meanwhile is repeated.
+func (r *rbac) invalidate() {
+	r.init.reset()
+	r.mu.Lock()
+	r.effective = make(map[string]*grants)
+	r.mu.Unlock()
+}
+
+// loadRBAC reads the role hierarchy and the permissions of every role.
+func (s *Server) loadRBAC() (map[string][]string, map[string][]string, error) {
+	inherits, err := s.loadPairs(s.queries.roleInherits)
+	if err != nil {
+		return nil, nil, err
+	}
+	permissions, err := s.loadPairs(s.queries.rolePermissions)
+	if err != nil {
+		return nil, nil, err
+	}
+	log.Println("role model loaded,", len(inherits), "roles inherit others,", len(permissions), "roles have permissions")
+	return inherits, permissions, nil
+}
+
+// loadPairs groups the second column of query by the first.
+func (s *Server) loadPairs(query string) (map[string][]string, error) {
+	rows, err := s.appCtx.DatabaseClient.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	result := make(map[string][]string)
+	for rows.Next() {
+		var key, value string
+		if err := rows.Scan(&key, &value); err != nil {
+			return nil, err
+		}
+		result[key] = append(result[key], value)
+	}
+	return result, rows.Err()
+}
+
+// HasRole : reports whether the user holds role, directly or through the roles their roles inherit
+func (s *Server) HasRole(email string, role string) (bool, error) {
+	return s.HasRoles(email, globalTenant, []string{role}, AnyOf)
+}
+
+// HasPermission : reports whether a role the user holds in tenant, or a role it inherits, is granted
+// permission. The global roles of the user count in every tenant.
+func (s *Server) HasPermission(email string, tenant string, permission string) (bool, error) {
+	held, err := s.rolesIn(email, tenant)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	for _, role := range held {
+		if s.rbac.hasPermission(role, permission) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// InvalidateRoles : drops the cached role model after role definitions changed, it is loaded again on next use
+func (s *Server) InvalidateRoles() {
+	s.rbac.invalidate()
+	log.Println("role model invalidated")
+}
@@ -0,0 +1,124 @@
+package cache
+
+import (
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const rbacSchema = `
+CREATE TABLE "roleInherits" ("role" TEXT, "inherits" TEXT);
+CREATE TABLE "rolePermissions" ("role" TEXT, "permission" TEXT);
+INSERT INTO "roleInherits" VALUES ('admin', 'editor'), ('editor', 'viewer'),
+	('auditor', 'support'), ('support', 'auditor');
+INSERT INTO "rolePermissions" VALUES ('viewer', 'products.read'), ('editor', 'products.write'), ('admin', 'users.write');
+`
+
+func TestRBAC(t *testing.T) {
+	srv := newSQLiteServer(t)
+	_, err := srv.appCtx.DatabaseClient.Exec(rbacSchema)
+	assert.NoError(t, err)
+
+	cases := map[string]struct {
+		call func() (bool, error)
+		want bool
+	}{
+		"own role": {
+			call: func() (bool, error) { return srv.HasRole("b@x", "editor") },
+			want: true,
+		},
+		"inherited role": {
+			call: func() (bool, error) { return srv.HasRole("a@x", "editor") },
+			want: true,
+		},
+		"transitively inherited role": {
+			call: func() (bool, error) { return srv.HasRole("a@x", "viewer") },
+			want: true,
+		},
+		"senior role is not inherited": {
+			call: func() (bool, error) { return srv.HasRole("b@x", "admin") },
+		},
+		"unknown user": {
+			call: func() (bool, error) { return srv.HasRole("ghost@x", "viewer") },
+		},
+		"inheritance cycle": {
+			call: func() (bool, error) { return srv.rbac.hasRole("support", "auditor"), nil },
+			want: true,
+		},
+		"role outside a cycle": {
+			call: func() (bool, error) { return srv.rbac.hasRole("support", "viewer"), nil },
+		},
+		"inherited permission": {
+			call: func() (bool, error) { return srv.HasPermission("b@x", "", "products.read") },
+			want: true,
+		},
+		"permission of a senior role": {
+			call: func() (bool, error) { return srv.HasPermission("b@x", "", "users.write") },
+		},
+	}
+	for k, v := range cases {
+		t.Run(k, func(t *testing.T) {
+			got, err := v.call()
+			assert.NoError(t, err)
+			assert.Equal(t, v.want, got)
+		})
+	}
+
+	// role verification requests use the hierarchy
+	go srv.Run()
+	defer srv.Close()
+	req := NewRequest("a@x", Role, "viewer")
+	srv.MakeRequest(req)
+	assert.True(t, <-req.Out)
+	batch := NewBatchRequest([]BatchItem{{Type: Role, ID: "a@x", Opt: "editor"}, {Type: Role, ID: "b@x", Opt: "admin"}})
+	srv.MakeBatchRequest(batch)
+	assert.Equal(t, []BatchResult{{Type: Role, ID: "a@x", Valid: true}, {Type: Role, ID: "b@x"}}, <-batch.Out)
+
+	// changed definitions apply once the model is invalidated
+	_, err = srv.appCtx.DatabaseClient.Exec(`INSERT INTO "rolePermissions" VALUES ('viewer', 'orders.read')`)
+	assert.NoError(t, err)
+	got, _ := srv.HasPermission("b@x", "", "orders.read")
+	assert.False(t, got)
+	srv.InvalidateRoles()
+	got, _ = srv.HasPermission("b@x", "", "orders.read")
+	assert.True(t, got)
+}
+
+func TestRBACWithoutTables(t *testing.T) {
+	srv := newSQLiteServer(t)
+
+	got, err := srv.HasRole("a@x", "admin")
+	assert.NoError(t, err)
+	assert.True(t, got)
+	got, err = srv.HasRole("a@x", "editor")
+	assert.NoError(t, err)
+	assert.False(t, got)
+	got, err = srv.HasPermission("a@x", "", "products.read")
+	assert.NoError(t, err)
+	assert.False(t, got)
+}
+
+func TestRBACInvalidateDuringLoad(t *testing.T) {
+	var loads atomic.Int32
+	loading := make(chan struct{})
+	release := make(chan struct{})
+	r := newRBAC(func() (map[string][]string, map[string][]string, error) {
+		if loads.Add(1) == 1 {
+			close(loading)
+			<-release
+			return nil, map[string][]string{"viewer": {"products.read"}}, nil
+		}
+		return nil, map[string][]string{"viewer": {"products.read", "orders.read"}}, nil
+	})
+
+	granted := make(chan bool)
+	go func() { granted <- r.hasPermission("viewer", "orders.read") }()
+	<-loading
+	// the definitions change while the first load is running
+	r.invalidate()
+	close(release)
+	assert.True(t, <-granted, "the check waits for the load after the invalidation")
+	assert.Equal(t, int32(2), loads.Load())
+	assert.Equal(t, stateReady, r.init.current())
+}
@@ -0,0 +1,190 @@
+package cache
+
+import (
+	"cacheServer/appcontext"
+	"cacheServer/apperror"
+	"cacheServer/logging"
+	"cacheServer/typedcache"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+)
+
+// globalTenant holds the roles a user has in every tenant.
+const globalTenant = ""
+
+// RoleSet : roles of a user per tenant, roles of the global tenant "" apply in every tenant
+type RoleSet map[string][]string
+
+// in returns the roles held in tenant, the global ones included.
+func (rs RoleSet) in(tenant string) []string {
+	if tenant == globalTenant {
+		return rs[globalTenant]
+	}
+	return append(append([]string(nil), rs[globalTenant]...), rs[tenant]...)
+}
+
+// Match : how a list of claimed roles is checked
+type Match int
+
+const (
+	// AnyOf : one of the claimed roles is held
+	AnyOf Match = iota
+	// AllOf : every claimed role is held
+	AllOf
+)
+
+// ParseMatch : returns the Match named s, "any" (default) or "all"
+func ParseMatch(s string) (Match, error) {
+	switch strings.ToLower(s) {
+	case "", "any", "anyof":
+		return AnyOf, nil
+	case "all", "allof":
+		return AllOf, nil
+	}
+	return AnyOf, fmt.Errorf("%w: unknown match %q, want any or all", apperror.ErrInvalidRequest, s)
+}
+
+// newRoleSetCache returns the cache of role sets read from userRoles, nil when every user has a single
+// role in users."role".
+func (s *Server) newRoleSetCache() *typedcache.Cache[string, RoleSet] {
+	if s.appCtx.Roles.Source != appcontext.RoleSourceTable {
+		return nil
+	}
+	opts := s.appCtx.CacheOptions
+	if opts.Fallback == nil {
+		opts.Fallback = isCircuitOpen
+	}
+	c := typedcache.New[string, RoleSet](roleSetLoader{s: s}, opts)
+	s.watchRoleSets(c)
+	return c
+}
+
+// roleSetLoader reads the role sets of users from userRoles, one at a time or in batches.
+type roleSetLoader struct {
+	s *Server
+}
+
+// Load ...
+func (l roleSetLoader) Load(email string) (RoleSet, error) {
+	logging.Debugln("role set of", email, "not present in cache")
+	sets, err := l.s.fetchRoleSets(l.s.queries.roleSet, email)
+	if err != nil {
+		return nil, err
+	}
+	set, ok := sets[email]
+	if !ok {
+		return nil, fmt.Errorf("%w: %w", typedcache.ErrNotFound, sql.ErrNoRows)
+	}
+	return set, nil
+}
+
+// LoadMany ...
+func (l roleSetLoader) LoadMany(emails []string) (map[string]RoleSet, error) {
+	logging.Debugln(len(emails), "role sets not present in cache")
+	query, args := l.s.queries.roleSetBatch(emails)
+	return l.s.fetchRoleSets(query, args...)
+}
+
+// fetchRoleSets groups the emailId, tenantID, role rows of query by user and tenant.
+func (s *Server) fetchRoleSets(query string, args ...interface{}) (map[string]RoleSet, error) {
+	rows, err := s.appCtx.DatabaseClient.Query(query, args...)
+	if err != nil {
+		log.Println("error while fetching role sets ", err)
+		return nil, err
+	}
+	defer rows.Close()
+	sets := make(map[string]RoleSet)
+	for rows.Next() {
+		var email, tenant, role string
+		if err := rows.Scan(&email, &tenant, &role); err != nil {
+			return nil, err
+		}
+		if sets[email] == nil {
+			sets[email] = make(RoleSet)
+		}
+		sets[email][tenant] = append(sets[email][tenant], role)
+	}
+	return sets, rows.Err()
+}
+
+// RoleSet : returns the roles of the user per tenant. With one role per user it is the role read without
+// a tenant scope, held in every tenant; rolesIn reads it from the namespace of the tenant instead.
+func (s *Server) RoleSet(email string) (RoleSet, error) {
+	if s.roleSets == nil {
+		role, err := s.store.data[Role].Get(email)
+		if err != nil {
+			return nil, err
+		}
+		return RoleSet{globalTenant: {role}}, nil
+	}
+	return s.roleSets.Get(email)
+}
+
+// rolesIn returns the roles the user holds in tenant, the global ones included. With one role per user
+// it is the role of the user in the namespace of tenant, the users rows of other tenants are not read.
+func (s *Server) rolesIn(email string, tenant string) ([]string, error) {
+	if s.roleSets == nil {
+		ns, err := s.lookupNamespace(tenant)
+		if err != nil {
+			return nil, err
+		}
+		role, err := ns.store.data[Role].Get(email)
+		if err != nil {
+			return nil, err
+		}
+		return []string{role}, nil
+	}
+	set, err := s.roleSets.Get(email)
+	if err != nil {
+		return nil, err
+	}
+	return set.in(tenant), nil
+}
+
+// HasRoles : checks the claimed roles against the roles the user holds in tenant, directly or through
+// inherited roles. Unknown users hold no role.
+func (s *Server) HasRoles(email string, tenant string, claimed []string, match Match) (bool, error) {
+	if len(claimed) == 0 {
+		return false, fmt.Errorf("%w: no role claimed", apperror.ErrInvalidRequest)
+	}
+	held, err := s.rolesIn(email, tenant)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return s.matchRoles(held, claimed, match), nil
+}
+
+// matchRoles reports whether held satisfies claimed.
+func (s *Server) matchRoles(held []string, claimed []string, match Match) bool {
+	for _, c := range claimed {
+		ok := false
+		for _, h := range held {
+			if s.rbac.hasRole(h, c) {
+				ok = true
+				break
+			}
+		}
+		if ok && match == AnyOf {
+			return true
+		}
+		if !ok && match == AllOf {
+			return false
+		}
+	}
+	return match == AllOf
+}
+
+// verifyRoleSets loads the role sets of the users of the Role items of a batch.
+func (s *Server) verifyRoleSets(emails []string) map[string]RoleSet {
+	sets, err := s.roleSets.GetMany(emails)
+	if err != nil {
+		log.Println("failed to load batch of role sets", err)
+	}
+	return sets
+}
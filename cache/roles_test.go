@@ -0,0 +1,162 @@
+package cache
+
+import (
+	"cacheServer/appcontext"
+	"cacheServer/apperror"
+	"cacheServer/typedcache"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const userRolesSchema = `
+CREATE TABLE "userRoles" ("emailId" TEXT, "role" TEXT, "tenantID" TEXT);
+INSERT INTO "userRoles" VALUES ('a@x', 'viewer', NULL), ('a@x', 'editor', 't1'), ('a@x', 'billing', 't1'),
+	('a@x', 'admin', 't2'), ('b@x', 'editor', NULL);
+CREATE TABLE "roleInherits" ("role" TEXT, "inherits" TEXT);
+CREATE TABLE "rolePermissions" ("role" TEXT, "permission" TEXT);
+INSERT INTO "roleInherits" VALUES ('admin', 'editor');
+`
+
+func newRoleSetServer(t *testing.T) *Server {
+	srv := newSQLiteServer(t, func(ctx *appcontext.Context) {
+		ctx.Roles.Source = appcontext.RoleSourceTable
+	})
+	_, err := srv.appCtx.DatabaseClient.Exec(userRolesSchema)
+	assert.NoError(t, err)
+	return srv
+}
+
+func TestHasRoles(t *testing.T) {
+	srv := newRoleSetServer(t)
+
+	cases := map[string]struct {
+		email   string
+		tenant  string
+		claimed []string
+		match   Match
+		want    bool
+		err     error
+	}{
+		"global role": {
+			email: "a@x", claimed: []string{"viewer"}, want: true,
+		},
+		"global role in a tenant": {
+			email: "a@x", tenant: "t1", claimed: []string{"viewer"}, want: true,
+		},
+		"tenant role outside its tenant": {
+			email: "a@x", claimed: []string{"editor"},
+		},
+		"any of": {
+			email: "a@x", tenant: "t1", claimed: []string{"admin", "billing"}, want: true,
+		},
+		"all of": {
+			email: "a@x", tenant: "t1", claimed: []string{"editor", "billing", "viewer"}, match: AllOf, want: true,
+		},
+		"all of with a missing role": {
+			email: "a@x", tenant: "t1", claimed: []string{"editor", "admin"}, match: AllOf,
+		},
+		"all of through the hierarchy": {
+			email: "a@x", tenant: "t2", claimed: []string{"admin", "editor"}, match: AllOf, want: true,
+		},
+		"unknown user": {
+			email: "ghost@x", claimed: []string{"viewer"},
+		},
+		"no claimed role": {
+			email: "a@x", err: apperror.ErrInvalidRequest,
+		},
+	}
+	for k, v := range cases {
+		t.Run(k, func(t *testing.T) {
+			got, err := srv.HasRoles(v.email, v.tenant, v.claimed, v.match)
+			assert.ErrorIs(t, err, v.err)
+			assert.Equal(t, v.want, got)
+		})
+	}
+
+	set, err := srv.RoleSet("a@x")
+	assert.NoError(t, err)
+	assert.Equal(t, RoleSet{"": {"viewer"}, "t1": {"editor", "billing"}, "t2": {"admin"}}, set)
+	// each user is read once, the unknown one included
+	assert.Equal(t, uint64(2), srv.Metrics().RoleSets.Loads)
+}
+
+func TestRoleSetVerification(t *testing.T) {
+	srv := newRoleSetServer(t)
+	go srv.Run()
+	defer srv.Close()
+
+	req := NewRequest("b@x", Role, "editor")
+	srv.MakeRequest(req)
+	assert.True(t, <-req.Out)
+
+	batch := NewBatchRequest([]BatchItem{
+		{Type: Role, ID: "a@x", Opt: "viewer"},
+		{Type: Role, ID: "a@x", Opt: "admin"},
+		{Type: Role, ID: "ghost@x", Opt: "viewer"},
+	})
+	srv.MakeBatchRequest(batch)
+	assert.Equal(t, []BatchResult{{Type: Role, ID: "a@x", Valid: true}, {Type: Role, ID: "a@x"}, {Type: Role, ID: "ghost@x"}}, <-batch.Out)
+
+	// deleting the role entry of a user drops its role set
+	_, err := srv.appCtx.DatabaseClient.Exec(`INSERT INTO "userRoles" VALUES ('b@x', 'auditor', NULL)`)
+	assert.NoError(t, err)
+	got, _ := srv.HasRole("b@x", "auditor")
+	assert.False(t, got)
+	srv.DeleteCache("b@x", Role)
+	got, _ = srv.HasRole("b@x", "auditor")
+	assert.True(t, got)
+}
+
+func TestRoleSetStatusEvents(t *testing.T) {
+	srv := newRoleSetServer(t)
+	srv.roleSets.SetOptions(typedcache.Options{TTL: time.Millisecond, Fallback: isCircuitOpen})
+	sub := srv.Events().Subscribe(EventFilter{Kinds: []EventKind{StatusChanged}}, 16)
+	defer sub.Close()
+
+	_, err := srv.RoleSet("a@x")
+	assert.NoError(t, err)
+	_, err = srv.appCtx.DatabaseClient.Exec(`DELETE FROM "userRoles" WHERE "emailId" = 'a@x' AND "role" = 'billing'`)
+	assert.NoError(t, err)
+	time.Sleep(5 * time.Millisecond)
+	_, err = srv.RoleSet("a@x")
+	assert.NoError(t, err)
+
+	got := <-sub.Events()
+	assert.Equal(t, Event{Seq: got.Seq, Time: got.Time, Kind: StatusChanged, Tenant: "t1", Type: Role, ID: "a@x",
+		Old: "billing,editor", New: "editor"}, got)
+	assert.Len(t, sub.Events(), 0)
+}
+
+func TestHasPermissionInTenant(t *testing.T) {
+	srv := newRoleSetServer(t)
+	_, err := srv.appCtx.DatabaseClient.Exec(`INSERT INTO "rolePermissions" VALUES ('billing', 'invoices.read'), ('viewer', 'products.read')`)
+	assert.NoError(t, err)
+
+	cases := map[string]struct {
+		tenant     string
+		permission string
+		want       bool
+	}{
+		"permission of a tenant role": {
+			tenant: "t1", permission: "invoices.read", want: true,
+		},
+		"tenant role outside its tenant": {
+			tenant: "t2", permission: "invoices.read",
+		},
+		"tenant role without a tenant": {
+			permission: "invoices.read",
+		},
+		"permission of a global role in a tenant": {
+			tenant: "t1", permission: "products.read", want: true,
+		},
+	}
+	for k, v := range cases {
+		t.Run(k, func(t *testing.T) {
+			got, err := srv.HasPermission("a@x", v.tenant, v.permission)
+			assert.NoError(t, err)
+			assert.Equal(t, v.want, got)
+		})
+	}
+}
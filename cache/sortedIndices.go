@@ -0,0 +1,152 @@
+package cache
+
+import (
+	"math/rand"
+	"sync"
+)
+
+const (
+	// maxSkipLevel bounds the height of the skiplist, enough for ~2^16 indices per subcategory.
+	maxSkipLevel = 16
+	// skipProbability is the chance of promoting a node to the next level.
+	skipProbability = 0.25
+)
+
+type skipNode struct {
+	index int
+	next  []*skipNode
+}
+
+// SortedIndices : skiplist used to store available indices and maintain the order.
+// Insert, Delete and Contains run in O(log n); it is safe for concurrent use.
+type SortedIndices struct {
+	mu     sync.RWMutex
+	head   *skipNode
+	level  int
+	length int
+	rnd    *rand.Rand
+}
+
+// NewSortedIndices returns a SortedIndices holding the given indices.
+func NewSortedIndices(s []int) *SortedIndices {
+	p := &SortedIndices{
+		head:  &skipNode{next: make([]*skipNode, maxSkipLevel)},
+		level: 1,
+		rnd:   rand.New(rand.NewSource(rand.Int63())),
+	}
+	for _, v := range s {
+		p.Insert(v)
+	}
+	return p
+}
+
+func (p *SortedIndices) randomLevel() int {
+	level := 1
+	for level < maxSkipLevel && p.rnd.Float64() < skipProbability {
+		level++
+	}
+	return level
+}
+
+// findPredecessors fills update with the rightmost node on every level whose index is below the given index.
+// Caller must hold the lock.
+func (p *SortedIndices) findPredecessors(index int, update []*skipNode) *skipNode {
+	x := p.head
+	for i := p.level - 1; i >= 0; i-- {
+		for x.next[i] != nil && x.next[i].index < index {
+			x = x.next[i]
+		}
+		if update != nil {
+			update[i] = x
+		}
+	}
+	return x.next[0]
+}
+
+// Insert adds index to the set, it returns false if it was already present.
+func (p *SortedIndices) Insert(index int) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	update := make([]*skipNode, maxSkipLevel)
+	if n := p.findPredecessors(index, update); n != nil && n.index == index {
+		return false
+	}
+	level := p.randomLevel()
+	if level > p.level {
+		for i := p.level; i < level; i++ {
+			update[i] = p.head
+		}
+		p.level = level
+	}
+	n := &skipNode{index: index, next: make([]*skipNode, level)}
+	for i := 0; i < level; i++ {
+		n.next[i] = update[i].next[i]
+		update[i].next[i] = n
+	}
+	p.length++
+	return true
+}
+
+// Delete removes index from the set, it returns false if it was not present.
+func (p *SortedIndices) Delete(index int) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	update := make([]*skipNode, maxSkipLevel)
+	n := p.findPredecessors(index, update)
+	if n == nil || n.index != index {
+		return false
+	}
+	for i := 0; i < p.level; i++ {
+		if update[i].next[i] != n {
+			break
+		}
+		update[i].next[i] = n.next[i]
+	}
+	for p.level > 1 && p.head.next[p.level-1] == nil {
+		p.level--
+	}
+	p.length--
+	return true
+}
+
+// Contains reports whether index is present.
+func (p *SortedIndices) Contains(index int) bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	n := p.findPredecessors(index, nil)
+	return n != nil && n.index == index
+}
+
+// Len returns the number of indices.
+func (p *SortedIndices) Len() int {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.length
+}
+
+// Max returns the highest index, ok is false when the set is empty.
+func (p *SortedIndices) Max() (index int, ok bool) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	x := p.head
+	for i := p.level - 1; i >= 0; i-- {
+		for x.next[i] != nil {
+			x = x.next[i]
+		}
+	}
+	if x == p.head {
+		return 0, false
+	}
+	return x.index, true
+}
+
+// Slice returns a copy of the indices in ascending order, nil when empty.
+func (p *SortedIndices) Slice() []int {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	var result []int
+	for x := p.head.next[0]; x != nil; x = x.next[0] {
+		result = append(result, x.index)
+	}
+	return result
+}
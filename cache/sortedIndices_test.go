@@ -0,0 +1,76 @@
+package cache
+
+import (
+	"sort"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSortedIndices(t *testing.T) {
+	cases := map[string]struct {
+		insert []int
+		delete []int
+		want   []int
+		max    int
+		ok     bool
+	}{
+		"empty": {
+			want: nil,
+			max:  0,
+			ok:   false,
+		},
+		"insert keeps order and ignores duplicates": {
+			insert: []int{5, 1, 3, 3, 2},
+			want:   []int{1, 2, 3, 5},
+			max:    5,
+			ok:     true,
+		},
+		"delete removes present and ignores missing": {
+			insert: []int{1, 2, 3, 4},
+			delete: []int{4, 2, 9},
+			want:   []int{1, 3},
+			max:    3,
+			ok:     true,
+		},
+	}
+
+	for k, v := range cases {
+		t.Run(k, func(t *testing.T) {
+			p := NewSortedIndices(v.insert)
+			for _, d := range v.delete {
+				p.Delete(d)
+			}
+			assert.Equal(t, v.want, p.Slice())
+			assert.Equal(t, len(v.want), p.Len())
+			max, ok := p.Max()
+			assert.Equal(t, v.max, max)
+			assert.Equal(t, v.ok, ok)
+		})
+	}
+}
+
+func TestSortedIndicesConcurrent(t *testing.T) {
+	p := NewSortedIndices(nil)
+	var wg sync.WaitGroup
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				p.Insert(w*1000 + i)
+				if i%2 == 1 {
+					p.Delete(w*1000 + i)
+				}
+				p.Slice()
+				p.Max()
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	res := p.Slice()
+	assert.Equal(t, 8*100, len(res))
+	assert.True(t, sort.IntsAreSorted(res))
+}
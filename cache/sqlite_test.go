@@ -0,0 +1,97 @@
+package cache
+
+import (
+	"cacheServer/appcontext"
+	"cacheServer/apperror"
+	database "cacheServer/db"
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const sqliteSchema = `
+CREATE TABLE "users" ("emailId" TEXT PRIMARY KEY, "role" TEXT);
+CREATE TABLE "productCategory" (id TEXT PRIMARY KEY, "index" INTEGER);
+CREATE TABLE "productSubCategory" (id TEXT PRIMARY KEY, "categoryID" TEXT, "index" INTEGER);
+CREATE TABLE "products" (id TEXT PRIMARY KEY, "subCategoryID" TEXT, "index" INTEGER);
+INSERT INTO "users" VALUES ('a@x', 'admin'), ('b@x', 'editor');
+INSERT INTO "productCategory" VALUES ('c1', 1), ('c2', 3);
+INSERT INTO "productSubCategory" VALUES ('s1', 'c1', 1), ('s2', 'c1', 2), ('s3', 'c2', 4);
+INSERT INTO "products" VALUES ('p1', 's1', 3), ('p2', 's1', 1);
+`
+
+// newSQLiteServer returns a server of its own backed by a seeded sqlite database, independent of the mocked singleton.
+// configure may adjust the context before the server is created.
+func newSQLiteServer(t *testing.T, configure ...func(ctx *appcontext.Context)) *Server {
+	client, err := database.NewSQLite(filepath.Join(t.TempDir(), "cache.db"))
+	if errors.Is(err, database.ErrSQLiteUnavailable) {
+		t.Skip(err)
+	}
+	assert.NoError(t, err)
+	_, err = client.DB.Exec(sqliteSchema)
+	assert.NoError(t, err)
+	t.Cleanup(func() { client.DB.Close() })
+
+	ctx := appcontext.NewContext(client.DB, 1)
+	ctx.Dialect = database.SQLiteDialect
+	for _, c := range configure {
+		c(ctx)
+	}
+	srv := NewServer(ctx)
+	srv.waitForInit()
+	return srv
+}
+
+func TestSQLiteBackend(t *testing.T) {
+	srv := newSQLiteServer(t)
+
+	cases := map[string]struct {
+		call func() ([]int, error)
+		want []int
+		err  error
+	}{
+		"category indices": {
+			call: srv.GetCategoryIndicesCache,
+			want: []int{2, 4},
+		},
+		"subcategory indices": {
+			call: func() ([]int, error) { return srv.GetSubcategoryIndicesCache("c2") },
+			want: []int{1, 2, 3, 5},
+		},
+		"product indices": {
+			call: func() ([]int, error) { return srv.GetProductIndicesCache("s1") },
+			want: []int{2, 4},
+		},
+		"subcategory without products": {
+			call: func() ([]int, error) { return srv.GetProductIndicesCache("s2") },
+			want: []int{1},
+		},
+		"unknown subcategory": {
+			call: func() ([]int, error) { return srv.GetProductIndicesCache("ghost") },
+			err:  &apperror.UnknownParentError{Kind: "subcategory", ID: "ghost"},
+		},
+	}
+	for k, v := range cases {
+		t.Run(k, func(t *testing.T) {
+			get, err := v.call()
+			assert.Equal(t, v.err, err)
+			assert.Equal(t, v.want, get)
+		})
+	}
+
+	role, err := srv.store.data[Role].Get("a@x")
+	assert.NoError(t, err)
+	assert.Equal(t, "admin", role)
+	_, err = srv.store.data[Product].Get("missing")
+	assert.Error(t, err)
+
+	products, err := srv.fetchMany([]string{"p1", "p2", "missing"}, Product)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"p1": "active", "p2": "active"}, products)
+
+	loaded, err := srv.warmupCaches(appcontext.WarmupConfig{PageSize: 1})
+	assert.NoError(t, err)
+	assert.Equal(t, map[Type]int{Role: 2, Category: 2, Subcategory: 3, Product: 2}, loaded)
+}
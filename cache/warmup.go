@@ -0,0 +1,130 @@
+package cache
+
+import (
+	"cacheServer/appcontext"
+	"cacheServer/apperror"
+	"log"
+	"sync"
+	"time"
+)
+
+// defaultWarmupPageSize is used when the warm-up config leaves PageSize unset.
+const defaultWarmupPageSize = 1000
+
+// warmupOrder is the order in which the entity caches are warmed up.
+var warmupOrder = []Type{Role, Category, Subcategory, Product}
+
+// WarmupStatus : progress of the startup warm-up
+type WarmupStatus struct {
+	Done   bool         `json:"done"`
+	Loaded map[Type]int `json:"loaded,omitempty"`
+	Error  string       `json:"error,omitempty"`
+}
+
+type warmupState struct {
+	sync.Mutex
+	done   chan struct{} // closed once warm-up finished or was skipped
+	loaded map[Type]int
+	err    error
+}
+
+func (w *warmupState) finish(loaded map[Type]int, err error) {
+	w.Lock()
+	w.loaded = loaded
+	w.err = err
+	w.Unlock()
+	close(w.done)
+}
+
+// Warm : returns a channel closed once the startup warm-up is complete
+func (s *Server) Warm() <-chan struct{} {
+	return s.warmup.done
+}
+
+// WarmupStatus : reports whether the startup warm-up is complete and how many rows it loaded
+func (s *Server) WarmupStatus() WarmupStatus {
+	var status WarmupStatus
+	select {
+	case <-s.warmup.done:
+		status.Done = true
+	default:
+		return status
+	}
+	s.warmup.Lock()
+	defer s.warmup.Unlock()
+	status.Loaded = s.warmup.loaded
+	if s.warmup.err != nil {
+		status.Error = s.warmup.err.Error()
+	}
+	return status
+}
+
+func (s *Server) runWarmup(cfg appcontext.WarmupConfig) {
+	defer s.initWg.Done()
+	start := time.Now()
+	loaded, err := s.warmupCaches(cfg)
+	if err != nil {
+		log.Println("cache warm-up failed", err)
+	}
+	log.Println("cache warm-up finished in", time.Since(start), loaded)
+	s.warmup.finish(loaded, err)
+}
+
+// warmupCaches bulk loads users' roles and active category/subcategory/product ids page by page.
+// Types loaded before a failure keep their entries.
+func (s *Server) warmupCaches(cfg appcontext.WarmupConfig) (map[Type]int, error) {
+	pageSize := cfg.PageSize
+	if pageSize <= 0 {
+		pageSize = defaultWarmupPageSize
+	}
+	loaded := make(map[Type]int, len(warmupOrder))
+	for _, t := range warmupOrder {
+		n, err := s.warmupType(t, pageSize, cfg.Limit)
+		loaded[t] = n
+		if err != nil {
+			return loaded, err
+		}
+	}
+	return loaded, nil
+}
+
+// warmupType loads rows of one Type using keyset pagination on the id column.
+func (ns *namespace) warmupType(t Type, pageSize int, limit int) (int, error) {
+	query, ok := ns.queries.warmup[t]
+	if !ok {
+		return 0, apperror.ErrInvalidRequest
+	}
+	var count int
+	last := ""
+	for limit <= 0 || count < limit {
+		size := pageSize
+		if limit > 0 && limit-count < size {
+			size = limit - count
+		}
+		rows, err := ns.client().Query(query, ns.queries.args(last, size)...)
+		if err != nil {
+			return count, err
+		}
+		var page int
+		for rows.Next() {
+			var id, value string
+			if err := rows.Scan(&id, &value); err != nil {
+				rows.Close()
+				return count, err
+			}
+			ns.store.data[t].Set(id, value)
+			last = id
+			page++
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return count, err
+		}
+		count += page
+		if page < size {
+			break
+		}
+	}
+	return count, nil
+}
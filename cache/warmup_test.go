@@ -0,0 +1,91 @@
+package cache
+
+import (
+	"cacheServer/appcontext"
+	"errors"
+	"regexp"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWarmupCaches(t *testing.T) {
+	roleQuery := `SELECT "emailId", "role" FROM "users" WHERE "emailId" > $1 ORDER BY "emailId" LIMIT $2;`
+	entityQuery := func(table string) string {
+		return `SELECT id, 'active' FROM "` + table + `" WHERE id > $1 ORDER BY id LIMIT $2;`
+	}
+	cases := map[string]struct {
+		cfg        appcontext.WarmupConfig
+		prepFunc   func()
+		want       map[Type]int
+		err        bool
+		wantCached map[Type]map[string]string
+	}{
+		"pages until a short page and stops at the limit": {
+			cfg: appcontext.WarmupConfig{Enabled: true, PageSize: 2, Limit: 3},
+			prepFunc: func() {
+				db.mocksql.ExpectQuery(regexp.QuoteMeta(roleQuery)).WithArgs("", 2).
+					WillReturnRows(sqlmock.NewRows([]string{"emailId", "role"}).AddRow("a@x", "admin").AddRow("b@x", "editor"))
+				db.mocksql.ExpectQuery(regexp.QuoteMeta(roleQuery)).WithArgs("b@x", 1).
+					WillReturnRows(sqlmock.NewRows([]string{"emailId", "role"}).AddRow("c@x", "admin"))
+				db.mocksql.ExpectQuery(regexp.QuoteMeta(entityQuery("productCategory"))).WithArgs("", 2).
+					WillReturnRows(sqlmock.NewRows([]string{"id", "active"}).AddRow("warmCat", "active"))
+				db.mocksql.ExpectQuery(regexp.QuoteMeta(entityQuery("productSubCategory"))).WithArgs("", 2).
+					WillReturnRows(sqlmock.NewRows([]string{"id", "active"}))
+				db.mocksql.ExpectQuery(regexp.QuoteMeta(entityQuery("products"))).WithArgs("", 2).
+					WillReturnRows(sqlmock.NewRows([]string{"id", "active"}).AddRow("warmProd", "active"))
+			},
+			want: map[Type]int{Role: 3, Category: 1, Subcategory: 0, Product: 1},
+			wantCached: map[Type]map[string]string{
+				Role:     {"a@x": "admin", "b@x": "editor", "c@x": "admin"},
+				Category: {"warmCat": "active"},
+				Product:  {"warmProd": "active"},
+			},
+		},
+		"stops at the first failing type": {
+			cfg: appcontext.WarmupConfig{Enabled: true},
+			prepFunc: func() {
+				db.mocksql.ExpectQuery(regexp.QuoteMeta(roleQuery)).WithArgs("", defaultWarmupPageSize).
+					WillReturnRows(sqlmock.NewRows([]string{"emailId", "role"}).AddRow("d@x", "admin"))
+				db.mocksql.ExpectQuery(regexp.QuoteMeta(entityQuery("productCategory"))).WithArgs("", defaultWarmupPageSize).
+					WillReturnError(errors.New("error"))
+			},
+			want:       map[Type]int{Role: 1, Category: 0},
+			err:        true,
+			wantCached: map[Type]map[string]string{Role: {"d@x": "admin"}},
+		},
+	}
+
+	for k, v := range cases {
+		t.Run(k, func(t *testing.T) {
+			v.prepFunc()
+			updates := s.Events().Subscribe(EventFilter{Kinds: []EventKind{EntryUpdated}}, 16)
+			defer updates.Close()
+			get, err := s.warmupCaches(v.cfg)
+			assert.Equal(t, v.err, err != nil)
+			assert.Equal(t, v.want, get)
+			assert.NoError(t, db.mocksql.ExpectationsWereMet())
+			// every warmed entry is published as stored
+			warmed := 0
+			for _, n := range v.want {
+				warmed += n
+			}
+			assert.Len(t, updates.Events(), warmed)
+			for typ, entries := range v.wantCached {
+				for id, want := range entries {
+					cached, ok := s.store.data[typ].Peek(id)
+					assert.True(t, ok)
+					assert.Equal(t, want, cached)
+					s.DeleteCache(id, typ)
+				}
+			}
+		})
+	}
+}
+
+func TestWarmupStatus(t *testing.T) {
+	// warm-up is disabled in the test context so it is complete from the start
+	<-s.Warm()
+	assert.Equal(t, WarmupStatus{Done: true}, s.WarmupStatus())
+}
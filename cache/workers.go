@@ -0,0 +1,50 @@
+package cache
+
+import "sync"
+
+// workerPool bounds the requests verified concurrently. Its size can change while requests run:
+// a smaller pool lets the busy workers finish and admits new ones once they are below the size.
+type workerPool struct {
+	mu   sync.Mutex
+	cond *sync.Cond
+	size int
+	busy int
+}
+
+func newWorkerPool(size int) *workerPool {
+	p := &workerPool{size: size}
+	p.cond = sync.NewCond(&p.mu)
+	return p
+}
+
+// acquire blocks until a worker is free and takes it.
+func (p *workerPool) acquire() {
+	p.mu.Lock()
+	for p.busy >= p.size {
+		p.cond.Wait()
+	}
+	p.busy++
+	p.mu.Unlock()
+}
+
+func (p *workerPool) release() {
+	p.mu.Lock()
+	p.busy--
+	p.mu.Unlock()
+	p.cond.Signal()
+}
+
+// resize sets the number of workers, waking the requests waiting for one if it grows.
+func (p *workerPool) resize(size int) {
+	p.mu.Lock()
+	p.size = size
+	p.mu.Unlock()
+	p.cond.Broadcast()
+}
+
+// stats returns the busy workers and the size of the pool.
+func (p *workerPool) stats() (busy int, size int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.busy, p.size
+}
@@ -0,0 +1,78 @@
+package cache
+
+import (
+	"cacheServer/appcontext"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWorkerPoolResize(t *testing.T) {
+	p := newWorkerPool(1)
+	p.acquire()
+
+	acquired := make(chan struct{})
+	go func() {
+		p.acquire()
+		close(acquired)
+	}()
+	select {
+	case <-acquired:
+		t.Fatal("acquired a worker of a full pool")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	p.resize(2)
+	<-acquired
+	busy, size := p.stats()
+	assert.Equal(t, 2, busy)
+	assert.Equal(t, 2, size)
+
+	// shrinking keeps the busy workers until they are released
+	p.resize(1)
+	p.release()
+	busy, _ = p.stats()
+	assert.Equal(t, 1, busy)
+	p.release()
+	p.acquire()
+	busy, size = p.stats()
+	assert.Equal(t, 1, busy)
+	assert.Equal(t, 1, size)
+}
+
+func TestReconfigure(t *testing.T) {
+	mockDB, _, err := sqlmock.New()
+	assert.NoError(t, err)
+	ctx := appcontext.NewContext(mockDB, 1)
+	ctx.CacheOptions.TTL = time.Minute
+	srv := NewServer(ctx)
+	srv.waitForInit()
+	srv.store.data[Role].Set("a@b.c", "admin")
+	srv.store.data[Role].Set("d@e.f", "user")
+
+	cfg := appcontext.DefaultConfig()
+	cfg.Cache.TTL = appcontext.Duration(time.Hour)
+	cfg.Cache.MaxEntries = 1
+	cfg.Queue.Workers = 4
+	srv.Reconfigure(cfg)
+
+	for _, c := range srv.store.data {
+		assert.Equal(t, time.Hour, c.Options().TTL)
+		assert.Equal(t, 1, c.Options().MaxEntries)
+		assert.NotNil(t, c.Options().Fallback)
+	}
+	assert.Equal(t, 1, srv.store.data[Role].Len())
+	assert.Equal(t, 4, srv.QueueStats().Workers)
+
+	// GOMAXPROCS goes back to the value the process started with once the setting is cleared
+	defer runtime.GOMAXPROCS(defaultMaxProcs)
+	cfg.Runtime.MaxProcs = defaultMaxProcs + 1
+	srv.Reconfigure(cfg)
+	assert.Equal(t, defaultMaxProcs+1, runtime.GOMAXPROCS(0))
+	cfg.Runtime.MaxProcs = 0
+	srv.Reconfigure(cfg)
+	assert.Equal(t, defaultMaxProcs, runtime.GOMAXPROCS(0))
+}
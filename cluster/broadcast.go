@@ -0,0 +1,543 @@
+package cluster
+
+import (
+	"bytes"
+	"cacheServer/cache"
+	"cacheServer/logging"
+	"cacheServer/typedcache"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// maxSeen is the number of message ids remembered to drop duplicates.
+	maxSeen = 100000
+	// maxVersions is the number of entries, indices and parents whose last applied version is remembered.
+	maxVersions = 100000
+)
+
+// Op is the mutation a Message replays on the other nodes.
+type Op string
+
+const (
+	// OpDeleteEntry drops an entry of a typed cache, DeleteCache.
+	OpDeleteEntry Op = "deleteEntry"
+	// OpReleaseIndex makes an index available, UpdateCategoryIndexCache and the like.
+	OpReleaseIndex Op = "releaseIndex"
+	// OpAllocateIndex takes an index, DeleteCategoryIndexCache and the like.
+	OpAllocateIndex Op = "allocateIndex"
+	// OpCreateParent resets the index space of a category or subcategory, CreateSubcategoryCache and
+	// CreateProductCache.
+	OpCreateParent Op = "createParent"
+	// OpInvalidateRoles drops the cached role model, InvalidateRoles.
+	OpInvalidateRoles Op = "invalidateRoles"
+)
+
+// Message is a mutation made on one node, sent to the others. ID makes its delivery idempotent.
+// Version is the hybrid logical clock of the origin when the mutation was made, its wall time in
+// nanoseconds unless it already saw a later version: of two messages for the same entry, index or parent,
+// the one with the higher (Version, Origin) wins whatever their arrival order. Being seeded from the wall
+// time, the clock of a restarted node is past the versions it sent before.
+// An index message older than the last createParent of its parent lost to it as well.
+type Message struct {
+	ID      string     `json:"id"`
+	Origin  string     `json:"origin"`
+	Version uint64     `json:"version"`
+	Op      Op         `json:"op"`
+	Tenant  string     `json:"tenant,omitempty"`
+	Type    cache.Type `json:"type"`
+	Key     string     `json:"key,omitempty"` // id of the entry, categoryID or subcategoryID of the index
+	Index   int        `json:"index,omitempty"`
+}
+
+// slot names what the message mutates, messages of one slot are ordered by version.
+func (m Message) slot() string {
+	switch m.Op {
+	case OpReleaseIndex, OpAllocateIndex:
+		return m.indexPrefix() + strconv.Itoa(m.Index)
+	case OpDeleteEntry:
+		return "entry/" + m.Tenant + "/" + m.Type.String() + "/" + m.Key
+	case OpCreateParent:
+		return m.parentSlot()
+	}
+	return string(m.Op)
+}
+
+// parentSlot names the parent of an index or createParent message, which orders the messages of the
+// parent against each other.
+func (m Message) parentSlot() string {
+	return "parent/" + m.Tenant + "/" + m.Type.String() + "/" + m.Key
+}
+
+// lockSlot names the slot locked while msg is checked, applied and recorded: the parent of index messages.
+func (m Message) lockSlot() string {
+	if m.Op == OpReleaseIndex || m.Op == OpAllocateIndex {
+		return m.parentSlot()
+	}
+	return m.slot()
+}
+
+// indexPrefix prefixes the slots of the indices of the parent of the message.
+func (m Message) indexPrefix() string {
+	return "index/" + m.Tenant + "/" + m.Type.String() + "/" + m.Key + "/"
+}
+
+// stamp is the version of the last message applied to a slot.
+type stamp struct {
+	version uint64
+	origin  string
+	op      Op // of an index slot, redone after an older createParent of its parent
+}
+
+func (s stamp) after(other stamp) bool {
+	return s.version > other.version || (s.version == other.version && s.origin > other.origin)
+}
+
+// BroadcastStats are the counters of the mutations exchanged with the other nodes.
+type BroadcastStats struct {
+	Sent       uint64 `json:"sent"`       // messages delivered to a peer
+	SendErrors uint64 `json:"sendErrors"` // messages a peer did not acknowledge
+	Received   uint64 `json:"received"`
+	Duplicates uint64 `json:"duplicates"` // received again, by id
+	Stale      uint64 `json:"stale"`      // older than the last mutation of their slot
+	Applied    uint64 `json:"applied"`
+}
+
+// slotLock is the lock of a slot, dropped once no mutation holds or waits for it.
+type slotLock struct {
+	sync.Mutex
+	refs int
+}
+
+// broadcaster numbers the local mutations and applies the ones of the peers at most once, in version
+// order per slot.
+type broadcaster struct {
+	clock    atomic.Uint64 // hybrid logical clock, see Message.Version
+	seenMu   sync.Mutex
+	seen     map[string]struct{}
+	seenFIFO []string
+	versions *typedcache.Cache[string, stamp]
+	locksMu  sync.Mutex           // guards locks, never held while a mutation runs
+	locks    map[string]*slotLock // makes checking, applying and recording the version of a slot atomic
+
+	sent, sendErrors, received, duplicates, stale, applied atomic.Uint64
+}
+
+func newBroadcaster() *broadcaster {
+	noLoad := typedcache.LoaderFunc[string, stamp](func(string) (stamp, error) { return stamp{}, typedcache.ErrNotFound })
+	return &broadcaster{
+		seen:     make(map[string]struct{}),
+		locks:    make(map[string]*slotLock),
+		versions: typedcache.New[string, stamp](noLoad, typedcache.Options{MaxEntries: maxVersions}),
+	}
+}
+
+// firstDelivery remembers id and reports whether it was not seen before.
+func (b *broadcaster) firstDelivery(id string) bool {
+	b.seenMu.Lock()
+	defer b.seenMu.Unlock()
+	if _, ok := b.seen[id]; ok {
+		return false
+	}
+	b.seen[id] = struct{}{}
+	b.seenFIFO = append(b.seenFIFO, id)
+	if len(b.seenFIFO) > maxSeen {
+		delete(b.seen, b.seenFIFO[0])
+		b.seenFIFO = b.seenFIFO[1:]
+	}
+	return true
+}
+
+// lock waits for the lock of slot and returns the function releasing it.
+func (b *broadcaster) lock(slot string) (unlock func()) {
+	b.locksMu.Lock()
+	l, ok := b.locks[slot]
+	if !ok {
+		l = &slotLock{}
+		b.locks[slot] = l
+	}
+	l.refs++
+	b.locksMu.Unlock()
+	l.Lock()
+	return func() {
+		l.Unlock()
+		b.locksMu.Lock()
+		if l.refs--; l.refs == 0 {
+			delete(b.locks, slot)
+		}
+		b.locksMu.Unlock()
+	}
+}
+
+// forget drops id so that the message is applied when it is delivered again.
+func (b *broadcaster) forget(id string) {
+	b.seenMu.Lock()
+	defer b.seenMu.Unlock()
+	delete(b.seen, id)
+}
+
+// isStale reports whether s is not after the last version recorded for the slot of msg, or for an index
+// message, the last createParent of its parent.
+func (b *broadcaster) isStale(msg Message, s stamp) bool {
+	if last, ok := b.versions.Peek(msg.slot()); ok && !s.after(last) {
+		return true
+	}
+	if msg.Op == OpReleaseIndex || msg.Op == OpAllocateIndex {
+		if created, ok := b.versions.Peek(msg.parentSlot()); ok && !s.after(created) {
+			return true
+		}
+	}
+	return false
+}
+
+// tick advances the clock to the wall time, or by one if it is ahead of it, and returns the new version.
+func (b *broadcaster) tick() uint64 {
+	for {
+		c := b.clock.Load()
+		next := c + 1
+		if now := uint64(time.Now().UnixNano()); now > next {
+			next = now
+		}
+		if b.clock.CompareAndSwap(c, next) {
+			return next
+		}
+	}
+}
+
+// witness moves the clock past a received version.
+func (b *broadcaster) witness(version uint64) {
+	for {
+		c := b.clock.Load()
+		if version <= c || b.clock.CompareAndSwap(c, version) {
+			return
+		}
+	}
+}
+
+func (b *broadcaster) stats() BroadcastStats {
+	return BroadcastStats{
+		Sent:       b.sent.Load(),
+		SendErrors: b.sendErrors.Load(),
+		Received:   b.received.Load(),
+		Duplicates: b.duplicates.Load(),
+		Stale:      b.stale.Load(),
+		Applied:    b.applied.Load(),
+	}
+}
+
+// mutate runs the local mutation op and, when it succeeded, sends msg to the other nodes. The version of
+// the slot is recorded along so that an older message of a peer cannot undo the mutation. With consensus
+// on, index mutations go through the Raft log instead.
+func (n *Node) mutate(msg Message, op func() error) error {
+	if c := n.consensus.Load(); c != nil && msg.Op != OpDeleteEntry && msg.Op != OpInvalidateRoles {
+		return c.propose(msg)
+	}
+	b := n.broadcast
+	unlock := b.lock(msg.lockSlot())
+	msg.Origin, msg.ID, msg.Version = n.cfg.Self, newMessageID(), b.tick()
+	err := op()
+	if err == nil {
+		b.versions.Set(msg.slot(), stamp{version: msg.Version, origin: msg.Origin, op: msg.Op})
+	}
+	unlock()
+	if err == nil {
+		go n.send(msg)
+	}
+	return err
+}
+
+// send delivers msg to every member of the ring but this node, best effort.
+func (n *Node) send(msg Message) {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		log.Println("cluster message not encoded", err)
+		return
+	}
+	var wg sync.WaitGroup
+	for _, peer := range n.ring.Load().Members() {
+		if peer == n.cfg.Self {
+			continue
+		}
+		wg.Add(1)
+		go func(peer string) {
+			defer wg.Done()
+			req, err := http.NewRequest(http.MethodPost, "http://"+peer+PathPrefix+"/broadcast", bytes.NewReader(data))
+			if err != nil {
+				return
+			}
+			req.Header.Set("Content-Type", "application/json")
+			resp, err := n.do(req)
+			if err != nil {
+				n.broadcast.sendErrors.Add(1)
+				log.Println("cluster peer", peer, "missed", msg.Op, "message", msg.ID, err)
+				return
+			}
+			resp.Body.Close()
+			n.broadcast.sent.Add(1)
+		}(peer)
+	}
+	wg.Wait()
+}
+
+// apply replays msg of a peer on the local cache unless it was delivered before or a newer mutation of
+// its slot was applied already. A message that fails is forgotten, so that it applies once delivered again.
+func (n *Node) apply(msg Message) error {
+	b := n.broadcast
+	b.received.Add(1)
+	if !b.firstDelivery(msg.ID) {
+		b.duplicates.Add(1)
+		return nil
+	}
+	b.witness(msg.Version)
+	s := stamp{version: msg.Version, origin: msg.Origin, op: msg.Op}
+	defer b.lock(msg.lockSlot())()
+	if b.isStale(msg, s) {
+		b.stale.Add(1)
+		logging.Debugln("cluster message", msg.ID, "older than the last mutation of", msg.slot())
+		return nil
+	}
+	if err := n.replay(msg); err != nil {
+		b.forget(msg.ID)
+		return err
+	}
+	b.versions.Set(msg.slot(), s)
+	if msg.Op == OpCreateParent {
+		n.redoIndices(msg, s)
+	}
+	b.applied.Add(1)
+	return nil
+}
+
+// redoIndices applies again the index messages of the parent created by msg that are newer than it. They
+// arrived first, the reset of the parent undid them. The caller holds the lock of the parent.
+func (n *Node) redoIndices(msg Message, created stamp) {
+	prefix := msg.indexPrefix()
+	for _, e := range n.broadcast.versions.Entries() {
+		if !strings.HasPrefix(e.Key, prefix) || !e.Value.after(created) {
+			continue
+		}
+		index, err := strconv.Atoi(strings.TrimPrefix(e.Key, prefix))
+		if err != nil {
+			continue
+		}
+		redo := Message{Op: e.Value.op, Tenant: msg.Tenant, Type: msg.Type, Key: msg.Key, Index: index}
+		if err := n.replay(redo); err != nil {
+			log.Println("cluster", redo.Op, "of", e.Key, "not applied again after", msg.ID, err)
+		}
+	}
+}
+
+// replay runs the mutation of msg on the local cache, without sending it again.
+func (n *Node) replay(msg Message) error {
+	if msg.Op == OpInvalidateRoles {
+		n.AppCache.InvalidateRoles()
+		return nil
+	}
+	var ns cache.Namespace = n.AppCache
+	if msg.Tenant != "" {
+		var err error
+		if ns, err = n.AppCache.Tenant(msg.Tenant); err != nil {
+			return err
+		}
+	}
+	switch msg.Op {
+	case OpDeleteEntry:
+		ns.DeleteCache(msg.Key, msg.Type)
+		return nil
+	case OpCreateParent:
+		if msg.Type == cache.Product {
+			return ns.CreateProductCache(msg.Key)
+		}
+		return ns.CreateSubcategoryCache(msg.Key)
+	case OpReleaseIndex:
+		switch msg.Type {
+		case cache.Category:
+			return ns.UpdateCategoryIndexCache(msg.Index)
+		case cache.Subcategory:
+			return ns.UpdateSubcategoryIndexCache(msg.Index, msg.Key)
+		}
+		return ns.UpdateProductCacheIndex(msg.Index, msg.Key)
+	case OpAllocateIndex:
+		switch msg.Type {
+		case cache.Category:
+			return ns.DeleteCategoryIndexCache(msg.Index)
+		case cache.Subcategory:
+			return ns.DeleteSubcategoryIndexCache(msg.Key, msg.Index)
+		}
+		return ns.DeleteProductCacheIndex(msg.Key, msg.Index)
+	}
+	return nil
+}
+
+func (n *Node) serveBroadcast(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var msg Message
+	if err := json.NewDecoder(r.Body).Decode(&msg); err != nil || msg.ID == "" {
+		http.Error(w, "invalid message", http.StatusBadRequest)
+		return
+	}
+	if err := n.apply(msg); err != nil {
+		log.Println("cluster message", msg.ID, "from", msg.Origin, "not applied", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// replicated is a cache.Namespace sending its mutations to the other nodes.
+type replicated struct {
+	cache.Namespace
+	node   *Node
+	tenant string
+}
+
+func (r replicated) message(op Op, t cache.Type, key string, index int) Message {
+	return Message{Op: op, Tenant: r.tenant, Type: t, Key: key, Index: index}
+}
+
+// DeleteCache ...
+func (r replicated) DeleteCache(id string, t cache.Type) {
+	r.node.mutate(r.message(OpDeleteEntry, t, id, 0), func() error {
+		r.Namespace.DeleteCache(id, t)
+		return nil
+	})
+}
+
+// UpdateCategoryIndexCache ...
+func (r replicated) UpdateCategoryIndexCache(index int) error {
+	return r.node.mutate(r.message(OpReleaseIndex, cache.Category, "", index), func() error {
+		return r.Namespace.UpdateCategoryIndexCache(index)
+	})
+}
+
+// DeleteCategoryIndexCache ...
+func (r replicated) DeleteCategoryIndexCache(key int) error {
+	return r.node.mutate(r.message(OpAllocateIndex, cache.Category, "", key), func() error {
+		return r.Namespace.DeleteCategoryIndexCache(key)
+	})
+}
+
+// UpdateSubcategoryIndexCache ...
+func (r replicated) UpdateSubcategoryIndexCache(index int, categoryID string) error {
+	return r.node.mutate(r.message(OpReleaseIndex, cache.Subcategory, categoryID, index), func() error {
+		return r.Namespace.UpdateSubcategoryIndexCache(index, categoryID)
+	})
+}
+
+// DeleteSubcategoryIndexCache ...
+func (r replicated) DeleteSubcategoryIndexCache(categoryID string, index int) error {
+	return r.node.mutate(r.message(OpAllocateIndex, cache.Subcategory, categoryID, index), func() error {
+		return r.Namespace.DeleteSubcategoryIndexCache(categoryID, index)
+	})
+}
+
+// CreateSubcategoryCache ...
+func (r replicated) CreateSubcategoryCache(categoryID string) error {
+	return r.node.mutate(r.message(OpCreateParent, cache.Subcategory, categoryID, 0), func() error {
+		return r.Namespace.CreateSubcategoryCache(categoryID)
+	})
+}
+
+// UpdateProductCacheIndex ...
+func (r replicated) UpdateProductCacheIndex(index int, subcategoryID string) error {
+	return r.node.mutate(r.message(OpReleaseIndex, cache.Product, subcategoryID, index), func() error {
+		return r.Namespace.UpdateProductCacheIndex(index, subcategoryID)
+	})
+}
+
+// DeleteProductCacheIndex ...
+func (r replicated) DeleteProductCacheIndex(subcategoryID string, key int) error {
+	return r.node.mutate(r.message(OpAllocateIndex, cache.Product, subcategoryID, key), func() error {
+		return r.Namespace.DeleteProductCacheIndex(subcategoryID, key)
+	})
+}
+
+// CreateProductCache ...
+func (r replicated) CreateProductCache(subcategoryID string) error {
+	return r.node.mutate(r.message(OpCreateParent, cache.Product, subcategoryID, 0), func() error {
+		return r.Namespace.CreateProductCache(subcategoryID)
+	})
+}
+
+// newMessageID returns a random message id.
+func newMessageID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Tenant returns the namespace of tenant, its mutations being sent to the other nodes.
+func (n *Node) Tenant(tenant string) (cache.Namespace, error) {
+	ns, err := n.AppCache.Tenant(tenant)
+	if err != nil {
+		return nil, err
+	}
+	return replicated{Namespace: ns, node: n, tenant: tenant}, nil
+}
+
+// InvalidateRoles drops the role model of every node.
+func (n *Node) InvalidateRoles() {
+	n.mutate(Message{Op: OpInvalidateRoles}, func() error {
+		n.AppCache.InvalidateRoles()
+		return nil
+	})
+}
+
+// defaultNamespace is the default namespace of the node, sending its mutations to the other nodes.
+func (n *Node) defaultNamespace() replicated {
+	return replicated{Namespace: n.AppCache, node: n}
+}
+
+// DeleteCache ...
+func (n *Node) DeleteCache(id string, t cache.Type) { n.defaultNamespace().DeleteCache(id, t) }
+
+// UpdateCategoryIndexCache ...
+func (n *Node) UpdateCategoryIndexCache(index int) error {
+	return n.defaultNamespace().UpdateCategoryIndexCache(index)
+}
+
+// DeleteCategoryIndexCache ...
+func (n *Node) DeleteCategoryIndexCache(key int) error {
+	return n.defaultNamespace().DeleteCategoryIndexCache(key)
+}
+
+// UpdateSubcategoryIndexCache ...
+func (n *Node) UpdateSubcategoryIndexCache(index int, categoryID string) error {
+	return n.defaultNamespace().UpdateSubcategoryIndexCache(index, categoryID)
+}
+
+// DeleteSubcategoryIndexCache ...
+func (n *Node) DeleteSubcategoryIndexCache(categoryID string, index int) error {
+	return n.defaultNamespace().DeleteSubcategoryIndexCache(categoryID, index)
+}
+
+// CreateSubcategoryCache ...
+func (n *Node) CreateSubcategoryCache(categoryID string) error {
+	return n.defaultNamespace().CreateSubcategoryCache(categoryID)
+}
+
+// UpdateProductCacheIndex ...
+func (n *Node) UpdateProductCacheIndex(index int, subcategoryID string) error {
+	return n.defaultNamespace().UpdateProductCacheIndex(index, subcategoryID)
+}
+
+// DeleteProductCacheIndex ...
+func (n *Node) DeleteProductCacheIndex(subcategoryID string, key int) error {
+	return n.defaultNamespace().DeleteProductCacheIndex(subcategoryID, key)
+}
+
+// CreateProductCache ...
+func (n *Node) CreateProductCache(subcategoryID string) error {
+	return n.defaultNamespace().CreateProductCache(subcategoryID)
+}
@@ -0,0 +1,170 @@
+package cluster
+
+import (
+	"bytes"
+	"cacheServer/cache"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func entries(node *testNode) int {
+	return node.server.Metrics().Caches[cache.Product].Entries
+}
+
+func categoryIndexFree(t *testing.T, ns cache.Namespace, index int) bool {
+	indices, err := ns.GetCategoryIndicesCache()
+	assert.NoError(t, err)
+	for _, i := range indices {
+		if i == index {
+			return true
+		}
+	}
+	return false
+}
+
+func TestBroadcastInvalidation(t *testing.T) {
+	nodes := newTestCluster(t, 3, "s3cret")
+	for _, node := range nodes {
+		// load p1 on every node, bypassing the ring
+		req := cache.NewRequest("p1", cache.Product, nil)
+		node.server.MakeRequest(req)
+		assert.True(t, <-req.Out)
+		assert.Equal(t, 1, entries(node))
+	}
+
+	nodes[0].DeleteCache("p1", cache.Product)
+	for _, node := range nodes {
+		assert.Eventually(t, func() bool { return entries(node) == 0 }, time.Second, 10*time.Millisecond)
+	}
+	assert.Eventually(t, func() bool { return nodes[0].ClusterStats().Broadcast.Sent == 2 }, time.Second, 10*time.Millisecond)
+	for _, node := range nodes[1:] {
+		assert.Equal(t, BroadcastStats{Received: 1, Applied: 1}, node.ClusterStats().Broadcast)
+	}
+}
+
+func TestBroadcastIndexMutations(t *testing.T) {
+	nodes := newTestCluster(t, 3, "")
+	// c1 holds index 1, only 2 is free until an index is released
+	assert.NoError(t, nodes[0].UpdateCategoryIndexCache(7))
+	for _, node := range nodes {
+		assert.Eventually(t, func() bool { return categoryIndexFree(t, node, 7) }, time.Second, 10*time.Millisecond)
+	}
+	assert.NoError(t, nodes[2].DeleteCategoryIndexCache(7))
+	for _, node := range nodes {
+		assert.Eventually(t, func() bool { return !categoryIndexFree(t, node, 7) }, time.Second, 10*time.Millisecond)
+	}
+
+	// tenant namespaces are replicated too
+	ns, err := nodes[1].Tenant("acme")
+	assert.NoError(t, err)
+	assert.NoError(t, ns.UpdateCategoryIndexCache(9))
+	for _, node := range nodes {
+		tenant, err := node.server.Tenant("acme")
+		assert.NoError(t, err)
+		assert.Eventually(t, func() bool { return categoryIndexFree(t, tenant, 9) }, time.Second, 10*time.Millisecond)
+	}
+	assert.False(t, categoryIndexFree(t, nodes[0].server, 9), "the default namespace is left alone")
+}
+
+func TestBroadcastOrdering(t *testing.T) {
+	nodes := newTestCluster(t, 1, "")
+	node := nodes[0]
+	steps := []struct {
+		name  string
+		msg   Message
+		stats BroadcastStats
+	}{
+		{
+			name:  "newer message is applied",
+			msg:   Message{ID: "m1", Origin: "b:1", Version: 10, Op: OpAllocateIndex, Type: cache.Category, Index: 3},
+			stats: BroadcastStats{Received: 1, Applied: 1},
+		},
+		{
+			name:  "duplicate is dropped",
+			msg:   Message{ID: "m1", Origin: "b:1", Version: 11, Op: OpReleaseIndex, Type: cache.Category, Index: 3},
+			stats: BroadcastStats{Received: 2, Applied: 1, Duplicates: 1},
+		},
+		{
+			name:  "older message arriving late is stale",
+			msg:   Message{ID: "m2", Origin: "a:1", Version: 5, Op: OpReleaseIndex, Type: cache.Category, Index: 3},
+			stats: BroadcastStats{Received: 3, Applied: 1, Duplicates: 1, Stale: 1},
+		},
+		{
+			name:  "same version loses to the higher origin",
+			msg:   Message{ID: "m3", Origin: "a:1", Version: 10, Op: OpReleaseIndex, Type: cache.Category, Index: 3},
+			stats: BroadcastStats{Received: 4, Applied: 1, Duplicates: 1, Stale: 2},
+		},
+	}
+	for _, step := range steps {
+		assert.NoError(t, node.apply(step.msg), step.name)
+		assert.False(t, categoryIndexFree(t, node.server, 3), step.name)
+		assert.Equal(t, step.stats, node.ClusterStats().Broadcast, step.name)
+	}
+
+	// the clock moved past the versions seen, so a local mutation wins over them
+	assert.NoError(t, node.UpdateCategoryIndexCache(3))
+	assert.True(t, categoryIndexFree(t, node.server, 3))
+	assert.NoError(t, node.apply(Message{ID: "m4", Origin: "z:1", Version: 10, Op: OpAllocateIndex, Type: cache.Category, Index: 3}))
+	assert.True(t, categoryIndexFree(t, node.server, 3))
+}
+
+func TestBroadcastAfterRestart(t *testing.T) {
+	nodes := newTestCluster(t, 2, "s3cret")
+	assert.NoError(t, nodes[0].UpdateCategoryIndexCache(7))
+	assert.Eventually(t, func() bool { return categoryIndexFree(t, nodes[1], 7) }, time.Second, 10*time.Millisecond)
+	assert.Eventually(t, func() bool { return nodes[0].ClusterStats().Broadcast.Sent == 1 }, time.Second, 10*time.Millisecond)
+
+	// a restarted node starts over with its clock and versions, its next change still wins on the peers
+	nodes[0].broadcast = newBroadcaster()
+	assert.NoError(t, nodes[0].DeleteCategoryIndexCache(7))
+	assert.Eventually(t, func() bool { return !categoryIndexFree(t, nodes[1], 7) }, time.Second, 10*time.Millisecond)
+	assert.Equal(t, BroadcastStats{Received: 2, Applied: 2}, nodes[1].ClusterStats().Broadcast)
+}
+
+func TestBroadcastParentOrdering(t *testing.T) {
+	node := newTestCluster(t, 1, "")[0]
+	subcategories := func() []int {
+		indices, err := node.server.GetSubcategoryIndicesCache("c1")
+		assert.NoError(t, err)
+		return indices
+	}
+	assert.Equal(t, []int{2}, subcategories())
+
+	// c1 was created at version 5 and index 7 released under it at 10, the release arrives first
+	release := Message{ID: "m1", Origin: "b:1", Version: 10, Op: OpReleaseIndex, Type: cache.Subcategory, Key: "c1", Index: 7}
+	assert.NoError(t, node.apply(release))
+	assert.Equal(t, []int{2, 7}, subcategories())
+	create := Message{ID: "m2", Origin: "b:1", Version: 5, Op: OpCreateParent, Type: cache.Subcategory, Key: "c1"}
+	assert.NoError(t, node.apply(create))
+	assert.Equal(t, []int{1, 7}, subcategories(), "the reset is applied and the newer release again")
+
+	// an index message older than the last creation of its parent lost to it
+	allocate := Message{ID: "m3", Origin: "a:1", Version: 4, Op: OpAllocateIndex, Type: cache.Subcategory, Key: "c1", Index: 1}
+	assert.NoError(t, node.apply(allocate))
+	assert.Equal(t, []int{1, 7}, subcategories())
+	assert.Equal(t, BroadcastStats{Received: 3, Applied: 2, Stale: 1}, node.ClusterStats().Broadcast)
+}
+
+func TestBroadcastNotApplied(t *testing.T) {
+	node := newTestCluster(t, 1, "")[0]
+	post := func(msg Message) int {
+		data, err := json.Marshal(msg)
+		assert.NoError(t, err)
+		resp, err := http.Post(node.http.URL+PathPrefix+"/broadcast", "application/json", bytes.NewReader(data))
+		assert.NoError(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	msg := Message{ID: "m1", Origin: "b:1", Version: 1, Op: OpReleaseIndex, Type: cache.Category, Index: 300}
+	assert.Equal(t, http.StatusInternalServerError, post(msg), "the sender learns the mutation failed")
+	assert.Equal(t, http.StatusInternalServerError, post(msg), "a failed message is not a duplicate")
+	assert.Equal(t, BroadcastStats{Received: 2}, node.ClusterStats().Broadcast)
+
+	msg.Index = 3
+	assert.Equal(t, http.StatusOK, post(msg))
+	assert.True(t, categoryIndexFree(t, node.server, 3))
+}
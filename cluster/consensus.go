@@ -0,0 +1,342 @@
+package cluster
+
+import (
+	"bytes"
+	"cacheServer/apperror"
+	"cacheServer/logging"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/raft"
+)
+
+const (
+	// retryDelay is the pause before proposing again while the group has no leader.
+	retryDelay = 20 * time.Millisecond
+	// maxPool is the number of connections kept open to each Raft peer.
+	maxPool = 3
+)
+
+var errNoLeader = errors.New("no raft leader")
+
+// ConsensusConfig makes the index mutations of the nodes go through a Raft group: every allocation,
+// release and reset of an index space is appended to a replicated log and applied in log order on each
+// node, so that of two nodes allocating the same index at once only one succeeds.
+type ConsensusConfig struct {
+	Servers   map[string]string // Self of every node, this one included, vs the address of its Raft transport
+	Transport raft.Transport    // nil for a TCP transport on the Raft address of this node, checking the cluster secret
+	Raft      *raft.Config      // timeouts, raft.DefaultConfig() when nil
+}
+
+// ConsensusStats are the Raft state of a node.
+type ConsensusStats struct {
+	State        string `json:"state"`  // Leader, Follower or Candidate
+	Leader       string `json:"leader"` // Self of the leader, empty during an election
+	AppliedIndex uint64 `json:"appliedIndex"`
+	Conflicts    uint64 `json:"conflicts"` // allocations refused as the index was taken
+}
+
+// consensus proposes the index mutations of a node to the Raft group.
+type consensus struct {
+	node    *Node
+	raft    *raft.Raft
+	fsm     *indexFSM
+	timeout time.Duration
+	owned   io.Closer // the transport StartConsensus opened, nil for one passed in
+}
+
+// StartConsensus makes the index mutations of the node go through a Raft group of cfg.Servers, from
+// then on. The group is bootstrapped with every server, the log being kept in memory as the indices
+// are read from the database again on restart. Call Close to leave the group.
+func (n *Node) StartConsensus(cfg ConsensusConfig) error {
+	addr, ok := cfg.Servers[n.cfg.Self]
+	if !ok {
+		return fmt.Errorf("cluster consensus: %s is not one of the servers", n.cfg.Self)
+	}
+	transport := cfg.Transport
+	var owned io.Closer
+	if transport == nil {
+		if n.cfg.Secret == "" {
+			return errors.New("cluster consensus: the Raft transport requires a cluster secret")
+		}
+		tcp, err := newSecretTransport(addr, n.cfg.Secret, n.cfg.Timeout)
+		if err != nil {
+			return fmt.Errorf("cluster consensus: %w", err)
+		}
+		transport, owned = tcp, tcp
+	}
+	conf := raft.DefaultConfig()
+	if cfg.Raft != nil {
+		c := *cfg.Raft
+		conf = &c
+	}
+	conf.LocalID = raft.ServerID(n.cfg.Self)
+	conf.Logger = hclog.New(&hclog.LoggerOptions{Name: "raft", Level: hclog.Warn, Output: log.Writer()})
+
+	fsm := &indexFSM{node: n, allocated: make(map[string]Message)}
+	store := raft.NewInmemStore()
+	r, err := raft.NewRaft(conf, fsm, store, store, raft.NewInmemSnapshotStore(), transport)
+	if err != nil {
+		if owned != nil {
+			owned.Close()
+		}
+		return fmt.Errorf("cluster consensus: %w", err)
+	}
+	var servers []raft.Server
+	for id, addr := range cfg.Servers {
+		servers = append(servers, raft.Server{ID: raft.ServerID(id), Address: raft.ServerAddress(addr)})
+	}
+	sort.Slice(servers, func(i, j int) bool { return servers[i].ID < servers[j].ID })
+	if err := r.BootstrapCluster(raft.Configuration{Servers: servers}).Error(); err != nil && err != raft.ErrCantBootstrap {
+		r.Shutdown()
+		if owned != nil {
+			owned.Close()
+		}
+		return fmt.Errorf("cluster consensus: %w", err)
+	}
+	n.consensus.Store(&consensus{node: n, raft: r, fsm: fsm, timeout: n.cfg.Timeout, owned: owned})
+	return nil
+}
+
+// Close leaves the Raft group, if any.
+func (n *Node) Close() error {
+	if c := n.consensus.Swap(nil); c != nil {
+		err := c.raft.Shutdown().Error()
+		if c.owned != nil {
+			c.owned.Close()
+		}
+		return err
+	}
+	return nil
+}
+
+// propose appends msg to the log, through the leader, and returns once this node applied it, with the
+// error of the mutation. While there is no leader, msg is proposed again until the timeout.
+func (c *consensus) propose(msg Message) error {
+	deadline := time.Now().Add(c.timeout)
+	for {
+		index, result, err := c.try(msg)
+		if err == nil {
+			if err := c.waitApplied(index, deadline); err != nil {
+				return err
+			}
+			return result
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("cluster consensus: %w", err)
+		}
+		logging.Debugln("cluster consensus: proposing", msg.Op, "again:", err)
+		time.Sleep(retryDelay)
+	}
+}
+
+// try proposes msg to the current leader once.
+func (c *consensus) try(msg Message) (index uint64, result error, err error) {
+	_, leader := c.raft.LeaderWithID()
+	switch string(leader) {
+	case "":
+		return 0, nil, errNoLeader
+	case c.node.cfg.Self:
+		return c.apply(msg)
+	}
+	return c.forward(string(leader), msg)
+}
+
+// apply appends msg to the log of this node, the leader, and returns its log index and the error of
+// the mutation.
+func (c *consensus) apply(msg Message) (index uint64, result error, err error) {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return 0, nil, err
+	}
+	f := c.raft.Apply(data, c.timeout)
+	if err := f.Error(); err != nil {
+		return 0, nil, err
+	}
+	result, _ = f.Response().(error)
+	return f.Index(), result, nil
+}
+
+// proposeResponse answers a follower once the leader committed its message.
+type proposeResponse struct {
+	Index uint64 `json:"index"`
+	Error string `json:"error,omitempty"`
+	Taken bool   `json:"taken,omitempty"` // the error is apperror.ErrIndexTaken
+}
+
+func (c *consensus) forward(leader string, msg Message) (index uint64, result error, err error) {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return 0, nil, err
+	}
+	req, err := http.NewRequest(http.MethodPost, "http://"+leader+PathPrefix+"/propose", bytes.NewReader(data))
+	if err != nil {
+		return 0, nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := c.node.do(req)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+	var out proposeResponse
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return 0, nil, err
+	}
+	switch {
+	case out.Taken:
+		result = fmt.Errorf("%w: %s", apperror.ErrIndexTaken, out.Error)
+	case out.Error != "":
+		result = errors.New(out.Error)
+	}
+	return out.Index, result, nil
+}
+
+// waitApplied waits for this node to apply the log up to index, so that a mutation is visible on the
+// node proposing it when propose returns.
+func (c *consensus) waitApplied(index uint64, deadline time.Time) error {
+	for c.fsm.applied.Load() < index {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("cluster consensus: log index %d not applied in time", index)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return nil
+}
+
+func (c *consensus) stats() ConsensusStats {
+	_, leader := c.raft.LeaderWithID()
+	return ConsensusStats{
+		State:        c.raft.State().String(),
+		Leader:       string(leader),
+		AppliedIndex: c.fsm.applied.Load(),
+		Conflicts:    c.fsm.conflicts.Load(),
+	}
+}
+
+func (n *Node) servePropose(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	c := n.consensus.Load()
+	if c == nil {
+		http.Error(w, "consensus is off", http.StatusNotFound)
+		return
+	}
+	var msg Message
+	if err := json.NewDecoder(r.Body).Decode(&msg); err != nil {
+		http.Error(w, "invalid message", http.StatusBadRequest)
+		return
+	}
+	index, result, err := c.apply(msg)
+	if err != nil {
+		// not the leader any more, the follower asks again
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	out := proposeResponse{Index: index}
+	if result != nil {
+		out.Error, out.Taken = result.Error(), errors.Is(result, apperror.ErrIndexTaken)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(out)
+}
+
+// indexFSM applies the committed index mutations to the local cache. It keeps the allocations made
+// through the log, refusing to allocate an index twice until it is released or its parent reset.
+type indexFSM struct {
+	node      *Node
+	mu        sync.Mutex
+	allocated map[string]Message // slot vs the allocation holding it
+	applied   atomic.Uint64      // log index of the last entry applied, raft.AppliedIndex runs ahead of it
+	conflicts atomic.Uint64
+}
+
+// Apply makes the mutation of a log entry on the local cache and only then records it, so that a
+// mutation the cache refuses leaves the allocations as they were.
+func (f *indexFSM) Apply(l *raft.Log) interface{} {
+	defer f.applied.Store(l.Index)
+	var msg Message
+	if err := json.Unmarshal(l.Data, &msg); err != nil {
+		return err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, taken := f.allocated[msg.slot()]; taken && msg.Op == OpAllocateIndex {
+		f.conflicts.Add(1)
+		return fmt.Errorf("%w: %s %d of %q", apperror.ErrIndexTaken, msg.Type, msg.Index, msg.Key)
+	}
+	if err := f.node.replay(msg); err != nil {
+		return err
+	}
+	switch msg.Op {
+	case OpAllocateIndex:
+		f.allocated[msg.slot()] = msg
+	case OpReleaseIndex:
+		delete(f.allocated, msg.slot())
+	case OpCreateParent:
+		prefix := msg.indexPrefix()
+		for slot := range f.allocated {
+			if strings.HasPrefix(slot, prefix) {
+				delete(f.allocated, slot)
+			}
+		}
+	}
+	return nil
+}
+
+// Snapshot ...
+func (f *indexFSM) Snapshot() (raft.FSMSnapshot, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	allocations := make([]Message, 0, len(f.allocated))
+	for _, msg := range f.allocated {
+		allocations = append(allocations, msg)
+	}
+	return allocationSnapshot(allocations), nil
+}
+
+// Restore replaces the allocations with the ones of a snapshot and applies them to the local cache.
+func (f *indexFSM) Restore(rc io.ReadCloser) error {
+	defer rc.Close()
+	var allocations []Message
+	if err := json.NewDecoder(rc).Decode(&allocations); err != nil {
+		return err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.allocated = make(map[string]Message, len(allocations))
+	for _, msg := range allocations {
+		if err := f.node.replay(msg); err != nil {
+			log.Println("cluster consensus: allocation of", msg.slot(), "not restored", err)
+			continue
+		}
+		f.allocated[msg.slot()] = msg
+	}
+	return nil
+}
+
+type allocationSnapshot []Message
+
+// Persist ...
+func (s allocationSnapshot) Persist(sink raft.SnapshotSink) error {
+	if err := json.NewEncoder(sink).Encode([]Message(s)); err != nil {
+		sink.Cancel()
+		return err
+	}
+	return sink.Close()
+}
+
+// Release ...
+func (s allocationSnapshot) Release() {}
@@ -0,0 +1,299 @@
+package cluster
+
+import (
+	"cacheServer/apperror"
+	"cacheServer/cache"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/raft"
+	"github.com/stretchr/testify/assert"
+)
+
+// newConsensusCluster starts n nodes whose index mutations go through a Raft group over in-memory
+// transports, and waits for a leader.
+func newConsensusCluster(t *testing.T, n int) []*testNode {
+	nodes := newTestCluster(t, n, "s3cret")
+	transports := make([]*raft.InmemTransport, n)
+	servers := make(map[string]string, n)
+	for i, node := range nodes {
+		var addr raft.ServerAddress
+		addr, transports[i] = raft.NewInmemTransport("")
+		servers[node.cfg.Self] = string(addr)
+	}
+	for i, a := range transports {
+		for j, b := range transports {
+			if i != j {
+				a.Connect(b.LocalAddr(), b)
+			}
+		}
+	}
+	conf := raft.DefaultConfig()
+	conf.HeartbeatTimeout = 50 * time.Millisecond
+	conf.ElectionTimeout = 50 * time.Millisecond
+	conf.LeaderLeaseTimeout = 50 * time.Millisecond
+	conf.CommitTimeout = 5 * time.Millisecond
+	for i, node := range nodes {
+		assert.NoError(t, node.StartConsensus(ConsensusConfig{Servers: servers, Transport: transports[i], Raft: conf}))
+		t.Cleanup(func() { node.Close() })
+	}
+	assert.Eventually(t, func() bool {
+		for _, node := range nodes {
+			if node.ClusterStats().Consensus.Leader == "" {
+				return false
+			}
+		}
+		return true
+	}, 5*time.Second, 10*time.Millisecond)
+	return nodes
+}
+
+func TestConsensusAllocatesOnce(t *testing.T) {
+	nodes := newConsensusCluster(t, 3)
+	// c1 holds index 1 and only 2 is free, every node sees index 2 released by node 0
+	assert.NoError(t, nodes[0].UpdateCategoryIndexCache(2))
+
+	errs := make([]error, len(nodes))
+	var wg sync.WaitGroup
+	for i, node := range nodes {
+		wg.Add(1)
+		go func(i int, node *testNode) {
+			defer wg.Done()
+			errs[i] = node.DeleteCategoryIndexCache(2)
+		}(i, node)
+	}
+	wg.Wait()
+	won := 0
+	for _, err := range errs {
+		if err == nil {
+			won++
+		} else {
+			assert.ErrorIs(t, err, apperror.ErrIndexTaken)
+		}
+	}
+	assert.Equal(t, 1, won, "one node allocates the index")
+	for _, node := range nodes {
+		// the proposing node applied the log before returning, the others catch up
+		assert.Eventually(t, func() bool { return !categoryIndexFree(t, node, 2) }, time.Second, 10*time.Millisecond)
+		assert.Equal(t, uint64(2), node.ClusterStats().Consensus.Conflicts)
+		assert.Zero(t, node.ClusterStats().Broadcast.Sent, "index mutations are not broadcast")
+	}
+
+	// released, the index can be allocated again, from a follower too
+	assert.NoError(t, nodes[1].UpdateCategoryIndexCache(2))
+	assert.True(t, categoryIndexFree(t, nodes[1], 2))
+	assert.NoError(t, nodes[2].DeleteCategoryIndexCache(2))
+	assert.False(t, categoryIndexFree(t, nodes[2], 2))
+
+	// resetting a parent forgets its allocations
+	assert.NoError(t, nodes[0].DeleteSubcategoryIndexCache("c1", 5))
+	assert.ErrorIs(t, nodes[1].DeleteSubcategoryIndexCache("c1", 5), apperror.ErrIndexTaken)
+	assert.NoError(t, nodes[2].CreateSubcategoryCache("c1"))
+	assert.NoError(t, nodes[1].DeleteSubcategoryIndexCache("c1", 5))
+}
+
+func TestConsensusLeaderFailover(t *testing.T) {
+	nodes := newConsensusCluster(t, 3)
+	leader := nodes[0].ClusterStats().Consensus.Leader
+	var rest []*testNode
+	for _, node := range nodes {
+		if node.cfg.Self == leader {
+			assert.NoError(t, node.Close())
+		} else {
+			rest = append(rest, node)
+		}
+	}
+	assert.Eventually(t, func() bool {
+		l := rest[0].ClusterStats().Consensus.Leader
+		return l != "" && l != leader
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.NoError(t, rest[0].UpdateCategoryIndexCache(4))
+	assert.NoError(t, rest[1].DeleteCategoryIndexCache(4))
+	assert.ErrorIs(t, rest[0].DeleteCategoryIndexCache(4), apperror.ErrIndexTaken)
+}
+
+// operation is an allocation or release of one index as seen by its caller.
+type operation struct {
+	allocate   bool
+	ok         bool // false for an allocation refused as the index was taken
+	call, done time.Time
+}
+
+// linearizable reports whether the history of one index can be ordered, respecting real time, so that
+// a sequential index yields the same results: an allocation succeeds only when the index is free and a
+// release always succeeds.
+func linearizable(history []operation) bool {
+	failed := make(map[string]bool)
+	var search func(done uint64, allocated bool) bool
+	search = func(done uint64, allocated bool) bool {
+		if done == 1<<len(history)-1 {
+			return true
+		}
+		state := fmt.Sprint(done, allocated)
+		if failed[state] {
+			return false
+		}
+		for i, op := range history {
+			if done&(1<<i) != 0 || !minimal(history, done, op) {
+				continue
+			}
+			next := allocated
+			if op.allocate {
+				if op.ok == allocated {
+					continue // the result does not match the index at this point
+				}
+				next = true
+			} else {
+				next = false
+			}
+			if search(done|1<<i, next) {
+				return true
+			}
+		}
+		failed[state] = true
+		return false
+	}
+	return search(0, false)
+}
+
+// minimal reports whether no pending operation of the history returned before op was called.
+func minimal(history []operation, done uint64, op operation) bool {
+	for i, other := range history {
+		if done&(1<<i) == 0 && other.done.Before(op.call) {
+			return false
+		}
+	}
+	return true
+}
+
+func TestConsensusLinearizable(t *testing.T) {
+	nodes := newConsensusCluster(t, 3)
+	indices := []int{10, 11, 12}
+	// the indices start free on every node
+	for _, index := range indices {
+		assert.NoError(t, nodes[0].DeleteCategoryIndexCache(index))
+		assert.NoError(t, nodes[0].UpdateCategoryIndexCache(index))
+	}
+
+	var mu sync.Mutex
+	histories := make(map[int][]operation)
+	var wg sync.WaitGroup
+	for w := 0; w < 6; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			node := nodes[w%len(nodes)]
+			rnd := rand.New(rand.NewSource(int64(w)))
+			for i := 0; i < 8; i++ {
+				index := indices[rnd.Intn(len(indices))]
+				op := operation{allocate: rnd.Intn(3) > 0, call: time.Now()}
+				var err error
+				if op.allocate {
+					err = node.DeleteCategoryIndexCache(index)
+				} else {
+					err = node.UpdateCategoryIndexCache(index)
+				}
+				op.done = time.Now()
+				if err != nil && !errors.Is(err, apperror.ErrIndexTaken) {
+					t.Error(err)
+					return
+				}
+				op.ok = err == nil
+				mu.Lock()
+				histories[index] = append(histories[index], op)
+				mu.Unlock()
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	for index, history := range histories {
+		assert.LessOrEqual(t, len(history), 64)
+		assert.True(t, linearizable(history), "history of index %d", index)
+	}
+	// every node ends up with the same indices
+	assert.Eventually(t, func() bool {
+		applied := nodes[0].ClusterStats().Consensus.AppliedIndex
+		for _, node := range nodes[1:] {
+			if node.ClusterStats().Consensus.AppliedIndex != applied {
+				return false
+			}
+		}
+		return true
+	}, time.Second, 10*time.Millisecond)
+	want, err := nodes[0].GetCategoryIndicesCache()
+	assert.NoError(t, err)
+	for _, node := range nodes[1:] {
+		got, err := node.GetCategoryIndicesCache()
+		assert.NoError(t, err)
+		assert.Equal(t, want, got)
+	}
+}
+
+func TestLinearizableChecker(t *testing.T) {
+	at := func(call, done int) (time.Time, time.Time) {
+		base := time.Unix(0, 0)
+		return base.Add(time.Duration(call) * time.Second), base.Add(time.Duration(done) * time.Second)
+	}
+	op := func(allocate, ok bool, call, done int) operation {
+		o := operation{allocate: allocate, ok: ok}
+		o.call, o.done = at(call, done)
+		return o
+	}
+	cases := map[string]struct {
+		history []operation
+		want    bool
+	}{
+		"concurrent allocations, one wins": {
+			history: []operation{op(true, true, 0, 2), op(true, false, 1, 3)},
+			want:    true,
+		},
+		"two allocations succeed": {
+			history: []operation{op(true, true, 0, 2), op(true, true, 1, 3)},
+			want:    false,
+		},
+		"allocation refused before any": {
+			history: []operation{op(true, false, 0, 1), op(true, true, 2, 3)},
+			want:    false,
+		},
+		"release between allocations": {
+			history: []operation{op(true, true, 0, 1), op(false, true, 2, 3), op(true, true, 4, 5)},
+			want:    true,
+		},
+		"concurrent release lets the allocation through": {
+			history: []operation{op(true, true, 0, 1), op(false, true, 2, 5), op(true, true, 3, 4)},
+			want:    true,
+		},
+	}
+	for k, v := range cases {
+		t.Run(k, func(t *testing.T) {
+			assert.Equal(t, v.want, linearizable(v.history))
+		})
+	}
+}
+
+func TestConsensusRefusedMutation(t *testing.T) {
+	node := newTestCluster(t, 1, "")[0]
+	fsm := &indexFSM{node: node.Node, allocated: make(map[string]Message)}
+	apply := func(index uint64, msg Message) error {
+		data, err := json.Marshal(msg)
+		assert.NoError(t, err)
+		result, _ := fsm.Apply(&raft.Log{Index: index, Data: data}).(error)
+		return result
+	}
+
+	// the cache refuses the allocation, the index stays free for a later one
+	unknown := Message{Op: OpAllocateIndex, Type: cache.Subcategory, Key: "c9", Index: 2}
+	assert.ErrorIs(t, apply(1, unknown), apperror.ErrUnknownParent)
+	assert.Empty(t, fsm.allocated)
+	assert.NoError(t, apply(2, Message{Op: OpCreateParent, Type: cache.Subcategory, Key: "c9"}))
+	assert.NoError(t, apply(3, unknown))
+	assert.ErrorIs(t, apply(4, unknown), apperror.ErrIndexTaken)
+	assert.Len(t, fsm.allocated, 1)
+	assert.Equal(t, uint64(4), fsm.applied.Load())
+}
@@ -0,0 +1,47 @@
+package cluster
+
+import (
+	"context"
+	"net"
+	"sort"
+)
+
+// Discoverer lists the addresses, host:port, of the nodes of the cluster. The list may include the
+// node asking.
+type Discoverer interface {
+	Peers(ctx context.Context) ([]string, error)
+}
+
+// StaticPeers is a fixed list of peer addresses.
+type StaticPeers []string
+
+// Peers ...
+func (p StaticPeers) Peers(context.Context) ([]string, error) {
+	return append([]string(nil), p...), nil
+}
+
+// DNSPeers finds the peers by resolving Host, e.g. the headless service of the pods, every address
+// answered being a peer listening on Port.
+type DNSPeers struct {
+	Host     string
+	Port     string
+	Resolver *net.Resolver // net.DefaultResolver when nil
+}
+
+// Peers ...
+func (d DNSPeers) Peers(ctx context.Context) ([]string, error) {
+	resolver := d.Resolver
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	addrs, err := resolver.LookupHost(ctx, d.Host)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(addrs)
+	peers := make([]string, 0, len(addrs))
+	for _, addr := range addrs {
+		peers = append(peers, net.JoinHostPort(addr, d.Port))
+	}
+	return peers, nil
+}
@@ -0,0 +1,405 @@
+// Package cluster spreads the verification cache over several pods. Every pod runs a Node which finds
+// its peers, places them on a consistent-hash ring and forwards the (Type, id) lookups of keys owned by
+// another node to it, so that each key is loaded and cached by a single pod. Invalidations and index
+// mutations made on one node are broadcast to the others, sharded or not.
+package cluster
+
+import (
+	"bytes"
+	"cacheServer/cache"
+	"cacheServer/logging"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// PathPrefix prefixes the endpoints peers call on each other.
+	PathPrefix = "/cluster"
+
+	defaultRefreshInterval = 10 * time.Second
+	defaultTimeout         = 2 * time.Second
+
+	// nodeHeader carries the id of the node answering a ping, a node finds itself among the peers by it.
+	nodeHeader = "X-Cluster-Node"
+)
+
+// Config configures a Node.
+type Config struct {
+	Self            string     // address, host:port, the peers reach this node at
+	Discoverer      Discoverer // nil for a cluster of one
+	RefreshInterval time.Duration
+	Replicas        int           // points per member on the ring, default DefaultReplicas
+	Timeout         time.Duration // of calls to peers, default 2s
+	Secret          string        // bearer token of the peer endpoints, empty for none
+	Sharding        bool          // forward lookups to their owner, otherwise every node verifies locally
+	Client          *http.Client
+}
+
+// Stats are the membership and counters of a Node.
+type Stats struct {
+	Self          string          `json:"self"`
+	Members       []string        `json:"members"`
+	Rebalances    uint64          `json:"rebalances"`    // membership changes
+	Forwarded     uint64          `json:"forwarded"`     // items sent to their owner
+	ForwardErrors uint64          `json:"forwardErrors"` // items verified locally as their owner could not be reached
+	Served        uint64          `json:"served"`        // items verified for peers
+	Broadcast     BroadcastStats  `json:"broadcast"`
+	Consensus     *ConsensusStats `json:"consensus,omitempty"` // set when index mutations go through Raft
+}
+
+// Node is a cache.AppCache forwarding the verification of keys owned by other nodes to them and sending
+// its mutations to the other nodes. The other operations are served by the local cache.
+type Node struct {
+	cache.AppCache // the local cache
+
+	cfg    Config
+	id     string // random, tells this node apart from the peers whatever address they are listed at
+	client *http.Client
+	ring   atomic.Pointer[Ring]
+	mu     sync.Mutex // serializes Refresh
+
+	broadcast *broadcaster
+	consensus atomic.Pointer[consensus] // set by StartConsensus
+
+	rebalances    atomic.Uint64
+	forwarded     atomic.Uint64
+	forwardErrors atomic.Uint64
+	served        atomic.Uint64
+}
+
+// NewNode returns the node of local, alone on its ring until Refresh finds peers.
+func NewNode(local cache.AppCache, cfg Config) *Node {
+	if cfg.RefreshInterval <= 0 {
+		cfg.RefreshInterval = defaultRefreshInterval
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = defaultTimeout
+	}
+	client := &http.Client{}
+	if cfg.Client != nil {
+		c := *cfg.Client
+		client = &c
+	}
+	client.Timeout = cfg.Timeout
+	n := &Node{AppCache: local, cfg: cfg, id: newMessageID(), client: client, broadcast: newBroadcaster()}
+	n.ring.Store(NewRing(cfg.Replicas, cfg.Self))
+	return n
+}
+
+// Run refreshes the membership every RefreshInterval until ctx is done.
+func (n *Node) Run(ctx context.Context) {
+	ticker := time.NewTicker(n.cfg.RefreshInterval)
+	defer ticker.Stop()
+	for {
+		if err := n.Refresh(ctx); err != nil {
+			log.Println("cluster membership not refreshed", err)
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Refresh discovers the peers and rebuilds the ring from this node and the peers answering a ping.
+// Keys move to their new owner when the members changed.
+func (n *Node) Refresh(ctx context.Context) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	members := []string{n.cfg.Self}
+	if n.cfg.Discoverer != nil {
+		peers, err := n.cfg.Discoverer.Peers(ctx)
+		if err != nil {
+			return err
+		}
+		members = append(members, n.alive(ctx, peers)...)
+	}
+	if n.ring.Load().equal(members) {
+		return nil
+	}
+	ring := NewRing(n.cfg.Replicas, members...)
+	n.ring.Store(ring)
+	n.rebalances.Add(1)
+	log.Println("cluster members changed:", strings.Join(ring.Members(), ", "))
+	return nil
+}
+
+// alive returns the peers, other than this node, answering a ping. This node is told apart by the id it
+// answers with, as discovery may list it at another address than Self, such as its IP.
+func (n *Node) alive(ctx context.Context, peers []string) []string {
+	up := make([]bool, len(peers))
+	var wg sync.WaitGroup
+	for i, peer := range peers {
+		if peer == n.cfg.Self {
+			continue
+		}
+		wg.Add(1)
+		go func(i int, peer string) {
+			defer wg.Done()
+			id, err := n.ping(ctx, peer)
+			up[i] = err == nil && id != n.id
+		}(i, peer)
+	}
+	wg.Wait()
+	var out []string
+	for i, peer := range peers {
+		if up[i] {
+			out = append(out, peer)
+		}
+	}
+	return out
+}
+
+// ping returns the id of the node listening at peer.
+func (n *Node) ping(ctx context.Context, peer string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://"+peer+PathPrefix+"/ping", nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := n.do(req)
+	if err != nil {
+		logging.Debugln("cluster peer", peer, "not reachable:", err)
+		return "", err
+	}
+	resp.Body.Close()
+	return resp.Header.Get(nodeHeader), nil
+}
+
+// Owner returns the address of the node owning the (Type, id) key of tenant.
+func (n *Node) Owner(t cache.Type, tenant string, id string) string {
+	return n.ring.Load().Owner(key(t, tenant, id))
+}
+
+func key(t cache.Type, tenant string, id string) string {
+	return tenant + "/" + t.String() + "/" + id
+}
+
+// MakeRequest verifies the request locally when this node owns its key or sharding is off and on the
+// owner otherwise.
+func (n *Node) MakeRequest(request *cache.Request) {
+	owner := n.Owner(request.Type(), request.Tenant(), request.ID())
+	if owner == n.cfg.Self || !n.cfg.Sharding {
+		n.AppCache.MakeRequest(request)
+		return
+	}
+	item := cache.BatchItem{Type: request.Type(), ID: request.ID(), Opt: request.Opt(), Tenant: request.Tenant()}
+	go func() {
+		request.Out <- n.verifyOn(owner, []cache.BatchItem{item})[0]
+	}()
+}
+
+// MakeBatchRequest verifies the items owned by this node locally and sends the others to their owners,
+// one call per owner, the results keeping the order of the items.
+func (n *Node) MakeBatchRequest(request *cache.BatchRequest) {
+	if !n.cfg.Sharding {
+		n.AppCache.MakeBatchRequest(request)
+		return
+	}
+	items := request.Items()
+	ring := n.ring.Load()
+	byOwner := make(map[string][]int)
+	for i, item := range items {
+		owner := ring.Owner(key(item.Type, item.Tenant, item.ID))
+		byOwner[owner] = append(byOwner[owner], i)
+	}
+	if _, local := byOwner[n.cfg.Self]; local && len(byOwner) == 1 {
+		n.AppCache.MakeBatchRequest(request)
+		return
+	}
+	go func() {
+		results := make([]cache.BatchResult, len(items))
+		var wg sync.WaitGroup
+		for owner, positions := range byOwner {
+			wg.Add(1)
+			go func(owner string, positions []int) {
+				defer wg.Done()
+				owned := make([]cache.BatchItem, len(positions))
+				for j, i := range positions {
+					owned[j] = items[i]
+				}
+				valid := n.verifyOn(owner, owned)
+				for j, i := range positions {
+					results[i] = cache.BatchResult{Type: items[i].Type, ID: items[i].ID, Valid: valid[j]}
+				}
+			}(owner, positions)
+		}
+		wg.Wait()
+		request.Out <- results
+	}()
+}
+
+// verifyOn verifies items on owner, locally when it is this node or cannot be reached.
+func (n *Node) verifyOn(owner string, items []cache.BatchItem) []bool {
+	if owner != n.cfg.Self {
+		valid, err := n.forward(owner, items)
+		if err == nil {
+			n.forwarded.Add(uint64(len(items)))
+			return valid
+		}
+		n.forwardErrors.Add(uint64(len(items)))
+		log.Println("cluster peer", owner, "did not verify", len(items), "items, verifying locally:", err)
+	}
+	return n.verifyLocally(items)
+}
+
+func (n *Node) verifyLocally(items []cache.BatchItem) []bool {
+	batch := cache.NewBatchRequest(items)
+	n.AppCache.MakeBatchRequest(batch)
+	results := <-batch.Out
+	valid := make([]bool, len(results))
+	for i, r := range results {
+		valid[i] = r.Valid
+	}
+	return valid
+}
+
+// wireItem is a cache.BatchItem as sent between peers.
+type wireItem struct {
+	Type   cache.Type `json:"type"`
+	ID     string     `json:"id"`
+	Tenant string     `json:"tenant,omitempty"`
+	Role   *string    `json:"role,omitempty"` // claimed role of Role items
+}
+
+type verifyRequest struct {
+	Items []wireItem `json:"items"`
+}
+
+type verifyResponse struct {
+	Valid []bool `json:"valid"`
+}
+
+func (n *Node) forward(owner string, items []cache.BatchItem) ([]bool, error) {
+	body := verifyRequest{Items: make([]wireItem, len(items))}
+	for i, item := range items {
+		body.Items[i] = wireItem{Type: item.Type, ID: item.ID, Tenant: item.Tenant}
+		if role, ok := item.Opt.(string); ok {
+			body.Items[i].Role = &role
+		}
+	}
+	data, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(http.MethodPost, "http://"+owner+PathPrefix+"/verify", bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := n.do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var out verifyResponse
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return nil, err
+	}
+	if len(out.Valid) != len(items) {
+		return nil, fmt.Errorf("%d results for %d items", len(out.Valid), len(items))
+	}
+	return out.Valid, nil
+}
+
+// call sends req with the cluster secret.
+func (n *Node) call(req *http.Request) (*http.Response, error) {
+	if n.cfg.Secret != "" {
+		req.Header.Set("Authorization", "Bearer "+n.cfg.Secret)
+	}
+	return n.client.Do(req)
+}
+
+// do sends req with the cluster secret, failing on answers other than 200.
+func (n *Node) do(req *http.Request) (*http.Response, error) {
+	resp, err := n.call(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<16))
+		resp.Body.Close()
+		return nil, fmt.Errorf("%s answered %s", req.URL.Host, resp.Status)
+	}
+	return resp, nil
+}
+
+// Handler serves the endpoints peers call under PathPrefix: GET /ping, POST /verify, which verifies
+// items on the local cache whatever their owner, so that nodes whose rings disagree for a moment do not
+// forward in circles, POST /broadcast, which applies the Message of a peer, and POST /propose, which
+// appends the Message of a follower to the Raft log of the leader.
+func (n *Node) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(PathPrefix+"/ping", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(nodeHeader, n.id)
+		w.WriteHeader(http.StatusOK)
+	})
+	mux.HandleFunc(PathPrefix+"/verify", n.serveVerify)
+	mux.HandleFunc(PathPrefix+"/broadcast", n.serveBroadcast)
+	mux.HandleFunc(PathPrefix+"/propose", n.servePropose)
+	return n.authorize(mux)
+}
+
+func (n *Node) authorize(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if n.cfg.Secret != "" {
+			token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(n.cfg.Secret)) != 1 {
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (n *Node) serveVerify(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var body verifyRequest
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, "invalid request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	items := make([]cache.BatchItem, len(body.Items))
+	for i, item := range body.Items {
+		items[i] = cache.BatchItem{Type: item.Type, ID: item.ID, Tenant: item.Tenant}
+		if item.Role != nil {
+			items[i].Opt = *item.Role
+		}
+	}
+	valid := n.verifyLocally(items)
+	n.served.Add(uint64(len(items)))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(verifyResponse{Valid: valid})
+}
+
+// ClusterStats returns the members of the ring and the counters of the node, Stats being the one of
+// the local cache.
+func (n *Node) ClusterStats() Stats {
+	stats := Stats{
+		Self:          n.cfg.Self,
+		Members:       n.ring.Load().Members(),
+		Rebalances:    n.rebalances.Load(),
+		Forwarded:     n.forwarded.Load(),
+		ForwardErrors: n.forwardErrors.Load(),
+		Served:        n.served.Load(),
+		Broadcast:     n.broadcast.stats(),
+	}
+	if c := n.consensus.Load(); c != nil {
+		consensus := c.stats()
+		stats.Consensus = &consensus
+	}
+	return stats
+}
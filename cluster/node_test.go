@@ -0,0 +1,224 @@
+package cluster
+
+import (
+	"cacheServer/appcontext"
+	"cacheServer/cache"
+	database "cacheServer/db"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const schema = `
+CREATE TABLE "users" ("emailId" TEXT PRIMARY KEY, "role" TEXT);
+CREATE TABLE "productCategory" (id TEXT PRIMARY KEY, "index" INTEGER);
+CREATE TABLE "productSubCategory" (id TEXT PRIMARY KEY, "categoryID" TEXT, "index" INTEGER);
+CREATE TABLE "products" (id TEXT PRIMARY KEY, "subCategoryID" TEXT, "index" INTEGER);
+INSERT INTO "users" VALUES ('a@x', 'admin'), ('b@x', 'editor');
+INSERT INTO "productCategory" VALUES ('c1', 1);
+INSERT INTO "productSubCategory" VALUES ('s1', 'c1', 1);
+`
+
+// testNode is a cache server of its own, behind a Node listening on loopback.
+type testNode struct {
+	*Node
+	server *cache.Server
+	http   *httptest.Server
+}
+
+// newTestCluster starts n nodes sharing one sqlite database that holds the products p0 to p29, each
+// node discovering the others from a static list.
+func newTestCluster(t *testing.T, n int, secret string) []*testNode {
+	client, err := database.NewSQLite(filepath.Join(t.TempDir(), "cache.db"))
+	if errors.Is(err, database.ErrSQLiteUnavailable) {
+		t.Skip(err)
+	}
+	assert.NoError(t, err)
+	t.Cleanup(func() { client.DB.Close() })
+	_, err = client.DB.Exec(schema)
+	assert.NoError(t, err)
+	for i := 0; i < 30; i++ {
+		_, err = client.DB.Exec(`INSERT INTO "products" VALUES (?, 's1', ?)`, fmt.Sprintf("p%d", i), i+1)
+		assert.NoError(t, err)
+	}
+
+	nodes := make([]*testNode, n)
+	var peers StaticPeers
+	for i := range nodes {
+		srv := httptest.NewUnstartedServer(nil)
+		nodes[i] = &testNode{http: srv}
+		peers = append(peers, srv.Listener.Addr().String())
+	}
+	for i, node := range nodes {
+		ctx := appcontext.NewContext(client.DB, 1)
+		ctx.Dialect = database.SQLiteDialect
+		node.server = cache.NewServer(ctx)
+		go node.server.Run()
+		t.Cleanup(node.server.Close)
+		node.Node = NewNode(node.server, Config{Self: peers[i], Discoverer: peers, Secret: secret, Sharding: true})
+		node.http.Config.Handler = node.Handler()
+		node.http.Start()
+		t.Cleanup(node.http.Close)
+	}
+	for _, node := range nodes {
+		assert.NoError(t, node.Refresh(context.Background()))
+	}
+	return nodes
+}
+
+func verify(node *testNode, id string) bool {
+	req := cache.NewRequest(id, cache.Product, nil)
+	node.MakeRequest(req)
+	return <-req.Out
+}
+
+func loads(node *testNode) uint64 {
+	return node.server.Metrics().Caches[cache.Product].Loads
+}
+
+func TestClusterForwardsToOwner(t *testing.T) {
+	nodes := newTestCluster(t, 3, "s3cret")
+	for _, node := range nodes {
+		assert.Len(t, node.ClusterStats().Members, 3)
+	}
+
+	owners := make(map[string]int)
+	for i := 0; i < 30; i++ {
+		id := fmt.Sprintf("p%d", i)
+		owner := nodes[0].Owner(cache.Product, "", id)
+		owners[owner]++
+		for _, node := range nodes {
+			assert.Equal(t, owner, node.Owner(cache.Product, "", id), "nodes agree on the owner")
+			assert.True(t, verify(node, id))
+		}
+	}
+	assert.Len(t, owners, 3, "keys are spread over every node")
+	stats := nodes[0].ClusterStats()
+	assert.Equal(t, uint64(30-owners[stats.Self]), stats.Forwarded)
+	assert.Zero(t, stats.ForwardErrors)
+	assert.False(t, verify(nodes[1], "ghost"))
+	owners[nodes[1].Owner(cache.Product, "", "ghost")]++
+
+	// every product was loaded once, by its owner
+	var total uint64
+	for _, node := range nodes {
+		assert.Equal(t, uint64(owners[node.cfg.Self]), loads(node))
+		total += loads(node)
+	}
+	assert.Equal(t, uint64(31), total)
+}
+
+func TestClusterBatch(t *testing.T) {
+	nodes := newTestCluster(t, 3, "")
+	role := "admin"
+	items := []cache.BatchItem{
+		{Type: cache.Product, ID: "p1"},
+		{Type: cache.Role, ID: "a@x", Opt: role},
+		{Type: cache.Product, ID: "ghost"},
+		{Type: cache.Role, ID: "b@x", Opt: role},
+	}
+	for i := 2; i < 12; i++ {
+		items = append(items, cache.BatchItem{Type: cache.Product, ID: fmt.Sprintf("p%d", i)})
+	}
+	batch := cache.NewBatchRequest(items)
+	nodes[2].MakeBatchRequest(batch)
+	results := <-batch.Out
+
+	assert.Len(t, results, len(items))
+	for i, r := range results {
+		assert.Equal(t, items[i].ID, r.ID)
+		assert.Equal(t, items[i].ID != "ghost" && items[i].ID != "b@x", r.Valid, items[i].ID)
+	}
+	served := 0
+	for _, node := range nodes {
+		served += int(node.ClusterStats().Served)
+	}
+	assert.Equal(t, int(nodes[2].ClusterStats().Forwarded), served)
+}
+
+func TestClusterRebalance(t *testing.T) {
+	nodes := newTestCluster(t, 3, "")
+	gone := nodes[1]
+	var moved []string
+	for i := 0; i < 30; i++ {
+		if id := fmt.Sprintf("p%d", i); nodes[0].Owner(cache.Product, "", id) == gone.cfg.Self {
+			moved = append(moved, id)
+		}
+	}
+	assert.NotEmpty(t, moved)
+
+	gone.http.Close()
+	for _, node := range []*testNode{nodes[0], nodes[2]} {
+		assert.NoError(t, node.Refresh(context.Background()))
+		assert.Len(t, node.ClusterStats().Members, 2)
+		assert.Equal(t, uint64(2), node.ClusterStats().Rebalances)
+	}
+	for _, id := range moved {
+		owner := nodes[0].Owner(cache.Product, "", id)
+		assert.NotEqual(t, gone.cfg.Self, owner)
+		assert.Equal(t, owner, nodes[2].Owner(cache.Product, "", id))
+		assert.True(t, verify(nodes[0], id))
+	}
+	assert.Zero(t, nodes[0].ClusterStats().ForwardErrors)
+}
+
+func TestClusterFallsBackToLocal(t *testing.T) {
+	nodes := newTestCluster(t, 2, "")
+	var remote string
+	for i := 0; remote == ""; i++ {
+		if id := fmt.Sprintf("p%d", i); nodes[0].Owner(cache.Product, "", id) != nodes[0].cfg.Self {
+			remote = id
+		}
+	}
+	nodes[1].http.Close()
+	// the ring still names the closed node until the next refresh
+	assert.True(t, verify(nodes[0], remote))
+	assert.Equal(t, uint64(1), nodes[0].ClusterStats().ForwardErrors)
+}
+
+func TestPeerEndpointsNeedTheSecret(t *testing.T) {
+	nodes := newTestCluster(t, 1, "s3cret")
+	resp, err := http.Get(nodes[0].http.URL + PathPrefix + "/ping")
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	req, _ := http.NewRequest(http.MethodGet, nodes[0].http.URL+PathPrefix+"/ping", nil)
+	req.Header.Set("Authorization", "Bearer s3cret")
+	resp, err = http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+func TestStaticAndDNSPeers(t *testing.T) {
+	peers, err := StaticPeers{"a:1", "b:1"}.Peers(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a:1", "b:1"}, peers)
+
+	peers, err = DNSPeers{Host: "127.0.0.1", Port: "8080"}.Peers(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"127.0.0.1:8080"}, peers)
+}
+
+func TestNodeFindsItselfAmongPeers(t *testing.T) {
+	nodes := newTestCluster(t, 2, "")
+	_, port, err := net.SplitHostPort(nodes[0].http.Listener.Addr().String())
+	assert.NoError(t, err)
+	// discovery lists the IP of this node, Self is its name
+	self := net.JoinHostPort("localhost", port)
+	node := NewNode(nodes[0].server, Config{Self: self, Discoverer: StaticPeers{
+		nodes[0].http.Listener.Addr().String(),
+		nodes[1].http.Listener.Addr().String(),
+	}})
+	nodes[0].http.Config.Handler = node.Handler()
+	assert.NoError(t, node.Refresh(context.Background()))
+	assert.ElementsMatch(t, []string{self, nodes[1].http.Listener.Addr().String()}, node.ClusterStats().Members)
+}
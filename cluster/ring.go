@@ -0,0 +1,95 @@
+package cluster
+
+import (
+	"hash/fnv"
+	"sort"
+	"strconv"
+)
+
+// DefaultReplicas is the number of points a member gets on the ring when none is configured.
+const DefaultReplicas = 128
+
+// Ring assigns keys to members by consistent hashing. Every member is placed at replicas points of a
+// hash circle and a key belongs to the member of the first point at or after its hash, so a member
+// joining or leaving only moves the keys of the arcs it gains or loses. A Ring is not modified after
+// NewRing and is safe for concurrent use.
+type Ring struct {
+	members []string
+	points  []uint64
+	owners  map[uint64]string
+}
+
+// NewRing returns the ring of members, each placed at replicas points.
+func NewRing(replicas int, members ...string) *Ring {
+	if replicas <= 0 {
+		replicas = DefaultReplicas
+	}
+	r := &Ring{owners: make(map[uint64]string, replicas*len(members))}
+	seen := make(map[string]bool, len(members))
+	for _, m := range members {
+		if m != "" && !seen[m] {
+			seen[m] = true
+			r.members = append(r.members, m)
+		}
+	}
+	// sorted so that every node builds the same ring whatever order it discovered the members in
+	sort.Strings(r.members)
+	for _, m := range r.members {
+		for i := 0; i < replicas; i++ {
+			p := hash(m + "#" + strconv.Itoa(i))
+			if _, taken := r.owners[p]; taken {
+				continue
+			}
+			r.owners[p] = m
+			r.points = append(r.points, p)
+		}
+	}
+	sort.Slice(r.points, func(i, j int) bool { return r.points[i] < r.points[j] })
+	return r
+}
+
+// Owner returns the member owning key, empty for a ring without members.
+func (r *Ring) Owner(key string) string {
+	if len(r.points) == 0 {
+		return ""
+	}
+	h := hash(key)
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i] >= h })
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.owners[r.points[i]]
+}
+
+// Members returns the members of the ring, sorted.
+func (r *Ring) Members() []string {
+	return append([]string(nil), r.members...)
+}
+
+// equal reports whether members, in any order and with duplicates, are the members of r.
+func (r *Ring) equal(members []string) bool {
+	other := NewRing(1, members...).members
+	if len(other) != len(r.members) {
+		return false
+	}
+	for i := range other {
+		if other[i] != r.members[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// hash is FNV-1a followed by the murmur3 finalizer, which spreads keys differing in their last bytes
+// over the whole circle.
+func hash(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
@@ -0,0 +1,83 @@
+package cluster
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func keys(n int) []string {
+	out := make([]string, n)
+	for i := range out {
+		out[i] = "/Product/p" + strconv.Itoa(i)
+	}
+	return out
+}
+
+func TestRingOwner(t *testing.T) {
+	cases := map[string]struct {
+		members []string
+		want    []string
+	}{
+		"empty ring": {
+			want: []string{""},
+		},
+		"single member owns every key": {
+			members: []string{"a:1"},
+			want:    []string{"a:1"},
+		},
+		"duplicates and empty members are ignored": {
+			members: []string{"b:1", "a:1", "", "b:1"},
+			want:    []string{"a:1", "b:1"},
+		},
+	}
+	for k, v := range cases {
+		t.Run(k, func(t *testing.T) {
+			r := NewRing(16, v.members...)
+			owners := make(map[string]bool)
+			for _, key := range keys(200) {
+				owners[r.Owner(key)] = true
+			}
+			var got []string
+			for _, m := range append(r.Members(), "") {
+				if owners[m] {
+					got = append(got, m)
+				}
+			}
+			assert.Equal(t, v.want, got)
+		})
+	}
+}
+
+func TestRingBalance(t *testing.T) {
+	r := NewRing(DefaultReplicas, "a:1", "b:1", "c:1", "d:1")
+	counts := make(map[string]int)
+	for _, key := range keys(10000) {
+		counts[r.Owner(key)]++
+	}
+	for m, n := range counts {
+		assert.InDelta(t, 2500, n, 750, "keys owned by %s", m)
+	}
+}
+
+func TestRingRebalance(t *testing.T) {
+	before := NewRing(DefaultReplicas, "a:1", "b:1", "c:1")
+	after := NewRing(DefaultReplicas, "d:1", "c:1", "b:1", "a:1") // order does not matter
+	moved := 0
+	for _, key := range keys(10000) {
+		if old, owner := before.Owner(key), after.Owner(key); old != owner {
+			// keys only move to the new member
+			assert.Equal(t, "d:1", owner)
+			moved++
+		}
+	}
+	assert.InDelta(t, 2500, moved, 750)
+
+	// removing the member moves its keys back
+	for _, key := range keys(1000) {
+		assert.Equal(t, before.Owner(key), NewRing(DefaultReplicas, "c:1", "a:1", "b:1").Owner(key))
+	}
+	assert.True(t, after.equal([]string{"a:1", "b:1", "c:1", "d:1", "a:1"}))
+	assert.False(t, after.equal([]string{"a:1", "b:1"}))
+}
@@ -0,0 +1,157 @@
+package cluster
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
+const (
+	// nonceSize is the length of the challenges exchanged when a Raft connection opens.
+	nonceSize = 32
+	// handshakeTimeout bounds the exchange, a peer that does not answer in time is dropped.
+	handshakeTimeout = 5 * time.Second
+)
+
+var errHandshake = errors.New("raft peer failed the cluster secret check")
+
+// secretStream is the raft.StreamLayer of the TCP transport. Both ends of a connection prove they know
+// the cluster secret before Raft uses it: each sends a random challenge and checks the HMAC-SHA256 of it,
+// keyed with the secret, that the other end returns. The secret itself is never sent.
+type secretStream struct {
+	listener  net.Listener
+	advertise net.Addr
+	secret    []byte
+	accepted  chan net.Conn // connections that passed the check
+	closed    chan struct{} // closed by Close
+	closeOnce sync.Once
+}
+
+// newSecretTransport returns a Raft transport listening on addr only, not on every interface of the host.
+func newSecretTransport(addr string, secret string, timeout time.Duration) (*raft.NetworkTransport, error) {
+	s, err := newSecretStream(addr, secret)
+	if err != nil {
+		return nil, err
+	}
+	return raft.NewNetworkTransport(s, maxPool, timeout, log.Writer()), nil
+}
+
+// newSecretStream listens on addr and starts accepting connections.
+func newSecretStream(addr string, secret string) (*secretStream, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	s := &secretStream{listener: listener, advertise: listener.Addr(), secret: []byte(secret),
+		accepted: make(chan net.Conn), closed: make(chan struct{})}
+	go s.acceptLoop()
+	return s, nil
+}
+
+// acceptLoop checks every incoming connection on its own, so a peer stalling the exchange does not hold
+// up the others.
+func (s *secretStream) acceptLoop() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			if err := s.handshake(conn, "server"); err != nil {
+				log.Println("raft connection from", conn.RemoteAddr(), "refused:", err)
+				conn.Close()
+				return
+			}
+			select {
+			case s.accepted <- conn:
+			case <-s.closed:
+				conn.Close()
+			}
+		}()
+	}
+}
+
+// Accept returns the next connection that passed the check.
+func (s *secretStream) Accept() (net.Conn, error) {
+	select {
+	case conn := <-s.accepted:
+		return conn, nil
+	case <-s.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close stops listening.
+func (s *secretStream) Close() error {
+	s.closeOnce.Do(func() { close(s.closed) })
+	return s.listener.Close()
+}
+
+// Addr returns the advertised address.
+func (s *secretStream) Addr() net.Addr {
+	return s.advertise
+}
+
+// Dial connects to a peer and runs the check.
+func (s *secretStream) Dial(address raft.ServerAddress, timeout time.Duration) (net.Conn, error) {
+	conn, err := net.DialTimeout("tcp", string(address), timeout)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.handshake(conn, "client"); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// handshake exchanges challenges over conn, as the given side, and checks the answer of the other end.
+func (s *secretStream) handshake(conn net.Conn, side string) error {
+	peer := "client"
+	if side == "client" {
+		peer = "server"
+	}
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	ours := make([]byte, nonceSize)
+	if _, err := rand.Read(ours); err != nil {
+		return err
+	}
+	if _, err := conn.Write(ours); err != nil {
+		return err
+	}
+	theirs := make([]byte, nonceSize)
+	if _, err := io.ReadFull(conn, theirs); err != nil {
+		return err
+	}
+	if _, err := conn.Write(s.mac(side, theirs)); err != nil {
+		return err
+	}
+	answer := make([]byte, sha256.Size)
+	if _, err := io.ReadFull(conn, answer); err != nil {
+		return err
+	}
+	if !hmac.Equal(answer, s.mac(peer, ours)) {
+		return fmt.Errorf("%w: %s", errHandshake, conn.RemoteAddr())
+	}
+	return nil
+}
+
+// mac answers the challenge nonce as side, the side being part of the message so that an answer cannot
+// be reflected back to its sender.
+func (s *secretStream) mac(side string, nonce []byte) []byte {
+	h := hmac.New(sha256.New, s.secret)
+	h.Write([]byte(side))
+	h.Write(nonce)
+	return h.Sum(nil)
+}
@@ -0,0 +1,84 @@
+package cluster
+
+import (
+	"crypto/sha256"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/raft"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSecretStream(t *testing.T) {
+	server, err := newSecretStream("127.0.0.1:0", "s3cret")
+	assert.NoError(t, err)
+	defer server.Close()
+	addr := raft.ServerAddress(server.Addr().String())
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		if conn, err := server.Accept(); err == nil {
+			accepted <- conn
+		}
+	}()
+
+	// a peer without the cluster secret is refused and never reaches Raft
+	_, err = (&secretStream{secret: []byte("guess")}).Dial(addr, time.Second)
+	assert.ErrorIs(t, err, errHandshake)
+	assert.Empty(t, accepted)
+
+	conn, err := (&secretStream{secret: []byte("s3cret")}).Dial(addr, time.Second)
+	assert.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("ping"))
+	assert.NoError(t, err)
+	got := <-accepted
+	defer got.Close()
+	buf := make([]byte, 4)
+	_, err = got.Read(buf)
+	assert.NoError(t, err)
+	assert.Equal(t, "ping", string(buf))
+
+	// a client sending garbage instead of the answer is disconnected
+	raw, err := net.Dial("tcp", string(addr))
+	assert.NoError(t, err)
+	defer raw.Close()
+	_, err = raw.Write(make([]byte, nonceSize+sha256.Size))
+	assert.NoError(t, err)
+	raw.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = io.ReadAll(raw)
+	assert.NoError(t, err, "the server closed the connection before the deadline")
+}
+
+func TestConsensusRequiresSecret(t *testing.T) {
+	node := newTestCluster(t, 1, "")[0]
+	err := node.StartConsensus(ConsensusConfig{Servers: map[string]string{node.cfg.Self: "127.0.0.1:0"}})
+	assert.ErrorContains(t, err, "requires a cluster secret")
+}
+
+func TestConsensusOverSecretTransport(t *testing.T) {
+	nodes := newTestCluster(t, 2, "s3cret")
+	servers := make(map[string]string, len(nodes))
+	for _, node := range nodes {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		assert.NoError(t, err)
+		servers[node.cfg.Self] = l.Addr().String()
+		l.Close()
+	}
+	conf := raft.DefaultConfig()
+	conf.HeartbeatTimeout = 50 * time.Millisecond
+	conf.ElectionTimeout = 50 * time.Millisecond
+	conf.LeaderLeaseTimeout = 50 * time.Millisecond
+	conf.CommitTimeout = 5 * time.Millisecond
+	for _, node := range nodes {
+		assert.NoError(t, node.StartConsensus(ConsensusConfig{Servers: servers, Raft: conf}))
+		t.Cleanup(func() { node.Close() })
+	}
+	assert.Eventually(t, func() bool {
+		return nodes[0].ClusterStats().Consensus.Leader != "" && nodes[1].ClusterStats().Consensus.Leader != ""
+	}, 5*time.Second, 10*time.Millisecond)
+
+	assert.NoError(t, nodes[0].UpdateCategoryIndexCache(2))
+	assert.Eventually(t, func() bool { return categoryIndexFree(t, nodes[1], 2) }, time.Second, 10*time.Millisecond)
+}
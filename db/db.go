@@ -14,3 +14,68 @@ type DatabaseClient interface {
 	PingContext(ctx context.Context) error
 	Close() error
 }
+
+// Open connects to the database of driverName, applies the pool settings and returns it with its Dialect.
+func Open(driverName string, dsn string, pool PoolConfig) (*sql.DB, Dialect, error) {
+	client, dialect, err := open(driverName, dsn)
+	if err != nil {
+		return nil, nil, err
+	}
+	pool.Apply(client)
+	return client, dialect, nil
+}
+
+func open(driverName string, dsn string) (*sql.DB, Dialect, error) {
+	dialect, err := DialectFor(driverName)
+	if err != nil {
+		return nil, nil, err
+	}
+	switch dialect {
+	case SQLiteDialect:
+		client, err := NewSQLite(dsn)
+		if err != nil {
+			return nil, nil, err
+		}
+		return client.DB, dialect, nil
+	case MySQLDialect:
+		client, err := NewMySQL(dsn)
+		if err != nil {
+			return nil, nil, err
+		}
+		return client.DB, dialect, nil
+	}
+	if driverName == "" {
+		driverName = DriverPostgres
+	}
+	client, err := NewPostgreSQL(driverName, dsn)
+	if err != nil {
+		return nil, nil, err
+	}
+	return client.DB, dialect, nil
+}
+
+// Reporter is implemented by clients with state worth exporting, such as replica health or breaker state.
+type Reporter interface {
+	Report() (name string, data interface{})
+}
+
+// Report collects the reports of client and of every client it wraps, with the pool statistics of a
+// wrapped *sql.DB under "pool".
+func Report(client DatabaseClient) map[string]interface{} {
+	result := make(map[string]interface{})
+	for client != nil {
+		if r, ok := client.(Reporter); ok {
+			name, data := r.Report()
+			result[name] = data
+		}
+		if stats := poolStats(client); stats != nil {
+			result["pool"] = stats
+		}
+		wrapper, ok := client.(interface{ Unwrap() DatabaseClient })
+		if !ok {
+			break
+		}
+		client = wrapper.Unwrap()
+	}
+	return result
+}
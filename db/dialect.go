@@ -0,0 +1,174 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// Dialect hides the SQL differences between the supported databases.
+type Dialect interface {
+	Name() string
+	// Quote quotes an identifier such as a table or column name.
+	Quote(identifier string) string
+	// Placeholder returns the bind parameter of the n-th argument, starting at 1.
+	Placeholder(n int) string
+	// AnyOf returns a condition matching column against values and the arguments binding it from the n-th on.
+	AnyOf(column string, n int, values []string) (string, []interface{})
+	// AggregateInts returns an aggregate expression collecting an integer column of a group.
+	AggregateInts(column string) string
+	// IntArray returns a Scanner reading a value of AggregateInts into dest in ascending order.
+	IntArray(dest *[]int32) sql.Scanner
+}
+
+// Driver names accepted by DialectFor.
+const (
+	DriverPostgres = "postgres"
+	DriverSQLite   = "sqlite3"
+	DriverMySQL    = "mysql"
+)
+
+var (
+	// PostgresDialect : quoted identifiers, $n placeholders, ANY over arrays and ARRAY_AGG.
+	PostgresDialect Dialect = postgresDialect{}
+	// SQLiteDialect : quoted identifiers, ? placeholders, IN lists and group_concat.
+	SQLiteDialect Dialect = sqliteDialect{}
+	// MySQLDialect : backtick identifiers, ? placeholders, IN lists and GROUP_CONCAT.
+	MySQLDialect Dialect = mysqlDialect{}
+)
+
+// DialectFor returns the Dialect of a database/sql driver name.
+func DialectFor(driverName string) (Dialect, error) {
+	switch driverName {
+	case DriverPostgres, "pgx", "":
+		return PostgresDialect, nil
+	case DriverSQLite, "sqlite":
+		return SQLiteDialect, nil
+	case DriverMySQL:
+		return MySQLDialect, nil
+	}
+	return nil, fmt.Errorf("unsupported database driver %q", driverName)
+}
+
+type postgresDialect struct{}
+
+func (postgresDialect) Name() string { return DriverPostgres }
+
+func (postgresDialect) Quote(identifier string) string {
+	return `"` + strings.ReplaceAll(identifier, `"`, `""`) + `"`
+}
+
+func (postgresDialect) Placeholder(n int) string { return "$" + strconv.Itoa(n) }
+
+func (d postgresDialect) AnyOf(column string, n int, values []string) (string, []interface{}) {
+	return column + " = ANY(" + d.Placeholder(n) + ")", []interface{}{pq.Array(values)}
+}
+
+func (postgresDialect) AggregateInts(column string) string { return "ARRAY_AGG(" + column + ")" }
+
+func (postgresDialect) IntArray(dest *[]int32) sql.Scanner {
+	return sortedScanner{dest: dest, scanner: (*pq.Int32Array)(dest)}
+}
+
+type sqliteDialect struct{}
+
+func (sqliteDialect) Name() string { return DriverSQLite }
+
+func (sqliteDialect) Quote(identifier string) string { return PostgresDialect.Quote(identifier) }
+
+func (sqliteDialect) Placeholder(n int) string { return "?" }
+
+func (sqliteDialect) AnyOf(column string, n int, values []string) (string, []interface{}) {
+	return inList(column, values)
+}
+
+func (sqliteDialect) AggregateInts(column string) string { return "group_concat(" + column + ")" }
+
+func (sqliteDialect) IntArray(dest *[]int32) sql.Scanner {
+	return sortedScanner{dest: dest, scanner: intList{dest}}
+}
+
+type mysqlDialect struct{}
+
+func (mysqlDialect) Name() string { return DriverMySQL }
+
+func (mysqlDialect) Quote(identifier string) string {
+	return "`" + strings.ReplaceAll(identifier, "`", "``") + "`"
+}
+
+func (mysqlDialect) Placeholder(n int) string { return "?" }
+
+func (mysqlDialect) AnyOf(column string, n int, values []string) (string, []interface{}) {
+	return inList(column, values)
+}
+
+func (mysqlDialect) AggregateInts(column string) string {
+	return "GROUP_CONCAT(" + column + " ORDER BY " + column + ")"
+}
+
+func (mysqlDialect) IntArray(dest *[]int32) sql.Scanner {
+	return sortedScanner{dest: dest, scanner: intList{dest}}
+}
+
+// inList binds every value to its own ? placeholder, an empty list matches nothing.
+func inList(column string, values []string) (string, []interface{}) {
+	if len(values) == 0 {
+		return "1 = 0", nil
+	}
+	args := make([]interface{}, len(values))
+	for i, v := range values {
+		args[i] = v
+	}
+	return column + " IN (" + strings.TrimSuffix(strings.Repeat("?,", len(values)), ",") + ")", args
+}
+
+// intList scans a comma separated list of integers as produced by group_concat.
+type intList struct {
+	dest *[]int32
+}
+
+func (l intList) Scan(src interface{}) error {
+	var s string
+	switch v := src.(type) {
+	case nil:
+		*l.dest = nil
+		return nil
+	case int64:
+		*l.dest = []int32{int32(v)}
+		return nil
+	case []byte:
+		s = string(v)
+	case string:
+		s = v
+	default:
+		return fmt.Errorf("cannot scan %T into an integer list", src)
+	}
+	var result []int32
+	for _, part := range strings.Split(s, ",") {
+		n, err := strconv.ParseInt(strings.TrimSpace(part), 10, 32)
+		if err != nil {
+			return err
+		}
+		result = append(result, int32(n))
+	}
+	*l.dest = result
+	return nil
+}
+
+// sortedScanner sorts the result of scanner, aggregates do not guarantee an order on every database.
+type sortedScanner struct {
+	dest    *[]int32
+	scanner sql.Scanner
+}
+
+func (s sortedScanner) Scan(src interface{}) error {
+	if err := s.scanner.Scan(src); err != nil {
+		return err
+	}
+	sort.Slice(*s.dest, func(i, j int) bool { return (*s.dest)[i] < (*s.dest)[j] })
+	return nil
+}
@@ -0,0 +1,108 @@
+package db
+
+import (
+	"testing"
+
+	"github.com/lib/pq"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAnyOf(t *testing.T) {
+	cases := map[string]struct {
+		dialect  Dialect
+		values   []string
+		want     string
+		wantArgs []interface{}
+	}{
+		"postgres binds one array": {
+			dialect:  PostgresDialect,
+			values:   []string{"a", "b"},
+			want:     `"id" = ANY($1)`,
+			wantArgs: []interface{}{pq.Array([]string{"a", "b"})},
+		},
+		"sqlite binds every value": {
+			dialect:  SQLiteDialect,
+			values:   []string{"a", "b"},
+			want:     `"id" IN (?,?)`,
+			wantArgs: []interface{}{"a", "b"},
+		},
+		"mysql quotes with backticks": {
+			dialect:  MySQLDialect,
+			values:   []string{"a"},
+			want:     "`id` IN (?)",
+			wantArgs: []interface{}{"a"},
+		},
+		"empty list matches nothing": {
+			dialect: MySQLDialect,
+			want:    "1 = 0",
+		},
+	}
+
+	for k, v := range cases {
+		t.Run(k, func(t *testing.T) {
+			get, args := v.dialect.AnyOf(v.dialect.Quote("id"), 1, v.values)
+			assert.Equal(t, v.want, get)
+			assert.Equal(t, v.wantArgs, args)
+		})
+	}
+}
+
+func TestIntArray(t *testing.T) {
+	cases := map[string]struct {
+		dialect Dialect
+		src     interface{}
+		want    []int32
+		err     bool
+	}{
+		"postgres array": {
+			dialect: PostgresDialect,
+			src:     []byte("{3,1,2}"),
+			want:    []int32{1, 2, 3},
+		},
+		"group_concat text is sorted": {
+			dialect: SQLiteDialect,
+			src:     "4,2",
+			want:    []int32{2, 4},
+		},
+		"single value": {
+			dialect: SQLiteDialect,
+			src:     int64(7),
+			want:    []int32{7},
+		},
+		"null": {
+			dialect: MySQLDialect,
+			src:     nil,
+			want:    nil,
+		},
+		"not a number": {
+			dialect: MySQLDialect,
+			src:     []byte("1,x"),
+			err:     true,
+		},
+	}
+
+	for k, v := range cases {
+		t.Run(k, func(t *testing.T) {
+			var get []int32
+			err := v.dialect.IntArray(&get).Scan(v.src)
+			assert.Equal(t, v.err, err != nil)
+			if !v.err {
+				assert.Equal(t, v.want, get)
+			}
+		})
+	}
+}
+
+func TestDialectFor(t *testing.T) {
+	for driver, want := range map[string]Dialect{
+		"postgres": PostgresDialect,
+		"sqlite3":  SQLiteDialect,
+		"mysql":    MySQLDialect,
+	} {
+		get, err := DialectFor(driver)
+		assert.NoError(t, err)
+		assert.Equal(t, want, get)
+	}
+	_, err := DialectFor("oracle")
+	assert.Error(t, err)
+}
@@ -0,0 +1,37 @@
+package db
+
+import (
+	"database/sql"
+	"log"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// mysqlGroupConcatMaxLen lifts the 1024 byte default of GROUP_CONCAT, which would cut long index lists.
+const mysqlGroupConcatMaxLen = "1048576"
+
+// MySQL ...
+type MySQL struct {
+	DB *sql.DB
+}
+
+// NewMySQL constructor for MySQL struct.
+func NewMySQL(dsn string) (*MySQL, error) {
+	cfg, err := mysql.ParseDSN(dsn)
+	if err != nil {
+		log.Println("invalid mysql DSN")
+		return nil, err
+	}
+	if cfg.Params == nil {
+		cfg.Params = make(map[string]string)
+	}
+	if _, ok := cfg.Params["group_concat_max_len"]; !ok {
+		cfg.Params["group_concat_max_len"] = mysqlGroupConcatMaxLen
+	}
+	DB, err := sql.Open(DriverMySQL, cfg.FormatDSN())
+	if err != nil {
+		log.Println("could not connect to database")
+		return nil, err
+	}
+	return &MySQL{DB: DB}, nil
+}
@@ -0,0 +1,136 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"time"
+)
+
+const (
+	defaultConnectAttempts  = 5
+	defaultConnectBaseDelay = 500 * time.Millisecond
+	defaultConnectMaxDelay  = 10 * time.Second
+	defaultConnectTimeout   = 5 * time.Second
+)
+
+// PoolConfig configures the connection pool of a *sql.DB, zero values keep the database/sql defaults.
+type PoolConfig struct {
+	MaxOpenConns    int
+	MaxIdleConns    int
+	ConnMaxLifetime time.Duration
+	ConnMaxIdleTime time.Duration
+}
+
+// Apply sets the non-zero settings on db.
+func (p PoolConfig) Apply(db *sql.DB) {
+	if p.MaxOpenConns > 0 {
+		db.SetMaxOpenConns(p.MaxOpenConns)
+	}
+	if p.MaxIdleConns > 0 {
+		db.SetMaxIdleConns(p.MaxIdleConns)
+	}
+	if p.ConnMaxLifetime > 0 {
+		db.SetConnMaxLifetime(p.ConnMaxLifetime)
+	}
+	if p.ConnMaxIdleTime > 0 {
+		db.SetConnMaxIdleTime(p.ConnMaxIdleTime)
+	}
+}
+
+// ConnectConfig configures the startup ping of a database.
+type ConnectConfig struct {
+	Attempts  int           // pings before giving up, default 5
+	BaseDelay time.Duration // wait after the first failed ping, doubled per attempt, default 500ms
+	MaxDelay  time.Duration // default 10s
+	Timeout   time.Duration // per ping, default 5s
+}
+
+// WaitForConnection pings client until it answers, backing off between attempts. It returns the last
+// ping error once the attempts are used up or ctx is done.
+func WaitForConnection(ctx context.Context, client DatabaseClient, cfg ConnectConfig) error {
+	if cfg.Attempts <= 0 {
+		cfg.Attempts = defaultConnectAttempts
+	}
+	if cfg.BaseDelay <= 0 {
+		cfg.BaseDelay = defaultConnectBaseDelay
+	}
+	if cfg.MaxDelay <= 0 {
+		cfg.MaxDelay = defaultConnectMaxDelay
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = defaultConnectTimeout
+	}
+	delay := cfg.BaseDelay
+	var err error
+	for attempt := 1; attempt <= cfg.Attempts; attempt++ {
+		pingCtx, cancel := context.WithTimeout(ctx, cfg.Timeout)
+		err = client.PingContext(pingCtx)
+		cancel()
+		if err == nil {
+			return nil
+		}
+		if attempt == cfg.Attempts {
+			break
+		}
+		log.Println("database not reachable, attempt", attempt, "of", cfg.Attempts, ":", err)
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(delay):
+		}
+		if delay *= 2; delay > cfg.MaxDelay {
+			delay = cfg.MaxDelay
+		}
+	}
+	return err
+}
+
+// PoolStats is sql.DBStats with json names, durations in nanoseconds.
+type PoolStats struct {
+	MaxOpenConnections int           `json:"maxOpenConnections"`
+	OpenConnections    int           `json:"openConnections"`
+	InUse              int           `json:"inUse"`
+	Idle               int           `json:"idle"`
+	WaitCount          int64         `json:"waitCount"`
+	WaitDuration       time.Duration `json:"waitDuration"`
+	MaxIdleClosed      int64         `json:"maxIdleClosed"`
+	MaxIdleTimeClosed  int64         `json:"maxIdleTimeClosed"`
+	MaxLifetimeClosed  int64         `json:"maxLifetimeClosed"`
+}
+
+// NewPoolStats converts s.
+func NewPoolStats(s sql.DBStats) PoolStats {
+	return PoolStats{
+		MaxOpenConnections: s.MaxOpenConnections,
+		OpenConnections:    s.OpenConnections,
+		InUse:              s.InUse,
+		Idle:               s.Idle,
+		WaitCount:          s.WaitCount,
+		WaitDuration:       s.WaitDuration,
+		MaxIdleClosed:      s.MaxIdleClosed,
+		MaxIdleTimeClosed:  s.MaxIdleTimeClosed,
+		MaxLifetimeClosed:  s.MaxLifetimeClosed,
+	}
+}
+
+// poolStats returns the pool statistics of client if it is a *sql.DB.
+func poolStats(client DatabaseClient) *PoolStats {
+	db, ok := client.(*sql.DB)
+	if !ok {
+		return nil
+	}
+	stats := NewPoolStats(db.Stats())
+	return &stats
+}
+
+// innermost returns the client at the end of the Unwrap chain of client.
+func innermost(client DatabaseClient) DatabaseClient {
+	for {
+		wrapper, ok := client.(interface{ Unwrap() DatabaseClient })
+		if !ok {
+			return client
+		}
+		client = wrapper.Unwrap()
+	}
+}
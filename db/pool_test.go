@@ -0,0 +1,64 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPoolConfig(t *testing.T) {
+	client, _, err := sqlmock.New()
+	assert.NoError(t, err)
+	PoolConfig{MaxOpenConns: 7, MaxIdleConns: 3, ConnMaxLifetime: time.Minute}.Apply(client)
+	assert.Equal(t, 7, NewPoolStats(client.Stats()).MaxOpenConnections)
+
+	// zero values keep the previous settings
+	PoolConfig{}.Apply(client)
+	assert.Equal(t, 7, poolStats(client).MaxOpenConnections)
+}
+
+func TestWaitForConnection(t *testing.T) {
+	refused := errors.New("connection refused")
+	cases := map[string]struct {
+		pings []error
+		err   error
+	}{
+		"answers on first ping": {
+			pings: []error{nil},
+		},
+		"answers after retries": {
+			pings: []error{refused, refused, nil},
+		},
+		"gives up after the last attempt": {
+			pings: []error{refused, refused, refused},
+			err:   refused,
+		},
+	}
+
+	for k, v := range cases {
+		t.Run(k, func(t *testing.T) {
+			client, mock, err := sqlmock.New(sqlmock.MonitorPingsOption(true))
+			assert.NoError(t, err)
+			for _, ping := range v.pings {
+				mock.ExpectPing().WillReturnError(ping)
+			}
+			err = WaitForConnection(context.Background(), client, ConnectConfig{Attempts: 3, BaseDelay: time.Millisecond})
+			assert.Equal(t, v.err, err)
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
+
+func TestWaitForConnectionCancelled(t *testing.T) {
+	client, mock, err := sqlmock.New(sqlmock.MonitorPingsOption(true))
+	assert.NoError(t, err)
+	mock.ExpectPing().WillReturnError(errors.New("connection refused"))
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = WaitForConnection(ctx, client, ConnectConfig{Attempts: 3, BaseDelay: time.Hour})
+	assert.Error(t, err)
+}
@@ -1,6 +1,7 @@
 package db
 
 import (
+	"context"
 	"database/sql"
 	"log"
 )
@@ -19,3 +20,18 @@ func NewPostgreSQL(driverName string, connStr string) (*PostgreSQL, error) {
 	}
 	return &PostgreSQL{DB: DB}, nil
 }
+
+// Configure applies the pool settings.
+func (p *PostgreSQL) Configure(pool PoolConfig) {
+	pool.Apply(p.DB)
+}
+
+// Connect pings the database until it answers, so that a bad connection string fails at startup.
+func (p *PostgreSQL) Connect(ctx context.Context, cfg ConnectConfig) error {
+	return WaitForConnection(ctx, p.DB, cfg)
+}
+
+// Stats returns the connection pool statistics.
+func (p *PostgreSQL) Stats() PoolStats {
+	return NewPoolStats(p.DB.Stats())
+}
@@ -0,0 +1,245 @@
+package db
+
+import (
+	"container/list"
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"sync"
+	"sync/atomic"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/lib/pq"
+)
+
+// defaultMaxStatements bounds the statements kept by a PreparedClient, the least recently used one is
+// closed beyond it.
+const defaultMaxStatements = 64
+
+// StatementStats counts the use of the prepared statement cache.
+type StatementStats struct {
+	Prepared   int    `json:"prepared"`
+	Hits       uint64 `json:"hits"`
+	Prepares   uint64 `json:"prepares"`
+	Reprepares uint64 `json:"reprepares"`
+	Evictions  uint64 `json:"evictions"`
+}
+
+// PreparedClient is a DatabaseClient preparing the queries passed to Query and QueryRow once per
+// connection pool and reusing the statements. database/sql prepares a statement again on every new
+// connection; a statement the server no longer knows, e.g. after a failover, is prepared anew and the
+// query retried once. Exec and Begin are passed through.
+type PreparedClient struct {
+	db  *sql.DB
+	max int
+
+	mu    sync.Mutex
+	stmts map[string]*cachedStmt
+	lru   *list.List // of *cachedStmt, the most recently used in front
+
+	hits       atomic.Uint64
+	prepares   atomic.Uint64
+	reprepares atomic.Uint64
+	evictions  atomic.Uint64
+}
+
+// cachedStmt is a statement of the cache. Its fields besides ready are guarded by PreparedClient.mu,
+// stmt and err are set once ready is closed.
+type cachedStmt struct {
+	query   string
+	ready   chan struct{}
+	stmt    *sql.Stmt
+	err     error
+	elem    *list.Element
+	refs    int  // queries using the statement, it is closed after the last one once dropped
+	dropped bool // evicted, forgotten or closed
+}
+
+// NewPreparedClient returns a PreparedClient over db keeping up to maxStatements statements, 64 if zero.
+func NewPreparedClient(db *sql.DB, maxStatements int) *PreparedClient {
+	if maxStatements <= 0 {
+		maxStatements = defaultMaxStatements
+	}
+	return &PreparedClient{db: db, max: maxStatements, stmts: make(map[string]*cachedStmt), lru: list.New()}
+}
+
+// acquire returns the statement of query, preparing it on first use, and has to be followed by release.
+// The statement is prepared without holding mu, concurrent first uses wait for the same prepare.
+func (p *PreparedClient) acquire(query string) (*cachedStmt, error) {
+	p.mu.Lock()
+	c, ok := p.stmts[query]
+	if ok {
+		p.hits.Add(1)
+		c.refs++
+		p.lru.MoveToFront(c.elem)
+		p.mu.Unlock()
+		<-c.ready
+		if c.err != nil {
+			p.release(c)
+			return nil, c.err
+		}
+		return c, nil
+	}
+	c = &cachedStmt{query: query, ready: make(chan struct{}), refs: 1}
+	c.elem = p.lru.PushFront(c)
+	p.stmts[query] = c
+	for p.lru.Len() > p.max {
+		p.drop(p.lru.Back().Value.(*cachedStmt))
+		p.evictions.Add(1)
+	}
+	p.mu.Unlock()
+
+	stmt, err := p.db.Prepare(query)
+	p.mu.Lock()
+	c.stmt, c.err = stmt, err
+	if err != nil {
+		p.drop(c)
+	} else {
+		p.prepares.Add(1)
+	}
+	p.mu.Unlock()
+	close(c.ready)
+	if err != nil {
+		p.release(c)
+		return nil, err
+	}
+	return c, nil
+}
+
+// drop removes c from the cache, its statement is closed once no query uses it. mu must be held.
+func (p *PreparedClient) drop(c *cachedStmt) {
+	if c.dropped {
+		return
+	}
+	c.dropped = true
+	p.lru.Remove(c.elem)
+	delete(p.stmts, c.query)
+	if c.refs == 0 && c.stmt != nil {
+		c.stmt.Close()
+	}
+}
+
+// release ends a use of c, closing its statement if it was the last use of a dropped one.
+func (p *PreparedClient) release(c *cachedStmt) {
+	p.mu.Lock()
+	c.refs--
+	if c.refs == 0 && c.dropped && c.stmt != nil {
+		c.stmt.Close()
+	}
+	p.mu.Unlock()
+}
+
+// forget drops c, a statement the server no longer knows.
+func (p *PreparedClient) forget(c *cachedStmt) {
+	p.mu.Lock()
+	p.drop(c)
+	p.mu.Unlock()
+}
+
+// Query ...
+func (p *PreparedClient) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	for attempt := 0; ; attempt++ {
+		c, err := p.acquire(query)
+		if err != nil {
+			return nil, err
+		}
+		// rows keep the statement open until they are closed, the statement can be released
+		rows, err := c.stmt.Query(args...)
+		if attempt == 0 && isStaleStatement(err) {
+			p.forget(c)
+			p.release(c)
+			p.reprepares.Add(1)
+			continue
+		}
+		p.release(c)
+		return rows, err
+	}
+}
+
+// QueryRow ...
+func (p *PreparedClient) QueryRow(query string, args ...interface{}) *sql.Row {
+	for attempt := 0; ; attempt++ {
+		c, err := p.acquire(query)
+		if err != nil {
+			return p.db.QueryRow(query, args...)
+		}
+		row := c.stmt.QueryRow(args...)
+		if attempt == 0 && isStaleStatement(row.Err()) {
+			p.forget(c)
+			p.release(c)
+			p.reprepares.Add(1)
+			continue
+		}
+		p.release(c)
+		return row
+	}
+}
+
+// Exec ...
+func (p *PreparedClient) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return p.db.Exec(query, args...)
+}
+
+// Begin ...
+func (p *PreparedClient) Begin() (*sql.Tx, error) {
+	return p.db.Begin()
+}
+
+// PingContext ...
+func (p *PreparedClient) PingContext(ctx context.Context) error {
+	return p.db.PingContext(ctx)
+}
+
+// Close closes the statements and the database.
+func (p *PreparedClient) Close() error {
+	p.mu.Lock()
+	for _, c := range p.stmts {
+		p.drop(c)
+	}
+	p.mu.Unlock()
+	return p.db.Close()
+}
+
+// Stats returns the statement cache counters.
+func (p *PreparedClient) Stats() StatementStats {
+	p.mu.Lock()
+	prepared := len(p.stmts)
+	p.mu.Unlock()
+	return StatementStats{
+		Prepared:   prepared,
+		Hits:       p.hits.Load(),
+		Prepares:   p.prepares.Load(),
+		Reprepares: p.reprepares.Load(),
+		Evictions:  p.evictions.Load(),
+	}
+}
+
+// Report ...
+func (p *PreparedClient) Report() (string, interface{}) {
+	return "statements", p.Stats()
+}
+
+// Unwrap returns the underlying database.
+func (p *PreparedClient) Unwrap() DatabaseClient {
+	return p.db
+}
+
+// isStaleStatement reports whether err means the statement has to be prepared again.
+func isStaleStatement(err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, driver.ErrBadConn) || errors.Is(err, sql.ErrConnDone) {
+		return true
+	}
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		return pqErr.Code == "26000" // invalid_sql_statement_name
+	}
+	var mysqlErr *mysql.MySQLError
+	if errors.As(err, &mysqlErr) {
+		return mysqlErr.Number == 1243 // ER_UNKNOWN_STMT_HANDLER
+	}
+	return false
+}
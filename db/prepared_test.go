@@ -0,0 +1,127 @@
+package db
+
+import (
+	"regexp"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/lib/pq"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPreparedClient(t *testing.T) {
+	const query = "SELECT id FROM products WHERE id=$1"
+	cases := map[string]struct {
+		max       int
+		queries   []string
+		prepFunc  func(mock sqlmock.Sqlmock)
+		wantStats StatementStats
+	}{
+		"statement is prepared once and reused": {
+			queries: []string{query, query, query},
+			prepFunc: func(mock sqlmock.Sqlmock) {
+				prep := mock.ExpectPrepare(regexp.QuoteMeta(query))
+				for i := 0; i < 3; i++ {
+					prep.ExpectQuery().WithArgs("1").WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("1"))
+				}
+			},
+			wantStats: StatementStats{Prepared: 1, Hits: 2, Prepares: 1},
+		},
+		"least recently used statement is closed beyond the limit": {
+			max:     1,
+			queries: []string{query, "SELECT id FROM users WHERE id=$1", query},
+			prepFunc: func(mock sqlmock.Sqlmock) {
+				mock.ExpectPrepare(regexp.QuoteMeta(query)).WillBeClosed().
+					ExpectQuery().WithArgs("1").WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("1"))
+				mock.ExpectPrepare(regexp.QuoteMeta("SELECT id FROM users WHERE id=$1")).WillBeClosed().
+					ExpectQuery().WithArgs("1").WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("1"))
+				mock.ExpectPrepare(regexp.QuoteMeta(query)).
+					ExpectQuery().WithArgs("1").WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("1"))
+			},
+			wantStats: StatementStats{Prepared: 1, Prepares: 3, Evictions: 2},
+		},
+		"stale statement is prepared again": {
+			queries: []string{query},
+			prepFunc: func(mock sqlmock.Sqlmock) {
+				mock.ExpectPrepare(regexp.QuoteMeta(query)).WillBeClosed().
+					ExpectQuery().WithArgs("1").WillReturnError(&pq.Error{Code: "26000"})
+				mock.ExpectPrepare(regexp.QuoteMeta(query)).
+					ExpectQuery().WithArgs("1").WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("1"))
+			},
+			wantStats: StatementStats{Prepared: 1, Prepares: 2, Reprepares: 1},
+		},
+	}
+
+	for k, v := range cases {
+		t.Run(k, func(t *testing.T) {
+			client, mock, err := sqlmock.New()
+			assert.NoError(t, err)
+			p := NewPreparedClient(client, v.max)
+			v.prepFunc(mock)
+			for i, q := range v.queries {
+				var id string
+				if i%2 == 0 {
+					assert.NoError(t, p.QueryRow(q, "1").Scan(&id))
+				} else {
+					rows, err := p.Query(q, "1")
+					assert.NoError(t, err)
+					assert.True(t, rows.Next())
+					assert.NoError(t, rows.Scan(&id))
+					rows.Close()
+				}
+				assert.Equal(t, "1", id)
+			}
+			assert.Equal(t, v.wantStats, p.Stats())
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
+
+func TestPreparedClientClose(t *testing.T) {
+	client, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	p := NewPreparedClient(client, 0)
+	mock.ExpectPrepare("SELECT 1").WillBeClosed().
+		ExpectQuery().WillReturnRows(sqlmock.NewRows([]string{"v"}).AddRow(1))
+	mock.ExpectClose()
+
+	var v int
+	assert.NoError(t, p.QueryRow("SELECT 1").Scan(&v))
+	name, report := p.Report()
+	assert.Equal(t, "statements", name)
+	assert.Equal(t, 1, report.(StatementStats).Prepared)
+	assert.Equal(t, map[string]interface{}{"statements": p.Stats(), "pool": poolStats(client)}, Report(p))
+
+	assert.NoError(t, p.Close())
+	assert.Equal(t, 0, p.Stats().Prepared)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestPreparedClientConcurrentUse(t *testing.T) {
+	const query = "SELECT id FROM products WHERE id=$1"
+	client, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	// database/sql prepares the statement on each connection, one keeps it to the prepare of the cache
+	client.SetMaxOpenConns(1)
+	p := NewPreparedClient(client, 0)
+	prep := mock.ExpectPrepare(regexp.QuoteMeta(query)).WillDelayFor(20 * time.Millisecond)
+	for i := 0; i < 8; i++ {
+		prep.ExpectQuery().WithArgs("1").WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("1"))
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var id string
+			assert.NoError(t, p.QueryRow(query, "1").Scan(&id))
+		}()
+	}
+	wg.Wait()
+	// the first use prepared the statement once for all of them
+	assert.Equal(t, StatementStats{Prepared: 1, Hits: 7, Prepares: 1}, p.Stats())
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
@@ -0,0 +1,284 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Policy decides which healthy replica serves a read.
+type Policy int
+
+const (
+	// RoundRobin spreads reads evenly over the healthy replicas.
+	RoundRobin Policy = iota
+	// LeastLatency sends reads to the healthy replica with the lowest ping latency.
+	LeastLatency
+)
+
+// ParsePolicy returns the Policy named s, "round-robin" or "least-latency".
+func ParsePolicy(s string) (Policy, error) {
+	switch strings.ToLower(s) {
+	case "", "round-robin", "roundrobin":
+		return RoundRobin, nil
+	case "least-latency", "leastlatency":
+		return LeastLatency, nil
+	}
+	return RoundRobin, fmt.Errorf("unknown replica policy %q", s)
+}
+
+const (
+	defaultCheckInterval    = 5 * time.Second
+	defaultReplicaTimeout   = time.Second
+	defaultFailureThreshold = 1
+	// latencyWeight is the weight of the newest ping in the moving average of a node's latency.
+	latencyWeight = 0.3
+)
+
+// ReplicaConfig configures routing and health checking of a ReplicaSet.
+type ReplicaConfig struct {
+	Policy           Policy
+	CheckInterval    time.Duration // time between pings of every node, default 5s
+	PingTimeout      time.Duration // default 1s
+	FailureThreshold int           // consecutive failed pings before a node is ejected, default 1
+}
+
+// NodeStatus is the health of one database node as seen by a ReplicaSet.
+type NodeStatus struct {
+	Name    string        `json:"name"`
+	Healthy bool          `json:"healthy"`
+	Latency time.Duration `json:"latency"`
+	Error   string        `json:"error,omitempty"`
+	Pool    *PoolStats    `json:"pool,omitempty"`
+}
+
+type node struct {
+	name   string
+	client DatabaseClient
+
+	mu       sync.Mutex
+	healthy  bool
+	failures int
+	latency  time.Duration
+	err      error
+}
+
+func (n *node) isHealthy() bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.healthy
+}
+
+func (n *node) currentLatency() time.Duration {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.latency
+}
+
+func (n *node) status() NodeStatus {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	st := NodeStatus{Name: n.name, Healthy: n.healthy, Latency: n.latency, Pool: poolStats(innermost(n.client))}
+	if n.err != nil {
+		st.Error = n.err.Error()
+	}
+	return st
+}
+
+// record applies the result of a ping, ejecting the node after threshold consecutive failures.
+func (n *node) record(latency time.Duration, err error, threshold int) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.err = err
+	if err != nil {
+		n.failures++
+		if n.failures >= threshold && n.healthy {
+			log.Println("database node", n.name, "ejected:", err)
+			n.healthy = false
+		}
+		return
+	}
+	if !n.healthy {
+		log.Println("database node", n.name, "is back")
+	}
+	n.failures = 0
+	n.healthy = true
+	if n.latency == 0 {
+		n.latency = latency
+	} else {
+		n.latency = time.Duration(latencyWeight*float64(latency) + (1-latencyWeight)*float64(n.latency))
+	}
+}
+
+// ReplicaSet is a DatabaseClient sending Query and QueryRow to healthy replicas and everything else to the
+// primary. Nodes are pinged in the background; failing replicas are ejected until their pings succeed again.
+// Reads fall back to the primary when no replica is healthy.
+type ReplicaSet struct {
+	primary  *node
+	replicas []*node
+	cfg      ReplicaConfig
+	next     atomic.Uint64
+
+	stop      chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// NewReplicaSet returns a ReplicaSet over primary and replicas and starts health checking them.
+func NewReplicaSet(primary DatabaseClient, replicas []DatabaseClient, cfg ReplicaConfig) *ReplicaSet {
+	if cfg.CheckInterval <= 0 {
+		cfg.CheckInterval = defaultCheckInterval
+	}
+	if cfg.PingTimeout <= 0 {
+		cfg.PingTimeout = defaultReplicaTimeout
+	}
+	if cfg.FailureThreshold <= 0 {
+		cfg.FailureThreshold = defaultFailureThreshold
+	}
+	r := &ReplicaSet{
+		primary: &node{name: "primary", client: primary, healthy: true},
+		cfg:     cfg,
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	for i, c := range replicas {
+		r.replicas = append(r.replicas, &node{name: fmt.Sprintf("replica-%d", i), client: c, healthy: true})
+	}
+	go r.monitor()
+	return r
+}
+
+func (r *ReplicaSet) monitor() {
+	defer close(r.done)
+	ticker := time.NewTicker(r.cfg.CheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.stop:
+			return
+		case <-ticker.C:
+			r.Check(context.Background())
+		}
+	}
+}
+
+// Check pings every node once and updates their health.
+func (r *ReplicaSet) Check(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, n := range append([]*node{r.primary}, r.replicas...) {
+		wg.Add(1)
+		go func(n *node) {
+			defer wg.Done()
+			pingCtx, cancel := context.WithTimeout(ctx, r.cfg.PingTimeout)
+			defer cancel()
+			start := time.Now()
+			err := n.client.PingContext(pingCtx)
+			n.record(time.Since(start), err, r.cfg.FailureThreshold)
+		}(n)
+	}
+	wg.Wait()
+}
+
+// Status returns the health of the primary followed by the replicas.
+func (r *ReplicaSet) Status() []NodeStatus {
+	result := []NodeStatus{r.primary.status()}
+	for _, n := range r.replicas {
+		result = append(result, n.status())
+	}
+	return result
+}
+
+// Report ...
+func (r *ReplicaSet) Report() (string, interface{}) {
+	return "replicas", r.Status()
+}
+
+// pick returns the replica serving the next read, nil when none is healthy.
+func (r *ReplicaSet) pick() *node {
+	var healthy []*node
+	for _, n := range r.replicas {
+		if n.isHealthy() {
+			healthy = append(healthy, n)
+		}
+	}
+	if len(healthy) == 0 {
+		return nil
+	}
+	if r.cfg.Policy == LeastLatency {
+		best := healthy[0]
+		for _, n := range healthy[1:] {
+			if n.currentLatency() < best.currentLatency() {
+				best = n
+			}
+		}
+		return best
+	}
+	return healthy[(r.next.Add(1)-1)%uint64(len(healthy))]
+}
+
+// Query runs on a healthy replica. A replica failing with a connection error is ejected and the query
+// retried on the next one, or on the primary once no replica is left.
+func (r *ReplicaSet) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	for {
+		n := r.pick()
+		if n == nil {
+			return r.primary.client.Query(query, args...)
+		}
+		rows, err := n.client.Query(query, args...)
+		if err == nil || !isConnError(err) {
+			return rows, err
+		}
+		n.record(0, err, 1)
+	}
+}
+
+// QueryRow runs on a healthy replica, or on the primary when none is healthy.
+func (r *ReplicaSet) QueryRow(query string, args ...interface{}) *sql.Row {
+	if n := r.pick(); n != nil {
+		return n.client.QueryRow(query, args...)
+	}
+	return r.primary.client.QueryRow(query, args...)
+}
+
+// Exec runs on the primary.
+func (r *ReplicaSet) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return r.primary.client.Exec(query, args...)
+}
+
+// Begin starts a transaction on the primary.
+func (r *ReplicaSet) Begin() (*sql.Tx, error) {
+	return r.primary.client.Begin()
+}
+
+// PingContext pings the primary.
+func (r *ReplicaSet) PingContext(ctx context.Context) error {
+	return r.primary.client.PingContext(ctx)
+}
+
+// Close stops health checking and closes every node.
+func (r *ReplicaSet) Close() error {
+	r.closeOnce.Do(func() { close(r.stop) })
+	<-r.done
+	var errs []error
+	for _, n := range append([]*node{r.primary}, r.replicas...) {
+		if err := n.client.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// isConnError reports whether err means the node could not be reached rather than that the query failed.
+func isConnError(err error) bool {
+	var netErr net.Error
+	return errors.Is(err, driver.ErrBadConn) || errors.Is(err, sql.ErrConnDone) ||
+		errors.Is(err, context.DeadlineExceeded) || errors.As(err, &netErr)
+}
@@ -0,0 +1,182 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"net"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+)
+
+type mockNode struct {
+	client DatabaseClient
+	mock   sqlmock.Sqlmock
+}
+
+func newMockNodes(t *testing.T, n int) []mockNode {
+	var nodes []mockNode
+	for i := 0; i < n; i++ {
+		client, mock, err := sqlmock.New(sqlmock.MonitorPingsOption(true))
+		assert.NoError(t, err)
+		nodes = append(nodes, mockNode{client: client, mock: mock})
+	}
+	return nodes
+}
+
+func newTestReplicaSet(nodes []mockNode, policy Policy) *ReplicaSet {
+	var replicas []DatabaseClient
+	for _, n := range nodes[1:] {
+		replicas = append(replicas, n.client)
+	}
+	return NewReplicaSet(nodes[0].client, replicas, ReplicaConfig{Policy: policy, CheckInterval: time.Hour})
+}
+
+func expectSelect(m mockNode, value string) {
+	m.mock.ExpectQuery(regexp.QuoteMeta("SELECT 1")).WillReturnRows(sqlmock.NewRows([]string{"v"}).AddRow(value))
+}
+
+func queryValue(t *testing.T, r *ReplicaSet) string {
+	rows, err := r.Query("SELECT 1")
+	if !assert.NoError(t, err) {
+		return ""
+	}
+	defer rows.Close()
+	var v string
+	assert.True(t, rows.Next())
+	assert.NoError(t, rows.Scan(&v))
+	return v
+}
+
+func TestReplicaSetRouting(t *testing.T) {
+	cases := map[string]struct {
+		prepFunc func(nodes []mockNode)
+		want     []string
+	}{
+		"reads alternate between healthy replicas": {
+			prepFunc: func(nodes []mockNode) {
+				for _, n := range nodes {
+					n.mock.ExpectPing()
+				}
+				expectSelect(nodes[1], "replica-0")
+				expectSelect(nodes[2], "replica-1")
+				expectSelect(nodes[1], "replica-0")
+			},
+			want: []string{"replica-0", "replica-1", "replica-0"},
+		},
+		"failing replica is ejected": {
+			prepFunc: func(nodes []mockNode) {
+				nodes[0].mock.ExpectPing()
+				nodes[1].mock.ExpectPing().WillReturnError(errors.New("connection refused"))
+				nodes[2].mock.ExpectPing()
+				expectSelect(nodes[2], "replica-1")
+				expectSelect(nodes[2], "replica-1")
+			},
+			want: []string{"replica-1", "replica-1"},
+		},
+		"reads fall back to the primary without healthy replicas": {
+			prepFunc: func(nodes []mockNode) {
+				nodes[0].mock.ExpectPing()
+				nodes[1].mock.ExpectPing().WillReturnError(errors.New("connection refused"))
+				nodes[2].mock.ExpectPing().WillReturnError(errors.New("connection refused"))
+				expectSelect(nodes[0], "primary")
+			},
+			want: []string{"primary"},
+		},
+		"connection error fails over to the next replica": {
+			prepFunc: func(nodes []mockNode) {
+				for _, n := range nodes {
+					n.mock.ExpectPing()
+				}
+				reset := &net.OpError{Op: "read", Net: "tcp", Err: errors.New("connection reset")}
+				nodes[1].mock.ExpectQuery(regexp.QuoteMeta("SELECT 1")).WillReturnError(reset)
+				expectSelect(nodes[2], "replica-1")
+				expectSelect(nodes[2], "replica-1")
+			},
+			want: []string{"replica-1", "replica-1"},
+		},
+	}
+
+	for k, v := range cases {
+		t.Run(k, func(t *testing.T) {
+			nodes := newMockNodes(t, 3)
+			r := newTestReplicaSet(nodes, RoundRobin)
+			v.prepFunc(nodes)
+			r.Check(context.Background())
+
+			var get []string
+			for range v.want {
+				get = append(get, queryValue(t, r))
+			}
+			assert.Equal(t, v.want, get)
+			for _, n := range nodes {
+				assert.NoError(t, n.mock.ExpectationsWereMet())
+			}
+		})
+	}
+}
+
+func TestReplicaSetRecovers(t *testing.T) {
+	nodes := newMockNodes(t, 2)
+	r := newTestReplicaSet(nodes, RoundRobin)
+	nodes[0].mock.ExpectPing()
+	nodes[1].mock.ExpectPing().WillReturnError(errors.New("connection refused"))
+	r.Check(context.Background())
+	assert.False(t, r.Status()[1].Healthy)
+	assert.Equal(t, "connection refused", r.Status()[1].Error)
+
+	nodes[0].mock.ExpectPing()
+	nodes[1].mock.ExpectPing()
+	r.Check(context.Background())
+	assert.True(t, r.Status()[1].Healthy)
+	expectSelect(nodes[1], "replica-0")
+	assert.Equal(t, "replica-0", queryValue(t, r))
+}
+
+func TestReplicaSetLeastLatency(t *testing.T) {
+	nodes := newMockNodes(t, 3)
+	r := newTestReplicaSet(nodes, LeastLatency)
+	nodes[0].mock.ExpectPing()
+	nodes[1].mock.ExpectPing().WillDelayFor(50 * time.Millisecond)
+	nodes[2].mock.ExpectPing()
+	r.Check(context.Background())
+
+	expectSelect(nodes[2], "replica-1")
+	expectSelect(nodes[2], "replica-1")
+	assert.Equal(t, "replica-1", queryValue(t, r))
+	assert.Equal(t, "replica-1", queryValue(t, r))
+}
+
+func TestReplicaSetWritesGoToPrimary(t *testing.T) {
+	nodes := newMockNodes(t, 2)
+	r := newTestReplicaSet(nodes, RoundRobin)
+	nodes[0].mock.ExpectExec("UPDATE").WillReturnResult(sqlmock.NewResult(0, 1))
+	nodes[0].mock.ExpectBegin()
+	nodes[0].mock.ExpectPing()
+
+	_, err := r.Exec("UPDATE t SET v = 1")
+	assert.NoError(t, err)
+	_, err = r.Begin()
+	assert.NoError(t, err)
+	assert.NoError(t, r.PingContext(context.Background()))
+	assert.NoError(t, nodes[0].mock.ExpectationsWereMet())
+
+	for _, n := range nodes {
+		n.mock.ExpectClose()
+	}
+	assert.NoError(t, r.Close())
+}
+
+func TestParsePolicy(t *testing.T) {
+	p, err := ParsePolicy("least-latency")
+	assert.NoError(t, err)
+	assert.Equal(t, LeastLatency, p)
+	p, err = ParsePolicy("")
+	assert.NoError(t, err)
+	assert.Equal(t, RoundRobin, p)
+	_, err = ParsePolicy("random")
+	assert.Error(t, err)
+}
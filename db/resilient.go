@@ -0,0 +1,284 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrCircuitOpen is returned without calling the database while the circuit breaker is open.
+var ErrCircuitOpen = errors.New("database circuit breaker is open")
+
+// BreakerState is the state of a circuit breaker.
+type BreakerState int32
+
+const (
+	// BreakerClosed lets every call through.
+	BreakerClosed BreakerState = iota
+	// BreakerOpen rejects calls until OpenTimeout has elapsed.
+	BreakerOpen
+	// BreakerHalfOpen lets a single probe call through to decide whether to close again.
+	BreakerHalfOpen
+)
+
+func (s BreakerState) String() string {
+	return [...]string{"closed", "open", "half-open"}[s]
+}
+
+// MarshalText : encodes the state by name
+func (s BreakerState) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+const (
+	defaultBreakerThreshold = 5
+	defaultOpenTimeout      = 30 * time.Second
+	defaultRetryBaseDelay   = 50 * time.Millisecond
+	defaultRetryMaxDelay    = time.Second
+)
+
+// RetryConfig configures retries of calls failing because the database could not be reached.
+type RetryConfig struct {
+	MaxAttempts int           // calls per operation including the first, default 1 (no retry)
+	BaseDelay   time.Duration // upper bound of the first jittered delay, doubled per attempt, default 50ms
+	MaxDelay    time.Duration // default 1s
+}
+
+// BreakerConfig configures the circuit breaker of a ResilientClient.
+type BreakerConfig struct {
+	FailureThreshold  int           // consecutive failures opening the breaker, default 5
+	OpenTimeout       time.Duration // time the breaker stays open before a probe is let through, default 30s
+	SlowCallThreshold time.Duration // successful calls slower than this count as failures, zero disables
+}
+
+// BreakerStats is a point in time copy of the breaker state and counters.
+type BreakerStats struct {
+	State    BreakerState `json:"state"`
+	Failures int          `json:"consecutiveFailures"`
+	Opened   uint64       `json:"opened"`   // times the breaker opened
+	Rejected uint64       `json:"rejected"` // calls answered with ErrCircuitOpen
+	Retries  uint64       `json:"retries"`
+}
+
+// ResilientClient is a DatabaseClient retrying calls that could not reach the database, with jittered
+// exponential backoff, behind a circuit breaker. Exec is not retried as it may not be idempotent, and
+// PingContext always reaches the database so that health checks report its real state.
+type ResilientClient struct {
+	client  DatabaseClient
+	retry   RetryConfig
+	breaker BreakerConfig
+
+	mu       sync.Mutex
+	state    BreakerState
+	failures int
+	openedAt time.Time
+	probing  bool // a half-open probe is in flight
+
+	opened   atomic.Uint64
+	rejected atomic.Uint64
+	retries  atomic.Uint64
+
+	rejectDB *sql.DB // answers QueryRow with ErrCircuitOpen
+	now      func() time.Time
+	sleep    func(time.Duration)
+}
+
+// NewResilientClient wraps client with retries and a circuit breaker.
+func NewResilientClient(client DatabaseClient, retry RetryConfig, breaker BreakerConfig) *ResilientClient {
+	if retry.MaxAttempts <= 0 {
+		retry.MaxAttempts = 1
+	}
+	if retry.BaseDelay <= 0 {
+		retry.BaseDelay = defaultRetryBaseDelay
+	}
+	if retry.MaxDelay <= 0 {
+		retry.MaxDelay = defaultRetryMaxDelay
+	}
+	if breaker.FailureThreshold <= 0 {
+		breaker.FailureThreshold = defaultBreakerThreshold
+	}
+	if breaker.OpenTimeout <= 0 {
+		breaker.OpenTimeout = defaultOpenTimeout
+	}
+	return &ResilientClient{
+		client:   client,
+		retry:    retry,
+		breaker:  breaker,
+		rejectDB: sql.OpenDB(rejectConnector{}),
+		now:      time.Now,
+		sleep:    time.Sleep,
+	}
+}
+
+// Stats returns the breaker state and counters.
+func (c *ResilientClient) Stats() BreakerStats {
+	c.mu.Lock()
+	state, failures := c.state, c.failures
+	c.mu.Unlock()
+	return BreakerStats{
+		State:    state,
+		Failures: failures,
+		Opened:   c.opened.Load(),
+		Rejected: c.rejected.Load(),
+		Retries:  c.retries.Load(),
+	}
+}
+
+// Report ...
+func (c *ResilientClient) Report() (string, interface{}) {
+	return "breaker", c.Stats()
+}
+
+// Unwrap returns the decorated client.
+func (c *ResilientClient) Unwrap() DatabaseClient {
+	return c.client
+}
+
+// Query ...
+func (c *ResilientClient) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	var rows *sql.Rows
+	err := c.do(true, func() (err error) {
+		rows, err = c.client.Query(query, args...)
+		return err
+	})
+	return rows, err
+}
+
+// QueryRow ...
+func (c *ResilientClient) QueryRow(query string, args ...interface{}) *sql.Row {
+	var row *sql.Row
+	c.do(true, func() error {
+		row = c.client.QueryRow(query, args...)
+		return row.Err()
+	})
+	if row == nil {
+		return c.rejectDB.QueryRow(query, args...)
+	}
+	return row
+}
+
+// Exec ...
+func (c *ResilientClient) Exec(query string, args ...interface{}) (sql.Result, error) {
+	var result sql.Result
+	err := c.do(false, func() (err error) {
+		result, err = c.client.Exec(query, args...)
+		return err
+	})
+	return result, err
+}
+
+// Begin ...
+func (c *ResilientClient) Begin() (*sql.Tx, error) {
+	var tx *sql.Tx
+	err := c.do(true, func() (err error) {
+		tx, err = c.client.Begin()
+		return err
+	})
+	return tx, err
+}
+
+// PingContext ...
+func (c *ResilientClient) PingContext(ctx context.Context) error {
+	return c.client.PingContext(ctx)
+}
+
+// Close ...
+func (c *ResilientClient) Close() error {
+	c.rejectDB.Close()
+	return c.client.Close()
+}
+
+// do runs op through the breaker, retrying failures that could not reach the database when retry is set.
+func (c *ResilientClient) do(retry bool, op func() error) error {
+	for attempt := 1; ; attempt++ {
+		if !c.allow() {
+			c.rejected.Add(1)
+			return ErrCircuitOpen
+		}
+		start := c.now()
+		err := op()
+		c.record(err, c.now().Sub(start))
+		if err == nil || !isConnError(err) || !retry || attempt >= c.retry.MaxAttempts {
+			return err
+		}
+		c.retries.Add(1)
+		c.sleep(c.backoff(attempt))
+	}
+}
+
+// backoff returns a random delay up to BaseDelay doubled per failed attempt, capped at MaxDelay.
+func (c *ResilientClient) backoff(attempt int) time.Duration {
+	d := c.retry.BaseDelay
+	for i := 1; i < attempt && d < c.retry.MaxDelay; i++ {
+		d *= 2
+	}
+	if d > c.retry.MaxDelay {
+		d = c.retry.MaxDelay
+	}
+	return time.Duration(rand.Int63n(int64(d) + 1))
+}
+
+// allow reports whether a call may reach the database, moving an open breaker to half-open after OpenTimeout.
+func (c *ResilientClient) allow() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	switch c.state {
+	case BreakerOpen:
+		if c.now().Before(c.openedAt.Add(c.breaker.OpenTimeout)) {
+			return false
+		}
+		c.state = BreakerHalfOpen
+		c.probing = true
+		return true
+	case BreakerHalfOpen:
+		if c.probing {
+			return false
+		}
+		c.probing = true
+	}
+	return true
+}
+
+// record counts the outcome of a call, opening the breaker after FailureThreshold consecutive failures
+// or a failed half-open probe, and closing it after a successful probe.
+func (c *ResilientClient) record(err error, elapsed time.Duration) {
+	failed := isConnError(err) ||
+		(err == nil && c.breaker.SlowCallThreshold > 0 && elapsed > c.breaker.SlowCallThreshold)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.state == BreakerHalfOpen {
+		c.probing = false
+	}
+	if !failed {
+		// a call started before the breaker opened does not close it
+		if c.state != BreakerOpen {
+			c.state = BreakerClosed
+			c.failures = 0
+		}
+		return
+	}
+	c.failures++
+	if c.state == BreakerHalfOpen || c.failures >= c.breaker.FailureThreshold {
+		if c.state != BreakerOpen {
+			c.opened.Add(1)
+		}
+		c.state = BreakerOpen
+		c.openedAt = c.now()
+	}
+}
+
+// rejectConnector fails every connection, giving QueryRow a Row whose Scan returns ErrCircuitOpen.
+type rejectConnector struct{}
+
+func (rejectConnector) Connect(context.Context) (driver.Conn, error) { return nil, ErrCircuitOpen }
+
+func (rejectConnector) Driver() driver.Driver { return rejectDriver{} }
+
+type rejectDriver struct{}
+
+func (rejectDriver) Open(string) (driver.Conn, error) { return nil, ErrCircuitOpen }
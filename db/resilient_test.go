@@ -0,0 +1,165 @@
+package db
+
+import (
+	"errors"
+	"net"
+	"regexp"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+)
+
+var errUnreachable = &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}
+
+type testClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *testClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *testClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	c.now = c.now.Add(d)
+	c.mu.Unlock()
+}
+
+func newTestResilientClient(t *testing.T, retry RetryConfig, breaker BreakerConfig) (*ResilientClient, sqlmock.Sqlmock, *testClock, *[]time.Duration) {
+	client, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	c := NewResilientClient(client, retry, breaker)
+	clock := &testClock{now: time.Unix(0, 0)}
+	var sleeps []time.Duration
+	c.now = clock.Now
+	c.sleep = func(d time.Duration) { sleeps = append(sleeps, d) }
+	return c, mock, clock, &sleeps
+}
+
+func expectFailure(mock sqlmock.Sqlmock, err error) {
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT 1")).WillReturnError(err)
+}
+
+func expectSuccess(mock sqlmock.Sqlmock) {
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT 1")).WillReturnRows(sqlmock.NewRows([]string{"v"}).AddRow(1))
+}
+
+func TestRetry(t *testing.T) {
+	cases := map[string]struct {
+		prepFunc   func(mock sqlmock.Sqlmock)
+		err        error
+		wantSleeps int
+	}{
+		"unreachable database is retried": {
+			prepFunc: func(mock sqlmock.Sqlmock) {
+				expectFailure(mock, errUnreachable)
+				expectFailure(mock, errUnreachable)
+				expectSuccess(mock)
+			},
+			wantSleeps: 2,
+		},
+		"gives up after max attempts": {
+			prepFunc: func(mock sqlmock.Sqlmock) {
+				expectFailure(mock, errUnreachable)
+				expectFailure(mock, errUnreachable)
+				expectFailure(mock, errUnreachable)
+			},
+			err:        errUnreachable,
+			wantSleeps: 2,
+		},
+		"query errors are not retried": {
+			prepFunc: func(mock sqlmock.Sqlmock) {
+				expectFailure(mock, errors.New("syntax error"))
+			},
+			err: errors.New("syntax error"),
+		},
+	}
+
+	for k, v := range cases {
+		t.Run(k, func(t *testing.T) {
+			c, mock, _, sleeps := newTestResilientClient(t,
+				RetryConfig{MaxAttempts: 3, BaseDelay: 10 * time.Millisecond, MaxDelay: 15 * time.Millisecond},
+				BreakerConfig{FailureThreshold: 10})
+			v.prepFunc(mock)
+			rows, err := c.Query("SELECT 1")
+			assert.Equal(t, v.err, err)
+			if rows != nil {
+				rows.Close()
+			}
+			assert.Len(t, *sleeps, v.wantSleeps)
+			for i, d := range *sleeps {
+				assert.LessOrEqual(t, d, []time.Duration{10 * time.Millisecond, 15 * time.Millisecond}[i])
+			}
+			assert.Equal(t, uint64(v.wantSleeps), c.Stats().Retries)
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
+
+func TestBreaker(t *testing.T) {
+	c, mock, clock, _ := newTestResilientClient(t, RetryConfig{}, BreakerConfig{FailureThreshold: 2, OpenTimeout: time.Minute})
+
+	// query errors show the database is reachable and reset the count
+	expectFailure(mock, errUnreachable)
+	expectFailure(mock, errors.New("syntax error"))
+	expectFailure(mock, errUnreachable)
+	for i := 0; i < 3; i++ {
+		c.Query("SELECT 1")
+	}
+	assert.Equal(t, BreakerClosed, c.Stats().State)
+	assert.Equal(t, 1, c.Stats().Failures)
+
+	// consecutive failures open the breaker
+	expectFailure(mock, errUnreachable)
+	c.Query("SELECT 1")
+	assert.Equal(t, BreakerOpen, c.Stats().State)
+
+	_, err := c.Query("SELECT 1")
+	assert.Equal(t, ErrCircuitOpen, err)
+	var v int
+	assert.Equal(t, ErrCircuitOpen, c.QueryRow("SELECT 1").Scan(&v))
+	assert.Equal(t, uint64(2), c.Stats().Rejected)
+
+	// a failed probe opens it again
+	clock.Advance(time.Minute)
+	expectFailure(mock, errUnreachable)
+	c.Query("SELECT 1")
+	assert.Equal(t, BreakerOpen, c.Stats().State)
+	_, err = c.Query("SELECT 1")
+	assert.Equal(t, ErrCircuitOpen, err)
+
+	// a successful probe closes it
+	clock.Advance(time.Minute)
+	expectSuccess(mock)
+	assert.NoError(t, c.QueryRow("SELECT 1").Scan(&v))
+	assert.Equal(t, 1, v)
+	stats := c.Stats()
+	assert.Equal(t, BreakerClosed, stats.State)
+	assert.Equal(t, uint64(2), stats.Opened)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestBreakerSlowCalls(t *testing.T) {
+	client, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	c := NewResilientClient(client, RetryConfig{}, BreakerConfig{FailureThreshold: 1, SlowCallThreshold: 10 * time.Millisecond})
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT 1")).WillDelayFor(20 * time.Millisecond).
+		WillReturnRows(sqlmock.NewRows([]string{"v"}).AddRow(1))
+
+	rows, err := c.Query("SELECT 1")
+	assert.NoError(t, err)
+	rows.Close()
+	assert.Equal(t, BreakerOpen, c.Stats().State)
+
+	name, report := c.Report()
+	assert.Equal(t, "breaker", name)
+	assert.Equal(t, BreakerOpen, report.(BreakerStats).State)
+	report = Report(c)
+	assert.Equal(t, map[string]interface{}{"breaker": c.Stats(), "pool": poolStats(client)}, report)
+}
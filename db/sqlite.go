@@ -0,0 +1,43 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"strings"
+)
+
+// ErrSQLiteUnavailable is returned by NewSQLite in a build without the sqlite3 driver, which needs cgo.
+var ErrSQLiteUnavailable = errors.New("sqlite3 driver not built in, it needs a build with cgo enabled")
+
+// sqliteBuilt is set by sqlite_cgo.go, the driver is only compiled in with cgo.
+var sqliteBuilt bool
+
+// sqliteBusyTimeout makes writers wait for a locked database instead of failing right away.
+const sqliteBusyTimeout = "_busy_timeout=5000"
+
+// SQLite ...
+type SQLite struct {
+	DB *sql.DB
+}
+
+// NewSQLite constructor for SQLite struct, path is a file name or a sqlite3 DSN.
+func NewSQLite(path string) (*SQLite, error) {
+	if !sqliteBuilt {
+		return nil, ErrSQLiteUnavailable
+	}
+	dsn := path
+	if !strings.Contains(dsn, "_busy_timeout") {
+		sep := "?"
+		if strings.Contains(dsn, "?") {
+			sep = "&"
+		}
+		dsn += sep + sqliteBusyTimeout
+	}
+	DB, err := sql.Open(DriverSQLite, dsn)
+	if err != nil {
+		log.Println("could not open sqlite database")
+		return nil, err
+	}
+	return &SQLite{DB: DB}, nil
+}
@@ -0,0 +1,12 @@
+//go:build cgo
+
+package db
+
+import (
+	// registers the sqlite3 driver, a cgo package
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func init() {
+	sqliteBuilt = true
+}
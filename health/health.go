@@ -0,0 +1,136 @@
+package health
+
+import (
+	"context"
+	"sort"
+	"sync"
+)
+
+// Status of a check or of a whole report.
+type Status string
+
+const (
+	// StatusUp ...
+	StatusUp Status = "up"
+	// StatusDown ...
+	StatusDown Status = "down"
+)
+
+// Result is the outcome of one check.
+type Result struct {
+	Status Status      `json:"status"`
+	Detail string      `json:"detail,omitempty"`
+	Data   interface{} `json:"data,omitempty"`
+}
+
+// Up returns a passing Result.
+func Up(detail string) Result {
+	return Result{Status: StatusUp, Detail: detail}
+}
+
+// Down returns a failing Result.
+func Down(detail string) Result {
+	return Result{Status: StatusDown, Detail: detail}
+}
+
+// Checker reports the status of one dependency or subsystem.
+type Checker interface {
+	Check(ctx context.Context) Result
+}
+
+// CheckerFunc adapts an ordinary function to the Checker interface.
+type CheckerFunc func(ctx context.Context) Result
+
+// Check calls f(ctx).
+func (f CheckerFunc) Check(ctx context.Context) Result {
+	return f(ctx)
+}
+
+// Report is the breakdown returned by the liveness and readiness endpoints.
+// Status is down as soon as one check is down.
+type Report struct {
+	Status Status            `json:"status"`
+	Checks map[string]Result `json:"checks"`
+}
+
+// Registry holds the liveness and readiness checks of the server.
+type Registry struct {
+	mu        sync.RWMutex
+	liveness  map[string]Checker
+	readiness map[string]Checker
+}
+
+// NewRegistry returns an empty Registry, it reports up until checks are added.
+func NewRegistry() *Registry {
+	return &Registry{
+		liveness:  make(map[string]Checker),
+		readiness: make(map[string]Checker),
+	}
+}
+
+// AddLiveness registers a check that fails liveness, replacing any check of the same name.
+func (r *Registry) AddLiveness(name string, c Checker) {
+	r.mu.Lock()
+	r.liveness[name] = c
+	r.mu.Unlock()
+}
+
+// AddReadiness registers a check that fails readiness, replacing any check of the same name.
+func (r *Registry) AddReadiness(name string, c Checker) {
+	r.mu.Lock()
+	r.readiness[name] = c
+	r.mu.Unlock()
+}
+
+// Live runs the liveness checks.
+func (r *Registry) Live(ctx context.Context) Report {
+	return r.run(ctx, r.liveness)
+}
+
+// Ready runs the liveness and readiness checks, a server that is not live is not ready either.
+func (r *Registry) Ready(ctx context.Context) Report {
+	live := r.run(ctx, r.liveness)
+	ready := r.run(ctx, r.readiness)
+	for name, res := range live.Checks {
+		ready.Checks[name] = res
+	}
+	if live.Status == StatusDown {
+		ready.Status = StatusDown
+	}
+	return ready
+}
+
+// run executes the checks concurrently so one slow dependency does not delay the others.
+func (r *Registry) run(ctx context.Context, checks map[string]Checker) Report {
+	r.mu.RLock()
+	names := make([]string, 0, len(checks))
+	checkers := make([]Checker, 0, len(checks))
+	for name := range checks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		checkers = append(checkers, checks[name])
+	}
+	r.mu.RUnlock()
+
+	results := make([]Result, len(checkers))
+	var wg sync.WaitGroup
+	for i, c := range checkers {
+		wg.Add(1)
+		go func(i int, c Checker) {
+			defer wg.Done()
+			results[i] = c.Check(ctx)
+		}(i, c)
+	}
+	wg.Wait()
+
+	report := Report{Status: StatusUp, Checks: make(map[string]Result, len(names))}
+	for i, name := range names {
+		report.Checks[name] = results[i]
+		if results[i].Status != StatusUp {
+			report.Status = StatusDown
+		}
+	}
+	return report
+}
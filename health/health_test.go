@@ -0,0 +1,74 @@
+package health
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func constant(res Result) Checker {
+	return CheckerFunc(func(ctx context.Context) Result { return res })
+}
+
+func TestRegistry(t *testing.T) {
+	cases := map[string]struct {
+		liveness  map[string]Checker
+		readiness map[string]Checker
+		wantLive  Status
+		wantReady Status
+	}{
+		"no checks": {
+			wantLive:  StatusUp,
+			wantReady: StatusUp,
+		},
+		"failing readiness check keeps the server live": {
+			liveness:  map[string]Checker{"loop": constant(Up(""))},
+			readiness: map[string]Checker{"db": constant(Down("timeout"))},
+			wantLive:  StatusUp,
+			wantReady: StatusDown,
+		},
+		"failing liveness check fails readiness": {
+			liveness:  map[string]Checker{"loop": constant(Down("stopped"))},
+			readiness: map[string]Checker{"db": constant(Up(""))},
+			wantLive:  StatusDown,
+			wantReady: StatusDown,
+		},
+	}
+
+	for k, v := range cases {
+		t.Run(k, func(t *testing.T) {
+			r := NewRegistry()
+			for name, c := range v.liveness {
+				r.AddLiveness(name, c)
+			}
+			for name, c := range v.readiness {
+				r.AddReadiness(name, c)
+			}
+			live := r.Live(context.Background())
+			ready := r.Ready(context.Background())
+			assert.Equal(t, v.wantLive, live.Status)
+			assert.Equal(t, v.wantReady, ready.Status)
+			assert.Len(t, ready.Checks, len(v.liveness)+len(v.readiness))
+		})
+	}
+}
+
+func TestPhase(t *testing.T) {
+	p := NewPhase()
+	assert.Equal(t, Down("pending"), p.Check(context.Background()))
+
+	p.Start()
+	assert.Equal(t, Down("running"), p.Check(context.Background()))
+
+	p.Finish(errors.New("query failed"))
+	state, err := p.State()
+	assert.Equal(t, PhaseFailed, state)
+	assert.EqualError(t, err, "query failed")
+	assert.Equal(t, Down("query failed"), p.Check(context.Background()))
+
+	p.Start()
+	p.Finish(nil)
+	assert.Equal(t, StatusUp, p.Check(context.Background()).Status)
+}
@@ -0,0 +1,77 @@
+package health
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// PhaseState is the lifecycle state of a startup phase.
+type PhaseState string
+
+const (
+	// PhasePending ...
+	PhasePending PhaseState = "pending"
+	// PhaseRunning ...
+	PhaseRunning PhaseState = "running"
+	// PhaseDone ...
+	PhaseDone PhaseState = "done"
+	// PhaseFailed ...
+	PhaseFailed PhaseState = "failed"
+)
+
+// Phase tracks one startup phase, such as loading an index cache, and is a readiness Checker.
+type Phase struct {
+	mu       sync.Mutex
+	state    PhaseState
+	err      error
+	started  time.Time
+	finished time.Time
+}
+
+// NewPhase returns a pending Phase.
+func NewPhase() *Phase {
+	return &Phase{state: PhasePending}
+}
+
+// Start marks the phase as running.
+func (p *Phase) Start() {
+	p.mu.Lock()
+	p.state = PhaseRunning
+	p.err = nil
+	p.started = time.Now()
+	p.mu.Unlock()
+}
+
+// Finish marks the phase done, or failed when err is not nil.
+func (p *Phase) Finish(err error) {
+	p.mu.Lock()
+	p.state = PhaseDone
+	if err != nil {
+		p.state = PhaseFailed
+	}
+	p.err = err
+	p.finished = time.Now()
+	p.mu.Unlock()
+}
+
+// State returns the current state and the error of a failed phase.
+func (p *Phase) State() (PhaseState, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.state, p.err
+}
+
+// Check is up once the phase is done.
+func (p *Phase) Check(ctx context.Context) Result {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	switch p.state {
+	case PhaseDone:
+		return Up("done in " + p.finished.Sub(p.started).String())
+	case PhaseFailed:
+		return Down(p.err.Error())
+	default:
+		return Down(string(p.state))
+	}
+}
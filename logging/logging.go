@@ -0,0 +1,94 @@
+package logging
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync/atomic"
+)
+
+// Level orders messages by severity.
+type Level int32
+
+const (
+	// Debug : per request details
+	Debug Level = iota
+	// Info : default
+	Info
+	// Warn ...
+	Warn
+	// Error ...
+	Error
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+// current is the lowest level written to the standard logger, it can change at any time.
+var current atomic.Int32
+
+func init() {
+	current.Store(int32(Info))
+}
+
+// ParseLevel returns the level named s, case insensitive. Empty means Info.
+func ParseLevel(s string) (Level, error) {
+	if s == "" {
+		return Info, nil
+	}
+	for l, name := range levelNames {
+		if strings.EqualFold(s, name) {
+			return Level(l), nil
+		}
+	}
+	return Info, fmt.Errorf("unknown log level %q, want debug, info, warn or error", s)
+}
+
+func (l Level) String() string {
+	if l < Debug || l > Error {
+		return fmt.Sprintf("Level(%d)", int32(l))
+	}
+	return levelNames[l]
+}
+
+// SetLevel drops messages below l from now on.
+func SetLevel(l Level) {
+	current.Store(int32(l))
+}
+
+// CurrentLevel ...
+func CurrentLevel() Level {
+	return Level(current.Load())
+}
+
+// Enabled reports whether messages of level l are written.
+func Enabled(l Level) bool {
+	return l >= CurrentLevel()
+}
+
+// Debugln ...
+func Debugln(v ...interface{}) {
+	if Enabled(Debug) {
+		log.Println(v...)
+	}
+}
+
+// Infoln ...
+func Infoln(v ...interface{}) {
+	if Enabled(Info) {
+		log.Println(v...)
+	}
+}
+
+// Warnln ...
+func Warnln(v ...interface{}) {
+	if Enabled(Warn) {
+		log.Println(v...)
+	}
+}
+
+// Errorln ...
+func Errorln(v ...interface{}) {
+	if Enabled(Error) {
+		log.Println(v...)
+	}
+}
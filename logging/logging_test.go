@@ -0,0 +1,51 @@
+package logging
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseLevel(t *testing.T) {
+	cases := map[string]struct {
+		in   string
+		want Level
+		err  bool
+	}{
+		"empty is info":    {in: "", want: Info},
+		"case insensitive": {in: "DEBUG", want: Debug},
+		"error":            {in: "error", want: Error},
+		"unknown":          {in: "loud", want: Info, err: true},
+	}
+
+	for k, v := range cases {
+		t.Run(k, func(t *testing.T) {
+			got, err := ParseLevel(v.in)
+			assert.Equal(t, v.want, got)
+			assert.Equal(t, v.err, err != nil)
+		})
+	}
+}
+
+func TestSetLevel(t *testing.T) {
+	var out bytes.Buffer
+	log.SetOutput(&out)
+	log.SetFlags(0)
+	defer func() {
+		log.SetOutput(os.Stderr)
+		log.SetFlags(log.LstdFlags)
+		SetLevel(Info)
+	}()
+
+	Debugln("hidden")
+	Infoln("shown")
+	SetLevel(Warn)
+	Infoln("hidden")
+	Warnln("warned")
+	SetLevel(Debug)
+	Debugln("debugged")
+	assert.Equal(t, "shown\nwarned\ndebugged\n", out.String())
+}
@@ -1,27 +1,149 @@
-package cacheServer
+package main
 
 import (
+	"cacheServer/api"
 	"cacheServer/appcontext"
 	"cacheServer/cache"
+	"cacheServer/cluster"
 	"cacheServer/db"
+	"cacheServer/logging"
+	"cacheServer/webhook"
+	"context"
+	"fmt"
+	"io"
 	"log"
+	"net"
 	"os"
 	"strconv"
+	"syscall"
+	"time"
 )
 
 func main() {
+	args := os.Args[1:]
+	if len(args) > 0 && args[0] == "print-config" {
+		os.Exit(printConfig(args[1:], os.LookupEnv, os.Stdout, os.Stderr))
+	}
+	cfg, err := appcontext.LoadConfig(args, os.LookupEnv)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	logging.SetLevel(cfg.LogLevel())
 
-	driver := os.Getenv("DB_DRIVER")
-	postgresURI := os.Getenv("POSTGRES_URI")
-	dbTimeout := os.Getenv("DB_TIMEOUT")
-	timeout, _ := strconv.Atoi(dbTimeout)
-	dbClient, err := db.NewPostgreSQL(driver, postgresURI)
+	dbCfg := cfg.Database
+	dbClient, dialect, err := db.Open(dbCfg.Driver, dbCfg.URI, dbCfg.PoolConfig())
 	if err != nil {
-		log.Println("error connecting Database")
+		log.Println("error connecting Database", err)
 		// TODO: Write the exit function
+		return
+	}
+	if err := db.WaitForConnection(context.Background(), dbClient, dbCfg.ConnectConfig()); err != nil {
+		log.Println("database not reachable, giving up", err)
+		return
 	}
-	ctx := appcontext.NewContext(dbClient.DB, timeout)
+	ctx := cfg.Context(db.NewPreparedClient(dbClient, dbCfg.MaxStatements))
+	ctx.Dialect = dialect
+	if len(dbCfg.Replicas.URIs) > 0 {
+		var replicas []db.DatabaseClient
+		for _, uri := range dbCfg.Replicas.URIs {
+			replica, _, err := db.Open(dbCfg.Driver, uri, dbCfg.PoolConfig())
+			if err != nil {
+				log.Println("error connecting replica", err)
+				continue
+			}
+			replicas = append(replicas, db.NewPreparedClient(replica, dbCfg.MaxStatements))
+		}
+		ctx.DatabaseClient = db.NewReplicaSet(ctx.DatabaseClient, replicas, dbCfg.ReplicaConfig())
+	}
+	ctx.DatabaseClient = db.NewResilientClient(ctx.DatabaseClient, dbCfg.RetryConfig(), dbCfg.BreakerConfig())
 
 	cacheServer := cache.GetCacheInstance(ctx)
+	if cfg.WAL.Dir != "" {
+		if err := cacheServer.OpenJournal(cfg.WAL); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+		defer cacheServer.CloseJournal()
+	}
 	go cacheServer.Run()
+
+	reloader := appcontext.NewReloader(cfg, args, os.LookupEnv, func(cfg *appcontext.Config) {
+		logging.SetLevel(cfg.LogLevel())
+		cacheServer.Reconfigure(cfg)
+	})
+	go reloader.Watch(context.Background(), 0)
+	reloader.ReloadOnSignal(context.Background(), syscall.SIGHUP)
+
+	webhooks, err := webhook.New(cfg.Webhooks)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	go webhooks.Run(cacheServer.Events())
+
+	opts := []api.Option{api.WithAdminToken(cfg.HTTP.AdminToken), api.WithReloader(reloader), api.WithWebhooks(webhooks)}
+	var appCache cache.AppCache = cacheServer
+	if cfg.Cluster.Self != "" {
+		node := newClusterNode(cacheServer, cfg.Cluster)
+		if cfg.Cluster.RaftPort != 0 {
+			if err := node.StartConsensus(consensusConfig(cfg.Cluster)); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(2)
+			}
+		}
+		go node.Run(context.Background())
+		appCache = node
+		opts = append(opts, api.WithCluster(node))
+	}
+
+	router := api.NewRouter(appCache, opts...)
+	if err := router.Run(cfg.HTTP.Addr); err != nil {
+		log.Println("http server stopped", err)
+	}
+}
+
+// printConfig writes the config loaded from args and the environment, secrets redacted, and returns the
+// exit code: 2 for an invalid config, 1 if it could not be written.
+func printConfig(args []string, lookupEnv func(string) (string, bool), stdout, stderr io.Writer) int {
+	cfg, err := appcontext.LoadConfig(args, lookupEnv)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 2
+	}
+	if err := cfg.Print(stdout); err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	return 0
+}
+
+// newClusterNode returns the cluster node of local, discovering its peers from the static list or DNS.
+func newClusterNode(local cache.AppCache, cfg appcontext.ClusterConfig) *cluster.Node {
+	var discoverer cluster.Discoverer
+	if len(cfg.Peers) > 0 {
+		discoverer = cluster.StaticPeers(cfg.Peers)
+	} else if cfg.DNS != "" {
+		host, port, _ := net.SplitHostPort(cfg.DNS)
+		discoverer = cluster.DNSPeers{Host: host, Port: port}
+	}
+	return cluster.NewNode(local, cluster.Config{
+		Self:            cfg.Self,
+		Discoverer:      discoverer,
+		RefreshInterval: time.Duration(cfg.RefreshInterval),
+		Replicas:        cfg.Replicas,
+		Timeout:         time.Duration(cfg.Timeout),
+		Secret:          cfg.Secret,
+		Sharding:        cfg.Sharding,
+	})
+}
+
+// consensusConfig returns the Raft group of the pods, each listening on the Raft port of its host.
+func consensusConfig(cfg appcontext.ClusterConfig) cluster.ConsensusConfig {
+	servers := make(map[string]string, len(cfg.Peers)+1)
+	for _, peer := range append([]string{cfg.Self}, cfg.Peers...) {
+		host, _, _ := net.SplitHostPort(peer)
+		servers[peer] = net.JoinHostPort(host, strconv.Itoa(cfg.RaftPort))
+	}
+	return cluster.ConsensusConfig{Servers: servers}
 }
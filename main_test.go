@@ -0,0 +1,50 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPrintConfig(t *testing.T) {
+	env := func(vars map[string]string) func(string) (string, bool) {
+		return func(key string) (string, bool) {
+			v, ok := vars[key]
+			return v, ok
+		}
+	}
+	cases := map[string]struct {
+		args       []string
+		env        map[string]string
+		wantCode   int
+		wantOut    []string
+		wantNotOut []string
+		wantErr    string
+	}{
+		"flags and environment": {
+			args:       []string{"-cache.ttl", "90s"},
+			env:        map[string]string{"DATABASE_URI": "postgres://cache:secret@db/shop"},
+			wantOut:    []string{"ttl: 1m30s", "uri: <redacted>"},
+			wantNotOut: []string{":secret@"},
+		},
+		"invalid config": {
+			args:     []string{"-cache.ttl", "soon"},
+			wantCode: 2,
+			wantErr:  "cache.ttl",
+		},
+	}
+	for k, v := range cases {
+		t.Run(k, func(t *testing.T) {
+			var stdout, stderr bytes.Buffer
+			assert.Equal(t, v.wantCode, printConfig(v.args, env(v.env), &stdout, &stderr))
+			for _, s := range v.wantOut {
+				assert.Contains(t, stdout.String(), s)
+			}
+			for _, s := range v.wantNotOut {
+				assert.NotContains(t, stdout.String(), s)
+			}
+			assert.Contains(t, stderr.String(), v.wantErr)
+		})
+	}
+}
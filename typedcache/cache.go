@@ -0,0 +1,630 @@
+package typedcache
+
+import (
+	"container/list"
+	"errors"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Loader loads the value of a key that is missing from the cache.
+type Loader[K comparable, V any] interface {
+	Load(key K) (V, error)
+}
+
+// LoaderFunc adapts an ordinary function to the Loader interface.
+type LoaderFunc[K comparable, V any] func(key K) (V, error)
+
+// Load calls f(key).
+func (f LoaderFunc[K, V]) Load(key K) (V, error) {
+	return f(key)
+}
+
+// BatchLoader is implemented by loaders that can load many keys in one call.
+// Keys left out of the returned map are treated as not found.
+type BatchLoader[K comparable, V any] interface {
+	Loader[K, V]
+	LoadMany(keys []K) (map[K]V, error)
+}
+
+// ErrNotFound is wrapped by loaders to report that a key does not exist. A cached key whose load returns
+// it is removed instead of keeping its last value.
+var ErrNotFound = errors.New("typedcache: key not found")
+
+// Change describes a cached key whose load found a different value, or found that it no longer exists.
+type Change[K comparable, V any] struct {
+	Key     K
+	Old     V
+	New     V    // zero when Removed
+	Removed bool // the key was not found
+}
+
+// Options configures expiry, eviction and background refresh of a Cache.
+type Options struct {
+	TTL        time.Duration // zero keeps entries until they are evicted or deleted
+	MaxEntries int           // zero means unbounded, otherwise least recently used entries are evicted
+
+	// RefreshAhead is the fraction of TTL after which a read of a hot entry reloads it in the background,
+	// e.g. 0.8 refreshes during the last fifth of its life. Zero disables refresh-ahead.
+	RefreshAhead float64
+	// RefreshMinHits is the number of reads an entry needs since it was stored to count as hot.
+	RefreshMinHits uint64
+	// MaxStale is how long past expiry an entry is still served while it is revalidated in the background.
+	// Zero disables stale-while-revalidate.
+	MaxStale time.Duration
+	// Fallback reports whether a failed load may be answered with the last known value of the key, however
+	// old. Expired entries are then kept until they are evicted, deleted or replaced. Nil disables fallback.
+	Fallback func(err error) bool
+}
+
+// Stats is a point in time copy of the cache metrics.
+type Stats struct {
+	Hits        uint64
+	Misses      uint64
+	Loads       uint64
+	LoadErrors  uint64
+	Evictions   uint64
+	Expirations uint64
+	StaleHits   uint64
+	Refreshes   uint64
+	Fallbacks   uint64
+	Entries     int
+}
+
+type metrics struct {
+	hits        atomic.Uint64
+	misses      atomic.Uint64
+	loads       atomic.Uint64
+	loadErrors  atomic.Uint64
+	evictions   atomic.Uint64
+	expirations atomic.Uint64
+	staleHits   atomic.Uint64
+	refreshes   atomic.Uint64
+	fallbacks   atomic.Uint64
+}
+
+// Sources of an entry, see EntryInfo.
+const (
+	SourceLoad = "load" // stored by the Loader, on a miss or a refresh
+	SourceSet  = "set"  // stored by Set
+)
+
+// EntryInfo is a point in time copy of a stored entry and its metadata.
+type EntryInfo[K comparable, V any] struct {
+	Key       K
+	Value     V
+	Source    string // SourceLoad or SourceSet
+	StoredAt  time.Time
+	ExpiresAt time.Time // zero without a TTL
+	Hits      uint64    // reads since the value was stored
+	Expired   bool      // kept past its expiry as a stale or fallback value
+}
+
+type entry[K comparable, V any] struct {
+	key       K
+	value     V
+	source    string
+	storedAt  time.Time
+	expiresAt time.Time
+	hits      uint64 // reads since the value was stored, used to tell hot entries apart
+	retained  bool   // expired but kept as a fallback value
+}
+
+// call is an in-flight load shared by every caller missing the same key.
+type call[V any] struct {
+	done  chan struct{}
+	gen   uint64 // generation of the key the load started under
+	value V
+	err   error
+}
+
+// pending counts the loads in flight of a key. Delete bumps its generation, a load that started under an
+// older generation returns its result without storing it.
+type pending struct {
+	loads int
+	gen   uint64
+}
+
+// Cache is a concurrent, typed key value cache that falls back to its Loader on a miss.
+type Cache[K comparable, V any] struct {
+	mu      sync.Mutex
+	loader  Loader[K, V]
+	opts    Options
+	entries map[K]*list.Element
+	lru     *list.List // front is most recently used
+	calls   map[K]*call[V]
+	pending map[K]*pending // keys with loads in flight, single or batched
+	metrics metrics
+	now     func() time.Time
+	watch   func(Change[K, V])   // set by Watch
+	onStore func(key K, value V) // set by OnStore
+}
+
+// New returns an empty Cache backed by loader.
+func New[K comparable, V any](loader Loader[K, V], opts Options) *Cache[K, V] {
+	return &Cache[K, V]{
+		loader:  loader,
+		opts:    opts,
+		entries: make(map[K]*list.Element),
+		lru:     list.New(),
+		calls:   make(map[K]*call[V]),
+		pending: make(map[K]*pending),
+		now:     time.Now,
+	}
+}
+
+// Get returns the cached value of key, loading and storing it on a miss.
+// Concurrent misses of the same key share a single load. Failed loads are not cached.
+// Hot entries close to expiry and stale entries within MaxStale are reloaded in the background.
+func (c *Cache[K, V]) Get(key K) (V, error) {
+	c.mu.Lock()
+	if v, ok := c.lookup(key); ok {
+		c.mu.Unlock()
+		c.metrics.hits.Add(1)
+		return v, nil
+	}
+	c.metrics.misses.Add(1)
+	return c.load(key)
+}
+
+// load runs the loader for key, joining an in-flight load of the same key. Caller must hold mu, it is released.
+func (c *Cache[K, V]) load(key K) (V, error) {
+	cl, started := c.begin(key)
+	c.mu.Unlock()
+	if started {
+		c.run(key, cl)
+	} else {
+		<-cl.done
+	}
+	return cl.value, cl.err
+}
+
+// refresh reloads key in the background unless a load is already in flight. Caller must hold mu.
+// The current value stays in place if the reload fails.
+func (c *Cache[K, V]) refresh(key K) {
+	if cl, started := c.begin(key); started {
+		c.metrics.refreshes.Add(1)
+		go c.run(key, cl)
+	}
+}
+
+// begin returns the in-flight load of key, registering a new one if there is none. Caller must hold mu.
+func (c *Cache[K, V]) begin(key K) (cl *call[V], started bool) {
+	if cl, ok := c.calls[key]; ok {
+		return cl, false
+	}
+	cl = &call[V]{done: make(chan struct{}), gen: c.startLoad(key)}
+	c.calls[key] = cl
+	return cl, true
+}
+
+// run loads key, stores a successful result and releases everyone waiting on cl. A result of a key deleted
+// during the load is returned to the waiters but not stored.
+func (c *Cache[K, V]) run(key K, cl *call[V]) {
+	c.metrics.loads.Add(1)
+	cl.value, cl.err = c.loader.Load(key)
+
+	c.mu.Lock()
+	if c.calls[key] == cl {
+		delete(c.calls, key)
+	}
+	current := c.endLoad(key, cl.gen)
+	var change *Change[K, V]
+	stored := cl.err == nil && current
+	if stored {
+		change = c.store(key, cl.value)
+	} else if cl.err != nil {
+		c.metrics.loadErrors.Add(1)
+		if errors.Is(cl.err, ErrNotFound) {
+			if current {
+				change = c.drop(key)
+			}
+		} else if v, ok := c.fallback(key, cl.err); ok {
+			cl.value, cl.err = v, nil
+		}
+	}
+	watch, onStore := c.watch, c.onStore
+	c.mu.Unlock()
+	close(cl.done)
+	if stored && onStore != nil {
+		onStore(key, cl.value)
+	}
+	if change != nil && watch != nil {
+		watch(*change)
+	}
+}
+
+// fallback returns the last known value of key if Fallback accepts err. Caller must hold mu.
+func (c *Cache[K, V]) fallback(key K, err error) (V, bool) {
+	var zero V
+	if c.opts.Fallback == nil || !c.opts.Fallback(err) {
+		return zero, false
+	}
+	el, ok := c.entries[key]
+	if !ok {
+		return zero, false
+	}
+	c.metrics.fallbacks.Add(1)
+	return el.Value.(*entry[K, V]).value, true
+}
+
+// GetMany returns the values of keys, serving hits from the cache. Misses are loaded with a single
+// LoadMany call when the loader is a BatchLoader, otherwise one key at a time. Keys that could not
+// be loaded are left out of the result.
+func (c *Cache[K, V]) GetMany(keys []K) (map[K]V, error) {
+	result := make(map[K]V, len(keys))
+	seen := make(map[K]struct{}, len(keys))
+	var missing []K
+	c.mu.Lock()
+	for _, key := range keys {
+		if _, ok := seen[key]; ok {
+			continue
+		}
+		seen[key] = struct{}{}
+		if v, ok := c.lookup(key); ok {
+			c.metrics.hits.Add(1)
+			result[key] = v
+			continue
+		}
+		c.metrics.misses.Add(1)
+		missing = append(missing, key)
+	}
+	c.mu.Unlock()
+	if len(missing) == 0 {
+		return result, nil
+	}
+
+	batch, ok := c.loader.(BatchLoader[K, V])
+	if !ok {
+		for _, key := range missing {
+			c.mu.Lock()
+			if v, err := c.load(key); err == nil {
+				result[key] = v
+			}
+		}
+		return result, nil
+	}
+
+	c.metrics.loads.Add(1)
+	gens := make([]uint64, len(missing))
+	c.mu.Lock()
+	for i, key := range missing {
+		gens[i] = c.startLoad(key)
+	}
+	c.mu.Unlock()
+	loaded, err := batch.LoadMany(missing)
+	if err != nil {
+		c.metrics.loadErrors.Add(1)
+		c.mu.Lock()
+		for i, key := range missing {
+			c.endLoad(key, gens[i])
+			if v, ok := c.fallback(key, err); ok {
+				result[key] = v
+			}
+		}
+		c.mu.Unlock()
+		return result, err
+	}
+	var changes []Change[K, V]
+	var stored []K
+	c.mu.Lock()
+	for i, key := range missing {
+		v, ok := loaded[key]
+		if ok {
+			result[key] = v
+		}
+		if !c.endLoad(key, gens[i]) {
+			continue
+		}
+		var change *Change[K, V]
+		if ok {
+			change = c.store(key, v)
+			stored = append(stored, key)
+		} else {
+			change = c.drop(key)
+		}
+		if change != nil {
+			changes = append(changes, *change)
+		}
+	}
+	watch, onStore := c.watch, c.onStore
+	c.mu.Unlock()
+	if onStore != nil {
+		for _, key := range stored {
+			onStore(key, loaded[key])
+		}
+	}
+	if watch != nil {
+		for _, change := range changes {
+			watch(change)
+		}
+	}
+	return result, nil
+}
+
+// Peek returns the cached value of key without loading it or touching recency and metrics.
+func (c *Cache[K, V]) Peek(key K) (V, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[key]; ok {
+		e := el.Value.(*entry[K, V])
+		if !c.expired(e) {
+			return e.value, true
+		}
+	}
+	var zero V
+	return zero, false
+}
+
+// Set stores value under key, replacing any previous value.
+func (c *Cache[K, V]) Set(key K, value V) {
+	c.mu.Lock()
+	c.set(key, value, SourceSet)
+	onStore := c.onStore
+	c.mu.Unlock()
+	if onStore != nil {
+		onStore(key, value)
+	}
+}
+
+// Inspect returns the stored entry of key, expired or not, without loading it or touching recency and metrics.
+func (c *Cache[K, V]) Inspect(key K) (EntryInfo[K, V], bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[key]
+	if !ok {
+		return EntryInfo[K, V]{}, false
+	}
+	return c.info(el.Value.(*entry[K, V])), true
+}
+
+// Entries returns the stored entries, most recently used first, without touching recency and metrics.
+func (c *Cache[K, V]) Entries() []EntryInfo[K, V] {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	out := make([]EntryInfo[K, V], 0, c.lru.Len())
+	for el := c.lru.Front(); el != nil; el = el.Next() {
+		out = append(out, c.info(el.Value.(*entry[K, V])))
+	}
+	return out
+}
+
+// DeleteFunc removes the keys for which match returns true and returns them. Loads in flight of matching
+// keys are not stored.
+func (c *Cache[K, V]) DeleteFunc(match func(key K) bool) []K {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var removed []K
+	for key, el := range c.entries {
+		if match(key) {
+			c.remove(el)
+			removed = append(removed, key)
+		}
+	}
+	for key := range c.pending {
+		if match(key) {
+			c.discardLoads(key)
+		}
+	}
+	return removed
+}
+
+// Delete removes key from the cache. A load of key in flight is not stored, later reads load it again.
+func (c *Cache[K, V]) Delete(key K) {
+	c.mu.Lock()
+	if el, ok := c.entries[key]; ok {
+		c.remove(el)
+	}
+	c.discardLoads(key)
+	c.mu.Unlock()
+}
+
+// Watch calls fn after a load replaced the value of a cached key with a different one, values compared
+// with reflect.DeepEqual, or found that a cached key no longer exists. Keys that were not cached, expired
+// ones removed included, are not reported. fn runs on the loading goroutine outside of the cache lock and
+// replaces the function of an earlier call.
+func (c *Cache[K, V]) Watch(fn func(Change[K, V])) {
+	c.mu.Lock()
+	c.watch = fn
+	c.mu.Unlock()
+}
+
+// OnStore calls fn after a value was stored, by Set or by a load, refreshes included. fn runs outside of
+// the cache lock and replaces the function of an earlier call.
+func (c *Cache[K, V]) OnStore(fn func(key K, value V)) {
+	c.mu.Lock()
+	c.onStore = fn
+	c.mu.Unlock()
+}
+
+// SetOptions replaces the options of c, keeping its Fallback. A new TTL applies to values stored from
+// then on, a lower MaxEntries evicts the least recently used entries at once.
+func (c *Cache[K, V]) SetOptions(opts Options) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	opts.Fallback = c.opts.Fallback
+	c.opts = opts
+	c.evict()
+}
+
+// Options returns the current options of c.
+func (c *Cache[K, V]) Options() Options {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.opts
+}
+
+// Len returns the number of stored entries, including expired ones not yet removed.
+func (c *Cache[K, V]) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lru.Len()
+}
+
+// Stats returns a snapshot of the cache metrics.
+func (c *Cache[K, V]) Stats() Stats {
+	return Stats{
+		Hits:        c.metrics.hits.Load(),
+		Misses:      c.metrics.misses.Load(),
+		Loads:       c.metrics.loads.Load(),
+		LoadErrors:  c.metrics.loadErrors.Load(),
+		Evictions:   c.metrics.evictions.Load(),
+		Expirations: c.metrics.expirations.Load(),
+		StaleHits:   c.metrics.staleHits.Load(),
+		Refreshes:   c.metrics.refreshes.Load(),
+		Fallbacks:   c.metrics.fallbacks.Load(),
+		Entries:     c.Len(),
+	}
+}
+
+// lookup returns a servable entry and marks it recently used. Hot entries past the refresh-ahead point and
+// stale entries are refreshed in the background, entries past MaxStale are dropped, or kept for Fallback.
+// Caller must hold mu.
+func (c *Cache[K, V]) lookup(key K) (V, bool) {
+	var zero V
+	el, ok := c.entries[key]
+	if !ok {
+		return zero, false
+	}
+	e := el.Value.(*entry[K, V])
+	now := c.now()
+	if c.expired(e) {
+		if c.opts.MaxStale <= 0 || !now.Before(e.expiresAt.Add(c.opts.MaxStale)) {
+			if !e.retained {
+				c.metrics.expirations.Add(1)
+			}
+			if c.opts.Fallback != nil {
+				e.retained = true
+			} else {
+				c.remove(el)
+			}
+			return zero, false
+		}
+		c.metrics.staleHits.Add(1)
+		c.refresh(key)
+	} else if c.shouldRefreshAhead(e, now) {
+		c.refresh(key)
+	}
+	e.hits++
+	c.lru.MoveToFront(el)
+	return e.value, true
+}
+
+// shouldRefreshAhead reports whether e is hot and old enough to be reloaded before it expires.
+func (c *Cache[K, V]) shouldRefreshAhead(e *entry[K, V], now time.Time) bool {
+	if c.opts.RefreshAhead <= 0 || e.expiresAt.IsZero() || e.hits < c.opts.RefreshMinHits {
+		return false
+	}
+	refreshAt := e.storedAt.Add(time.Duration(float64(c.opts.TTL) * c.opts.RefreshAhead))
+	return !now.Before(refreshAt)
+}
+
+// set stores the value and evicts the least recently used entries above MaxEntries. Caller must hold mu.
+func (c *Cache[K, V]) set(key K, value V, source string) {
+	now := c.now()
+	var expiresAt time.Time
+	if c.opts.TTL > 0 {
+		expiresAt = now.Add(c.opts.TTL)
+	}
+	if el, ok := c.entries[key]; ok {
+		e := el.Value.(*entry[K, V])
+		e.value = value
+		e.source = source
+		e.storedAt = now
+		e.expiresAt = expiresAt
+		e.hits = 0
+		e.retained = false
+		c.lru.MoveToFront(el)
+		return
+	}
+	c.entries[key] = c.lru.PushFront(&entry[K, V]{key: key, value: value, source: source, storedAt: now, expiresAt: expiresAt})
+	c.evict()
+}
+
+// store sets the loaded value of key and returns the change to report, if any. Caller must hold mu.
+func (c *Cache[K, V]) store(key K, value V) *Change[K, V] {
+	var change *Change[K, V]
+	if el, ok := c.entries[key]; ok && c.watch != nil {
+		if old := el.Value.(*entry[K, V]).value; !reflect.DeepEqual(old, value) {
+			change = &Change[K, V]{Key: key, Old: old, New: value}
+		}
+	}
+	c.set(key, value, SourceLoad)
+	return change
+}
+
+// drop removes key, found missing by a load, and returns the change to report, if any. Caller must hold mu.
+func (c *Cache[K, V]) drop(key K) *Change[K, V] {
+	el, ok := c.entries[key]
+	if !ok {
+		return nil
+	}
+	c.remove(el)
+	if c.watch == nil {
+		return nil
+	}
+	return &Change[K, V]{Key: key, Old: el.Value.(*entry[K, V]).value, Removed: true}
+}
+
+// evict removes the least recently used entries above MaxEntries. Caller must hold mu.
+func (c *Cache[K, V]) evict() {
+	for c.opts.MaxEntries > 0 && c.lru.Len() > c.opts.MaxEntries {
+		c.remove(c.lru.Back())
+		c.metrics.evictions.Add(1)
+	}
+}
+
+// startLoad registers a load of key and returns the generation it started under. Caller must hold mu.
+func (c *Cache[K, V]) startLoad(key K) uint64 {
+	p, ok := c.pending[key]
+	if !ok {
+		p = &pending{}
+		c.pending[key] = p
+	}
+	p.loads++
+	return p.gen
+}
+
+// endLoad unregisters a load of key and reports whether its result may be stored, i.e. key was not
+// deleted since the load started. Caller must hold mu.
+func (c *Cache[K, V]) endLoad(key K, gen uint64) bool {
+	p := c.pending[key]
+	p.loads--
+	if p.loads == 0 {
+		delete(c.pending, key)
+	}
+	return p.gen == gen
+}
+
+// discardLoads keeps the loads of key in flight from storing their results and lets the next read start
+// a new one. Caller must hold mu.
+func (c *Cache[K, V]) discardLoads(key K) {
+	if p, ok := c.pending[key]; ok {
+		p.gen++
+	}
+	delete(c.calls, key)
+}
+
+func (c *Cache[K, V]) remove(el *list.Element) {
+	c.lru.Remove(el)
+	delete(c.entries, el.Value.(*entry[K, V]).key)
+}
+
+// info copies e. Caller must hold mu.
+func (c *Cache[K, V]) info(e *entry[K, V]) EntryInfo[K, V] {
+	return EntryInfo[K, V]{
+		Key:       e.key,
+		Value:     e.value,
+		Source:    e.source,
+		StoredAt:  e.storedAt,
+		ExpiresAt: e.expiresAt,
+		Hits:      e.hits,
+		Expired:   c.expired(e),
+	}
+}
+
+func (c *Cache[K, V]) expired(e *entry[K, V]) bool {
+	return !e.expiresAt.IsZero() && !c.now().Before(e.expiresAt)
+}
@@ -0,0 +1,605 @@
+package typedcache
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (f *fakeClock) Now() time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.now
+}
+
+func (f *fakeClock) Advance(d time.Duration) {
+	f.mu.Lock()
+	f.now = f.now.Add(d)
+	f.mu.Unlock()
+}
+
+func newTestCache(opts Options, clock *fakeClock, values map[string]int) (*Cache[string, int], *atomic.Int32) {
+	var loads atomic.Int32
+	c := New[string, int](LoaderFunc[string, int](func(key string) (int, error) {
+		loads.Add(1)
+		if v, ok := values[key]; ok {
+			return v, nil
+		}
+		return 0, errors.New("not found")
+	}), opts)
+	c.now = clock.Now
+	return c, &loads
+}
+
+func TestGet(t *testing.T) {
+	cases := map[string]struct {
+		key       string
+		preset    map[string]int
+		want      int
+		err       bool
+		wantLoads int32
+	}{
+		"hit is served from cache": {
+			key:       "a",
+			preset:    map[string]int{"a": 10},
+			want:      10,
+			wantLoads: 0,
+		},
+		"miss falls back to loader": {
+			key:       "b",
+			want:      2,
+			wantLoads: 1,
+		},
+		"loader error is returned": {
+			key:       "missing",
+			err:       true,
+			wantLoads: 1,
+		},
+	}
+
+	for k, v := range cases {
+		t.Run(k, func(t *testing.T) {
+			c, loads := newTestCache(Options{}, &fakeClock{}, map[string]int{"b": 2})
+			for pk, pv := range v.preset {
+				c.Set(pk, pv)
+			}
+			get, err := c.Get(v.key)
+			assert.Equal(t, v.err, err != nil)
+			assert.Equal(t, v.want, get)
+			assert.Equal(t, v.wantLoads, loads.Load())
+		})
+	}
+}
+
+func TestFailedLoadIsNotCached(t *testing.T) {
+	c, loads := newTestCache(Options{}, &fakeClock{}, nil)
+	c.Get("a")
+	c.Get("a")
+	_, ok := c.Peek("a")
+	assert.False(t, ok)
+	assert.Equal(t, int32(2), loads.Load())
+	assert.Equal(t, uint64(2), c.Stats().LoadErrors)
+}
+
+func TestTTL(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	c, loads := newTestCache(Options{TTL: time.Minute}, clock, map[string]int{"a": 1})
+
+	c.Get("a")
+	clock.Advance(30 * time.Second)
+	c.Get("a")
+	assert.Equal(t, int32(1), loads.Load())
+
+	clock.Advance(time.Minute)
+	_, ok := c.Peek("a")
+	assert.False(t, ok)
+	c.Get("a")
+	assert.Equal(t, int32(2), loads.Load())
+	assert.Equal(t, uint64(1), c.Stats().Expirations)
+}
+
+func TestEviction(t *testing.T) {
+	c, _ := newTestCache(Options{MaxEntries: 2}, &fakeClock{}, nil)
+	c.Set("a", 1)
+	c.Set("b", 2)
+	c.Get("a") // a becomes most recently used
+	c.Set("c", 3)
+
+	_, ok := c.Peek("b")
+	assert.False(t, ok)
+	_, ok = c.Peek("a")
+	assert.True(t, ok)
+	assert.Equal(t, 2, c.Len())
+	assert.Equal(t, uint64(1), c.Stats().Evictions)
+}
+
+func TestSetOptions(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	fallback := func(err error) bool { return true }
+	c, _ := newTestCache(Options{TTL: time.Minute, Fallback: fallback}, clock, nil)
+	c.Set("a", 1)
+	c.Set("b", 2)
+	c.Set("c", 3)
+
+	c.SetOptions(Options{TTL: time.Hour, MaxEntries: 2})
+	assert.Equal(t, 2, c.Len())
+	assert.Equal(t, uint64(1), c.Stats().Evictions)
+	assert.NotNil(t, c.Options().Fallback)
+
+	// entries stored before keep their TTL
+	c.Set("d", 4)
+	clock.Advance(2 * time.Minute)
+	_, ok := c.Peek("c")
+	assert.False(t, ok)
+	_, ok = c.Peek("d")
+	assert.True(t, ok)
+}
+
+func TestDelete(t *testing.T) {
+	c, _ := newTestCache(Options{}, &fakeClock{}, nil)
+	c.Set("a", 1)
+	c.Delete("a")
+	c.Delete("missing")
+	_, ok := c.Peek("a")
+	assert.False(t, ok)
+}
+
+func TestInspect(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	c, loads := newTestCache(Options{TTL: time.Minute, Fallback: func(error) bool { return true }}, clock, map[string]int{"a": 1})
+	_, err := c.Get("a")
+	assert.NoError(t, err)
+	c.Get("a")
+	clock.Advance(10 * time.Second)
+	c.Set("b", 2)
+
+	info, ok := c.Inspect("a")
+	assert.True(t, ok)
+	assert.Equal(t, EntryInfo[string, int]{
+		Key: "a", Value: 1, Source: SourceLoad, StoredAt: time.Unix(0, 0), ExpiresAt: time.Unix(60, 0), Hits: 1,
+	}, info)
+	_, ok = c.Inspect("missing")
+	assert.False(t, ok)
+	assert.Equal(t, int32(1), loads.Load(), "inspecting does not load")
+
+	entries := c.Entries()
+	assert.Len(t, entries, 2)
+	assert.Equal(t, "b", entries[0].Key, "most recently used first")
+	assert.Equal(t, SourceSet, entries[0].Source)
+
+	clock.Advance(55 * time.Second)
+	info, ok = c.Inspect("b")
+	assert.True(t, ok)
+	assert.False(t, info.Expired)
+	info, _ = c.Inspect("a")
+	assert.True(t, info.Expired, "kept for fallback")
+	assert.Equal(t, uint64(1), c.Stats().Hits, "inspecting does not count")
+}
+
+func TestDeleteFunc(t *testing.T) {
+	c, _ := newTestCache(Options{}, &fakeClock{}, nil)
+	c.Set("ab", 1)
+	c.Set("ac", 2)
+	c.Set("b", 3)
+	removed := c.DeleteFunc(func(key string) bool { return key[0] == 'a' })
+	assert.ElementsMatch(t, []string{"ab", "ac"}, removed)
+	assert.Equal(t, 1, c.Len())
+	assert.Empty(t, c.DeleteFunc(func(string) bool { return false }))
+}
+
+func TestDeleteDuringLoad(t *testing.T) {
+	cases := map[string]func(c *Cache[string, int]){
+		"delete":      func(c *Cache[string, int]) { c.Delete("a") },
+		"delete func": func(c *Cache[string, int]) { c.DeleteFunc(func(key string) bool { return key == "a" }) },
+	}
+	for k, remove := range cases {
+		t.Run(k, func(t *testing.T) {
+			var loads atomic.Int32
+			started := make(chan struct{})
+			release := make(chan struct{})
+			c := New[string, int](LoaderFunc[string, int](func(key string) (int, error) {
+				if loads.Add(1) == 1 {
+					close(started)
+					<-release
+					return 1, nil
+				}
+				return 2, nil
+			}), Options{})
+
+			first := make(chan int)
+			go func() {
+				v, _ := c.Get("a")
+				first <- v
+			}()
+			<-started
+			remove(c)
+			// a read after the delete does not join the load that started before it
+			v, err := c.Get("a")
+			assert.NoError(t, err)
+			assert.Equal(t, 2, v)
+			close(release)
+			assert.Equal(t, 1, <-first, "the earlier reader gets its own load")
+
+			v, ok := c.Peek("a")
+			assert.True(t, ok)
+			assert.Equal(t, 2, v, "the load from before the delete is not stored")
+			assert.Empty(t, c.pending)
+		})
+	}
+}
+
+func TestConcurrentMissesShareLoad(t *testing.T) {
+	release := make(chan struct{})
+	var loads atomic.Int32
+	c := New[string, int](LoaderFunc[string, int](func(key string) (int, error) {
+		loads.Add(1)
+		<-release
+		return 7, nil
+	}), Options{})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			v, err := c.Get("a")
+			assert.NoError(t, err)
+			assert.Equal(t, 7, v)
+		}()
+	}
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	assert.Equal(t, int32(1), loads.Load())
+	stats := c.Stats()
+	assert.Equal(t, uint64(10), stats.Hits+stats.Misses)
+	assert.Equal(t, uint64(1), stats.Loads)
+}
+
+type batchLoader struct {
+	values map[string]int
+	calls  [][]string
+	err    error
+}
+
+func (b *batchLoader) Load(key string) (int, error) {
+	return 0, errors.New("unexpected single load")
+}
+
+func (b *batchLoader) LoadMany(keys []string) (map[string]int, error) {
+	b.calls = append(b.calls, keys)
+	if b.err != nil {
+		return nil, b.err
+	}
+	result := make(map[string]int)
+	for _, k := range keys {
+		if v, ok := b.values[k]; ok {
+			result[k] = v
+		}
+	}
+	return result, nil
+}
+
+func TestGetMany(t *testing.T) {
+	cases := map[string]struct {
+		keys      []string
+		loaderErr error
+		want      map[string]int
+		wantCalls [][]string
+		err       bool
+	}{
+		"hits are served from cache and misses loaded in one call": {
+			keys:      []string{"cached", "a", "b", "a", "missing"},
+			want:      map[string]int{"cached": 0, "a": 1, "b": 2},
+			wantCalls: [][]string{{"a", "b", "missing"}},
+		},
+		"only hits does not call loader": {
+			keys: []string{"cached"},
+			want: map[string]int{"cached": 0},
+		},
+		"loader error keeps hits": {
+			keys:      []string{"cached", "a"},
+			loaderErr: errors.New("db down"),
+			want:      map[string]int{"cached": 0},
+			wantCalls: [][]string{{"a"}},
+			err:       true,
+		},
+	}
+
+	for k, v := range cases {
+		t.Run(k, func(t *testing.T) {
+			loader := &batchLoader{values: map[string]int{"a": 1, "b": 2}, err: v.loaderErr}
+			c := New[string, int](loader, Options{})
+			c.Set("cached", 0)
+			get, err := c.GetMany(v.keys)
+			assert.Equal(t, v.err, err != nil)
+			assert.Equal(t, v.want, get)
+			assert.Equal(t, v.wantCalls, loader.calls)
+		})
+	}
+}
+
+func TestGetManyWithoutBatchLoader(t *testing.T) {
+	c, loads := newTestCache(Options{}, &fakeClock{}, map[string]int{"a": 1, "b": 2})
+	get, err := c.GetMany([]string{"a", "b", "missing"})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]int{"a": 1, "b": 2}, get)
+	assert.Equal(t, int32(3), loads.Load())
+}
+
+// versionLoader returns how many times it has been called, failing while fail is set.
+type versionLoader struct {
+	calls atomic.Int32
+	fail  atomic.Bool
+}
+
+func (v *versionLoader) Load(key string) (int, error) {
+	n := v.calls.Add(1)
+	if v.fail.Load() {
+		return 0, errors.New("db down")
+	}
+	return int(n), nil
+}
+
+func TestRefreshAhead(t *testing.T) {
+	cases := map[string]struct {
+		reads       int
+		wantRefresh bool
+	}{
+		"hot entry is refreshed before expiry": {
+			reads:       3,
+			wantRefresh: true,
+		},
+		"cold entry is left to expire": {
+			reads:       1,
+			wantRefresh: false,
+		},
+	}
+
+	for k, v := range cases {
+		t.Run(k, func(t *testing.T) {
+			clock := &fakeClock{now: time.Unix(0, 0)}
+			loader := &versionLoader{}
+			c := New[string, int](loader, Options{TTL: 10 * time.Second, RefreshAhead: 0.5, RefreshMinHits: 2})
+			c.now = clock.Now
+
+			c.Get("a")
+			clock.Advance(6 * time.Second)
+			for i := 0; i < v.reads; i++ {
+				get, err := c.Get("a")
+				assert.NoError(t, err)
+				assert.Equal(t, 1, get)
+			}
+			if v.wantRefresh {
+				assert.Eventually(t, func() bool {
+					get, _ := c.Peek("a")
+					return get == 2
+				}, time.Second, time.Millisecond)
+				assert.Equal(t, uint64(1), c.Stats().Refreshes)
+			} else {
+				assert.Equal(t, int32(1), loader.calls.Load())
+			}
+		})
+	}
+}
+
+func TestStaleWhileRevalidate(t *testing.T) {
+	cases := map[string]struct {
+		age       time.Duration
+		fail      bool
+		want      int
+		err       bool
+		wantAfter int
+	}{
+		"stale entry is served while it is reloaded": {
+			age:       12 * time.Second,
+			want:      1,
+			wantAfter: 2,
+		},
+		"failed reload keeps serving the stale entry": {
+			age:       12 * time.Second,
+			fail:      true,
+			want:      1,
+			wantAfter: 1,
+		},
+		"entry past max staleness is loaded synchronously": {
+			age:       16 * time.Second,
+			want:      2,
+			wantAfter: 2,
+		},
+	}
+
+	for k, v := range cases {
+		t.Run(k, func(t *testing.T) {
+			clock := &fakeClock{now: time.Unix(0, 0)}
+			loader := &versionLoader{}
+			c := New[string, int](loader, Options{TTL: 10 * time.Second, MaxStale: 5 * time.Second})
+			c.now = clock.Now
+
+			c.Get("a")
+			clock.Advance(v.age)
+			loader.fail.Store(v.fail)
+			get, err := c.Get("a")
+			assert.Equal(t, v.err, err != nil)
+			assert.Equal(t, v.want, get)
+
+			assert.Eventually(t, func() bool { return loader.calls.Load() == 2 }, time.Second, time.Millisecond)
+			assert.Eventually(t, func() bool {
+				c.mu.Lock()
+				defer c.mu.Unlock()
+				return len(c.calls) == 0
+			}, time.Second, time.Millisecond)
+			c.mu.Lock()
+			get = c.entries["a"].Value.(*entry[string, int]).value
+			c.mu.Unlock()
+			assert.Equal(t, v.wantAfter, get)
+		})
+	}
+}
+
+var errUnavailable = errors.New("unavailable")
+
+func TestFallback(t *testing.T) {
+	cases := map[string]struct {
+		key       string
+		loaderErr error
+		want      int
+		err       bool
+		fallbacks uint64
+	}{
+		"expired value is served while the database is unavailable": {
+			key:       "a",
+			loaderErr: errUnavailable,
+			want:      1,
+			fallbacks: 1,
+		},
+		"other errors are returned": {
+			key:       "a",
+			loaderErr: errors.New("syntax error"),
+			err:       true,
+		},
+		"key without a previous value returns the error": {
+			key:       "b",
+			loaderErr: errUnavailable,
+			err:       true,
+		},
+	}
+
+	for k, v := range cases {
+		t.Run(k, func(t *testing.T) {
+			clock := &fakeClock{now: time.Unix(0, 0)}
+			var loaderErr error
+			c := New[string, int](LoaderFunc[string, int](func(key string) (int, error) {
+				if loaderErr != nil {
+					return 0, loaderErr
+				}
+				return 1, nil
+			}), Options{TTL: time.Second, Fallback: func(err error) bool { return errors.Is(err, errUnavailable) }})
+			c.now = clock.Now
+
+			c.Get("a")
+			clock.Advance(time.Hour)
+			loaderErr = v.loaderErr
+			get, err := c.Get(v.key)
+			assert.Equal(t, v.err, err != nil)
+			assert.Equal(t, v.want, get)
+			assert.Equal(t, v.fallbacks, c.Stats().Fallbacks)
+			_, ok := c.Peek("a")
+			assert.False(t, ok)
+		})
+	}
+}
+
+func TestGetManyFallback(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	loader := &batchLoader{values: map[string]int{"a": 1}}
+	c := New[string, int](loader, Options{TTL: time.Second, Fallback: func(err error) bool { return errors.Is(err, errUnavailable) }})
+	c.now = clock.Now
+	c.GetMany([]string{"a"})
+
+	clock.Advance(time.Hour)
+	loader.err = errUnavailable
+	get, err := c.GetMany([]string{"a", "b"})
+	assert.Error(t, err)
+	assert.Equal(t, map[string]int{"a": 1}, get)
+	assert.Equal(t, uint64(1), c.Stats().Expirations)
+
+	// a successful load replaces the retained value
+	loader.err = nil
+	loader.values["a"] = 2
+	get, err = c.GetMany([]string{"a"})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]int{"a": 2}, get)
+	assert.Equal(t, uint64(1), c.Stats().Expirations)
+}
+
+func TestWatch(t *testing.T) {
+	cases := map[string]struct {
+		next  map[string]int
+		batch bool
+		want  []Change[string, int]
+	}{
+		"changed value is reported": {
+			next: map[string]int{"a": 2},
+			want: []Change[string, int]{{Key: "a", Old: 1, New: 2}},
+		},
+		"equal value is not reported": {
+			next: map[string]int{"a": 1},
+		},
+		"missing key is removed and reported": {
+			next: map[string]int{},
+			want: []Change[string, int]{{Key: "a", Old: 1, Removed: true}},
+		},
+		"changed value is reported by GetMany": {
+			next:  map[string]int{"a": 2},
+			batch: true,
+			want:  []Change[string, int]{{Key: "a", Old: 1, New: 2}},
+		},
+		"missing key is removed and reported by GetMany": {
+			next:  map[string]int{},
+			batch: true,
+			want:  []Change[string, int]{{Key: "a", Old: 1, Removed: true}},
+		},
+	}
+
+	for k, v := range cases {
+		t.Run(k, func(t *testing.T) {
+			clock := &fakeClock{now: time.Unix(0, 0)}
+			opts := Options{TTL: time.Second, Fallback: func(error) bool { return false }}
+			var c *Cache[string, int]
+			if v.batch {
+				c = New[string, int](&batchLoader{values: v.next}, opts)
+			} else {
+				c = New[string, int](LoaderFunc[string, int](func(key string) (int, error) {
+					if value, ok := v.next[key]; ok {
+						return value, nil
+					}
+					return 0, ErrNotFound
+				}), opts)
+			}
+			c.now = clock.Now
+			var got []Change[string, int]
+			c.Watch(func(change Change[string, int]) { got = append(got, change) })
+
+			c.Set("a", 1)
+			clock.Advance(time.Hour)
+			if v.batch {
+				_, err := c.GetMany([]string{"a"})
+				assert.NoError(t, err)
+			} else {
+				c.Get("a")
+			}
+			assert.Equal(t, v.want, got)
+			_, ok := c.Peek("a")
+			assert.Equal(t, len(v.next) > 0, ok)
+		})
+	}
+}
+
+func TestOnStore(t *testing.T) {
+	c, _ := newTestCache(Options{}, &fakeClock{}, map[string]int{"a": 1})
+	var stored []string
+	c.OnStore(func(key string, value int) { stored = append(stored, key) })
+	c.Set("s", 5)
+	c.Get("a")
+	c.Get("a")
+	c.Get("missing")
+	assert.Equal(t, []string{"s", "a"}, stored, "hits and failed loads store nothing")
+
+	b := New[string, int](&batchLoader{values: map[string]int{"x": 1, "y": 2}}, Options{})
+	stored = nil
+	b.OnStore(func(key string, value int) { stored = append(stored, key) })
+	_, err := b.GetMany([]string{"x", "y", "z"})
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []string{"x", "y"}, stored)
+}
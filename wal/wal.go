@@ -0,0 +1,531 @@
+// Package wal is an append-only log of records split in segment files. A snapshot written at a sequence
+// number replaces the records up to it, the segments holding only such records are then removed.
+//
+// Every record is framed by its length, a CRC-32C checksum and its sequence number. Opening a log whose
+// last segment ends in a torn or corrupt record, as left by a crash during a write, truncates the segment
+// before that record; a damaged record in an older segment is reported as ErrCorrupt.
+package wal
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Sync modes of Options.
+const (
+	SyncAlways   = "always"   // every append is fsynced before it returns
+	SyncInterval = "interval" // appends are fsynced every Options.SyncInterval
+	SyncNever    = "never"    // flushing is left to the operating system
+)
+
+const (
+	segmentExt  = ".wal"
+	snapshotExt = ".snap"
+	headerSize  = 16 // length, checksum and sequence number
+	// maxRecordSize bounds the length read from a header, larger ones are taken as corrupt.
+	maxRecordSize = 64 << 20
+
+	defaultSyncInterval = time.Second
+	defaultSegmentSize  = 16 << 20
+)
+
+// ErrCorrupt is returned for a damaged record that is not at the tail of the log.
+var ErrCorrupt = errors.New("wal: corrupt record")
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// Options ...
+type Options struct {
+	Sync         string        // SyncAlways, SyncInterval or SyncNever, SyncInterval if empty
+	SyncInterval time.Duration // one second if zero
+	SegmentSize  int64         // bytes after which appends start a new segment, 16 MiB if zero
+}
+
+// segmentFile is the segment appended to, an *os.File.
+type segmentFile interface {
+	io.WriteSeeker
+	Truncate(size int64) error
+	Sync() error
+	Close() error
+}
+
+// Log is a write-ahead log in a directory of its own. It is safe for concurrent use.
+type Log struct {
+	dir  string
+	opts Options
+
+	mu       sync.Mutex
+	seg      segmentFile
+	segSize  int64
+	next     uint64 // sequence number of the next record
+	dirty    bool   // appends not fsynced yet
+	snapshot uint64 // sequence number of the latest snapshot, zero if none
+	hasSnap  bool
+	closed   bool
+	failed   error // a partial record could not be cut off, appends are refused
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// Open opens the log in dir, creating dir if needed, and repairs the tail of its last segment.
+func Open(dir string, opts Options) (*Log, error) {
+	if opts.Sync == "" {
+		opts.Sync = SyncInterval
+	}
+	if opts.SyncInterval <= 0 {
+		opts.SyncInterval = defaultSyncInterval
+	}
+	if opts.SegmentSize <= 0 {
+		opts.SegmentSize = defaultSegmentSize
+	}
+	switch opts.Sync {
+	case SyncAlways, SyncInterval, SyncNever:
+	default:
+		return nil, fmt.Errorf("wal: unknown sync mode %q", opts.Sync)
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	l := &Log{dir: dir, opts: opts}
+	snapshots, err := l.list(snapshotExt)
+	if err != nil {
+		return nil, err
+	}
+	if len(snapshots) > 0 {
+		l.snapshot, l.hasSnap = snapshots[len(snapshots)-1], true
+	}
+	segments, err := l.list(segmentExt)
+	if err != nil {
+		return nil, err
+	}
+	l.next = l.snapshot + 1
+	for i, start := range segments {
+		// records up to the snapshot may be missing or cut short, the ones after it must follow each other
+		if start != l.next && (start > l.snapshot+1 || l.next > l.snapshot+1) {
+			return nil, fmt.Errorf("%w: segment %s does not follow record %d", ErrCorrupt, l.name(start, segmentExt), l.next-1)
+		}
+		last := i == len(segments)-1
+		next, size, err := l.scan(start, last)
+		if err != nil {
+			return nil, err
+		}
+		l.next = next
+		if last && next > l.snapshot {
+			if err := l.openSegment(start, size); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if l.seg == nil {
+		// no segment, or the last one ends before the snapshot: appends continue after the snapshot
+		l.next = l.snapshot + 1
+		if err := l.openSegment(l.next, 0); err != nil {
+			return nil, err
+		}
+	}
+	if opts.Sync == SyncInterval {
+		l.stop = make(chan struct{})
+		l.done = make(chan struct{})
+		go l.syncLoop()
+	}
+	return l, nil
+}
+
+// Append writes data as the next record and returns its sequence number.
+func (l *Log) Append(data []byte) (uint64, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return 0, errors.New("wal: log closed")
+	}
+	if l.failed != nil {
+		return 0, l.failed
+	}
+	if l.segSize >= l.opts.SegmentSize {
+		if err := l.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	seq := l.next
+	frame := encode(seq, data)
+	if _, err := l.seg.Write(frame); err != nil {
+		// cut off a partial frame, a record appended after it would be dropped with it by the next Open
+		if cerr := l.cut(); cerr != nil {
+			l.failed = fmt.Errorf("wal: segment holds a partial record: %w", cerr)
+		}
+		return 0, err
+	}
+	l.segSize += int64(len(frame))
+	l.next++
+	if l.opts.Sync == SyncAlways {
+		return seq, l.seg.Sync()
+	}
+	l.dirty = true
+	return seq, nil
+}
+
+// Last returns the sequence number of the last record, or of the snapshot if no record followed it.
+func (l *Log) Last() uint64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.next - 1
+}
+
+// Sync fsyncs the records appended so far.
+func (l *Log) Sync() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return nil
+	}
+	return l.sync()
+}
+
+// Replay calls fn with every record after the latest snapshot, in order.
+func (l *Log) Replay(fn func(seq uint64, data []byte) error) error {
+	l.mu.Lock()
+	after, end := l.snapshot, l.next
+	segments, err := l.list(segmentExt)
+	l.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	for i, start := range segments {
+		if i+1 < len(segments) && segments[i+1] <= after+1 {
+			continue // only records covered by the snapshot
+		}
+		err := l.read(start, func(seq uint64, data []byte) error {
+			if seq <= after || seq >= end {
+				return nil
+			}
+			return fn(seq, data)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// LoadSnapshot returns the latest snapshot and its sequence number, nil data if there is none.
+func (l *Log) LoadSnapshot() (uint64, []byte, error) {
+	l.mu.Lock()
+	seq, ok := l.snapshot, l.hasSnap
+	l.mu.Unlock()
+	if !ok {
+		return 0, nil, nil
+	}
+	var data []byte
+	err := l.readFile(l.name(seq, snapshotExt), false, func(got uint64, d []byte) error {
+		if got != seq {
+			return fmt.Errorf("%w: snapshot %d holds %d", ErrCorrupt, seq, got)
+		}
+		data = d
+		return nil
+	})
+	if err == nil && data == nil {
+		err = fmt.Errorf("%w: snapshot %d is empty", ErrCorrupt, seq)
+	}
+	return seq, data, err
+}
+
+// Snapshot stores data as the state after the record seq, then removes the older snapshots and the
+// segments holding only records up to seq.
+func (l *Log) Snapshot(seq uint64, data []byte) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return errors.New("wal: log closed")
+	}
+	if seq < l.snapshot || seq >= l.next {
+		return fmt.Errorf("wal: snapshot at %d outside of records %d to %d", seq, l.snapshot, l.next-1)
+	}
+	frame := encode(seq, data)
+	tmp := filepath.Join(l.dir, l.name(seq, snapshotExt)+".tmp")
+	if err := writeFile(tmp, frame); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, filepath.Join(l.dir, l.name(seq, snapshotExt))); err != nil {
+		return err
+	}
+	if err := l.syncDir(); err != nil {
+		return err
+	}
+	l.snapshot, l.hasSnap = seq, true
+	if seq == l.next-1 && l.segSize > 0 {
+		// the current segment is covered as a whole, appends go to a new one
+		if err := l.rotate(); err != nil {
+			return err
+		}
+	}
+	return l.compact()
+}
+
+// Close fsyncs and closes the log.
+func (l *Log) Close() error {
+	l.mu.Lock()
+	if l.closed {
+		l.mu.Unlock()
+		return nil
+	}
+	l.closed = true
+	err := l.sync()
+	if cerr := l.seg.Close(); err == nil {
+		err = cerr
+	}
+	l.mu.Unlock()
+	if l.stop != nil {
+		close(l.stop)
+		<-l.done
+	}
+	return err
+}
+
+func (l *Log) syncLoop() {
+	defer close(l.done)
+	ticker := time.NewTicker(l.opts.SyncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-l.stop:
+			return
+		case <-ticker.C:
+			if err := l.Sync(); err != nil {
+				log.Println("wal: fsync failed:", err)
+			}
+		}
+	}
+}
+
+// sync fsyncs the current segment, the caller holds mu.
+func (l *Log) sync() error {
+	if !l.dirty {
+		return nil
+	}
+	if err := l.seg.Sync(); err != nil {
+		return err
+	}
+	l.dirty = false
+	return nil
+}
+
+// rotate closes the current segment and starts one at the next record, the caller holds mu.
+func (l *Log) rotate() error {
+	if err := l.seg.Sync(); err != nil {
+		return err
+	}
+	l.dirty = false
+	if err := l.seg.Close(); err != nil {
+		return err
+	}
+	return l.openSegment(l.next, 0)
+}
+
+// compact removes the snapshots before the latest and the segments whose records it covers, the caller holds mu.
+func (l *Log) compact() error {
+	snapshots, err := l.list(snapshotExt)
+	if err != nil {
+		return err
+	}
+	for _, seq := range snapshots {
+		if seq < l.snapshot {
+			if err := os.Remove(filepath.Join(l.dir, l.name(seq, snapshotExt))); err != nil {
+				return err
+			}
+		}
+	}
+	segments, err := l.list(segmentExt)
+	if err != nil {
+		return err
+	}
+	for i, start := range segments {
+		// a segment is covered once the next one starts right after the snapshot or earlier
+		if i+1 < len(segments) && segments[i+1] <= l.snapshot+1 {
+			if err := os.Remove(filepath.Join(l.dir, l.name(start, segmentExt))); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// cut truncates the segment appended to after its last record.
+func (l *Log) cut() error {
+	if err := l.seg.Truncate(l.segSize); err != nil {
+		return err
+	}
+	_, err := l.seg.Seek(l.segSize, io.SeekStart)
+	return err
+}
+
+// openSegment opens the segment starting at start for appending, cut to size bytes.
+func (l *Log) openSegment(start uint64, size int64) error {
+	f, err := os.OpenFile(filepath.Join(l.dir, l.name(start, segmentExt)), os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	if err := f.Truncate(size); err != nil {
+		f.Close()
+		return err
+	}
+	if _, err := f.Seek(size, io.SeekStart); err != nil {
+		f.Close()
+		return err
+	}
+	if size == 0 {
+		if err := l.syncDir(); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	l.seg, l.segSize = f, size
+	return nil
+}
+
+// scan checks the records of the segment starting at start and returns the sequence number following
+// them and the size they take. The tail of the last segment may be damaged, it is left out.
+func (l *Log) scan(start uint64, last bool) (uint64, int64, error) {
+	next := start
+	var size int64
+	err := l.readFile(l.name(start, segmentExt), last, func(seq uint64, data []byte) error {
+		if seq != next {
+			return fmt.Errorf("%w: record %d where %d was expected in %s", ErrCorrupt, seq, next, l.name(start, segmentExt))
+		}
+		next++
+		size += int64(headerSize + len(data))
+		return nil
+	})
+	return next, size, err
+}
+
+// read calls fn with the records of the segment starting at start.
+func (l *Log) read(start uint64, fn func(seq uint64, data []byte) error) error {
+	return l.readFile(l.name(start, segmentExt), true, fn)
+}
+
+// readFile calls fn with the records of the file name. With tolerant, a torn or corrupt record ends the
+// file, logged once, instead of failing with ErrCorrupt.
+func (l *Log) readFile(name string, tolerant bool, fn func(seq uint64, data []byte) error) error {
+	f, err := os.Open(filepath.Join(l.dir, name))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var offset int64
+	header := make([]byte, headerSize)
+	for {
+		_, err := io.ReadFull(f, header)
+		if err == io.EOF {
+			return nil
+		}
+		var data []byte
+		if err == nil {
+			size := binary.BigEndian.Uint32(header[0:])
+			if size > maxRecordSize {
+				err = fmt.Errorf("record of %d bytes", size)
+			} else {
+				data = make([]byte, size)
+				if _, err = io.ReadFull(f, data); err == io.EOF || err == io.ErrUnexpectedEOF {
+					err = errors.New("torn payload")
+				}
+			}
+		}
+		if err == nil {
+			sum := crc32.Update(crc32.Checksum(header[8:], crcTable), crcTable, data)
+			if sum != binary.BigEndian.Uint32(header[4:]) {
+				err = errors.New("checksum mismatch")
+			}
+		}
+		if err != nil {
+			if err == io.ErrUnexpectedEOF {
+				err = errors.New("torn header")
+			}
+			if tolerant {
+				log.Printf("wal: %s ends in a damaged record at offset %d (%v), dropping it", name, offset, err)
+				return nil
+			}
+			return fmt.Errorf("%w: %s at offset %d: %v", ErrCorrupt, name, offset, err)
+		}
+		if err := fn(binary.BigEndian.Uint64(header[8:]), data); err != nil {
+			return err
+		}
+		offset += int64(headerSize + len(data))
+	}
+}
+
+// list returns the sequence numbers the files with extension ext are named after, in order.
+func (l *Log) list(ext string) ([]uint64, error) {
+	entries, err := os.ReadDir(l.dir)
+	if err != nil {
+		return nil, err
+	}
+	var seqs []uint64
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || !strings.HasSuffix(name, ext) {
+			continue
+		}
+		seq, err := strconv.ParseUint(strings.TrimSuffix(name, ext), 10, 64)
+		if err != nil {
+			continue
+		}
+		seqs = append(seqs, seq)
+	}
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+	return seqs, nil
+}
+
+func (l *Log) name(seq uint64, ext string) string {
+	return fmt.Sprintf("%020d%s", seq, ext)
+}
+
+// syncDir makes created, renamed and removed files of the directory durable.
+func (l *Log) syncDir() error {
+	if l.opts.Sync == SyncNever {
+		return nil
+	}
+	d, err := os.Open(l.dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// encode frames data as the record seq.
+func encode(seq uint64, data []byte) []byte {
+	frame := make([]byte, headerSize+len(data))
+	binary.BigEndian.PutUint32(frame[0:], uint32(len(data)))
+	binary.BigEndian.PutUint64(frame[8:], seq)
+	copy(frame[headerSize:], data)
+	binary.BigEndian.PutUint32(frame[4:], crc32.Checksum(frame[8:], crcTable))
+	return frame
+}
+
+func writeFile(name string, data []byte) error {
+	f, err := os.OpenFile(name, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,264 @@
+package wal
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// records returns the records after the snapshot of l as "seq:data".
+func records(t *testing.T, l *Log) []string {
+	var out []string
+	assert.NoError(t, l.Replay(func(seq uint64, data []byte) error {
+		out = append(out, fmt.Sprintf("%d:%s", seq, data))
+		return nil
+	}))
+	return out
+}
+
+func appendAll(t *testing.T, l *Log, data ...string) {
+	for _, d := range data {
+		_, err := l.Append([]byte(d))
+		assert.NoError(t, err)
+	}
+}
+
+func segments(t *testing.T, dir string) []string {
+	names, err := filepath.Glob(filepath.Join(dir, "*"+segmentExt))
+	assert.NoError(t, err)
+	for i := range names {
+		names[i] = filepath.Base(names[i])
+	}
+	return names
+}
+
+func TestAppendReplay(t *testing.T) {
+	for _, mode := range []string{SyncAlways, SyncInterval, SyncNever} {
+		t.Run(mode, func(t *testing.T) {
+			dir := t.TempDir()
+			l, err := Open(dir, Options{Sync: mode})
+			assert.NoError(t, err)
+			seq, err := l.Append([]byte("a"))
+			assert.NoError(t, err)
+			assert.Equal(t, uint64(1), seq)
+			appendAll(t, l, "b", "c")
+			assert.Equal(t, uint64(3), l.Last())
+			assert.NoError(t, l.Close())
+
+			l, err = Open(dir, Options{Sync: mode})
+			assert.NoError(t, err)
+			defer l.Close()
+			assert.Equal(t, []string{"1:a", "2:b", "3:c"}, records(t, l))
+			seq, err = l.Append([]byte("d"))
+			assert.NoError(t, err)
+			assert.Equal(t, uint64(4), seq)
+		})
+	}
+	_, err := Open(t.TempDir(), Options{Sync: "sometimes"})
+	assert.EqualError(t, err, `wal: unknown sync mode "sometimes"`)
+}
+
+func TestRecoverTail(t *testing.T) {
+	cases := map[string]func(f *os.File, size int64){
+		"torn header": func(f *os.File, size int64) {
+			f.Truncate(size - int64(headerSize+len("c")) + 5)
+		},
+		"torn payload": func(f *os.File, size int64) {
+			f.Truncate(size - 1)
+		},
+		"corrupt payload": func(f *os.File, size int64) {
+			f.WriteAt([]byte("x"), size-1)
+		},
+		"corrupt length": func(f *os.File, size int64) {
+			f.WriteAt([]byte{0xff, 0xff, 0xff, 0xff}, size-int64(headerSize+len("c")))
+		},
+		"garbage after the last record": func(f *os.File, size int64) {
+			f.WriteAt([]byte("garbage"), size)
+		},
+	}
+	for k, damage := range cases {
+		t.Run(k, func(t *testing.T) {
+			dir := t.TempDir()
+			l, err := Open(dir, Options{Sync: SyncAlways})
+			assert.NoError(t, err)
+			appendAll(t, l, "a", "b", "c")
+			assert.NoError(t, l.Close())
+
+			name := filepath.Join(dir, segments(t, dir)[0])
+			f, err := os.OpenFile(name, os.O_RDWR, 0)
+			assert.NoError(t, err)
+			info, err := f.Stat()
+			assert.NoError(t, err)
+			damage(f, info.Size())
+			assert.NoError(t, f.Close())
+
+			l, err = Open(dir, Options{Sync: SyncAlways})
+			assert.NoError(t, err)
+			want := []string{"1:a", "2:b"}
+			if k == "garbage after the last record" {
+				want = append(want, "3:c")
+			}
+			assert.Equal(t, want, records(t, l))
+			// appends continue right after the last intact record
+			appendAll(t, l, "d")
+			assert.NoError(t, l.Close())
+
+			l, err = Open(dir, Options{Sync: SyncAlways})
+			assert.NoError(t, err)
+			defer l.Close()
+			want = append(want, fmt.Sprintf("%d:d", len(want)+1))
+			assert.Equal(t, want, records(t, l))
+		})
+	}
+}
+
+// failingSegment writes half of a frame and fails, once, and fails to truncate if truncateErr is set.
+type failingSegment struct {
+	segmentFile
+	failed      bool
+	truncateErr error
+}
+
+func (f *failingSegment) Write(p []byte) (int, error) {
+	if f.failed {
+		return f.segmentFile.Write(p)
+	}
+	f.failed = true
+	n, _ := f.segmentFile.Write(p[:len(p)/2])
+	return n, errors.New("no space left on device")
+}
+
+func (f *failingSegment) Truncate(size int64) error {
+	if f.truncateErr != nil {
+		return f.truncateErr
+	}
+	return f.segmentFile.Truncate(size)
+}
+
+func TestFailedAppend(t *testing.T) {
+	cases := map[string]struct {
+		truncateErr error
+		want        []string
+	}{
+		"partial record cut off": {
+			want: []string{"1:a", "2:c"},
+		},
+		"partial record left": {
+			truncateErr: errors.New("read-only file system"),
+			want:        []string{"1:a"},
+		},
+	}
+	for k, v := range cases {
+		t.Run(k, func(t *testing.T) {
+			dir := t.TempDir()
+			l, err := Open(dir, Options{Sync: SyncAlways})
+			assert.NoError(t, err)
+			appendAll(t, l, "a")
+			l.seg = &failingSegment{segmentFile: l.seg, truncateErr: v.truncateErr}
+			_, err = l.Append([]byte("b"))
+			assert.EqualError(t, err, "no space left on device")
+			_, err = l.Append([]byte("c"))
+			if v.truncateErr != nil {
+				assert.ErrorContains(t, err, "partial record", "appends would follow the partial record")
+			} else {
+				assert.NoError(t, err)
+			}
+			assert.NoError(t, l.Close())
+
+			l, err = Open(dir, Options{Sync: SyncAlways})
+			assert.NoError(t, err)
+			defer l.Close()
+			assert.Equal(t, v.want, records(t, l), "every acknowledged record is recovered")
+		})
+	}
+}
+
+func TestCorruptOlderSegment(t *testing.T) {
+	dir := t.TempDir()
+	l, err := Open(dir, Options{Sync: SyncNever, SegmentSize: 1})
+	assert.NoError(t, err)
+	appendAll(t, l, "a", "b", "c")
+	assert.NoError(t, l.Close())
+	names := segments(t, dir)
+	assert.Len(t, names, 3, "one record per segment")
+
+	f, err := os.OpenFile(filepath.Join(dir, names[0]), os.O_RDWR, 0)
+	assert.NoError(t, err)
+	f.WriteAt([]byte("x"), headerSize)
+	assert.NoError(t, f.Close())
+	_, err = Open(dir, Options{Sync: SyncNever})
+	assert.ErrorIs(t, err, ErrCorrupt)
+
+	assert.NoError(t, os.Remove(filepath.Join(dir, names[0])))
+	_, err = Open(dir, Options{Sync: SyncNever})
+	assert.ErrorIs(t, err, ErrCorrupt, "records are missing")
+}
+
+func TestSnapshotCompacts(t *testing.T) {
+	dir := t.TempDir()
+	opts := Options{Sync: SyncAlways, SegmentSize: 2 * (headerSize + 1)}
+	l, err := Open(dir, opts)
+	assert.NoError(t, err)
+	seq, data, err := l.LoadSnapshot()
+	assert.NoError(t, err)
+	assert.Zero(t, seq)
+	assert.Nil(t, data)
+
+	appendAll(t, l, "a", "b", "c", "d", "e")
+	assert.Len(t, segments(t, dir), 3)
+	assert.NoError(t, l.Snapshot(3, []byte("abc")))
+	assert.Equal(t, []string{"00000000000000000003.wal", "00000000000000000005.wal"}, segments(t, dir),
+		"the segment of records 1 and 2 is removed, the one holding 3 and 4 kept")
+	assert.Equal(t, []string{"4:d", "5:e"}, records(t, l))
+	assert.Error(t, l.Snapshot(2, nil), "snapshots go forward")
+	assert.Error(t, l.Snapshot(6, nil), "record 6 is not written yet")
+
+	// a snapshot of every record starts a new segment and removes the others
+	assert.NoError(t, l.Snapshot(5, []byte("abcde")))
+	assert.Equal(t, []string{"00000000000000000006.wal"}, segments(t, dir))
+	snapshots, err := filepath.Glob(filepath.Join(dir, "*"+snapshotExt))
+	assert.NoError(t, err)
+	assert.Len(t, snapshots, 1)
+	appendAll(t, l, "f")
+	assert.NoError(t, l.Close())
+
+	l, err = Open(dir, opts)
+	assert.NoError(t, err)
+	defer l.Close()
+	seq, data, err = l.LoadSnapshot()
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(5), seq)
+	assert.Equal(t, "abcde", string(data))
+	assert.Equal(t, []string{"6:f"}, records(t, l))
+	seq, err = l.Append([]byte("g"))
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(7), seq)
+}
+
+func TestSnapshotPastTornSegment(t *testing.T) {
+	dir := t.TempDir()
+	l, err := Open(dir, Options{Sync: SyncNever})
+	assert.NoError(t, err)
+	appendAll(t, l, "a", "b")
+	assert.NoError(t, l.Snapshot(1, []byte("a")))
+	assert.NoError(t, l.Close())
+	// without fsync the snapshot can outlive the records it covers
+	assert.NoError(t, os.Truncate(filepath.Join(dir, segments(t, dir)[0]), 0))
+
+	l, err = Open(dir, Options{Sync: SyncNever})
+	assert.NoError(t, err)
+	assert.Empty(t, records(t, l))
+	seq, err := l.Append([]byte("c"))
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(2), seq, "appends continue after the snapshot")
+	assert.NoError(t, l.Close())
+
+	l, err = Open(dir, Options{Sync: SyncNever})
+	assert.NoError(t, err)
+	defer l.Close()
+	assert.Equal(t, []string{"2:c"}, records(t, l))
+}
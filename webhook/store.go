@@ -0,0 +1,61 @@
+package webhook
+
+import "sync"
+
+// DeadLetterStore keeps the deliveries that kept failing until they are replayed.
+type DeadLetterStore interface {
+	Add(delivery Delivery)
+	List() []Delivery                  // oldest first
+	Remove(id string) (Delivery, bool) // takes the delivery out for a replay
+	Len() int
+}
+
+// MemoryStore is a DeadLetterStore holding up to a maximum of deliveries in memory, dropping the oldest
+// when full. Its content is lost on restart.
+type MemoryStore struct {
+	mu         sync.Mutex
+	max        int
+	deliveries []Delivery
+}
+
+// NewMemoryStore returns a store of up to max deliveries, zero for no limit.
+func NewMemoryStore(max int) *MemoryStore {
+	return &MemoryStore{max: max}
+}
+
+// Add ...
+func (s *MemoryStore) Add(delivery Delivery) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.max > 0 && len(s.deliveries) >= s.max {
+		s.deliveries = append(s.deliveries[:0], s.deliveries[len(s.deliveries)-s.max+1:]...)
+	}
+	s.deliveries = append(s.deliveries, delivery)
+}
+
+// List ...
+func (s *MemoryStore) List() []Delivery {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Delivery{}, s.deliveries...)
+}
+
+// Remove ...
+func (s *MemoryStore) Remove(id string) (Delivery, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, delivery := range s.deliveries {
+		if delivery.ID == id {
+			s.deliveries = append(s.deliveries[:i], s.deliveries[i+1:]...)
+			return delivery, true
+		}
+	}
+	return Delivery{}, false
+}
+
+// Len ...
+func (s *MemoryStore) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.deliveries)
+}
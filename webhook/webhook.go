@@ -0,0 +1,364 @@
+// Package webhook posts the status changes of cache entities to HTTP receivers. Payloads are signed with
+// the secret of their subscription, failed deliveries are retried with exponential backoff and the ones
+// that keep failing are kept in a dead-letter store from which they can be replayed.
+package webhook
+
+import (
+	"bytes"
+	"cacheServer/appcontext"
+	"cacheServer/apperror"
+	"cacheServer/cache"
+	"cacheServer/logging"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// HeaderID carries the id of a delivery, the same for its retries and replays.
+	HeaderID = "X-Webhook-ID"
+	// HeaderTimestamp carries the unix time the payload was signed at.
+	HeaderTimestamp = "X-Webhook-Timestamp"
+	// HeaderSignature carries "sha256=" and the hex HMAC-SHA256 of the timestamp, a dot and the body.
+	HeaderSignature = "X-Webhook-Signature"
+
+	// queueSize is the number of deliveries waiting for a worker before new ones are dead-lettered.
+	queueSize = 1024
+	// eventBuffer is the number of status changes buffered between the event bus and the dispatcher.
+	eventBuffer = 1024
+)
+
+// Delivery is one event sent to one subscription.
+type Delivery struct {
+	ID           string      `json:"id"`
+	Subscription string      `json:"subscription"`
+	Event        cache.Event `json:"event"`
+	Attempts     int         `json:"attempts"`
+	LastError    string      `json:"lastError,omitempty"`
+	FailedAt     time.Time   `json:"failedAt"` // when the delivery was dead-lettered
+}
+
+// payload is the body posted to a receiver.
+type payload struct {
+	ID           string      `json:"id"`
+	Subscription string      `json:"subscription"`
+	Event        cache.Event `json:"event"`
+}
+
+// Stats are the counters of a Dispatcher.
+type Stats struct {
+	Subscriptions int    `json:"subscriptions"`
+	Queued        int    `json:"queued"`
+	Delivered     uint64 `json:"delivered"`
+	Retried       uint64 `json:"retried"`
+	DeadLettered  uint64 `json:"deadLettered"`
+	Replayed      uint64 `json:"replayed"`
+	DeadLetters   int    `json:"deadLetters"` // deliveries held for replay
+}
+
+// subscription is a receiver and the types it is sent.
+type subscription struct {
+	name   string
+	url    string
+	secret string
+	types  []cache.Type // empty for every type
+}
+
+func (s subscription) match(t cache.Type) bool {
+	if len(s.types) == 0 {
+		return true
+	}
+	for _, typ := range s.types {
+		if typ == t {
+			return true
+		}
+	}
+	return false
+}
+
+// Dispatcher sends the StatusChanged events of an event bus to the matching subscriptions.
+type Dispatcher struct {
+	subs        []subscription
+	cfg         appcontext.WebhooksConfig
+	client      *http.Client
+	deadLetters DeadLetterStore
+
+	queue chan Delivery
+	done  chan struct{}
+	once  sync.Once
+	wg    sync.WaitGroup
+
+	delivered    atomic.Uint64
+	retried      atomic.Uint64
+	deadLettered atomic.Uint64
+	replayed     atomic.Uint64
+
+	now func() time.Time
+}
+
+// Option configures a Dispatcher.
+type Option func(d *Dispatcher)
+
+// WithDeadLetterStore keeps the failed deliveries in store instead of memory.
+func WithDeadLetterStore(store DeadLetterStore) Option {
+	return func(d *Dispatcher) {
+		d.deadLetters = store
+	}
+}
+
+// WithHTTPClient sends the deliveries with client, its Timeout is replaced by the configured one.
+func WithHTTPClient(client *http.Client) Option {
+	return func(d *Dispatcher) {
+		d.client = client
+	}
+}
+
+// New returns a Dispatcher for the subscriptions of cfg, which must have been validated. Type names
+// of the subscriptions are checked here.
+func New(cfg appcontext.WebhooksConfig, opts ...Option) (*Dispatcher, error) {
+	d := &Dispatcher{cfg: cfg, queue: make(chan Delivery, queueSize), done: make(chan struct{}), now: time.Now}
+	for _, sub := range cfg.Subscriptions {
+		s := subscription{name: sub.Name, url: sub.URL, secret: sub.Secret}
+		for _, name := range sub.Types {
+			t, err := cache.ParseType(name)
+			if err != nil {
+				return nil, fmt.Errorf("%w: webhook %s: unknown type %q", apperror.ErrInvalidConfig, sub.Name, name)
+			}
+			s.types = append(s.types, t)
+		}
+		d.subs = append(d.subs, s)
+	}
+	for _, opt := range opts {
+		opt(d)
+	}
+	if d.client == nil {
+		d.client = &http.Client{}
+	}
+	client := *d.client
+	client.Timeout = time.Duration(cfg.Timeout)
+	d.client = &client
+	if d.deadLetters == nil {
+		d.deadLetters = NewMemoryStore(cfg.DeadLetters)
+	}
+	if d.cfg.Workers <= 0 {
+		d.cfg.Workers = 1
+	}
+	if d.cfg.Attempts <= 0 {
+		d.cfg.Attempts = 1
+	}
+	return d, nil
+}
+
+// Run sends the status changes published on bus until Close. It returns at once without subscriptions.
+func (d *Dispatcher) Run(bus *cache.EventBus) {
+	if len(d.subs) == 0 {
+		return
+	}
+	events := bus.Subscribe(cache.EventFilter{Kinds: []cache.EventKind{cache.StatusChanged}}, eventBuffer)
+	defer events.Close()
+	for i := 0; i < d.cfg.Workers; i++ {
+		d.wg.Add(1)
+		go d.work()
+	}
+	defer d.wg.Wait()
+	for {
+		select {
+		case e := <-events.Events():
+			d.dispatch(e)
+		case <-d.done:
+			return
+		}
+	}
+}
+
+// Close stops Run and the retries still waiting, it is safe to call more than once.
+func (d *Dispatcher) Close() {
+	d.once.Do(func() { close(d.done) })
+}
+
+// dispatch queues a delivery of e for every subscription of its type.
+func (d *Dispatcher) dispatch(e cache.Event) {
+	for _, sub := range d.subs {
+		if sub.match(e.Type) {
+			d.enqueue(Delivery{ID: newID(), Subscription: sub.name, Event: e})
+		}
+	}
+}
+
+// enqueue hands delivery to the workers, dead-lettering it when the queue is full.
+func (d *Dispatcher) enqueue(delivery Delivery) {
+	select {
+	case <-d.done:
+		return
+	default:
+	}
+	select {
+	case d.queue <- delivery:
+	default:
+		d.deadLetter(delivery, "delivery queue full")
+	}
+}
+
+func (d *Dispatcher) work() {
+	defer d.wg.Done()
+	for {
+		select {
+		case delivery := <-d.queue:
+			d.deliver(delivery)
+		case <-d.done:
+			return
+		}
+	}
+}
+
+// deliver posts delivery once and schedules its retry, or dead-letters it, when it fails.
+func (d *Dispatcher) deliver(delivery Delivery) {
+	sub, ok := d.subscription(delivery.Subscription)
+	if !ok {
+		d.deadLetter(delivery, "unknown subscription")
+		return
+	}
+	delivery.Attempts++
+	retry, err := d.post(sub, delivery)
+	if err == nil {
+		d.delivered.Add(1)
+		return
+	}
+	delivery.LastError = err.Error()
+	if !retry || delivery.Attempts >= d.cfg.Attempts {
+		d.deadLetter(delivery, err.Error())
+		return
+	}
+	d.retried.Add(1)
+	logging.Debugln("webhook", delivery.ID, "to", sub.name, "failed, retrying:", err)
+	time.AfterFunc(d.backoff(delivery.Attempts), func() { d.enqueue(delivery) })
+}
+
+// post sends delivery to sub. retry reports whether a failure may succeed later: transport errors,
+// 408, 429 and 5xx answers.
+func (d *Dispatcher) post(sub subscription, delivery Delivery) (retry bool, err error) {
+	body, err := json.Marshal(payload{ID: delivery.ID, Subscription: delivery.Subscription, Event: delivery.Event})
+	if err != nil {
+		return false, err
+	}
+	req, err := http.NewRequest(http.MethodPost, sub.url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	timestamp := d.now().Unix()
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(HeaderID, delivery.ID)
+	req.Header.Set(HeaderTimestamp, strconv.FormatInt(timestamp, 10))
+	req.Header.Set(HeaderSignature, Sign(sub.secret, timestamp, body))
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<16))
+	resp.Body.Close()
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return false, nil
+	}
+	err = fmt.Errorf("receiver answered %s", resp.Status)
+	switch {
+	case resp.StatusCode == http.StatusRequestTimeout, resp.StatusCode == http.StatusTooManyRequests:
+		return true, err
+	case resp.StatusCode >= 500:
+		return true, err
+	}
+	return false, err
+}
+
+// backoff returns BaseDelay doubled per failed attempt, capped at MaxDelay.
+func (d *Dispatcher) backoff(attempt int) time.Duration {
+	delay, max := time.Duration(d.cfg.BaseDelay), time.Duration(d.cfg.MaxDelay)
+	for i := 1; i < attempt && delay < max; i++ {
+		delay *= 2
+	}
+	if max > 0 && delay > max {
+		delay = max
+	}
+	return delay
+}
+
+func (d *Dispatcher) deadLetter(delivery Delivery, reason string) {
+	delivery.LastError = reason
+	delivery.FailedAt = d.now()
+	d.deadLettered.Add(1)
+	d.deadLetters.Add(delivery)
+	log.Println("webhook", delivery.ID, "to", delivery.Subscription, "dead-lettered after", delivery.Attempts, "attempts:", reason)
+}
+
+func (d *Dispatcher) subscription(name string) (subscription, bool) {
+	for _, sub := range d.subs {
+		if sub.name == name {
+			return sub, true
+		}
+	}
+	return subscription{}, false
+}
+
+// DeadLetters returns the deliveries that kept failing, oldest first.
+func (d *Dispatcher) DeadLetters() []Delivery {
+	return d.deadLetters.List()
+}
+
+// Replay takes the dead-lettered delivery id out of the store and sends it again with a fresh number of
+// attempts, under the same id.
+func (d *Dispatcher) Replay(id string) error {
+	delivery, ok := d.deadLetters.Remove(id)
+	if !ok {
+		return fmt.Errorf("%w: dead-lettered webhook %q", apperror.ErrNotFound, id)
+	}
+	delivery.Attempts, delivery.LastError, delivery.FailedAt = 0, "", time.Time{}
+	d.replayed.Add(1)
+	d.enqueue(delivery)
+	return nil
+}
+
+// Stats returns the counters of the dispatcher.
+func (d *Dispatcher) Stats() Stats {
+	return Stats{
+		Subscriptions: len(d.subs),
+		Queued:        len(d.queue),
+		Delivered:     d.delivered.Load(),
+		Retried:       d.retried.Load(),
+		DeadLettered:  d.deadLettered.Load(),
+		Replayed:      d.replayed.Load(),
+		DeadLetters:   d.deadLetters.Len(),
+	}
+}
+
+// Sign returns the signature header value of body signed at timestamp with secret.
+func Sign(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10)))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verify reports whether signature, the value of HeaderSignature, is the one of body signed at
+// timestamp with secret. Receivers should also reject old timestamps.
+func Verify(secret string, timestamp int64, body []byte, signature string) bool {
+	return hmac.Equal([]byte(Sign(secret, timestamp, body)), []byte(signature))
+}
+
+// newID returns a random delivery id.
+func newID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 36)
+	}
+	return hex.EncodeToString(b)
+}
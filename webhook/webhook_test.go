@@ -0,0 +1,253 @@
+package webhook
+
+import (
+	"cacheServer/appcontext"
+	"cacheServer/apperror"
+	"cacheServer/cache"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// receiver is an httptest webhook endpoint answering the queued status codes, then 200.
+type receiver struct {
+	*httptest.Server
+	t      *testing.T
+	secret string
+
+	mu       sync.Mutex
+	statuses []int
+	received []payload
+	ids      []string
+}
+
+func newReceiver(t *testing.T, secret string, statuses ...int) *receiver {
+	r := &receiver{t: t, secret: secret, statuses: statuses}
+	r.Server = httptest.NewServer(http.HandlerFunc(r.serve))
+	t.Cleanup(r.Close)
+	return r
+}
+
+func (r *receiver) serve(w http.ResponseWriter, req *http.Request) {
+	body, err := io.ReadAll(req.Body)
+	assert.NoError(r.t, err)
+	timestamp, err := strconv.ParseInt(req.Header.Get(HeaderTimestamp), 10, 64)
+	assert.NoError(r.t, err)
+	if !Verify(r.secret, timestamp, body, req.Header.Get(HeaderSignature)) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.ids = append(r.ids, req.Header.Get(HeaderID))
+	status := http.StatusOK
+	if len(r.statuses) > 0 {
+		status, r.statuses = r.statuses[0], r.statuses[1:]
+	}
+	if status == http.StatusOK {
+		var p payload
+		assert.NoError(r.t, json.Unmarshal(body, &p))
+		r.received = append(r.received, p)
+	}
+	w.WriteHeader(status)
+}
+
+func (r *receiver) requests() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string(nil), r.ids...)
+}
+
+func (r *receiver) payloads() []payload {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]payload(nil), r.received...)
+}
+
+func testConfig(subs ...appcontext.WebhookConfig) appcontext.WebhooksConfig {
+	return appcontext.WebhooksConfig{
+		Subscriptions: subs,
+		Workers:       2,
+		Attempts:      3,
+		BaseDelay:     appcontext.Duration(time.Millisecond),
+		MaxDelay:      appcontext.Duration(5 * time.Millisecond),
+		Timeout:       appcontext.Duration(time.Second),
+		DeadLetters:   10,
+	}
+}
+
+// start runs d on a new bus until the test ends.
+func start(t *testing.T, d *Dispatcher) *cache.EventBus {
+	bus := cache.NewEventBus()
+	done := make(chan struct{})
+	go func() {
+		d.Run(bus)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		d.Close()
+		<-done
+	})
+	// Run subscribes asynchronously
+	assert.Eventually(t, func() bool { return bus.Stats().Subscribers == 1 }, time.Second, time.Millisecond)
+	return bus
+}
+
+var productPassive = cache.Event{Kind: cache.StatusChanged, Type: cache.Product, ID: "p1", Old: "active", New: "passive"}
+
+func TestDeliveries(t *testing.T) {
+	cases := map[string]struct {
+		statuses      []int
+		wantRequests  int
+		wantDelivered uint64
+		wantRetried   uint64
+		wantDead      int
+	}{
+		"delivered at once": {
+			wantRequests:  1,
+			wantDelivered: 1,
+		},
+		"retried until it succeeds": {
+			statuses:      []int{http.StatusServiceUnavailable, http.StatusTooManyRequests},
+			wantRequests:  3,
+			wantDelivered: 1,
+			wantRetried:   2,
+		},
+		"dead-lettered after every attempt failed": {
+			statuses:     []int{http.StatusInternalServerError, http.StatusBadGateway, http.StatusInternalServerError},
+			wantRequests: 3,
+			wantRetried:  2,
+			wantDead:     1,
+		},
+		"client errors are not retried": {
+			statuses:     []int{http.StatusGone},
+			wantRequests: 1,
+			wantDead:     1,
+		},
+	}
+
+	for k, v := range cases {
+		t.Run(k, func(t *testing.T) {
+			r := newReceiver(t, "s3cret", v.statuses...)
+			d, err := New(testConfig(appcontext.WebhookConfig{Name: "shop", URL: r.URL, Secret: "s3cret"}))
+			assert.NoError(t, err)
+			bus := start(t, d)
+
+			bus.Publish(productPassive)
+			assert.Eventually(t, func() bool {
+				stats := d.Stats()
+				return stats.Delivered+stats.DeadLettered == 1
+			}, time.Second, time.Millisecond)
+
+			ids := r.requests()
+			assert.Len(t, ids, v.wantRequests)
+			for _, id := range ids {
+				assert.Equal(t, ids[0], id, "retries keep the delivery id")
+			}
+			stats := d.Stats()
+			assert.Equal(t, v.wantDelivered, stats.Delivered)
+			assert.Equal(t, v.wantRetried, stats.Retried)
+			assert.Len(t, d.DeadLetters(), v.wantDead)
+			if v.wantDelivered == 1 {
+				got := r.payloads()[0]
+				assert.Equal(t, ids[0], got.ID)
+				assert.Equal(t, "shop", got.Subscription)
+				assert.Equal(t, "p1", got.Event.ID)
+				assert.Equal(t, "passive", got.Event.New)
+			}
+		})
+	}
+}
+
+func TestSubscriptionTypes(t *testing.T) {
+	products := newReceiver(t, "a")
+	roles := newReceiver(t, "b")
+	d, err := New(testConfig(
+		appcontext.WebhookConfig{Name: "products", URL: products.URL, Secret: "a", Types: []string{"product", "category"}},
+		appcontext.WebhookConfig{Name: "roles", URL: roles.URL, Secret: "b", Types: []string{"role"}},
+	))
+	assert.NoError(t, err)
+	bus := start(t, d)
+
+	bus.Publish(productPassive)
+	bus.Publish(cache.Event{Kind: cache.StatusChanged, Type: cache.Role, ID: "a@x", Old: "admin", New: "viewer"})
+	bus.Publish(cache.Event{Kind: cache.EntryDeleted, Type: cache.Role, ID: "a@x"}) // not a status change
+	assert.Eventually(t, func() bool { return d.Stats().Delivered == 2 }, time.Second, time.Millisecond)
+
+	assert.Equal(t, "p1", products.payloads()[0].Event.ID)
+	assert.Equal(t, "viewer", roles.payloads()[0].Event.New)
+	assert.Len(t, products.payloads(), 1)
+	assert.Len(t, roles.payloads(), 1)
+}
+
+func TestWrongSecretIsRejected(t *testing.T) {
+	r := newReceiver(t, "expected")
+	cfg := testConfig(appcontext.WebhookConfig{Name: "shop", URL: r.URL, Secret: "other"})
+	d, err := New(cfg)
+	assert.NoError(t, err)
+	bus := start(t, d)
+
+	bus.Publish(productPassive)
+	assert.Eventually(t, func() bool { return len(d.DeadLetters()) == 1 }, time.Second, time.Millisecond)
+	assert.Equal(t, "receiver answered 401 Unauthorized", d.DeadLetters()[0].LastError)
+	assert.Empty(t, r.payloads())
+}
+
+func TestReplay(t *testing.T) {
+	r := newReceiver(t, "s3cret", http.StatusInternalServerError, http.StatusInternalServerError, http.StatusInternalServerError)
+	d, err := New(testConfig(appcontext.WebhookConfig{Name: "shop", URL: r.URL, Secret: "s3cret"}))
+	assert.NoError(t, err)
+	bus := start(t, d)
+
+	bus.Publish(productPassive)
+	assert.Eventually(t, func() bool { return len(d.DeadLetters()) == 1 }, time.Second, time.Millisecond)
+	dead := d.DeadLetters()[0]
+	assert.Equal(t, 3, dead.Attempts)
+	assert.Equal(t, "receiver answered 500 Internal Server Error", dead.LastError)
+	assert.False(t, dead.FailedAt.IsZero())
+
+	assert.NoError(t, d.Replay(dead.ID))
+	assert.Eventually(t, func() bool { return d.Stats().Delivered == 1 }, time.Second, time.Millisecond)
+	assert.Empty(t, d.DeadLetters())
+	assert.Equal(t, dead.ID, r.payloads()[0].ID)
+	assert.Equal(t, uint64(1), d.Stats().Replayed)
+
+	assert.ErrorIs(t, d.Replay(dead.ID), apperror.ErrNotFound)
+}
+
+func TestNewRejectsUnknownTypes(t *testing.T) {
+	_, err := New(testConfig(appcontext.WebhookConfig{Name: "shop", URL: "http://x", Secret: "s", Types: []string{"order"}}))
+	assert.ErrorIs(t, err, apperror.ErrInvalidConfig)
+}
+
+func TestBackoff(t *testing.T) {
+	d, err := New(appcontext.WebhooksConfig{BaseDelay: appcontext.Duration(time.Second), MaxDelay: appcontext.Duration(5 * time.Second)})
+	assert.NoError(t, err)
+	var got []time.Duration
+	for attempt := 1; attempt <= 5; attempt++ {
+		got = append(got, d.backoff(attempt))
+	}
+	assert.Equal(t, []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second}, got)
+}
+
+func TestMemoryStore(t *testing.T) {
+	s := NewMemoryStore(2)
+	s.Add(Delivery{ID: "a"})
+	s.Add(Delivery{ID: "b"})
+	s.Add(Delivery{ID: "c"}) // drops a
+	assert.Equal(t, []Delivery{{ID: "b"}, {ID: "c"}}, s.List())
+
+	got, ok := s.Remove("b")
+	assert.True(t, ok)
+	assert.Equal(t, "b", got.ID)
+	_, ok = s.Remove("a")
+	assert.False(t, ok)
+	assert.Equal(t, 1, s.Len())
+}